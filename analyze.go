@@ -3,27 +3,68 @@ package fennec
 import (
 	"image"
 	"math"
+	"runtime"
 )
 
 // ImageStats contains analysis results for an image.
 type ImageStats struct {
-	Width, Height  int
-	HasAlpha       bool
-	IsGrayscale    bool
-	UniqueColors   int
-	Entropy        float64
-	EdgeDensity    float64
-	MeanBrightness float64
-	Contrast       float64
-
-	RecommendedFormat    Format
-	RecommendedQuality   Quality
-	EstimatedCompression float64
+	Width          int     `json:"width"`
+	Height         int     `json:"height"`
+	HasAlpha       bool    `json:"has_alpha"`
+	IsGrayscale    bool    `json:"is_grayscale"`
+	UniqueColors   int     `json:"unique_colors"`
+	Entropy        float64 `json:"entropy"`
+	EdgeDensity    float64 `json:"edge_density"`
+	MeanBrightness float64 `json:"mean_brightness"`
+	Contrast       float64 `json:"contrast"`
+
+	RecommendedFormat    Format      `json:"recommended_format"`
+	RecommendedQuality   Quality     `json:"recommended_quality"`
+	RecommendedTables    QuantTables `json:"recommended_tables"`
+	EstimatedCompression float64     `json:"estimated_compression"`
 }
 
 // Analyze performs comprehensive image analysis to inform compression decisions.
 // Uses toNRGBARef for zero-copy when the input is already NRGBA.
 func Analyze(img image.Image) ImageStats {
+	return AnalyzeSamples(img, 0)
+}
+
+// defaultAnalyzeSamples is how many pixels Analyze samples for its color
+// count.
+const defaultAnalyzeSamples = 50000
+
+// defaultEdgeThreshold is the Sobel gradient magnitude, on the 0–255
+// luminance scale, above which Analyze counts a pixel as an edge.
+const defaultEdgeThreshold = 30.0
+
+// AnalyzeOptions tunes AnalyzeWith. The zero value gives Analyze's results.
+type AnalyzeOptions struct {
+	// Samples is how many pixels the color count samples, as for
+	// AnalyzeSamples. Default: 0 (50,000).
+	Samples int
+
+	// EdgeThreshold is the Sobel gradient magnitude above which a pixel
+	// counts toward EdgeDensity. Lower it to find faint edges, such as
+	// light text on a low-contrast scan; that raises EdgeDensity and can
+	// change the recommended format and quality. Default: 0 (30).
+	EdgeThreshold float64
+}
+
+// AnalyzeSamples is Analyze with the color count sampling about samples
+// pixels instead of the default 50,000 (0 keeps the default). Denser
+// sampling costs time roughly in proportion but makes UniqueColors, and
+// the format recommendation that rests on it, more reliable for very large
+// images or ones dominated by a flat area. Every pixel is sampled once
+// samples reaches width × height.
+func AnalyzeSamples(img image.Image, samples int) ImageStats {
+	return AnalyzeWith(img, AnalyzeOptions{Samples: samples})
+}
+
+// AnalyzeWith is Analyze with the sampling and edge detection tuned by
+// opts.
+func AnalyzeWith(img image.Image, opts AnalyzeOptions) ImageStats {
+	samples := opts.Samples
 	src := toNRGBARef(img)
 	w := src.Bounds().Dx()
 	h := src.Bounds().Dy()
@@ -37,44 +78,44 @@ func Analyze(img image.Image) ImageStats {
 		return stats
 	}
 
-	// Single pass: collect color info, brightness, alpha.
-	histogram := [256]float64{}
-	var brightSum float64
-	colorSet := make(map[uint32]struct{})
-	maxSample := 50000
+	// Single pass: collect color info, brightness, alpha. Rows are split
+	// into bands scanned concurrently, then merged in band order.
+	maxSample := defaultAnalyzeSamples
+	if samples > 0 {
+		maxSample = samples
+	}
 	step := 1
 	if w*h > maxSample {
 		step = w * h / maxSample
 	}
 
+	bands := runtime.GOMAXPROCS(0)
+	if bands > h {
+		bands = h
+	}
+	scans := make([]analyzeScan, bands)
+	parallelDo(0, bands, func(band int) {
+		scans[band].scan(src, band*h/bands, (band+1)*h/bands, step)
+	})
+
+	histogram := [256]float64{}
+	var brightSum float64
+	colorSet := make(map[uint32]struct{}, maxAnalyzeColors)
 	allGray := true
 	hasAlpha := false
-	idx := 0
-
-	for y := 0; y < h; y++ {
-		off := y * src.Stride
-		for x := 0; x < w; x++ {
-			i := off + x*4
-			r := src.Pix[i]
-			g := src.Pix[i+1]
-			b := src.Pix[i+2]
-			a := src.Pix[i+3]
-
-			lum := 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
-			brightSum += lum
-			histogram[int(lum+0.5)]++
-
-			if a < 255 {
-				hasAlpha = true
-			}
-			if r != g || g != b {
-				allGray = false
-			}
-			if idx%step == 0 && len(colorSet) < 1024 {
-				key := uint32(r)<<24 | uint32(g)<<16 | uint32(b)<<8 | uint32(a)
-				colorSet[key] = struct{}{}
+	for i := range scans {
+		sc := &scans[i]
+		for v, c := range sc.histogram {
+			histogram[v] += c
+		}
+		brightSum += sc.brightSum
+		allGray = allGray && sc.allGray
+		hasAlpha = hasAlpha || sc.hasAlpha
+		for _, key := range sc.colors {
+			if len(colorSet) >= maxAnalyzeColors {
+				break
 			}
-			idx++
+			colorSet[key] = struct{}{}
 		}
 	}
 
@@ -84,14 +125,98 @@ func Analyze(img image.Image) ImageStats {
 	stats.UniqueColors = len(colorSet)
 	stats.MeanBrightness = brightSum / n
 
-	// Compute contrast with consistent fixed-grid sampling.
+	stats.Contrast = computeContrast(src, stats.MeanBrightness)
+
+	// Compute entropy from luminance histogram.
+	stats.Entropy = computeEntropy(histogram[:], n)
+
+	// Compute edge density using Sobel operator (sampled).
+	threshold := defaultEdgeThreshold
+	if opts.EdgeThreshold > 0 {
+		threshold = opts.EdgeThreshold
+	}
+	stats.EdgeDensity = computeEdgeDensity(src, threshold)
+
+	// Make recommendations.
+	stats.RecommendedFormat = recommendFormat(stats)
+	stats.RecommendedQuality = recommendQuality(stats)
+	stats.RecommendedTables = recommendTables(stats)
+	stats.EstimatedCompression = estimateCompression(stats)
+
+	return stats
+}
+
+// RecommendFormat returns the format CompressImage chooses for img when
+// Options.Format is Auto, so callers can pick an output extension before
+// compressing. It samples at most about 10,000 pixels and is cheap. Target-
+// size mode ignores it and picks whichever format gets closest to the target.
+func RecommendFormat(img image.Image) Format {
+	return analyzeFormat(toNRGBARef(img), 0)
+}
+
+// RecommendQuality returns the quality preset Analyze recommends for img.
+// It runs a full Analyze; call that instead if other statistics are needed too.
+func RecommendQuality(img image.Image) Quality {
+	return recommendQuality(Analyze(img))
+}
+
+// Entropy returns the Shannon entropy of img's luminance histogram in bits
+// (0–8), the same value as Analyze's ImageStats.Entropy. It reads every
+// pixel once and skips the rest of the analysis.
+func Entropy(img image.Image) float64 {
+	src := toNRGBARef(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	histogram, _ := luminanceHistogram(src)
+	return computeEntropy(histogram[:], float64(w*h))
+}
+
+// EdgeDensity returns the fraction of sampled pixels (0–1) on a Sobel edge,
+// the same value as Analyze's ImageStats.EdgeDensity. It samples at most
+// about 40,000 pixels.
+func EdgeDensity(img image.Image) float64 {
+	return computeEdgeDensity(toNRGBARef(img), defaultEdgeThreshold)
+}
+
+// Contrast returns the standard deviation of img's luminance (0–127.5),
+// the same value as Analyze's ImageStats.Contrast. It reads every pixel
+// once for the mean and samples about 10,000 for the deviation.
+func Contrast(img image.Image) float64 {
+	src := toNRGBARef(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w == 0 || h == 0 {
+		return 0
+	}
+	_, sum := luminanceHistogram(src)
+	return computeContrast(src, sum/float64(w*h))
+}
+
+// luminanceHistogram returns the histogram of every pixel's luminance in
+// src and the sum of those luminances.
+func luminanceHistogram(src *image.NRGBA) ([256]float64, float64) {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	var histogram [256]float64
+	var sum float64
+	for y := 0; y < h; y++ {
+		off := y * src.Stride
+		for x := 0; x < w; x++ {
+			i := off + x*4
+			lum := 0.299*float64(src.Pix[i]) + 0.587*float64(src.Pix[i+1]) + 0.114*float64(src.Pix[i+2])
+			sum += lum
+			histogram[int(lum+0.5)]++
+		}
+	}
+	return histogram, sum
+}
+
+// computeContrast returns the standard deviation of luminance around mean,
+// sampled on a fixed grid of about 100×100 points.
+func computeContrast(src *image.NRGBA, mean float64) float64 {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
 	stepY := int(math.Max(1, math.Ceil(float64(h)/100)))
 	stepX := int(math.Max(1, math.Ceil(float64(w)/100)))
 
 	var varianceSum float64
 	var sampleCount int
-	mean := stats.MeanBrightness
-
 	for y := 0; y < h; y += stepY {
 		off := y * src.Stride
 		for x := 0; x < w; x += stepX {
@@ -102,22 +227,60 @@ func Analyze(img image.Image) ImageStats {
 			sampleCount++
 		}
 	}
-	if sampleCount > 0 {
-		stats.Contrast = math.Sqrt(varianceSum / float64(sampleCount))
+	if sampleCount == 0 {
+		return 0
 	}
+	return math.Sqrt(varianceSum / float64(sampleCount))
+}
 
-	// Compute entropy from luminance histogram.
-	stats.Entropy = computeEntropy(histogram[:], n)
+// maxAnalyzeColors caps the sampled unique-color count in Analyze.
+const maxAnalyzeColors = 1024
+
+// analyzeScan accumulates the single-pass statistics for a band of rows.
+type analyzeScan struct {
+	histogram [256]float64
+	brightSum float64
+	allGray   bool
+	hasAlpha  bool
+	// colors holds the distinct sampled colors in first-seen order, so
+	// merging bands in order matches a sequential scan.
+	colors []uint32
+}
 
-	// Compute edge density using Sobel operator (sampled).
-	stats.EdgeDensity = computeEdgeDensity(src)
+func (sc *analyzeScan) scan(src *image.NRGBA, y0, y1, step int) {
+	w := src.Bounds().Dx()
+	seen := make(map[uint32]struct{})
+	sc.allGray = true
 
-	// Make recommendations.
-	stats.RecommendedFormat = recommendFormat(stats)
-	stats.RecommendedQuality = recommendQuality(stats)
-	stats.EstimatedCompression = estimateCompression(stats)
+	for y := y0; y < y1; y++ {
+		off := y * src.Stride
+		for x := 0; x < w; x++ {
+			i := off + x*4
+			r := src.Pix[i]
+			g := src.Pix[i+1]
+			b := src.Pix[i+2]
+			a := src.Pix[i+3]
 
-	return stats
+			lum := 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			sc.brightSum += lum
+			sc.histogram[int(lum+0.5)]++
+
+			if a < 255 {
+				sc.hasAlpha = true
+			}
+			if r != g || g != b {
+				sc.allGray = false
+			}
+			// A band never needs more distinct colors than the global cap.
+			if (y*w+x)%step == 0 && len(sc.colors) < maxAnalyzeColors {
+				key := uint32(r)<<24 | uint32(g)<<16 | uint32(b)<<8 | uint32(a)
+				if _, ok := seen[key]; !ok {
+					seen[key] = struct{}{}
+					sc.colors = append(sc.colors, key)
+				}
+			}
+		}
+	}
 }
 
 // computeEntropy calculates Shannon entropy from a histogram.
@@ -135,8 +298,9 @@ func computeEntropy(histogram []float64, total float64) float64 {
 	return entropy
 }
 
-// computeEdgeDensity uses a Sobel operator to detect edges.
-func computeEdgeDensity(img *image.NRGBA) float64 {
+// computeEdgeDensity uses a Sobel operator to detect edges: pixels whose
+// gradient magnitude exceeds threshold.
+func computeEdgeDensity(img *image.NRGBA, threshold float64) float64 {
 	w := img.Bounds().Dx()
 	h := img.Bounds().Dy()
 
@@ -149,7 +313,6 @@ func computeEdgeDensity(img *image.NRGBA) float64 {
 
 	edgeCount := 0
 	totalCount := 0
-	threshold := 30.0
 
 	for y := 1; y < h-1; y += stepY {
 		for x := 1; x < w-1; x += stepX {
@@ -206,6 +369,19 @@ func recommendQuality(stats ImageStats) Quality {
 	return Balanced
 }
 
+// recommendTables picks JPEG quantization tables: flat tables for
+// limited-palette images with hard edges (screenshots, text), where ringing
+// shows, and photographic tables for high-entropy images.
+func recommendTables(stats ImageStats) QuantTables {
+	if stats.UniqueColors < maxAnalyzeColors && stats.EdgeDensity > 0.02 {
+		return TablesFlat
+	}
+	if stats.Entropy > 6 {
+		return TablesPhotographic
+	}
+	return TablesStandard
+}
+
 func estimateCompression(stats ImageStats) float64 {
 	if stats.RecommendedFormat == PNG {
 		if stats.UniqueColors <= 256 {
@@ -0,0 +1,170 @@
+package fennec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Animated input: the image package decodes only the first frame of a GIF
+// (and Go's PNG and WebP decoders ignore APNG and WebP animation), and
+// Fennec writes only still images. Rather than silently turn an
+// animation into a still, the entry points that read encoded data reject
+// inputs with more than one frame; decode the frame you want and use
+// CompressImage to compress it as a still.
+
+// checkAnimated returns an ErrAnimated error if the encoded image read
+// from r has more than one frame, and nil for stills and for data it
+// can't parse (which the decoder will reject with a better message).
+func checkAnimated(r io.Reader) error {
+	format, frames := animationFrames(r)
+	if frames > 1 {
+		return animatedError(format, frames)
+	}
+	return nil
+}
+
+// animatedError is the error for an input in format with frames frames.
+func animatedError(format string, frames int) error {
+	return fmt.Errorf("%w: %s with %d frames; decode a frame and use CompressImage to compress it as a still",
+		ErrAnimated, format, frames)
+}
+
+// animationFrames reports the format of the encoded image read from r and
+// how many frames it has: the APNG frame count for PNG, the image
+// descriptors in a GIF, and the ANMF chunks in a WebP. It reads only as far
+// as it needs to, and returns 0 frames for other formats or on a parse
+// error.
+func animationFrames(r io.Reader) (string, int) {
+	var sig [12]byte
+	if _, err := io.ReadFull(r, sig[:6]); err != nil {
+		return "", 0
+	}
+	switch {
+	case string(sig[:6]) == pngSignature[:6]:
+		if _, err := io.ReadFull(r, sig[6:8]); err != nil || string(sig[:8]) != pngSignature {
+			return "", 0
+		}
+		return "png", pngFrames(r)
+	case string(sig[:6]) == "GIF87a" || string(sig[:6]) == "GIF89a":
+		return "gif", gifFrames(r)
+	case string(sig[:4]) == "RIFF":
+		if _, err := io.ReadFull(r, sig[6:12]); err != nil || string(sig[8:12]) != "WEBP" {
+			return "", 0
+		}
+		return "webp", webpFrames(r)
+	}
+	return "", 0
+}
+
+// pngFrames returns num_frames from the acTL chunk, which APNG requires
+// before the first IDAT, or 1 if there is none.
+func pngFrames(r io.Reader) int {
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return 0
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[:4]))
+		switch string(hdr[4:8]) {
+		case "acTL":
+			var actl [4]byte
+			if n < 8 {
+				return 0
+			}
+			if _, err := io.ReadFull(r, actl[:]); err != nil {
+				return 0
+			}
+			return int(binary.BigEndian.Uint32(actl[:]))
+		case "IDAT", "IEND":
+			return 1
+		}
+		if _, err := io.CopyN(io.Discard, r, n+4); err != nil { // data + CRC
+			return 0
+		}
+	}
+}
+
+// gifFrames counts the image descriptors in a GIF, after the 6-byte
+// signature.
+func gifFrames(r io.Reader) int {
+	var lsd [7]byte
+	if _, err := io.ReadFull(r, lsd[:]); err != nil {
+		return 0
+	}
+	if lsd[4]&0x80 != 0 {
+		if _, err := io.CopyN(io.Discard, r, 3<<(lsd[4]&7+1)); err != nil {
+			return 0
+		}
+	}
+	frames := 0
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return frames
+		}
+		switch b[0] {
+		case 0x21: // Extension: label, then sub-blocks.
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return frames
+			}
+		case 0x2C: // Image descriptor, optional local color table, LZW code size.
+			var desc [9]byte
+			if _, err := io.ReadFull(r, desc[:]); err != nil {
+				return frames
+			}
+			frames++
+			skip := int64(1)
+			if desc[8]&0x80 != 0 {
+				skip += 3 << (desc[8]&7 + 1)
+			}
+			if _, err := io.CopyN(io.Discard, r, skip); err != nil {
+				return frames
+			}
+		case 0x3B: // Trailer.
+			return frames
+		default:
+			return frames
+		}
+		if !skipGIFSubBlocks(r) {
+			return frames
+		}
+	}
+}
+
+// skipGIFSubBlocks reads past a run of GIF data sub-blocks, up to and
+// including the zero-length terminator.
+func skipGIFSubBlocks(r io.Reader) bool {
+	var n [1]byte
+	for {
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return false
+		}
+		if n[0] == 0 {
+			return true
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(n[0])); err != nil {
+			return false
+		}
+	}
+}
+
+// webpFrames counts the ANMF chunks of an animated WebP, after the 12-byte
+// RIFF header, or returns 1 for a still.
+func webpFrames(r io.Reader) int {
+	frames := 0
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return max(frames, 1)
+		}
+		if bytes.Equal(hdr[:4], []byte("ANMF")) {
+			frames++
+		}
+		n := int64(binary.LittleEndian.Uint32(hdr[4:]))
+		if _, err := io.CopyN(io.Discard, r, n+n&1); err != nil { // Chunks pad to even size.
+			return max(frames, 1)
+		}
+	}
+}
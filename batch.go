@@ -1,10 +1,18 @@
 package fennec
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
+	"time"
 )
 
 // BatchItem represents one file to compress in a batch operation.
@@ -15,6 +23,12 @@ type BatchItem struct {
 	Dst string
 	// Opts are the per-item compression options. If nil, BatchOptions.DefaultOpts is used.
 	Opts *Options
+	// AutoExt marks Dst as a path without an extension, to which the
+	// output format's is appended as CompressFileAuto does. The item in
+	// the BatchResult then has Dst set to the written path and AutoExt
+	// cleared. CompressDir sets it for inputs in formats Fennec doesn't
+	// write, such as TIFF.
+	AutoExt bool
 }
 
 // BatchResult holds the result for a single item in a batch.
@@ -27,17 +41,49 @@ type BatchResult struct {
 	Err error
 	// Index is the position in the original input slice.
 	Index int
+	// Skipped is true when SkipUpToDate found Dst newer than Src and the
+	// item was not recompressed. Result is nil for skipped items.
+	Skipped bool
+	// Retries counts the attempts repeated after a transient I/O error
+	// (see BatchOptions.MaxRetries).
+	Retries int
 }
 
 // BatchOptions configures batch compression behavior.
 type BatchOptions struct {
 	// Workers is the number of concurrent workers. 0 = runtime.NumCPU().
 	Workers int
+	// MaxInFlightBytes caps the estimated memory of the images being
+	// compressed at once, so a few huge sources can't exhaust memory
+	// however many Workers run. Each item weighs width × height × 4 bytes
+	// (one decoded RGBA copy, sized with DecodeConfig) and waits until it
+	// fits under the cap; an item larger than the cap runs alone. The
+	// pipeline holds several copies at its peak, so leave headroom.
+	// 0 = no limit.
+	MaxInFlightBytes int64
 	// DefaultOpts is used for any BatchItem where Opts is nil.
 	DefaultOpts Options
 	// OnItem is called after each item completes (for progress reporting).
 	// It receives the item index and total count.
 	OnItem func(completed, total int)
+	// OnResult is like OnItem but also receives the finished item's
+	// BatchResult, so progress logs can say which file finished and how it
+	// went. Calls never overlap, and completed counts up by one per call.
+	// CompressBatchBytes fills in only Index, Result, and Err. Either
+	// callback, or both, may be set.
+	OnResult func(r BatchResult, completed, total int)
+	// MaxRetries retries an item up to this many times when it fails with
+	// a transient I/O error, such as a read or write error on network
+	// storage, waiting 100ms before the first retry and twice as long
+	// before each next one. Errors that would fail again — undecodable or
+	// unsupported data, invalid options, a missing file, denied access —
+	// are reported at once. 0 disables retries.
+	MaxRetries int
+	// Recursive makes CompressDir descend into subdirectories of srcDir.
+	Recursive bool
+	// SkipUpToDate skips items whose Dst already exists and is newer than
+	// Src, like an incremental make. Skipped items are marked in BatchResult.
+	SkipUpToDate bool
 }
 
 // CompressBatch compresses multiple image files concurrently using a worker pool.
@@ -60,71 +106,432 @@ func CompressBatch(ctx context.Context, items []BatchItem, batchOpts BatchOption
 		return nil
 	}
 
-	workers := batchOpts.Workers
+	results := make([]BatchResult, len(items))
+	delivered := make([]bool, len(items))
+	// Each worker writes only its own index.
+	compressBatchItems(ctx, items, batchOpts, func(br BatchResult) {
+		results[br.Index] = br
+		delivered[br.Index] = true
+	})
+	// Items not started before ctx was done report its error.
+	for i, ok := range delivered {
+		if !ok {
+			results[i] = BatchResult{Item: items[i], Err: ctx.Err(), Index: i}
+		}
+	}
+	return results
+}
+
+// CompressBatchChan is like CompressBatch but delivers each BatchResult on the
+// returned channel as soon as its worker finishes, so callers can stream
+// progress and write outputs incrementally. Results arrive in completion order;
+// use BatchResult.Index to map them back to the input slice. The channel is
+// closed once every started item has been reported.
+//
+// The caller must drain the channel until it is closed; workers block until
+// their result is received. Every item that was started is reported, its
+// output file written or not. Once ctx is cancelled no new items start, and
+// the channel closes without results for them, so after a cancellation the
+// caller waits only for the items already in flight.
+func CompressBatchChan(ctx context.Context, items []BatchItem, batchOpts BatchOptions) <-chan BatchResult {
+	out := make(chan BatchResult, resolveWorkers(batchOpts.Workers, len(items)))
+	go func() {
+		defer close(out)
+		compressBatchItems(ctx, items, batchOpts, func(br BatchResult) { out <- br })
+	}()
+	return out
+}
+
+// compressBatchItems runs the batch worker pool and passes each finished
+// item's result to emit, from the worker goroutines. Items not started
+// before ctx is done are skipped without a result.
+func compressBatchItems(ctx context.Context, items []BatchItem, batchOpts BatchOptions, emit func(BatchResult)) {
+	workers := resolveWorkers(batchOpts.Workers, len(items))
+	progress := newBatchProgress(len(items), batchOpts)
+	mem := newMemLimiter(batchOpts.MaxInFlightBytes)
+
+	runPool(len(items), workers, func(idx int) {
+		item := items[idx]
+
+		// Check cancellation before starting new work.
+		if ctx.Err() != nil {
+			return
+		}
+
+		opts := batchOpts.DefaultOpts
+		if item.Opts != nil {
+			opts = *item.Opts
+		}
+
+		var br BatchResult
+		if batchOpts.SkipUpToDate && item.upToDate() {
+			br = BatchResult{Item: item, Index: idx, Skipped: true}
+		} else if n, err := mem.acquire(ctx, fileDecodedSize(item.Src)); err != nil {
+			br = BatchResult{Item: item, Err: err, Index: idx}
+		} else {
+			result, retries, err := compressFileRetry(ctx, &item, opts, batchOpts.MaxRetries)
+			mem.release(n)
+			br = BatchResult{Item: item, Result: result, Err: err, Index: idx, Retries: retries}
+		}
+		progress.done(br)
+		emit(br)
+	})
+}
+
+// BatchBytesResult holds the result for a single input of CompressBatchBytes.
+type BatchBytesResult struct {
+	// Data is the compressed output (nil if Err is non-nil).
+	Data []byte
+	// Result is the compression result (nil if Err is non-nil).
+	Result *Result
+	// Err is any error that occurred.
+	Err error
+}
+
+// CompressBatchBytes compresses in-memory images concurrently, calling
+// CompressBytes for each input. It uses the same worker pool as CompressBatch
+// and honours BatchOptions.Workers, MaxInFlightBytes, DefaultOpts, and
+// OnItem. Results are returned in the same order as inputs.
+func CompressBatchBytes(ctx context.Context, inputs [][]byte, batchOpts BatchOptions) []BatchBytesResult {
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	results := make([]BatchBytesResult, len(inputs))
+	progress := newBatchProgress(len(inputs), batchOpts)
+	mem := newMemLimiter(batchOpts.MaxInFlightBytes)
+
+	runPool(len(inputs), resolveWorkers(batchOpts.Workers, len(inputs)), func(idx int) {
+		if err := ctx.Err(); err != nil {
+			results[idx] = BatchBytesResult{Err: err}
+			return
+		}
+		n, err := mem.acquire(ctx, decodedSize(bytes.NewReader(inputs[idx])))
+		if err != nil {
+			results[idx] = BatchBytesResult{Err: err}
+			progress.done(BatchResult{Err: err, Index: idx})
+			return
+		}
+		result, err := CompressBytes(ctx, inputs[idx], batchOpts.DefaultOpts)
+		mem.release(n)
+		if err != nil {
+			results[idx] = BatchBytesResult{Err: err}
+		} else {
+			results[idx] = BatchBytesResult{Data: result.Bytes(), Result: result}
+		}
+		progress.done(BatchResult{Result: result, Err: err, Index: idx})
+	})
+	return results
+}
+
+// batchRetryDelay is the wait before the first retry of BatchOptions.MaxRetries.
+const batchRetryDelay = 100 * time.Millisecond
+
+// compressFileRetry runs CompressFile for item, retrying up to maxRetries
+// times with exponential backoff while it fails with a transient I/O error.
+// It returns the number of retries made. An item with AutoExt goes
+// through CompressFileAuto and comes back with Dst set to the written path.
+func compressFileRetry(ctx context.Context, item *BatchItem, opts Options, maxRetries int) (*Result, int, error) {
+	delay := batchRetryDelay
+	for retries := 0; ; retries++ {
+		var result *Result
+		var err error
+		if item.AutoExt {
+			var path string
+			result, path, err = CompressFileAuto(ctx, item.Src, item.Dst, opts)
+			if err == nil {
+				item.Dst, item.AutoExt = path, false
+			}
+		} else {
+			result, err = CompressFile(ctx, item.Src, item.Dst, opts)
+		}
+		if err == nil || retries >= maxRetries || !isTransientIOError(err) {
+			return result, retries, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, retries, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// isTransientIOError reports whether err comes from a file operation that
+// may succeed if repeated. Decode errors only qualify when a read failed
+// underneath, not when the data itself is bad; missing files and denied
+// access would fail the same way again.
+func isTransientIOError(err error) bool {
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) {
+		return false
+	}
+	return !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// resolveWorkers returns the worker count to use for n items.
+// 0 or negative means runtime.NumCPU(); never more workers than items.
+func resolveWorkers(workers, n int) int {
 	if workers <= 0 {
 		workers = runtime.NumCPU()
 	}
-	if workers > len(items) {
-		workers = len(items)
+	if workers > n {
+		workers = n
 	}
+	return workers
+}
 
-	results := make([]BatchResult, len(items))
-	workCh := make(chan int, len(items))
-	var wg sync.WaitGroup
-	var completed int
-	var completedMu sync.Mutex
-
-	// Feed work.
-	for i := range items {
+// runPool calls fn(idx) for every idx in [0, n) on a pool of workers
+// goroutines and blocks until all calls have returned.
+func runPool(n, workers int, fn func(idx int)) {
+	workCh := make(chan int, n)
+	for i := 0; i < n; i++ {
 		workCh <- i
 	}
 	close(workCh)
 
-	// Start workers.
+	var wg sync.WaitGroup
 	for w := 0; w < workers; w++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for idx := range workCh {
-				// Check cancellation before starting new work.
-				select {
-				case <-ctx.Done():
-					results[idx] = BatchResult{
-						Item:  items[idx],
-						Err:   ctx.Err(),
-						Index: idx,
-					}
-					continue
-				default:
-				}
+				fn(idx)
+			}
+		}()
+	}
+	wg.Wait()
+}
 
-				item := items[idx]
-				opts := batchOpts.DefaultOpts
-				if item.Opts != nil {
-					opts = *item.Opts
-				}
+// memLimiter is a weighted semaphore over estimated decoded-image bytes,
+// for BatchOptions.MaxInFlightBytes. Waiters are served in arrival order,
+// so a large item isn't starved by a stream of small ones. A nil
+// *memLimiter never blocks.
+type memLimiter struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	waiters []*memWaiter
+}
 
-				result, err := CompressFile(ctx, item.Src, item.Dst, opts)
-				results[idx] = BatchResult{
-					Item:   item,
-					Result: result,
-					Err:    err,
-					Index:  idx,
-				}
+type memWaiter struct {
+	n     int64
+	ready chan struct{}
+}
 
-				if batchOpts.OnItem != nil {
-					completedMu.Lock()
-					completed++
-					c := completed
-					completedMu.Unlock()
-					batchOpts.OnItem(c, len(items))
+// newMemLimiter returns a limiter for limit bytes, or nil if limit is not
+// positive.
+func newMemLimiter(limit int64) *memLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &memLimiter{limit: limit}
+}
+
+// acquire blocks until n bytes fit under the limit or ctx is done, and
+// returns the amount to pass to release. Requests over the limit are
+// clamped to it, so they wait for every other item to finish and then run
+// alone.
+func (l *memLimiter) acquire(ctx context.Context, n int64) (int64, error) {
+	if l == nil {
+		return 0, nil
+	}
+	n = min(max(n, 0), l.limit)
+
+	l.mu.Lock()
+	if len(l.waiters) == 0 && l.used+n <= l.limit {
+		l.used += n
+		l.mu.Unlock()
+		return n, nil
+	}
+	w := &memWaiter{n: n, ready: make(chan struct{})}
+	l.waiters = append(l.waiters, w)
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return n, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		select {
+		case <-w.ready:
+			// Granted while giving up: hand the bytes back.
+			l.used -= n
+		default:
+			for i, other := range l.waiters {
+				if other == w {
+					l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+					break
 				}
 			}
-		}()
+		}
+		l.grant()
+		return 0, ctx.Err()
 	}
+}
 
-	wg.Wait()
-	return results
+// release returns n bytes from acquire and wakes the waiters that now fit.
+func (l *memLimiter) release(n int64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.used -= n
+	l.grant()
+}
+
+// grant wakes waiters in order while the first one fits. l.mu must be held.
+func (l *memLimiter) grant() {
+	for len(l.waiters) > 0 {
+		w := l.waiters[0]
+		if l.used+w.n > l.limit {
+			return
+		}
+		l.used += w.n
+		l.waiters = l.waiters[1:]
+		close(w.ready)
+	}
+}
+
+// decodedSize estimates the bytes one decoded RGBA copy of the image in r
+// takes, from its header. Unreadable headers weigh nothing; the
+// compression that follows reports the error.
+func decodedSize(r io.Reader) int64 {
+	cfg, _, err := decodeImageConfig(r)
+	if err != nil {
+		return 0
+	}
+	return int64(cfg.Width) * int64(cfg.Height) * 4
+}
+
+// fileDecodedSize is decodedSize for the file at path.
+func fileDecodedSize(path string) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	return decodedSize(f)
+}
+
+// batchProgress serializes OnItem and OnResult callbacks with a shared
+// completion counter.
+type batchProgress struct {
+	mu        sync.Mutex
+	completed int
+	total     int
+	onItem    func(completed, total int)
+	onResult  func(r BatchResult, completed, total int)
+}
+
+func newBatchProgress(total int, batchOpts BatchOptions) *batchProgress {
+	return &batchProgress{total: total, onItem: batchOpts.OnItem, onResult: batchOpts.OnResult}
+}
+
+func (p *batchProgress) done(r BatchResult) {
+	if p.onItem == nil && p.onResult == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.completed++
+	if p.onItem != nil {
+		p.onItem(p.completed, p.total)
+	}
+	if p.onResult != nil {
+		p.onResult(r, p.completed, p.total)
+	}
+}
+
+// upToDate reports whether item's output exists and is newer than its
+// input. With AutoExt it looks for Dst plus each output format's
+// extension, and sets Dst to the one it finds.
+func (item *BatchItem) upToDate() bool {
+	if !item.AutoExt {
+		return isUpToDate(item.Src, item.Dst)
+	}
+	for _, f := range []Format{JPEG, PNG, GIF} {
+		if dst := item.Dst + f.extension(); isUpToDate(item.Src, dst) {
+			item.Dst, item.AutoExt = dst, false
+			return true
+		}
+	}
+	return false
+}
+
+// isUpToDate reports whether dst exists and was modified after src.
+func isUpToDate(src, dst string) bool {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false
+	}
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		return false
+	}
+	return dstInfo.ModTime().After(srcInfo.ModTime())
+}
+
+// CompressDir compresses every supported image in srcDir whose base name
+// matches pattern (e.g. "*.jpg"; empty matches all) and writes the results to
+// mirrored paths under dstDir, creating subdirectories as needed. Files with
+// unsupported extensions are skipped. Inputs in formats Fennec reads but
+// doesn't write (TIFF, BMP) take the output format's extension instead of
+// their own, and BatchResult.Item.Dst reports the path written. Set
+// BatchOptions.Recursive to descend into subdirectories. The returned error
+// covers walking and pattern problems; per-file failures are reported in the
+// BatchResults.
+func CompressDir(ctx context.Context, srcDir, dstDir, pattern string, batchOpts BatchOptions) ([]BatchResult, error) {
+	if pattern != "" {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("fennec: pattern %q: %w", pattern, err)
+		}
+	}
+
+	var items []BatchItem
+	err := filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != srcDir && !batchOpts.Recursive {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !isSupportedInput(path) {
+			return nil
+		}
+		if pattern != "" {
+			if ok, _ := filepath.Match(pattern, d.Name()); !ok {
+				return nil
+			}
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		item := BatchItem{Src: path, Dst: filepath.Join(dstDir, rel)}
+		if !isWritableExt(path) {
+			item.Dst = strings.TrimSuffix(item.Dst, filepath.Ext(item.Dst))
+			item.AutoExt = true
+		}
+		items = append(items, item)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fennec: walk %q: %w", srcDir, err)
+	}
+
+	for _, item := range items {
+		if err := os.MkdirAll(filepath.Dir(item.Dst), 0755); err != nil {
+			return nil, fmt.Errorf("fennec: mkdir %q: %w", filepath.Dir(item.Dst), err)
+		}
+	}
+	return CompressBatch(ctx, items, batchOpts), nil
 }
 
 // BatchSummary provides aggregate statistics for a batch operation.
@@ -132,6 +539,7 @@ type BatchSummary struct {
 	Total      int
 	Succeeded  int
 	Failed     int
+	Skipped    int
 	TotalSaved int64
 	AvgSSIM    float64
 }
@@ -141,6 +549,10 @@ func Summarize(results []BatchResult) BatchSummary {
 	s := BatchSummary{Total: len(results)}
 	var ssimSum float64
 	for _, r := range results {
+		if r.Skipped {
+			s.Skipped++
+			continue
+		}
 		if r.Err != nil {
 			s.Failed++
 			continue
@@ -159,8 +571,12 @@ func Summarize(results []BatchResult) BatchSummary {
 
 // String returns a human-readable batch summary.
 func (s BatchSummary) String() string {
+	skipped := ""
+	if s.Skipped > 0 {
+		skipped = fmt.Sprintf(" | %d skipped", s.Skipped)
+	}
 	return fmt.Sprintf(
-		"Batch: %d/%d succeeded | %s saved | Avg SSIM: %.4f",
-		s.Succeeded, s.Total, humanBytes(s.TotalSaved), s.AvgSSIM,
+		"Batch: %d/%d succeeded%s | %s saved | Avg SSIM: %.4f",
+		s.Succeeded, s.Total, skipped, humanBytes(s.TotalSaved), s.AvgSSIM,
 	)
 }
@@ -0,0 +1,212 @@
+package fennec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math/bits"
+)
+
+// BMP input: uncompressed Windows bitmaps at 1, 4, 8, 24, and 32 bits per
+// pixel, bottom-up or top-down, with BITMAPINFOHEADER or its V4/V5
+// extensions. RLE compression is not supported. Fennec never writes BMP.
+
+// maxDecodePixels bounds the images the built-in BMP and TIFF decoders
+// allocate, so a forged header can't demand gigabytes.
+const maxDecodePixels = 1 << 28
+
+var errBMP = errors.New("fennec: invalid BMP")
+
+// bmpHeader is the part of a BMP header the decoder needs.
+type bmpHeader struct {
+	width, height int
+	topDown       bool
+	bpp           int
+	pixelOffset   int
+	masks         [4]uint32 // R, G, B, A; only for 32 bpp
+	palette       color.Palette
+}
+
+const (
+	bmpRGB       = 0
+	bmpBitfields = 3
+)
+
+// readBMPHeader parses the file and info headers and the palette. It
+// consumes exactly the bytes it parses and reports how many that was.
+func readBMPHeader(r io.Reader) (bmpHeader, int, error) {
+	var h bmpHeader
+	var buf [18]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return h, 0, err
+	}
+	if buf[0] != 'B' || buf[1] != 'M' {
+		return h, 0, errBMP
+	}
+	h.pixelOffset = int(binary.LittleEndian.Uint32(buf[10:14]))
+	infoSize := int(binary.LittleEndian.Uint32(buf[14:18]))
+	if infoSize < 40 || infoSize > 1024 {
+		return h, 0, fmt.Errorf("%w: info header size %d", errBMP, infoSize)
+	}
+	info := make([]byte, infoSize-4)
+	if _, err := io.ReadFull(r, info); err != nil {
+		return h, 0, err
+	}
+	read := len(buf) + len(info)
+
+	h.width = int(int32(binary.LittleEndian.Uint32(info[0:4])))
+	height := int(int32(binary.LittleEndian.Uint32(info[4:8])))
+	h.bpp = int(binary.LittleEndian.Uint16(info[10:12]))
+	compression := binary.LittleEndian.Uint32(info[12:16])
+	colorsUsed := int(binary.LittleEndian.Uint32(info[28:32]))
+
+	if height < 0 {
+		h.topDown = true
+		height = -height
+	}
+	h.height = height
+	if h.width <= 0 || h.height <= 0 || h.width*h.height > maxDecodePixels {
+		return h, 0, fmt.Errorf("%w: dimensions %dx%d", errBMP, h.width, h.height)
+	}
+
+	switch {
+	case compression == bmpRGB && h.bpp == 32:
+		h.masks = [4]uint32{0xff0000, 0xff00, 0xff, 0}
+	case compression == bmpBitfields && h.bpp == 32:
+		// Masks follow a 40-byte header as three extra DWORDs, or sit
+		// inside a V4/V5 header (which also carries the alpha mask).
+		if infoSize == 40 {
+			var m [12]byte
+			if _, err := io.ReadFull(r, m[:]); err != nil {
+				return h, 0, err
+			}
+			read += len(m)
+			for i := range 3 {
+				h.masks[i] = binary.LittleEndian.Uint32(m[i*4:])
+			}
+		} else {
+			for i := range 3 {
+				h.masks[i] = binary.LittleEndian.Uint32(info[36+i*4:])
+			}
+			if infoSize >= 56 {
+				h.masks[3] = binary.LittleEndian.Uint32(info[48:52])
+			}
+		}
+	case compression == bmpRGB && (h.bpp == 1 || h.bpp == 4 || h.bpp == 8 || h.bpp == 24):
+	default:
+		return h, 0, fmt.Errorf("%w: %d bpp with compression %d", ErrUnsupportedFormat, h.bpp, compression)
+	}
+
+	if h.bpp <= 8 {
+		n := colorsUsed
+		if n == 0 || n > 1<<h.bpp {
+			n = 1 << h.bpp
+		}
+		pal := make([]byte, n*4)
+		if _, err := io.ReadFull(r, pal); err != nil {
+			return h, 0, err
+		}
+		read += len(pal)
+		h.palette = make(color.Palette, n)
+		for i := range n {
+			h.palette[i] = color.NRGBA{pal[i*4+2], pal[i*4+1], pal[i*4], 255}
+		}
+	}
+	return h, read, nil
+}
+
+func decodeBMPConfig(r io.Reader) (image.Config, error) {
+	h, _, err := readBMPHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	cfg := image.Config{ColorModel: color.NRGBAModel, Width: h.width, Height: h.height}
+	if h.palette != nil {
+		cfg.ColorModel = h.palette
+	}
+	return cfg, nil
+}
+
+func decodeBMP(r io.Reader) (image.Image, error) {
+	h, read, err := readBMPHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if skip := h.pixelOffset - read; skip > 0 {
+		if _, err := io.CopyN(io.Discard, r, int64(skip)); err != nil {
+			return nil, err
+		}
+	}
+
+	stride := (h.width*h.bpp + 31) / 32 * 4
+	row := make([]byte, stride)
+	img := image.NewNRGBA(image.Rect(0, 0, h.width, h.height))
+	hasAlpha := false
+
+	for i := 0; i < h.height; i++ {
+		if _, err := io.ReadFull(r, row); err != nil {
+			return nil, err
+		}
+		y := h.height - 1 - i
+		if h.topDown {
+			y = i
+		}
+		dst := img.Pix[y*img.Stride : y*img.Stride+h.width*4]
+		switch h.bpp {
+		case 1, 4, 8:
+			perByte := 8 / h.bpp
+			mask := byte(1<<h.bpp - 1)
+			for x := 0; x < h.width; x++ {
+				shift := uint(8 - h.bpp*(x%perByte+1))
+				idx := int(row[x/perByte] >> shift & mask)
+				c := color.NRGBA{A: 255}
+				if idx < len(h.palette) {
+					c = h.palette[idx].(color.NRGBA)
+				}
+				dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = c.R, c.G, c.B, 255
+			}
+		case 24:
+			for x := 0; x < h.width; x++ {
+				dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = row[x*3+2], row[x*3+1], row[x*3], 255
+			}
+		case 32:
+			for x := 0; x < h.width; x++ {
+				v := binary.LittleEndian.Uint32(row[x*4:])
+				dst[x*4] = bmpChannel(v, h.masks[0])
+				dst[x*4+1] = bmpChannel(v, h.masks[1])
+				dst[x*4+2] = bmpChannel(v, h.masks[2])
+				dst[x*4+3] = 255
+				if h.masks[3] != 0 {
+					dst[x*4+3] = bmpChannel(v, h.masks[3])
+					hasAlpha = hasAlpha || dst[x*4+3] != 0
+				}
+			}
+		}
+	}
+
+	// Many writers leave a declared alpha channel all zero; treat that as
+	// opaque rather than returning an invisible image.
+	if h.masks[3] != 0 && !hasAlpha {
+		for i := 3; i < len(img.Pix); i += 4 {
+			img.Pix[i] = 255
+		}
+	}
+	return img, nil
+}
+
+// bmpChannel extracts the bits of v selected by mask, scaled to 8 bits.
+func bmpChannel(v, mask uint32) uint8 {
+	if mask == 0 {
+		return 0
+	}
+	shift := bits.TrailingZeros32(mask)
+	width := bits.OnesCount32(mask)
+	c := (v & mask) >> shift
+	if width >= 8 {
+		return uint8(c >> (width - 8))
+	}
+	return uint8(c * 255 / (1<<width - 1))
+}
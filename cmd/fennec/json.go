@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/shamspias/fennec"
+)
+
+// jsonResult is the -json output for one compression, on its own or as an
+// entry of a batch. Exactly one of Result and Error is set; Result uses the
+// library's own JSON form.
+type jsonResult struct {
+	Input     string         `json:"input"`
+	Output    string         `json:"output"`
+	Result    *fennec.Result `json:"result,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	ElapsedMS int64          `json:"elapsed_ms,omitempty"`
+}
+
+// newJSONResult returns the jsonResult for a compression of input to
+// output that produced r or failed with err.
+func newJSONResult(input, output string, r *fennec.Result, err error, elapsed time.Duration) jsonResult {
+	out := jsonResult{Input: input, Output: output, ElapsedMS: elapsed.Milliseconds()}
+	if err != nil {
+		out.Error = err.Error()
+	} else {
+		out.Result = r
+	}
+	return out
+}
+
+// jsonAnalysis is the -json output for -analyze: the input's name and its
+// ImageStats.
+type jsonAnalysis struct {
+	Input string `json:"input"`
+	fennec.ImageStats
+}
+
+// jsonCompare is the -json output for -compare.
+type jsonCompare struct {
+	A    string  `json:"a"`
+	B    string  `json:"b"`
+	SSIM float64 `json:"ssim"`
+	Pass bool    `json:"pass"`
+}
+
+// jsonBatch is the -json output for -out-dir batch mode.
+type jsonBatch struct {
+	Results   []jsonResult `json:"results"`
+	Total     int          `json:"total"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Saved     int64        `json:"saved_bytes"`
+	AvgSSIM   float64      `json:"avg_ssim"`
+	ElapsedMS int64        `json:"elapsed_ms"`
+}
+
+func newJSONBatch(results []fennec.BatchResult, s fennec.BatchSummary, elapsed time.Duration) jsonBatch {
+	out := jsonBatch{
+		Results:   make([]jsonResult, len(results)),
+		Total:     s.Total,
+		Succeeded: s.Succeeded,
+		Failed:    s.Failed,
+		Saved:     s.TotalSaved,
+		AvgSSIM:   s.AvgSSIM,
+		ElapsedMS: elapsed.Milliseconds(),
+	}
+	for i, r := range results {
+		out.Results[i] = newJSONResult(r.Item.Src, r.Item.Dst, r.Result, r.Err, 0)
+	}
+	return out
+}
+
+// writeJSON pretty-prints v to w, exiting on encode failure.
+func writeJSON(w io.Writer, v any) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
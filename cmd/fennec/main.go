@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
+	"image"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -50,18 +55,61 @@ func parseSize(s string) (int, error) {
 	return val, nil
 }
 
+// parseAspect parses an aspect ratio like "16:9", "1:1", or "1.91:1" and
+// returns width / height.
+func parseAspect(s string) (float64, error) {
+	ws, hs, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid aspect %q: expected W:H, like 16:9", s)
+	}
+	w, errW := strconv.ParseFloat(strings.TrimSpace(ws), 64)
+	h, errH := strconv.ParseFloat(strings.TrimSpace(hs), 64)
+	if errW != nil || errH != nil || !(w > 0) || !(h > 0) || math.IsInf(w, 0) || math.IsInf(h, 0) {
+		return 0, fmt.Errorf("invalid aspect %q: expected two positive numbers, like 16:9", s)
+	}
+	return w / h, nil
+}
+
+// parseFit parses a -fit mode name.
+func parseFit(s string) (fennec.FitMode, error) {
+	switch strings.ToLower(s) {
+	case "cover":
+		return fennec.FitCover, nil
+	case "contain":
+		return fennec.FitContain, nil
+	case "stretch":
+		return fennec.FitStretch, nil
+	}
+	return 0, fmt.Errorf("invalid fit %q: expected cover, contain, or stretch", s)
+}
+
 type appConfig struct {
 	quality, format, targetSize string
 	maxWidth, maxHeight         int
+	aspect                      float64 // width / height from -aspect; 0 if unset
+	fit                         fennec.FitMode
 	ssimTarget                  float64
 	noOrient, analyze, verbose  bool
+	jsonOut, compare            bool
 	input, output               string
+	autoExt                     bool // output is a base name; the extension follows the chosen format
+	outDir                      string
+	workers                     int
+	inputs                      []string
 }
 
 func main() {
 	cfg := parseFlags()
 	if cfg.analyze {
-		runAnalyze(cfg.input)
+		runAnalyze(cfg)
+		return
+	}
+	if cfg.compare {
+		runCompare(cfg)
+		return
+	}
+	if cfg.outDir != "" {
+		runBatch(cfg)
 		return
 	}
 	runCompression(cfg)
@@ -73,37 +121,96 @@ func parseFlags() appConfig {
 	flag.StringVar(&cfg.format, "format", "auto", "Output format")
 	flag.IntVar(&cfg.maxWidth, "max-width", 0, "Max width")
 	flag.IntVar(&cfg.maxHeight, "max-height", 0, "Max height")
+	aspect := flag.String("aspect", "", "Crop or pad to this aspect ratio, e.g. 16:9 (sized by -max-width/-max-height)")
+	fit := flag.String("fit", "cover", "How -aspect fits the image: cover (crop), contain (pad), or stretch")
 	flag.StringVar(&cfg.targetSize, "target-size", "", "Target file size")
 	flag.Float64Var(&cfg.ssimTarget, "ssim", 0, "Custom SSIM target")
 	flag.BoolVar(&cfg.noOrient, "no-orient", false, "Don't auto-rotate")
 	flag.BoolVar(&cfg.analyze, "analyze", false, "Analyze image")
+	flag.BoolVar(&cfg.compare, "compare", false, "Print the SSIM between two images (fails if below -ssim)")
 	flag.BoolVar(&cfg.verbose, "v", false, "Verbose output")
-	flag.Parse()
+	flag.BoolVar(&cfg.jsonOut, "json", false, "Print results as JSON")
+	flag.StringVar(&cfg.outDir, "out-dir", "", "Batch mode: compress all inputs into this directory")
+	flag.IntVar(&cfg.workers, "workers", 0, "Batch mode: concurrent workers (0 = all CPUs)")
+	args := parseInterspersed(flag.CommandLine, os.Args[1:])
 
-	args := flag.Args()
 	if len(args) < 1 {
-		fmt.Fprintf(os.Stderr, "Usage: fennec [options] <input> [output]\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: fennec [options] <input> [output]\n       fennec [options] -out-dir <dir> <input>...\n       fennec -compare [-ssim min] <a> <b>\n\n")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
+	var err error
+	if *aspect != "" {
+		if cfg.aspect, err = parseAspect(*aspect); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.fit, err = parseFit(*fit); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if cfg.outDir != "" {
+		cfg.inputs = args
+		return cfg
+	}
+	if cfg.compare && len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "Error: -compare needs exactly two images\n")
+		os.Exit(1)
+	}
+
 	cfg.input = args[0]
 	if len(args) >= 2 {
 		cfg.output = args[1]
+	} else if cfg.input == stdioPath {
+		cfg.output = stdioPath
 	} else {
-		base := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(cfg.input, ".jpg"), ".jpeg"), ".png")
-		cfg.output = base + "_fennec.jpg"
+		base := cfg.input
+		for _, ext := range []string{".jpg", ".jpeg", ".png", ".gif"} {
+			base = strings.TrimSuffix(base, ext)
+		}
+		cfg.output = base + "_fennec"
+		cfg.autoExt = true
 	}
 	return cfg
 }
 
-func runAnalyze(input string) {
+// parseInterspersed parses flags that may appear before, between, or after
+// positional arguments (e.g. "fennec *.jpg -out-dir out") and returns the
+// positional arguments in order. Everything after "--" is positional, so
+// "fennec -- -photo.jpg" names a file starting with a dash.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			os.Exit(2)
+		}
+		if parsed := len(args) - fs.NArg(); parsed > 0 && args[parsed-1] == "--" {
+			return append(positional, fs.Args()...)
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func runAnalyze(cfg appConfig) {
+	input := cfg.input
 	img, err := fennec.Open(input)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 	stats := fennec.Analyze(img)
+	if cfg.jsonOut {
+		writeJSON(os.Stdout, jsonAnalysis{Input: input, ImageStats: stats})
+		return
+	}
 	fmt.Printf("Image Analysis: %s\n", input)
 	// Fixed the Printf arguments to include stats.UniqueColors
 	fmt.Printf("  Dimensions:     %d x %d\n  Has Alpha:      %v\n  Grayscale:      %v\n  Unique Colors:  %d\n", stats.Width, stats.Height, stats.HasAlpha, stats.IsGrayscale, stats.UniqueColors)
@@ -111,23 +218,197 @@ func runAnalyze(input string) {
 	fmt.Printf("  Recommended:    %s / %s\n", stats.RecommendedFormat, stats.RecommendedQuality)
 }
 
+// runCompare prints the SSIM between the two inputs. With -ssim set, it
+// exits 1 when the score falls below that threshold, for use in QA scripts.
+func runCompare(cfg appConfig) {
+	ssim, err := fennec.SSIMFiles(cfg.input, cfg.output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	pass := cfg.ssimTarget <= 0 || ssim >= cfg.ssimTarget
+	if cfg.jsonOut {
+		writeJSON(os.Stdout, jsonCompare{A: cfg.input, B: cfg.output, SSIM: ssim, Pass: pass})
+	} else {
+		fmt.Printf("%s vs %s | SSIM: %.4f\n", cfg.input, cfg.output, ssim)
+	}
+	if !pass {
+		if !cfg.jsonOut {
+			fmt.Fprintf(os.Stderr, "SSIM %.4f is below %.4f\n", ssim, cfg.ssimTarget)
+		}
+		os.Exit(1)
+	}
+}
+
 func runCompression(cfg appConfig) {
-	opts := buildOptions(cfg)
+	if cfg.input == stdioPath || cfg.output == stdioPath {
+		runStream(cfg)
+		return
+	}
+	opts, err := withAspect(buildOptions(cfg), cfg, func() (int, int, error) {
+		return fileDimensions(cfg.input, !cfg.noOrient)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 	start := time.Now()
-	result, err := fennec.CompressFile(context.Background(), cfg.input, cfg.output, opts)
+	var result *fennec.Result
+	if cfg.autoExt {
+		result, cfg.output, err = fennec.CompressFileAuto(context.Background(), cfg.input, cfg.output, opts)
+	} else {
+		result, err = fennec.CompressFile(context.Background(), cfg.input, cfg.output, opts)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 	elapsed := time.Since(start).Round(time.Millisecond)
+	printResult(os.Stdout, cfg, result, elapsed)
+}
 
-	if cfg.verbose {
-		fmt.Printf("%v\n  Time: %v\n", result, elapsed)
+// printResult writes the summary for a single compression as JSON, the
+// verbose Result string, or the default one-line format.
+func printResult(w io.Writer, cfg appConfig, result *fennec.Result, elapsed time.Duration) {
+	switch {
+	case cfg.jsonOut:
+		writeJSON(w, newJSONResult(cfg.input, cfg.output, result, nil, elapsed))
+	case cfg.verbose:
+		fmt.Fprintf(w, "%v\n  Time: %v\n", result, elapsed)
+	default:
+		fmt.Fprintf(w, "%s -> %s | %s | SSIM: %.4f | Saved: %.1f%% | %v\n", cfg.input, cfg.output, result.Format, result.SSIM, result.SavingsPercent, elapsed)
+	}
+}
+
+// stdioPath is the conventional "-" argument meaning stdin for input and
+// stdout for output.
+const stdioPath = "-"
+
+// runStream compresses when either end is stdin/stdout. The image is decoded
+// from its bytes, so the output format comes from the data (or -format), not
+// a file extension. When writing the image to stdout, the summary goes to
+// stderr so it doesn't corrupt the image stream.
+func runStream(cfg appConfig) {
+	opts := buildOptions(cfg)
+
+	var data []byte
+	var err error
+	if cfg.input == stdioPath {
+		data, err = io.ReadAll(os.Stdin)
 	} else {
-		fmt.Printf("%s -> %s | %s | SSIM: %.4f | Saved: %.1f%% | %v\n", cfg.input, cfg.output, result.Format, result.SSIM, result.SavingsPercent, elapsed)
+		data, err = os.ReadFile(cfg.input)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	opts, err = withAspect(opts, cfg, func() (int, int, error) {
+		return readDimensions(bytes.NewReader(data), !cfg.noOrient)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	start := time.Now()
+	result, err := fennec.CompressBytes(context.Background(), data, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	summaryOut := os.Stdout
+	if cfg.output == stdioPath {
+		summaryOut = os.Stderr
+		_, err = result.WriteTo(os.Stdout)
+	} else {
+		err = os.WriteFile(cfg.output, result.Bytes(), 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	elapsed := time.Since(start).Round(time.Millisecond)
+	printResult(summaryOut, cfg, result, elapsed)
+}
+
+func runBatch(cfg appConfig) {
+	items, err := batchItems(cfg.inputs, cfg.outDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.MkdirAll(cfg.outDir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	defaults := buildOptions(cfg)
+	for i, in := range cfg.inputs {
+		if cfg.aspect == 0 {
+			continue
+		}
+		// Without a size limit the output size follows each input's
+		// dimensions, so every item gets its own options. An input whose
+		// header can't be read fails in the batch like any other.
+		opts, err := withAspect(defaults, cfg, func() (int, int, error) {
+			return fileDimensions(in, !cfg.noOrient)
+		})
+		if err == nil {
+			items[i].Opts = &opts
+		}
+	}
+
+	start := time.Now()
+	results := fennec.CompressBatch(context.Background(), items, fennec.BatchOptions{
+		Workers:     cfg.workers,
+		DefaultOpts: defaults,
+	})
+	elapsed := time.Since(start).Round(time.Millisecond)
+	summary := fennec.Summarize(results)
+
+	if cfg.jsonOut {
+		writeJSON(os.Stdout, newJSONBatch(results, summary, elapsed))
+		if summary.Failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s: error: %v\n", r.Item.Src, r.Err)
+			continue
+		}
+		fmt.Printf("%s -> %s | %s | SSIM: %.4f | Saved: %.1f%%\n", r.Item.Src, r.Item.Dst, r.Result.Format, r.Result.SSIM, r.Result.SavingsPercent)
+	}
+
+	fmt.Printf("%v | %v\n", summary, elapsed)
+	if summary.Failed > 0 {
+		os.Exit(1)
 	}
 }
 
+// batchItems pairs each input with an output in outDir named after it,
+// with the extension of the format actually written. Two inputs with the
+// same name but for the extension, such as a/photo.jpg and b/photo.png,
+// could overwrite each other's output, so they are an error.
+func batchItems(inputs []string, outDir string) ([]fennec.BatchItem, error) {
+	items := make([]fennec.BatchItem, len(inputs))
+	srcs := make(map[string]string, len(inputs))
+	for i, in := range inputs {
+		base := filepath.Base(in)
+		dst := filepath.Join(outDir, strings.TrimSuffix(base, filepath.Ext(base)))
+		if prev, ok := srcs[dst]; ok {
+			return nil, fmt.Errorf("%s and %s would both be written as %s", prev, in, dst)
+		}
+		srcs[dst] = in
+		items[i] = fennec.BatchItem{Src: in, Dst: dst, AutoExt: true}
+	}
+	return items, nil
+}
+
 func buildOptions(cfg appConfig) fennec.Options {
 	opts := fennec.DefaultOptions()
 	opts.MaxWidth, opts.MaxHeight = cfg.maxWidth, cfg.maxHeight
@@ -157,10 +438,89 @@ func buildOptions(cfg appConfig) fennec.Options {
 	return opts
 }
 
+// withAspect returns opts with ExactSize and ExactFit set for -aspect, or
+// opts unchanged if it wasn't given. dims reports the source's dimensions
+// as displayed; it is called only when neither -max-width nor -max-height
+// is set, so the output size follows the source.
+func withAspect(opts fennec.Options, cfg appConfig, dims func() (int, int, error)) (fennec.Options, error) {
+	if cfg.aspect == 0 {
+		return opts, nil
+	}
+	var size image.Point
+	if cfg.maxWidth > 0 || cfg.maxHeight > 0 {
+		size = boxSize(cfg.aspect, cfg.maxWidth, cfg.maxHeight)
+	} else {
+		w, h, err := dims()
+		if err != nil {
+			return opts, err
+		}
+		size = sourceAspectSize(cfg.aspect, cfg.fit, w, h)
+	}
+	opts.ExactSize, opts.ExactFit = size, cfg.fit
+	return opts, nil
+}
+
+// boxSize is the largest size with the given aspect ratio that fits
+// within maxW×maxH, where 0 leaves that side unconstrained.
+func boxSize(aspect float64, maxW, maxH int) image.Point {
+	w, h := float64(maxW), float64(maxH)
+	switch {
+	case maxH <= 0:
+		h = w / aspect
+	case maxW <= 0:
+		w = h * aspect
+	case w/h > aspect:
+		w = h * aspect
+	default:
+		h = w / aspect
+	}
+	return image.Pt(max(1, int(math.Round(w))), max(1, int(math.Round(h))))
+}
+
+// sourceAspectSize is the size with the given aspect ratio that keeps a
+// w×h source at its own scale: the largest box inside it for cover and
+// stretch, which crop or squeeze, and the smallest box around it for
+// contain, which pads.
+func sourceAspectSize(aspect float64, fit fennec.FitMode, w, h int) image.Point {
+	if (float64(w)/float64(h) > aspect) == (fit == fennec.FitContain) {
+		return image.Pt(w, max(1, int(math.Round(float64(w)/aspect))))
+	}
+	return image.Pt(max(1, int(math.Round(float64(h)*aspect))), h)
+}
+
+// fileDimensions returns the dimensions of the image file at path, after
+// EXIF orientation if orient is set.
+func fileDimensions(path string, orient bool) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	return readDimensions(f, orient)
+}
+
+// readDimensions reads the header of the encoded image in r and returns
+// its dimensions, after EXIF orientation if orient is set.
+func readDimensions(r io.ReadSeeker, orient bool) (int, int, error) {
+	w, h, _, err := fennec.DecodeConfig(r)
+	if err != nil || !orient {
+		return w, h, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	if fennec.ReadOrientation(r) >= fennec.OrientTranspose {
+		w, h = h, w
+	}
+	return w, h, nil
+}
+
 func parseQuality(q string) fennec.Quality {
 	switch strings.ToLower(q) {
 	case "lossless":
 		return fennec.Lossless
+	case "near-lossless", "nearlossless":
+		return fennec.NearLossless
 	case "ultra":
 		return fennec.Ultra
 	case "high":
@@ -180,6 +540,8 @@ func parseFormat(f string) fennec.Format {
 		return fennec.JPEG
 	case "png":
 		return fennec.PNG
+	case "gif":
+		return fennec.GIF
 	default:
 		return fennec.Auto
 	}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
 	"image"
 	"image/jpeg"
 	"image/png"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -100,7 +105,7 @@ func TestCLIQualityPresets(t *testing.T) {
 	src := filepath.Join(tmpDir, "input.jpg")
 	createTestJPEG(t, src)
 
-	presets := []string{"ultra", "high", "balanced", "aggressive", "maximum"}
+	presets := []string{"near-lossless", "ultra", "high", "balanced", "aggressive", "maximum"}
 	for _, preset := range presets {
 		t.Run(preset, func(t *testing.T) {
 			dst := filepath.Join(tmpDir, "out_"+preset+".jpg")
@@ -150,6 +155,60 @@ func TestCLIMaxDimensions(t *testing.T) {
 	}
 }
 
+func TestCLIAspect(t *testing.T) {
+	binary := buildBinary(t)
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "input.jpg") // 200×200
+	createTestJPEG(t, src)
+
+	for _, tc := range []struct {
+		args []string
+		w, h int
+	}{
+		{[]string{"-aspect", "16:9", "-fit", "cover"}, 200, 113},
+		{[]string{"-aspect", "16:9", "-fit", "contain"}, 356, 200},
+		{[]string{"-aspect", "1:1", "-fit", "cover", "-max-width", "120"}, 120, 120},
+		{[]string{"-aspect", "16:9", "-max-width", "160"}, 160, 90},
+		{[]string{"-aspect", "4:5", "-max-width", "400", "-max-height", "300"}, 240, 300},
+		{[]string{"-aspect", "1.91:1", "-fit", "stretch", "-max-height", "100"}, 191, 100},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "output.jpg")
+			out, err := exec.Command(binary, append(tc.args, src, dst)...).CombinedOutput()
+			if err != nil {
+				t.Fatalf("CLI failed: %v\n%s", err, out)
+			}
+			f, err := os.Open(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			cfg, _, err := image.DecodeConfig(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != tc.w || cfg.Height != tc.h {
+				t.Fatalf("output is %dx%d, want %dx%d", cfg.Width, cfg.Height, tc.w, tc.h)
+			}
+		})
+	}
+
+	for _, args := range [][]string{
+		{"-aspect", "16-9"},
+		{"-aspect", "0:1"},
+		{"-aspect", "a:b"},
+		{"-aspect", "16:"},
+		{"-aspect", "1:1", "-fit", "fill"},
+	} {
+		out, err := exec.Command(binary, append(args, src, filepath.Join(tmpDir, "bad.jpg"))...).CombinedOutput()
+		if err == nil {
+			t.Errorf("%v: expected failure, got success", args)
+		} else if !strings.Contains(string(out), "invalid") {
+			t.Errorf("%v: expected a validation message, got %q", args, out)
+		}
+	}
+}
+
 func TestCLITargetSize(t *testing.T) {
 	binary := buildBinary(t)
 	tmpDir := t.TempDir()
@@ -267,6 +326,304 @@ func TestCLIAutoOutput(t *testing.T) {
 	if err != nil {
 		t.Fatalf("CLI auto-output failed: %v\n%s", err, out)
 	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "input_fennec.jpg")); err != nil {
+		t.Fatalf("auto output not written: %v", err)
+	}
+}
+
+func TestCLIAutoOutputFollowsFormat(t *testing.T) {
+	binary := buildBinary(t)
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "input.png")
+	createTestPNG(t, src)
+
+	for _, format := range []string{"png", "gif"} {
+		out, err := exec.Command(binary, "-format", format, src).CombinedOutput()
+		if err != nil {
+			t.Fatalf("CLI failed: %v\n%s", err, out)
+		}
+		dst := filepath.Join(tmpDir, "input_fennec."+format)
+		if _, err := os.Stat(dst); err != nil {
+			t.Fatalf("%s output not written with .%s extension: %v", format, format, err)
+		}
+		if !strings.Contains(string(out), dst) {
+			t.Fatalf("summary should name %q, got %q", dst, out)
+		}
+	}
+}
+
+func TestCLIBatchOutDir(t *testing.T) {
+	binary := buildBinary(t)
+	tmpDir := t.TempDir()
+	outDir := filepath.Join(tmpDir, "compressed")
+	a := filepath.Join(tmpDir, "a.jpg")
+	b := filepath.Join(tmpDir, "b.jpg")
+	createTestJPEG(t, a)
+	createTestJPEG(t, b)
+
+	// Flags after positional args must still be honoured.
+	cmd := exec.Command(binary, "-quality", "high", a, b, "-out-dir", outDir, "-workers", "2")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("CLI batch failed: %v\n%s", err, out)
+	}
+	for _, name := range []string{"a", "b"} {
+		if matches, _ := filepath.Glob(filepath.Join(outDir, name+".*")); len(matches) != 1 {
+			t.Fatalf("batch output for %s not created: %v", name, matches)
+		}
+	}
+	if !strings.Contains(string(out), "2/2 succeeded") {
+		t.Fatalf("expected summary line, got:\n%s", out)
+	}
+}
+
+func TestCLIBatchOutputExtension(t *testing.T) {
+	binary := buildBinary(t)
+	tmpDir := t.TempDir()
+	outDir := filepath.Join(tmpDir, "out")
+	photo := filepath.Join(tmpDir, "photo.jpg")
+	createTestJPEG(t, photo)
+	// PNG data under a read-only extension must not come out as .tif.
+	scan := filepath.Join(tmpDir, "scan.tif")
+	createTestPNG(t, scan)
+
+	for _, format := range []string{"auto", "png"} {
+		dir := filepath.Join(outDir, format)
+		out, err := exec.Command(binary, "-format", format, "-out-dir", dir, photo, scan).CombinedOutput()
+		if err != nil {
+			t.Fatalf("-format %s: CLI batch failed: %v\n%s", format, err, out)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("-format %s: expected two outputs, got %v (%v)", format, entries, err)
+		}
+		for _, e := range entries {
+			f, err := os.Open(filepath.Join(dir, e.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, kind, err := image.DecodeConfig(f)
+			f.Close()
+			if err != nil {
+				t.Fatalf("%s doesn't decode: %v", e.Name(), err)
+			}
+			want := map[string]string{"jpeg": ".jpg", "png": ".png", "gif": ".gif"}[kind]
+			if filepath.Ext(e.Name()) != want {
+				t.Fatalf("-format %s: %s holds %s data", format, e.Name(), kind)
+			}
+		}
+	}
+}
+
+func TestCLIBatchNameCollision(t *testing.T) {
+	binary := buildBinary(t)
+	tmpDir := t.TempDir()
+	outDir := filepath.Join(tmpDir, "out")
+	a := filepath.Join(tmpDir, "a", "photo.jpg")
+	b := filepath.Join(tmpDir, "b", "photo.jpg")
+	for _, p := range []string{a, b} {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		createTestJPEG(t, p)
+	}
+
+	out, err := exec.Command(binary, "-out-dir", outDir, a, b).CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected same-named inputs to be rejected, got:\n%s", out)
+	}
+	if !strings.Contains(string(out), "would both be written") {
+		t.Fatalf("expected a collision error, got:\n%s", out)
+	}
+	if _, err := os.Stat(outDir); !os.IsNotExist(err) {
+		t.Fatalf("nothing should be written on a collision, stat err = %v", err)
+	}
+}
+
+func TestCLIDoubleDash(t *testing.T) {
+	binary := buildBinary(t)
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "-v.jpg")
+	createTestJPEG(t, src)
+
+	cmd := exec.Command(binary, "-quality", "high", "--", "-v.jpg", "-json.jpg")
+	cmd.Dir = tmpDir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("CLI failed: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "-json.jpg")); err != nil {
+		t.Fatalf("output after -- not treated as a file name: %v\n%s", err, out)
+	}
+}
+
+func TestCLIStdinStdout(t *testing.T) {
+	binary := buildBinary(t)
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "input.jpg")
+	createTestJPEG(t, src)
+
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(binary, "-quality", "high", "-", "-")
+	cmd.Stdin = in
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("CLI stdin/stdout failed: %v\n%s", err, stderr.String())
+	}
+
+	if _, _, err := image.Decode(&stdout); err != nil {
+		t.Fatalf("stdout is not a valid image: %v", err)
+	}
+	if !strings.Contains(stderr.String(), "SSIM") {
+		t.Fatalf("summary should go to stderr, got %q", stderr.String())
+	}
+}
+
+func TestCLIJSONOutput(t *testing.T) {
+	binary := buildBinary(t)
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "input.jpg")
+	dst := filepath.Join(tmpDir, "output.jpg")
+	createTestJPEG(t, src)
+
+	out, err := exec.Command(binary, "-json", src, dst).Output()
+	if err != nil {
+		t.Fatalf("CLI -json failed: %v", err)
+	}
+	var res struct {
+		Input  string `json:"input"`
+		Result struct {
+			Format          string  `json:"format"`
+			SSIM            float64 `json:"ssim"`
+			FinalDimensions struct {
+				Width int `json:"width"`
+			} `json:"final_dimensions"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		t.Fatalf("compression output is not JSON: %v\n%s", err, out)
+	}
+	if res.Input != src || res.Result.Format == "" || res.Result.SSIM <= 0 || res.Result.FinalDimensions.Width != 200 {
+		t.Fatalf("unexpected JSON result: %+v", res)
+	}
+
+	// Batch entries have the same shape, with an error instead of a result.
+	missing := filepath.Join(tmpDir, "missing.jpg")
+	out, _ = exec.Command(binary, "-json", "-out-dir", filepath.Join(tmpDir, "out"), src, missing).Output()
+	var batch struct {
+		Results []struct {
+			Input  string `json:"input"`
+			Result *struct {
+				Format string `json:"format"`
+			} `json:"result"`
+			Error string `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(out, &batch); err != nil {
+		t.Fatalf("batch output is not JSON: %v\n%s", err, out)
+	}
+	if len(batch.Results) != 2 || batch.Results[0].Result == nil || batch.Results[0].Result.Format == "" ||
+		batch.Results[1].Result != nil || batch.Results[1].Error == "" {
+		t.Fatalf("unexpected JSON batch:\n%s", out)
+	}
+
+	out, err = exec.Command(binary, "-json", "-analyze", src).Output()
+	if err != nil {
+		t.Fatalf("CLI -json -analyze failed: %v", err)
+	}
+	var stats struct {
+		Input             string `json:"input"`
+		Width             int    `json:"width"`
+		RecommendedFormat string `json:"recommended_format"`
+	}
+	if err := json.Unmarshal(out, &stats); err != nil {
+		t.Fatalf("analyze output is not JSON: %v\n%s", err, out)
+	}
+	if stats.Input != src || stats.Width != 200 || stats.RecommendedFormat == "" {
+		t.Fatalf("unexpected JSON analysis: %+v", stats)
+	}
+}
+
+func TestCLICompare(t *testing.T) {
+	binary := buildBinary(t)
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "input.jpg")
+	dst := filepath.Join(tmpDir, "output.jpg")
+	createTestJPEG(t, src)
+	if out, err := exec.Command(binary, "-quality", "maximum", src, dst).CombinedOutput(); err != nil {
+		t.Fatalf("CLI failed: %v\n%s", err, out)
+	}
+
+	out, err := exec.Command(binary, "-compare", src, dst).CombinedOutput()
+	if err != nil {
+		t.Fatalf("CLI -compare failed: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "SSIM:") {
+		t.Fatalf("expected SSIM in output, got %q", out)
+	}
+
+	if err := exec.Command(binary, "-compare", "-ssim", "0.9999", src, dst).Run(); err == nil {
+		t.Fatal("expected failure when SSIM is below -ssim threshold")
+	}
+
+	out, err = exec.Command(binary, "-compare", "-json", "-ssim", "0.5", src, src).Output()
+	if err != nil {
+		t.Fatalf("CLI -compare -json failed: %v", err)
+	}
+	var res struct {
+		SSIM float64 `json:"ssim"`
+		Pass bool    `json:"pass"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		t.Fatalf("compare output is not JSON: %v\n%s", err, out)
+	}
+	if !res.Pass || res.SSIM < 0.999 {
+		t.Fatalf("unexpected compare result: %+v", res)
+	}
+}
+
+func TestParseInterspersed(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    []string
+		verbose bool
+	}{
+		{[]string{"a.jpg", "-v", "b.jpg"}, []string{"a.jpg", "b.jpg"}, true},
+		{[]string{"-v", "--", "-a.jpg", "-v"}, []string{"-a.jpg", "-v"}, true},
+		{[]string{"a.jpg", "--", "-v"}, []string{"a.jpg", "-v"}, false},
+		{[]string{"a.jpg", "--"}, []string{"a.jpg"}, false},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("fennec", flag.ContinueOnError)
+		verbose := fs.Bool("v", false, "")
+		got := parseInterspersed(fs, tt.args)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseInterspersed(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+		if *verbose != tt.verbose {
+			t.Errorf("parseInterspersed(%q): -v = %v, want %v", tt.args, *verbose, tt.verbose)
+		}
+	}
+}
+
+func TestBatchItems(t *testing.T) {
+	items, err := batchItems([]string{"a/x.jpg", "b/y.png"}, "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items[0].Dst != filepath.Join("out", "x") || items[1].Dst != filepath.Join("out", "y") || !items[0].AutoExt {
+		t.Fatalf("unexpected outputs %+v", items)
+	}
+	if _, err := batchItems([]string{"a/x.jpg", "b/x.png"}, "out"); err == nil {
+		t.Fatal("expected an error for two inputs named x")
+	}
 }
 
 func TestParseSize(t *testing.T) {
@@ -0,0 +1,104 @@
+package fennec
+
+import (
+	"image"
+	"math"
+)
+
+// CompareResult summarizes how close two images are.
+type CompareResult struct {
+	// SSIM is the structural similarity (see SSIMFast), 1.0 for identical images.
+	SSIM float64
+	// PSNR is the peak signal-to-noise ratio in dB over all RGBA channels.
+	// It is +Inf for identical images.
+	PSNR float64
+	// MaxDelta is the largest absolute per-channel difference (0–255).
+	MaxDelta uint8
+	// Identical is true when both images have the same dimensions and
+	// every pixel, including alpha, matches exactly.
+	Identical bool
+}
+
+// Compare measures the difference between a and b. If the dimensions differ,
+// b is resized to match a (as SSIM does) and the images are never Identical.
+// Alpha is included in MaxDelta, PSNR, and Identical.
+func Compare(a, b image.Image) CompareResult {
+	na, nb, sameSize := matchSizes(a, b)
+	mse, maxDelta := channelDiff(na, nb)
+	return CompareResult{
+		SSIM:      SSIMFast(na, nb),
+		PSNR:      psnrFromMSE(mse),
+		MaxDelta:  maxDelta,
+		Identical: sameSize && maxDelta == 0,
+	}
+}
+
+// PSNR computes the peak signal-to-noise ratio between two images in dB,
+// over all RGBA channels. Higher is better; identical images return +Inf.
+// If the dimensions differ, b is resized to match a.
+func PSNR(a, b image.Image) float64 {
+	na, nb, _ := matchSizes(a, b)
+	mse, _ := channelDiff(na, nb)
+	return psnrFromMSE(mse)
+}
+
+// matchSizes returns read-only NRGBA views of a and b with b resized to
+// a's dimensions if needed. The bool reports whether the sizes already matched.
+func matchSizes(a, b image.Image) (*image.NRGBA, *image.NRGBA, bool) {
+	na := toNRGBARef(a)
+	nb := toNRGBARef(b)
+	w, h := na.Bounds().Dx(), na.Bounds().Dy()
+	if w != nb.Bounds().Dx() || h != nb.Bounds().Dy() {
+		return na, lanczosResize(nb, w, h), false
+	}
+	return na, nb, true
+}
+
+// channelDiff returns the mean squared error and maximum absolute difference
+// across all RGBA channels of two equally sized images.
+func channelDiff(a, b *image.NRGBA) (float64, uint8) {
+	w, h := a.Bounds().Dx(), a.Bounds().Dy()
+	if w == 0 || h == 0 {
+		return 0, 0
+	}
+
+	var sum float64
+	var maxDelta uint8
+	for y := 0; y < h; y++ {
+		offA := y * a.Stride
+		offB := y * b.Stride
+		for i := 0; i < w*4; i++ {
+			va, vb := a.Pix[offA+i], b.Pix[offB+i]
+			d := va - vb
+			if vb > va {
+				d = vb - va
+			}
+			if d > maxDelta {
+				maxDelta = d
+			}
+			sum += float64(d) * float64(d)
+		}
+	}
+	return sum / float64(w*h*4), maxDelta
+}
+
+func psnrFromMSE(mse float64) float64 {
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(ssimL*ssimL/mse)
+}
+
+// SSIMFiles opens two image files and returns their SSIM (see SSIM).
+// If the dimensions differ, the second image is resized to match the first.
+func SSIMFiles(pathA, pathB string) (float64, error) {
+	a, err := Open(pathA)
+	if err != nil {
+		return 0, err
+	}
+	b, err := Open(pathB)
+	if err != nil {
+		return 0, err
+	}
+	return SSIM(a, b), nil
+}
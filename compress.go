@@ -9,6 +9,17 @@ import (
 	"io"
 )
 
+// jpegSearchMinGain is the relative size drop between two passing probes
+// below which the JPEG search stops early: if lowering the quality that far
+// barely shrank the file, the few qualities left below can't save much
+// more. Flat images hit this after a few probes.
+const jpegSearchMinGain = 0.01
+
+// jpegSearchStopSpan is how many untried qualities may remain below a
+// passing probe for jpegSearchMinGain to stop the search. A wider range
+// could hide a passing quality well below it, so the search goes on.
+const jpegSearchStopSpan = 4
+
 // compressJPEGOptimal uses binary search to find the lowest JPEG quality
 // that still meets the target SSIM. Returns the quality, SSIM, cached encoded
 // bytes (from the winning iteration), and any error.
@@ -18,7 +29,8 @@ import (
 //
 // The fourth return value is the cached JPEG bytes from the binary search.
 // This avoids the double-encode bug where the final output would be re-encoded.
-func compressJPEGOptimal(src *image.NRGBA, w io.Writer, targetSSIM float64, opts Options) (int, float64, []byte, error) {
+// If trace is non-nil, every probe of the search is appended to it.
+func compressJPEGOptimal(src *image.NRGBA, w io.Writer, targetSSIM float64, opts Options, trace *[]QualityProbe) (int, float64, []byte, error) {
 	// Guard: if target is 1.0 (Lossless) and format is JPEG, clamp to 0.999
 	// since JPEG is inherently lossy and SSIM=1.0 is unreachable.
 	if targetSSIM >= 1.0 {
@@ -26,28 +38,36 @@ func compressJPEGOptimal(src *image.NRGBA, w io.Writer, targetSSIM float64, opts
 	}
 
 	// Binary search bounds.
-	lo, hi := 1, 100
+	lo, hi := jpegSearchFloor(targetSSIM, opts), 100
 	bestQuality := hi
 	bestSSIM := 1.0
 	var bestData []byte
-
-	// Fast path: if target is very high, start from higher quality.
-	if targetSSIM >= 0.99 {
-		lo = 75
-	} else if targetSSIM >= 0.97 {
-		lo = 50
-	} else if targetSSIM >= 0.94 {
-		lo = 30
-	} else if targetSSIM >= 0.90 {
-		lo = 15
+	// The last probe that missed the target, for when none reaches it.
+	var missSSIM float64
+	var missData []byte
+
+	// The source side of SSIM is the same for every probe: prepare it once.
+	var compare func(*image.NRGBA) float64
+	if opts.UseMSSSIM {
+		ref := newMSSSIMRef(src, opts.scratch)
+		defer ref.release()
+		compare = ref.compare
+	} else {
+		ref := newSSIMRef(src, opts.scratch)
+		defer ref.release()
+		if opts.FocusRegion != nil {
+			ref.setFocus(*opts.FocusRegion, src.Bounds().Dx(), src.Bounds().Dy())
+		}
+		compare = ref.compare
 	}
+	enc := opts.jpegEncoding(src)
 
 	for lo <= hi {
 		mid := (lo + hi) / 2
 
 		// Encode at this quality.
 		var buf bytes.Buffer
-		if err := encodeJPEG(&buf, src, mid, opts.Subsample); err != nil {
+		if err := encodeJPEG(&buf, src, mid, enc); err != nil {
 			return 0, 0, nil, err
 		}
 
@@ -56,12 +76,28 @@ func compressJPEGOptimal(src *image.NRGBA, w io.Writer, targetSSIM float64, opts
 		if err != nil {
 			return 0, 0, nil, err
 		}
-		decodedNRGBA := toNRGBARef(decoded)
+		decodedNRGBA := opts.scratch.tempNRGBA(decoded.Bounds().Dx(), decoded.Bounds().Dy())
+		convertToNRGBAInto(decodedNRGBA, decoded)
 
 		// Compute SSIM between original and compressed.
-		ssim := SSIMFast(src, decodedNRGBA)
+		ssim := compare(decodedNRGBA)
+		opts.scratch.releaseNRGBA(decodedNRGBA)
 
+		opts.logf("jpeg search: q=%d size=%d ssim=%.4f (target %.4f)", mid, buf.Len(), ssim, targetSSIM)
+		if trace != nil {
+			*trace = append(*trace, QualityProbe{Quality: mid, SSIM: ssim, Size: buf.Len()})
+		}
 		if ssim >= targetSSIM {
+			if bestData != nil && mid-lo <= jpegSearchStopSpan &&
+				float64(len(bestData)-buf.Len()) < jpegSearchMinGain*float64(len(bestData)) {
+				// The step down from the last passing quality barely
+				// shrank the file: keep the smaller and stop.
+				if buf.Len() < len(bestData) {
+					bestQuality, bestSSIM, bestData = mid, ssim, copyBytes(buf.Bytes())
+				}
+				opts.logf("jpeg search: size within %.0f%% of the last pass; stopping", jpegSearchMinGain*100)
+				break
+			}
 			// Quality is sufficient — cache this result and try lower quality.
 			bestQuality = mid
 			bestSSIM = ssim
@@ -69,6 +105,7 @@ func compressJPEGOptimal(src *image.NRGBA, w io.Writer, targetSSIM float64, opts
 			hi = mid - 1
 		} else {
 			// Quality too low — increase quality.
+			missSSIM, missData = ssim, buf.Bytes()
 			lo = mid + 1
 		}
 	}
@@ -78,33 +115,80 @@ func compressJPEGOptimal(src *image.NRGBA, w io.Writer, targetSSIM float64, opts
 		_, err := w.Write(bestData)
 		return bestQuality, bestSSIM, bestData, err
 	}
+	if missData != nil {
+		// Every probe missed, so the last one was quality 100: keep it,
+		// with the SSIM it actually reached.
+		opts.logf("jpeg search: target %.4f unreachable; best is %.4f at q=100", targetSSIM, missSSIM)
+		_, err := w.Write(missData)
+		return 100, missSSIM, missData, err
+	}
 
 	// Fallback: encode at best quality found.
-	if err := encodeJPEG(w, src, bestQuality, opts.Subsample); err != nil {
+	if err := encodeJPEG(w, src, bestQuality, enc); err != nil {
 		return 0, 0, nil, err
 	}
 	return bestQuality, bestSSIM, nil, nil
 }
 
-// compressPNG applies PNG-specific optimizations.
-func compressPNG(img *image.NRGBA, w io.Writer, opts Options) error {
+// jpegSearchFloor is the lowest quality compressJPEGOptimal tries for
+// targetSSIM. Fast path: if the target is very high, start from a higher
+// quality. The thresholds are SSIM values; MS-SSIM runs higher, so it
+// searches the full range.
+func jpegSearchFloor(targetSSIM float64, opts Options) int {
+	lo := 1
+	if !opts.UseMSSSIM {
+		switch {
+		case targetSSIM >= 0.99:
+			lo = 75
+		case targetSSIM >= 0.97:
+			lo = 50
+		case targetSSIM >= 0.94:
+			lo = 30
+		case targetSSIM >= 0.90:
+			lo = 15
+		}
+	}
+	if opts.Quality == NearLossless {
+		lo = max(lo, nearLosslessMinQuality)
+	}
+	return lo
+}
+
+// compressPNG applies PNG-specific optimizations and returns the SSIM of the
+// encoded image against img (1.0 unless opts.LossyPNG quantized it).
+func compressPNG(img *image.NRGBA, w io.Writer, opts Options) (float64, error) {
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+
+	// Lossy mode quantizes to a palette sized by the quality preset; images
+	// that already fit it losslessly take the exact path below.
+	lossy := opts.LossyPNG && opts.Quality != Lossless
+	maxColors := 256
+	if lossy {
+		maxColors = opts.Quality.paletteColors()
+	}
+
 	// Check if we can reduce to a palette (indexed color).
-	paletted := tryPalettize(img, 256)
+	paletted := tryPalettize(img, maxColors)
 	if paletted != nil {
-		encoder := png.Encoder{CompressionLevel: png.BestCompression}
-		return encoder.Encode(w, paletted)
+		return 1.0, encoder.Encode(w, paletted)
+	}
+
+	if lossy {
+		quantized := applyPalette(img, medianCut(img, maxColors), opts.PerceptualQuantize)
+		ssim := SSIMFast(img, toNRGBARef(quantized))
+		return ssim, encoder.Encode(w, quantized)
 	}
 
-	// Check if image is grayscale — use Gray format for ~3× savings.
-	if isGrayscale(img) {
+	// Check if image is grayscale — use Gray format for ~3× savings. Gray
+	// has no alpha channel, and image/png can't write gray with alpha, so
+	// transparent gray images stay NRGBA.
+	if isGrayscale(img) && isOpaque(img) {
 		gray := toGray(img)
-		encoder := png.Encoder{CompressionLevel: png.BestCompression}
-		return encoder.Encode(w, gray)
+		return 1.0, encoder.Encode(w, gray)
 	}
 
 	// Full NRGBA with best compression.
-	encoder := png.Encoder{CompressionLevel: png.BestCompression}
-	return encoder.Encode(w, img)
+	return 1.0, encoder.Encode(w, img)
 }
 
 // tryPalettize attempts to convert the image to an indexed palette.
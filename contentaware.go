@@ -0,0 +1,106 @@
+package fennec
+
+import (
+	"image"
+	"math"
+)
+
+// Content-aware smoothing: the stdlib JPEG encoder uses one quantization
+// table for the whole image, so instead of varying quality per region, flat
+// regions are blurred slightly before encoding. Their high-frequency DCT
+// coefficients then quantize to zero and cost almost nothing, while tiles
+// with real edges are left untouched.
+const (
+	// contentAwareTile is the tile size edge density is measured over,
+	// matching a JPEG 4:2:0 MCU.
+	contentAwareTile = 16
+
+	// contentAwareSigma is the blur applied to the flattest tiles.
+	contentAwareSigma = 1.2
+
+	// contentAwareEdgeDensity is the mean edge strength (see
+	// localEdgeStrength) at which a tile counts as detailed and is left
+	// alone. Tiles below it are blurred in proportion to how flat they are.
+	contentAwareEdgeDensity = 0.1
+)
+
+// contentAwareSmooth returns img with low-detail tiles blurred, for
+// Options.ContentAware. Blur weights are interpolated between tile centers
+// so no tile seams show, and capped at the pixel's own tile weight so
+// detailed tiles stay exact. Alpha is preserved. The blur's intermediate
+// is pooled in s.
+func contentAwareSmooth(img *image.NRGBA, s *scratch) *image.NRGBA {
+	w := img.Bounds().Dx()
+	h := img.Bounds().Dy()
+	if w < 3 || h < 3 {
+		return img
+	}
+
+	tilesX := (w + contentAwareTile - 1) / contentAwareTile
+	tilesY := (h + contentAwareTile - 1) / contentAwareTile
+	weights := make([]float64, tilesX*tilesY)
+
+	parallelDoCost(0, tilesY, w*contentAwareTile, func(ty int) {
+		y0 := max(ty*contentAwareTile, 1)
+		y1 := min((ty+1)*contentAwareTile, h-1)
+		for tx := 0; tx < tilesX; tx++ {
+			x0 := max(tx*contentAwareTile, 1)
+			x1 := min((tx+1)*contentAwareTile, w-1)
+
+			var sum float64
+			n := 0
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					sum += localEdgeStrength(img, x, y)
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			density := sum / float64(n)
+			weights[ty*tilesX+tx] = math.Max(0, 1-density/contentAwareEdgeDensity)
+		}
+	})
+
+	blurred := gaussianBlur(img, contentAwareSigma, s)
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	// tileCoord maps a pixel coordinate to the two nearest tile centers
+	// along one axis and the blend factor between them.
+	tileCoord := func(p, tiles int) (int, int, float64) {
+		f := (float64(p)+0.5)/contentAwareTile - 0.5
+		if f <= 0 {
+			return 0, 0, 0
+		}
+		t0 := int(f)
+		if t0 >= tiles-1 {
+			return tiles - 1, tiles - 1, 0
+		}
+		return t0, t0 + 1, f - float64(t0)
+	}
+
+	parallelDoCost(0, h, w, func(y int) {
+		ty0, ty1, fy := tileCoord(y, tilesY)
+		for x := 0; x < w; x++ {
+			tx0, tx1, fx := tileCoord(x, tilesX)
+			top := weights[ty0*tilesX+tx0]*(1-fx) + weights[ty0*tilesX+tx1]*fx
+			bottom := weights[ty1*tilesX+tx0]*(1-fx) + weights[ty1*tilesX+tx1]*fx
+			// A detailed tile is never blurred: the blend toward it
+			// happens inside its flat neighbors.
+			amount := min(top*(1-fy)+bottom*fy, weights[(y/contentAwareTile)*tilesX+x/contentAwareTile])
+
+			srcOff := y*img.Stride + x*4
+			blurOff := y*blurred.Stride + x*4
+			dstOff := y*dst.Stride + x*4
+			for c := 0; c < 3; c++ {
+				orig := float64(img.Pix[srcOff+c])
+				blur := float64(blurred.Pix[blurOff+c])
+				dst.Pix[dstOff+c] = clampF(orig + amount*(blur-orig))
+			}
+			dst.Pix[dstOff+3] = img.Pix[srcOff+3]
+		}
+	})
+
+	return dst
+}
@@ -34,30 +34,140 @@ func toNRGBARef(img image.Image) *image.NRGBA {
 func convertToNRGBA(img image.Image) *image.NRGBA {
 	bounds := img.Bounds()
 	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	convertToNRGBAInto(dst, img)
+	return dst
+}
+
+// convertToNRGBAInto converts img into dst, which must be a zero-origin
+// image of the same size. The types decoders return most get direct paths:
+// going through At boxes a color per pixel, which dominated allocations in
+// the SSIM search. JPEG's *image.YCbCr reads its planes, and a PNG's
+// *image.Paletted looks its indices up in a converted palette.
+func convertToNRGBAInto(dst *image.NRGBA, img image.Image) {
+	bounds := img.Bounds()
+	switch src := img.(type) {
+	case *image.YCbCr:
+		convertYCbCr(dst, src)
+		return
+	case *image.Paletted:
+		convertPaletted(dst, src)
+		return
+	}
 
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
 			r, g, b, a := img.At(x, y).RGBA()
 			off := (y-bounds.Min.Y)*dst.Stride + (x-bounds.Min.X)*4
-			if a == 0 {
-				// Fully transparent \u2014 zero everything.
-				dst.Pix[off] = 0
-				dst.Pix[off+1] = 0
-				dst.Pix[off+2] = 0
-				dst.Pix[off+3] = 0
-			} else if a == 0xffff {
-				// Fully opaque \u2014 simple shift.
-				dst.Pix[off] = uint8(r >> 8)
-				dst.Pix[off+1] = uint8(g >> 8)
-				dst.Pix[off+2] = uint8(b >> 8)
-				dst.Pix[off+3] = 0xff
-			} else {
-				// Semi-transparent \u2014 un-premultiply alpha.
-				dst.Pix[off] = uint8(((r * 0xffff) / a) >> 8)
-				dst.Pix[off+1] = uint8(((g * 0xffff) / a) >> 8)
-				dst.Pix[off+2] = uint8(((b * 0xffff) / a) >> 8)
-				dst.Pix[off+3] = uint8(a >> 8)
-			}
+			putNRGBA(dst.Pix[off:off+4], r, g, b, a)
+		}
+	}
+}
+
+// putNRGBA writes the alpha-premultiplied 16-bit color r, g, b, a to p as
+// non-premultiplied 8-bit NRGBA.
+func putNRGBA(p []uint8, r, g, b, a uint32) {
+	if a == 0 {
+		// Fully transparent \u2014 zero everything.
+		p[0] = 0
+		p[1] = 0
+		p[2] = 0
+		p[3] = 0
+	} else if a == 0xffff {
+		// Fully opaque \u2014 simple shift.
+		p[0] = uint8(r >> 8)
+		p[1] = uint8(g >> 8)
+		p[2] = uint8(b >> 8)
+		p[3] = 0xff
+	} else {
+		// Semi-transparent \u2014 un-premultiply alpha.
+		p[0] = uint8(((r * 0xffff) / a) >> 8)
+		p[1] = uint8(((g * 0xffff) / a) >> 8)
+		p[2] = uint8(((b * 0xffff) / a) >> 8)
+		p[3] = uint8(a >> 8)
+	}
+}
+
+// convertYCbCr is convertToNRGBAInto for *image.YCbCr. It walks each row's
+// luma and chroma offsets directly instead of calling YOffset and COffset,
+// whose subsampling switch would otherwise run per pixel.
+func convertYCbCr(dst *image.NRGBA, src *image.YCbCr) {
+	bounds := src.Bounds()
+	// Chroma columns per luma column; 4:4:0 subsamples only vertically.
+	hdiv := 1
+	switch src.SubsampleRatio {
+	case image.YCbCrSubsampleRatio422, image.YCbCrSubsampleRatio420:
+		hdiv = 2
+	case image.YCbCrSubsampleRatio411, image.YCbCrSubsampleRatio410:
+		hdiv = 4
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		yi := src.YOffset(bounds.Min.X, y)
+		cBase := src.COffset(bounds.Min.X, y) - bounds.Min.X/hdiv
+		row := dst.Pix[(y-bounds.Min.Y)*dst.Stride:]
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			ci := cBase + x/hdiv
+			// color.YCbCrToRGB's fixed-point math, written out because
+			// the call isn't inlined and costs as much as the math.
+			yy := int32(src.Y[yi]) * 0x10101
+			cb := int32(src.Cb[ci]) - 128
+			cr := int32(src.Cr[ci]) - 128
+			row[0] = clampYCbCr(yy + 91881*cr)
+			row[1] = clampYCbCr(yy - 22554*cb - 46802*cr)
+			row[2] = clampYCbCr(yy + 116130*cb)
+			row[3] = 0xff
+			row = row[4:]
+			yi++
+		}
+	}
+}
+
+// clampYCbCr turns a 16.16 fixed-point channel from convertYCbCr into a
+// byte, clamping it to [0, 255] the way color.YCbCrToRGB does.
+func clampYCbCr(v int32) uint8 {
+	if uint32(v)&0xff000000 == 0 {
+		return uint8(v >> 16)
+	}
+	return uint8(^(v >> 31))
+}
+
+// convertPaletted is convertToNRGBAInto for *image.Paletted. The palette
+// is converted once; indices past its end come out transparent black.
+func convertPaletted(dst *image.NRGBA, src *image.Paletted) {
+	var lut [256][4]uint8
+	for i, c := range src.Palette {
+		if i == len(lut) {
+			break
+		}
+		r, g, b, a := c.RGBA()
+		putNRGBA(lut[i][:], r, g, b, a)
+	}
+	bounds := src.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		idx := src.Pix[src.PixOffset(bounds.Min.X, y):][:bounds.Dx()]
+		row := dst.Pix[(y-bounds.Min.Y)*dst.Stride:]
+		for i, v := range idx {
+			c := &lut[v]
+			row[i*4], row[i*4+1], row[i*4+2], row[i*4+3] = c[0], c[1], c[2], c[3]
+		}
+	}
+}
+
+// flattenAlpha composites img over an opaque background color and returns
+// a new, fully opaque image. Used before JPEG encoding, which has no alpha.
+func flattenAlpha(img *image.NRGBA, bg color.NRGBA) *image.NRGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		srcOff := y * img.Stride
+		dstOff := y * dst.Stride
+		for x := 0; x < w; x++ {
+			s := img.Pix[srcOff+x*4 : srcOff+x*4+4]
+			d := dst.Pix[dstOff+x*4 : dstOff+x*4+4]
+			a := uint32(s[3])
+			d[0] = uint8((uint32(s[0])*a + uint32(bg.R)*(255-a) + 127) / 255)
+			d[1] = uint8((uint32(s[1])*a + uint32(bg.G)*(255-a) + 127) / 255)
+			d[2] = uint8((uint32(s[2])*a + uint32(bg.B)*(255-a) + 127) / 255)
+			d[3] = 0xff
 		}
 	}
 	return dst
@@ -73,7 +183,7 @@ func isOpaque(img *image.NRGBA) bool {
 	return true
 }
 
-// isGrayscale checks if all pixels have R == G == B.
+// isGrayscale checks if all pixels have R == G == B. Alpha is ignored.
 func isGrayscale(img *image.NRGBA) bool {
 	for i := 0; i < len(img.Pix); i += 4 {
 		if img.Pix[i] != img.Pix[i+1] || img.Pix[i+1] != img.Pix[i+2] {
@@ -84,6 +194,7 @@ func isGrayscale(img *image.NRGBA) bool {
 }
 
 // toGray converts to grayscale image (1 byte per pixel instead of 4).
+// Alpha is dropped, so img should be opaque.
 func toGray(img *image.NRGBA) *image.Gray {
 	w := img.Bounds().Dx()
 	h := img.Bounds().Dy()
@@ -99,16 +210,23 @@ func toGray(img *image.NRGBA) *image.Gray {
 	return gray
 }
 
+// defaultFormatSamples is how many pixels analyzeFormat samples by default.
+const defaultFormatSamples = 10000
+
 // analyzeFormat examines the image to determine the best output format.
 // Images with transparency or very few colors \u2192 PNG.
 // Photographic images with many colors \u2192 JPEG.
-func analyzeFormat(img *image.NRGBA) Format {
+// It samples about samples pixels, or defaultFormatSamples if samples is 0.
+func analyzeFormat(img *image.NRGBA, samples int) Format {
 	bounds := img.Bounds()
 	w, h := bounds.Dx(), bounds.Dy()
 
 	hasAlpha := false
 	colorSet := make(map[color.NRGBA]struct{})
-	maxSamples := 10000
+	maxSamples := defaultFormatSamples
+	if samples > 0 {
+		maxSamples = samples
+	}
 	step := 1
 	total := w * h
 	if total > maxSamples {
@@ -182,6 +300,66 @@ func abs64(x int64) int64 {
 	return x
 }
 
+// Rotate90 returns a copy of img rotated 90° clockwise.
+func Rotate90(img image.Image) *image.NRGBA {
+	return rotateNRGBA90CW(toNRGBA(img))
+}
+
+// Rotate180 returns a copy of img rotated 180°.
+func Rotate180(img image.Image) *image.NRGBA {
+	return rotateNRGBA180(toNRGBA(img))
+}
+
+// Rotate270 returns a copy of img rotated 270° clockwise (90° counter-clockwise).
+func Rotate270(img image.Image) *image.NRGBA {
+	return rotateNRGBA270CW(toNRGBA(img))
+}
+
+// FlipHorizontal returns a copy of img mirrored left to right.
+func FlipHorizontal(img image.Image) *image.NRGBA {
+	return flipNRGBAHorizontal(toNRGBA(img))
+}
+
+// FlipVertical returns a copy of img mirrored top to bottom.
+func FlipVertical(img image.Image) *image.NRGBA {
+	return flipNRGBAVertical(toNRGBA(img))
+}
+
+// Crop returns a copy of the rect region of img as a new zero-origin
+// NRGBA that does not share memory with img. rect is in img's coordinate
+// space and must be non-empty and lie within img.Bounds().
+func Crop(img image.Image, rect image.Rectangle) (*image.NRGBA, error) {
+	if rect.Empty() {
+		return nil, fmt.Errorf("%w: crop rectangle %v is empty", ErrEmptyImage, rect)
+	}
+	if !rect.In(img.Bounds()) {
+		return nil, fmt.Errorf("fennec: crop rectangle %v outside image bounds %v", rect, img.Bounds())
+	}
+
+	w, h := rect.Dx(), rect.Dy()
+	if src, ok := img.(*image.NRGBA); ok {
+		dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			off := src.PixOffset(rect.Min.X, rect.Min.Y+y)
+			copy(dst.Pix[y*dst.Stride:y*dst.Stride+w*4], src.Pix[off:off+w*4])
+		}
+		return dst, nil
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBAModel.Convert(img.At(rect.Min.X+x, rect.Min.Y+y)).(color.NRGBA)
+			off := y*dst.Stride + x*4
+			dst.Pix[off] = c.R
+			dst.Pix[off+1] = c.G
+			dst.Pix[off+2] = c.B
+			dst.Pix[off+3] = c.A
+		}
+	}
+	return dst, nil
+}
+
 // rotateNRGBA90CW rotates an NRGBA image 90\u00b0 clockwise.
 func rotateNRGBA90CW(img *image.NRGBA) *image.NRGBA {
 	w := img.Bounds().Dx()
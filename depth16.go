@@ -0,0 +1,122 @@
+package fennec
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// is16Bit reports whether img stores more than 8 bits per channel.
+func is16Bit(img image.Image) bool {
+	switch img.(type) {
+	case *image.Gray16, *image.RGBA64, *image.NRGBA64:
+		return true
+	}
+	return false
+}
+
+// fitsWithin reports whether a w×h image needs no downscaling for the given
+// MaxWidth/MaxHeight constraints (0 means unconstrained).
+func fitsWithin(w, h, maxW, maxH int) bool {
+	return (maxW <= 0 || w <= maxW) && (maxH <= 0 || h <= maxH)
+}
+
+// to16Bit returns img as a zero-origin *image.Gray16 or *image.NRGBA64,
+// the two 16-bit layouts the PNG encoder writes without loss. The result
+// is always a new image, so callers may mutate it.
+func to16Bit(img image.Image) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if g, ok := img.(*image.Gray16); ok {
+		dst := image.NewGray16(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			srcOff := g.PixOffset(b.Min.X, b.Min.Y+y)
+			copy(dst.Pix[y*dst.Stride:y*dst.Stride+w*2], g.Pix[srcOff:srcOff+w*2])
+		}
+		return dst
+	}
+	dst := image.NewNRGBA64(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dst.Set(x, y, color.NRGBA64Model.Convert(img.At(b.Min.X+x, b.Min.Y+y)))
+		}
+	}
+	return dst
+}
+
+// orient16 converts a 16-bit image with to16Bit and applies the EXIF
+// orientation with the same pixel mapping as ApplyOrientation.
+func orient16(img image.Image, orient Orientation) image.Image {
+	wide := to16Bit(img)
+	if orient <= OrientNormal || orient > OrientRotate270CW {
+		return wide
+	}
+
+	var pix []byte
+	var stride, bpp int
+	switch m := wide.(type) {
+	case *image.Gray16:
+		pix, stride, bpp = m.Pix, m.Stride, 2
+	case *image.NRGBA64:
+		pix, stride, bpp = m.Pix, m.Stride, 8
+	}
+
+	w, h := wide.Bounds().Dx(), wide.Bounds().Dy()
+	dw, dh := w, h
+	if orient >= OrientTranspose {
+		dw, dh = h, w
+	}
+
+	var dst image.Image
+	var dstPix []byte
+	var dstStride int
+	if bpp == 2 {
+		g := image.NewGray16(image.Rect(0, 0, dw, dh))
+		dst, dstPix, dstStride = g, g.Pix, g.Stride
+	} else {
+		n := image.NewNRGBA64(image.Rect(0, 0, dw, dh))
+		dst, dstPix, dstStride = n, n.Pix, n.Stride
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := orientPoint(x, y, w, h, orient)
+			srcOff := y*stride + x*bpp
+			dstOff := dy*dstStride + dx*bpp
+			copy(dstPix[dstOff:dstOff+bpp], pix[srcOff:srcOff+bpp])
+		}
+	}
+	return dst
+}
+
+// orientPoint maps source pixel (x, y) of a w×h image to its position after
+// ApplyOrientation, matching the NRGBA rotation and flip helpers.
+func orientPoint(x, y, w, h int, orient Orientation) (int, int) {
+	switch orient {
+	case OrientFlipH:
+		return w - 1 - x, y
+	case OrientRotate180:
+		return w - 1 - x, h - 1 - y
+	case OrientFlipV:
+		return x, h - 1 - y
+	case OrientTranspose:
+		// Rotate 270 CW, then flip horizontal.
+		return h - 1 - y, w - 1 - x
+	case OrientRotate90CW:
+		return h - 1 - y, x
+	case OrientTransverse:
+		// Rotate 90 CW, then flip horizontal.
+		return y, x
+	case OrientRotate270CW:
+		return y, w - 1 - x
+	default:
+		return x, y
+	}
+}
+
+// compressPNG16 writes a 16-bit image as PNG at full bit depth.
+func compressPNG16(img image.Image, w io.Writer) error {
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	return encoder.Encode(w, img)
+}
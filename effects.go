@@ -25,7 +25,7 @@ func Sharpen(img *image.NRGBA, strength float64) *image.NRGBA {
 	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
 	amount := 1.0 + strength*1.5
 
-	parallelDo(0, h, func(y int) {
+	parallelDoCost(0, h, w, func(y int) {
 		for x := 0; x < w; x++ {
 			srcOff := y*img.Stride + x*4
 			blurOff := y*blurred.Stride + x*4
@@ -67,7 +67,7 @@ func AdaptiveSharpen(img *image.NRGBA, strength float64) *image.NRGBA {
 	// Copy the entire source first (handles borders).
 	copy(dst.Pix, img.Pix)
 
-	parallelDo(1, h-1, func(y int) {
+	parallelDoCost(1, h-1, w, func(y int) {
 		for x := 1; x < w-1; x++ {
 			srcOff := y*img.Stride + x*4
 			edgeStr := localEdgeStrength(img, x, y)
@@ -89,6 +89,168 @@ func AdaptiveSharpen(img *image.NRGBA, strength float64) *image.NRGBA {
 	return dst
 }
 
+// Denoise smooths sensor noise with a 3×3 median filter, blended in at the
+// given strength (0.0–1.0). Edges, measured with localEdgeStrength, are
+// protected so outlines stay crisp while flat areas lose their grain.
+// Only RGB channels are filtered; alpha is preserved.
+func Denoise(img *image.NRGBA, strength float64) *image.NRGBA {
+	if strength <= 0 {
+		return img
+	}
+	if strength > 1 {
+		strength = 1
+	}
+
+	w := img.Bounds().Dx()
+	h := img.Bounds().Dy()
+	if w < 3 || h < 3 {
+		return img
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	// Copy the entire source first (handles borders).
+	for y := 0; y < h; y++ {
+		copy(dst.Pix[y*dst.Stride:y*dst.Stride+w*4], img.Pix[y*img.Stride:y*img.Stride+w*4])
+	}
+
+	parallelDoCost(1, h-1, w, func(y int) {
+		var window [9]uint8
+		for x := 1; x < w-1; x++ {
+			srcOff := y*img.Stride + x*4
+			dstOff := y*dst.Stride + x*4
+			amount := strength * (1 - localEdgeStrength(img, x, y))
+
+			for c := 0; c < 3; c++ {
+				i := 0
+				for dy := -1; dy <= 1; dy++ {
+					row := (y+dy)*img.Stride + c
+					for dx := -1; dx <= 1; dx++ {
+						window[i] = img.Pix[row+(x+dx)*4]
+						i++
+					}
+				}
+				orig := float64(img.Pix[srcOff+c])
+				med := float64(median9(&window))
+				dst.Pix[dstOff+c] = clampF(orig + amount*(med-orig))
+			}
+		}
+	})
+
+	return dst
+}
+
+// autoLevelsClip is the fraction of pixels AutoLevels lets clip at each end
+// of the histogram, so a few specks of dust or specular highlights don't
+// pin the range.
+const autoLevelsClip = 0.005
+
+// AutoLevels stretches the luminance histogram to the full 0–255 range,
+// brightening underexposed scans and restoring contrast to faded photos.
+// The same linear map is applied to R, G, and B, so there is no color
+// cast; up to 0.5% of pixels at each end may clip. Fully transparent
+// pixels are ignored and alpha is preserved. img is returned unchanged if
+// it already spans the full range or is a single flat tone.
+func AutoLevels(img *image.NRGBA) *image.NRGBA {
+	w := img.Bounds().Dx()
+	h := img.Bounds().Dy()
+
+	var histogram [256]int
+	total := 0
+	for y := 0; y < h; y++ {
+		off := y * img.Stride
+		for x := 0; x < w; x++ {
+			i := off + x*4
+			if img.Pix[i+3] == 0 {
+				continue
+			}
+			lum := 0.299*float64(img.Pix[i]) + 0.587*float64(img.Pix[i+1]) + 0.114*float64(img.Pix[i+2])
+			histogram[int(lum+0.5)]++
+			total++
+		}
+	}
+
+	clip := int(float64(total) * autoLevelsClip)
+	lo, hi := 0, 255
+	for n := 0; lo < 255; lo++ {
+		if n += histogram[lo]; n > clip {
+			break
+		}
+	}
+	for n := 0; hi > 0; hi-- {
+		if n += histogram[hi]; n > clip {
+			break
+		}
+	}
+	if hi <= lo || (lo == 0 && hi == 255) {
+		return img
+	}
+
+	var lut [256]uint8
+	scale := 255 / float64(hi-lo)
+	for v := range lut {
+		lut[v] = clampF(float64(v-lo) * scale)
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	parallelDoCost(0, h, w, func(y int) {
+		for x := 0; x < w; x++ {
+			srcOff := y*img.Stride + x*4
+			dstOff := y*dst.Stride + x*4
+			dst.Pix[dstOff] = lut[img.Pix[srcOff]]
+			dst.Pix[dstOff+1] = lut[img.Pix[srcOff+1]]
+			dst.Pix[dstOff+2] = lut[img.Pix[srcOff+2]]
+			dst.Pix[dstOff+3] = img.Pix[srcOff+3]
+		}
+	})
+	return dst
+}
+
+// AdjustBrightnessContrast applies a linear tone adjustment to R, G, and B.
+// contrast (−1..1) scales each channel's distance from mid-gray by
+// 1+contrast, so −1 flattens the image to gray and 1 doubles its contrast;
+// brightness (−1..1) then shifts every channel by brightness×255, so −1 and
+// 1 push it to black and white. Results saturate at 0 and 255, and alpha is
+// preserved. img is returned unchanged if both are 0.
+func AdjustBrightnessContrast(img *image.NRGBA, brightness, contrast float64) *image.NRGBA {
+	if brightness == 0 && contrast == 0 {
+		return img
+	}
+	var lut [256]uint8
+	for v := range lut {
+		lut[v] = clampF((float64(v)-128)*(1+contrast) + 128 + brightness*255)
+	}
+
+	w := img.Bounds().Dx()
+	h := img.Bounds().Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	parallelDoCost(0, h, w, func(y int) {
+		for x := 0; x < w; x++ {
+			srcOff := y*img.Stride + x*4
+			dstOff := y*dst.Stride + x*4
+			dst.Pix[dstOff] = lut[img.Pix[srcOff]]
+			dst.Pix[dstOff+1] = lut[img.Pix[srcOff+1]]
+			dst.Pix[dstOff+2] = lut[img.Pix[srcOff+2]]
+			dst.Pix[dstOff+3] = img.Pix[srcOff+3]
+		}
+	})
+	return dst
+}
+
+// median9 returns the median of nine values, partially sorting v in place.
+func median9(v *[9]uint8) uint8 {
+	for i := 0; i <= 4; i++ {
+		minIdx := i
+		for j := i + 1; j < 9; j++ {
+			if v[j] < v[minIdx] {
+				minIdx = j
+			}
+		}
+		v[i], v[minIdx] = v[minIdx], v[i]
+	}
+	return v[4]
+}
+
 // localEdgeStrength computes edge strength at a pixel using Sobel gradients.
 func localEdgeStrength(img *image.NRGBA, x, y int) float64 {
 	getLum := func(px, py int) float64 {
@@ -119,7 +281,7 @@ func gaussianBlur3x3(img *image.NRGBA) *image.NRGBA {
 	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
 	copy(dst.Pix, img.Pix)
 
-	parallelDo(1, h-1, func(y int) {
+	parallelDoCost(1, h-1, w, func(y int) {
 		for x := 1; x < w-1; x++ {
 			for c := 0; c < 3; c++ {
 				var sum float64
@@ -140,13 +302,31 @@ func gaussianBlur3x3(img *image.NRGBA) *image.NRGBA {
 	return dst
 }
 
+// boxBlurSigma is the sigma above which GaussianBlur switches to the
+// three-pass box approximation. Past this point the difference from a true
+// Gaussian is not visible, and the exact kernel gets expensive.
+const boxBlurSigma = 10.0
+
 // GaussianBlur applies Gaussian blur with the specified sigma.
 // Uses separable convolution for O(n*r) instead of O(n*r²) complexity.
-// Only blurs RGB channels; alpha is preserved from the source image.
+// For sigma > 10 it delegates to a three-pass box blur, which is O(n)
+// regardless of sigma. Only blurs RGB channels; alpha is preserved from
+// the source image.
 func GaussianBlur(img *image.NRGBA, sigma float64) *image.NRGBA {
 	if sigma <= 0 {
 		return img
 	}
+	return gaussianBlur(img, sigma, nil)
+}
+
+// gaussianBlur is GaussianBlur with its intermediate pooled in s.
+func gaussianBlur(img *image.NRGBA, sigma float64, s *scratch) *image.NRGBA {
+	if sigma <= 0 {
+		return img
+	}
+	if sigma > boxBlurSigma {
+		return boxBlur3(img, boxesForGauss(sigma), s)
+	}
 
 	w := img.Bounds().Dx()
 	h := img.Bounds().Dy()
@@ -165,8 +345,9 @@ func GaussianBlur(img *image.NRGBA, sigma float64) *image.NRGBA {
 	}
 
 	// Horizontal pass.
-	tmp := image.NewNRGBA(image.Rect(0, 0, w, h))
-	parallelDo(0, h, func(y int) {
+	tmp := s.tempNRGBA(w, h)
+	defer s.releaseNRGBA(tmp)
+	parallelDoCost(0, h, w*kernelSize, func(y int) {
 		for x := 0; x < w; x++ {
 			var r, g, b float64
 			for k := 0; k < kernelSize; k++ {
@@ -192,7 +373,7 @@ func GaussianBlur(img *image.NRGBA, sigma float64) *image.NRGBA {
 
 	// Vertical pass.
 	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
-	parallelDo(0, w, func(x int) {
+	parallelDoCost(0, w, h*kernelSize, func(x int) {
 		for y := 0; y < h; y++ {
 			var r, g, b float64
 			for k := 0; k < kernelSize; k++ {
@@ -218,3 +399,103 @@ func GaussianBlur(img *image.NRGBA, sigma float64) *image.NRGBA {
 
 	return dst
 }
+
+// BoxBlur applies three successive box blurs of the given radius, which
+// approximates a Gaussian with sigma ≈ radius. Running sums make it O(n)
+// regardless of radius, so it suits large bokeh-style blurs. Only blurs RGB
+// channels; alpha is preserved from the source image.
+func BoxBlur(img *image.NRGBA, radius int) *image.NRGBA {
+	if radius <= 0 {
+		return img
+	}
+	return boxBlur3(img, [3]int{radius, radius, radius}, nil)
+}
+
+// boxesForGauss returns the radii of three box blurs whose combined
+// variance matches a Gaussian of the given sigma (Kutskir's method).
+func boxesForGauss(sigma float64) [3]int {
+	const n = 3
+	wIdeal := math.Sqrt(12*sigma*sigma/n + 1)
+	wl := int(math.Floor(wIdeal))
+	if wl%2 == 0 {
+		wl--
+	}
+	wu := wl + 2
+	m := int(math.Round((12*sigma*sigma - float64(n*wl*wl+4*n*wl+3*n)) / float64(-4*wl-4)))
+
+	var radii [3]int
+	for i := range radii {
+		size := wu
+		if i < m {
+			size = wl
+		}
+		radii[i] = (size - 1) / 2
+	}
+	return radii
+}
+
+// boxBlur3 runs one horizontal and one vertical box pass per radius,
+// pooling its intermediate in s.
+func boxBlur3(img *image.NRGBA, radii [3]int, s *scratch) *image.NRGBA {
+	w := img.Bounds().Dx()
+	h := img.Bounds().Dy()
+
+	src := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		copy(src.Pix[y*src.Stride:y*src.Stride+w*4], img.Pix[y*img.Stride:y*img.Stride+w*4])
+	}
+	if w == 0 || h == 0 {
+		return src
+	}
+	tmp := s.tempNRGBA(w, h)
+	defer s.releaseNRGBA(tmp)
+	copy(tmp.Pix, src.Pix) // Alpha is never written by the passes.
+
+	for _, r := range radii {
+		if r <= 0 {
+			continue
+		}
+		parallelDoCost(0, h, w, func(y int) {
+			boxBlurLine(src.Pix, tmp.Pix, y*src.Stride, 4, w, r)
+		})
+		parallelDoCost(0, w, h, func(x int) {
+			boxBlurLine(tmp.Pix, src.Pix, x*4, src.Stride, h, r)
+		})
+	}
+	return src
+}
+
+// boxBlurLine blurs the RGB channels of n pixels starting at offset start
+// and spaced step bytes apart, using a running sum with clamped edges.
+func boxBlurLine(src, dst []byte, start, step, n, r int) {
+	div := 2*r + 1
+	last := start + (n-1)*step
+	for c := 0; c < 3; c++ {
+		first := int(src[start+c])
+		lastV := int(src[last+c])
+
+		// Window for pixel 0: r+1 copies of the edge plus pixels 1..r.
+		sum := (r + 1) * first
+		for i := 1; i <= r; i++ {
+			if i < n {
+				sum += int(src[start+i*step+c])
+			} else {
+				sum += lastV
+			}
+		}
+
+		for i := 0; i < n; i++ {
+			dst[start+i*step+c] = uint8((sum + div/2) / div)
+
+			in := lastV
+			if i+r+1 < n {
+				in = int(src[start+(i+r+1)*step+c])
+			}
+			out := first
+			if i-r >= 0 {
+				out = int(src[start+(i-r)*step+c])
+			}
+			sum += in - out
+		}
+	}
+}
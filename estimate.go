@@ -0,0 +1,294 @@
+package fennec
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"math"
+)
+
+// EstimateResult is Estimate's prediction of what CompressImage would
+// produce at each quality preset.
+type EstimateResult struct {
+	// Format is the output format: Options.Format, or what Auto would pick.
+	Format Format `json:"format"`
+
+	// Dimensions is the output size after MaxWidth, MaxHeight, or ExactSize.
+	Dimensions image.Point `json:"dimensions"`
+
+	// Presets holds one estimate per quality preset, from the smallest
+	// output (Maximum) to the largest (Lossless).
+	Presets []PresetEstimate `json:"presets"`
+}
+
+// PresetEstimate is the predicted outcome for one quality preset.
+type PresetEstimate struct {
+	Quality     Quality `json:"quality"`
+	JPEGQuality int     `json:"jpeg_quality,omitempty"` // 0 for PNG
+	Size        int64   `json:"size"`
+	SSIM        float64 `json:"ssim"`
+}
+
+// Preset returns the estimate for q, or false if the result has none.
+func (e EstimateResult) Preset(q Quality) (PresetEstimate, bool) {
+	for _, p := range e.Presets {
+		if p.Quality == q {
+			return p, true
+		}
+	}
+	return PresetEstimate{}, false
+}
+
+// estimatePresets is the order of EstimateResult.Presets.
+var estimatePresets = []Quality{Maximum, Aggressive, Balanced, High, Ultra, NearLossless, Lossless}
+
+// estimateTile and estimateTiles set the proxy Estimate encodes: up to
+// estimateTiles full-resolution tiles of estimateTile pixels square.
+const (
+	estimateTile  = 64
+	estimateTiles = 16
+)
+
+// estimateAnchors are the JPEG qualities Estimate encodes; the model
+// interpolates between them.
+var estimateAnchors = []int{5, 20, 50, 75, 90, 100}
+
+// Estimate predicts the size and SSIM CompressImage would reach at each
+// quality preset, fast enough to update a UI as options change. Options
+// other than Quality apply as they would to CompressImage (format,
+// resizing, quantization tables, and so on); target-size options are
+// ignored.
+//
+// The figures are estimates, not exact. For JPEG, Estimate encodes a proxy
+// of at most 16 tiles of 64×64 pixels, taken at full resolution across the
+// image, at six qualities from 5 to 100, interpolates size and SSIM
+// between them on log scales, and reads each preset's quality off the SSIM
+// curve. For PNG it encodes the proxy once per distinct outcome and scales
+// the size by area. That costs a small fraction of one full compression.
+// Expect sizes within a few tens of percent, closer for uniform images
+// than for ones whose detail is concentrated in a small area.
+func Estimate(img image.Image, opts Options) EstimateResult {
+	var est EstimateResult
+	if img == nil {
+		return est
+	}
+	src := toNRGBARef(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= 0 || h <= 0 {
+		return est
+	}
+
+	est.Dimensions = estimateDimensions(w, h, opts)
+	if est.Dimensions.X < w && est.Dimensions.Y < h {
+		src = boxDownsample(src, est.Dimensions.X, est.Dimensions.Y)
+	}
+	est.Format = opts.Format
+	if est.Format == Auto {
+		est.Format = analyzeFormat(src, opts.AnalysisSamples)
+	}
+
+	proxy := estimateProxy(src)
+	scale := float64(est.Dimensions.X*est.Dimensions.Y) / float64(proxy.Bounds().Dx()*proxy.Bounds().Dy())
+	if est.Format != JPEG {
+		opts.Format = est.Format
+		est.Presets = estimatePNG(proxy, scale, opts)
+	} else {
+		if !isOpaque(proxy) {
+			proxy = flattenAlpha(proxy, opts.background())
+		}
+		est.Presets = estimateJPEG(proxy, scale, opts)
+	}
+	return est
+}
+
+// estimateDimensions is the output size prepareImage's resize steps give a
+// w×h image.
+func estimateDimensions(w, h int, opts Options) image.Point {
+	switch {
+	case opts.ExactSize != (image.Point{}):
+		if opts.ExactFit != FitContain {
+			return opts.ExactSize
+		}
+		return image.Pt(fitBox(w, h, opts.ExactSize.X, opts.ExactSize.Y))
+	case opts.MaxWidth > 0 || opts.MaxHeight > 0:
+		if !opts.AllowUpscale && fitsWithin(w, h, opts.MaxWidth, opts.MaxHeight) {
+			break
+		}
+		return image.Pt(fitBox(w, h, opts.MaxWidth, opts.MaxHeight))
+	}
+	return image.Pt(w, h)
+}
+
+// estimateProxy returns a mosaic of full-resolution tiles spread evenly
+// over src, or src itself if it is no larger than the mosaic. Tiles start
+// on the 8-pixel JPEG block grid, so seams fall between blocks.
+func estimateProxy(src *image.NRGBA) *image.NRGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	tw, th := min(estimateTile, w), min(estimateTile, h)
+	tilesY := min(h/th, 4)
+	tilesX := min(w/tw, (estimateTiles+tilesY-1)/tilesY)
+	if tilesX*tw >= w && tilesY*th >= h {
+		return src
+	}
+
+	mosaic := image.NewNRGBA(image.Rect(0, 0, tilesX*tw, tilesY*th))
+	for ty := range tilesY {
+		sy := (h - th) * ty / max(tilesY-1, 1) &^ 7
+		for tx := range tilesX {
+			sx := (w - tw) * tx / max(tilesX-1, 1) &^ 7
+			for y := range th {
+				srcOff := (sy+y)*src.Stride + sx*4
+				dstOff := (ty*th+y)*mosaic.Stride + tx*tw*4
+				copy(mosaic.Pix[dstOff:dstOff+tw*4], src.Pix[srcOff:srcOff+tw*4])
+			}
+		}
+	}
+	return mosaic
+}
+
+// estimatePNG encodes proxy once, or once per palette size with LossyPNG
+// or GIF output, and scales the sizes by area.
+func estimatePNG(proxy *image.NRGBA, scale float64, opts Options) []PresetEstimate {
+	type outcome struct {
+		size int64
+		ssim float64
+	}
+	seen := make(map[int]outcome)
+	presets := make([]PresetEstimate, len(estimatePresets))
+	for i, q := range estimatePresets {
+		opts.Quality = q
+		colors := 0
+		if opts.Format == GIF || opts.LossyPNG && q != Lossless {
+			colors = q.paletteColors()
+		}
+		o, ok := seen[colors]
+		if !ok {
+			var buf bytes.Buffer
+			compress := compressPNG
+			if opts.Format == GIF {
+				compress = compressGIF
+			}
+			ssim, err := compress(proxy, &buf, opts)
+			if err == nil {
+				o = outcome{int64(float64(buf.Len()) * scale), ssim}
+			}
+			seen[colors] = o
+		}
+		presets[i] = PresetEstimate{Quality: q, Size: o.size, SSIM: o.ssim}
+	}
+	return presets
+}
+
+// jpegAnchor is one encode of the proxy: bits per pixel of entropy-coded
+// data, header bytes, and SSIM.
+type jpegAnchor struct {
+	q        int
+	bpp      float64
+	overhead float64
+	ssim     float64
+}
+
+// loss is the anchor's ln(1-SSIM), which falls roughly linearly with
+// quality between anchors.
+func (a jpegAnchor) loss() float64 {
+	return math.Log(max(1-a.ssim, 1e-6))
+}
+
+// estimateJPEG encodes proxy at the anchor qualities, then for each preset
+// finds where the SSIM curve crosses its target and interpolates the size
+// there.
+func estimateJPEG(proxy *image.NRGBA, scale float64, opts Options) []PresetEstimate {
+	pixels := float64(proxy.Bounds().Dx() * proxy.Bounds().Dy())
+	ref := newSSIMRef(proxy, opts.scratch)
+	defer ref.release()
+	tiny := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+
+	curves := make(map[bool][]jpegAnchor) // by jpegEncoding.fullChroma
+	presets := make([]PresetEstimate, len(estimatePresets))
+	for i, q := range estimatePresets {
+		opts.Quality = q
+		enc := opts.jpegEncoding(proxy)
+		target := min(q.targetSSIM(), 0.999)
+		floor := jpegSearchFloor(target, opts)
+		curve, ok := curves[enc.fullChroma]
+		if !ok {
+			// Presets are in ascending order, so the first one to use a
+			// curve has the lowest floor; anchors under it are skipped.
+			for j, aq := range estimateAnchors {
+				if j+1 < len(estimateAnchors) && estimateAnchors[j+1] <= floor {
+					continue
+				}
+				curve = append(curve, encodeAnchor(proxy, tiny, ref, aq, pixels, opts, enc))
+			}
+			curves[enc.fullChroma] = curve
+		}
+
+		jq := max(floor, estimateCrossing(curve, target))
+		a, b, t := estimateSegment(curve, jq)
+		ssim := 1 - math.Exp(a.loss()+t*(b.loss()-a.loss()))
+		bpp := math.Exp(math.Log(a.bpp) + t*(math.Log(b.bpp)-math.Log(a.bpp)))
+		overhead := a.overhead + t*(b.overhead-a.overhead)
+		presets[i] = PresetEstimate{
+			Quality:     q,
+			JPEGQuality: jq,
+			Size:        int64(bpp*pixels*scale/8 + overhead),
+			SSIM:        min(max(ssim, 0), 1),
+		}
+	}
+	return presets
+}
+
+// estimateCrossing returns the lowest quality at which the interpolated
+// SSIM curve reaches target, or 100 if it never does.
+func estimateCrossing(curve []jpegAnchor, target float64) int {
+	want := math.Log(1 - target)
+	if curve[0].loss() <= want {
+		// Below the first anchor the curve is extrapolated along its
+		// first segment.
+		a, b := curve[0], curve[1]
+		if b.loss() >= a.loss() {
+			return 1
+		}
+		q := float64(a.q) + (want-a.loss())*float64(b.q-a.q)/(b.loss()-a.loss())
+		return min(max(int(math.Ceil(q)), 1), a.q)
+	}
+	for i := 1; i < len(curve); i++ {
+		a, b := curve[i-1], curve[i]
+		if b.loss() <= want {
+			q := float64(a.q) + (want-a.loss())*float64(b.q-a.q)/(b.loss()-a.loss())
+			return min(max(int(math.Ceil(q)), a.q), b.q)
+		}
+	}
+	return 100
+}
+
+// estimateSegment returns the anchors around quality q and q's position
+// between them (0 at a, 1 at b; below 0 when extrapolating under the
+// first anchor).
+func estimateSegment(curve []jpegAnchor, q int) (a, b jpegAnchor, t float64) {
+	i := 1
+	for i < len(curve)-1 && curve[i].q < q {
+		i++
+	}
+	a, b = curve[i-1], curve[i]
+	return a, b, float64(q-a.q) / float64(b.q-a.q)
+}
+
+// encodeAnchor encodes proxy at quality q and measures it. The header
+// overhead is the size of an 8×8 encode with the same settings.
+func encodeAnchor(proxy, tiny *image.NRGBA, ref *ssimRef, q int, pixels float64, opts Options, enc jpegEncoding) jpegAnchor {
+	a := jpegAnchor{q: q, bpp: 1e-3}
+	var buf bytes.Buffer
+	if encodeJPEG(&buf, tiny, q, enc) == nil {
+		a.overhead = float64(buf.Len())
+	}
+	buf.Reset()
+	if encodeJPEG(&buf, proxy, q, enc) != nil {
+		return a
+	}
+	a.bpp = max(float64(buf.Len())-a.overhead, 1) * 8 / pixels
+	if decoded, err := jpeg.Decode(&buf); err == nil {
+		a.ssim = ref.compare(toNRGBARef(decoded))
+	}
+	return a
+}
@@ -1,6 +1,7 @@
 package fennec
 
 import (
+	"bytes"
 	"encoding/binary"
 	"image"
 	"io"
@@ -44,85 +45,226 @@ func (o Orientation) String() string {
 	}
 }
 
-// ReadOrientation reads the EXIF orientation tag from a JPEG stream.
-// Returns OrientNormal (1) if no orientation is found or the file is not JPEG.
-// This is a minimal parser that only reads the orientation tag — it does not
-// parse the full EXIF tree, keeping the zero-dependency promise.
+// ReadOrientation reads the EXIF orientation tag from a JPEG, PNG (eXIf
+// chunk), or TIFF stream, starting at r's current position.
+// Returns OrientNormal (1) if no orientation is found or the format is
+// something else. This is a minimal parser that only reads the orientation
+// tag — it does not parse the full EXIF tree, keeping the zero-dependency
+// promise.
 func ReadOrientation(r io.ReadSeeker) Orientation {
+	return readInputMeta(r).orient
+}
+
+// ReadOrientationBytes is ReadOrientation for an encoded image already held
+// in memory, such as an HTTP upload. CompressBytes uses it to honor
+// Options.AutoOrient.
+func ReadOrientationBytes(data []byte) Orientation {
+	return ReadOrientation(bytes.NewReader(data))
+}
+
+// exifHeader starts the payload of an EXIF APP1 segment; the TIFF block
+// holding the tags follows it.
+const exifHeader = "Exif\x00\x00"
+
+// readEXIF returns the payload of the first EXIF APP1 segment in a JPEG
+// stream (exifHeader followed by the TIFF block), or nil if there is none.
+func readEXIF(r io.ReadSeeker) []byte {
 	// Read JPEG SOI marker.
 	var soi [2]byte
 	if _, err := io.ReadFull(r, soi[:]); err != nil {
-		return OrientNormal
+		return nil
 	}
 	if soi[0] != 0xFF || soi[1] != 0xD8 {
-		return OrientNormal // Not a JPEG.
+		return nil // Not a JPEG.
 	}
 
 	// Scan for APP1 marker (0xFFE1) which contains EXIF data.
 	for {
 		var marker [2]byte
 		if _, err := io.ReadFull(r, marker[:]); err != nil {
-			return OrientNormal
+			return nil
 		}
 		if marker[0] != 0xFF {
-			return OrientNormal
+			return nil
 		}
 
 		// Skip padding bytes.
 		for marker[1] == 0xFF {
 			if _, err := io.ReadFull(r, marker[1:]); err != nil {
-				return OrientNormal
+				return nil
 			}
 		}
 
 		// Read segment length.
 		var lenBuf [2]byte
 		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
-			return OrientNormal
+			return nil
 		}
 		segLen := int(binary.BigEndian.Uint16(lenBuf[:])) - 2
 
 		if segLen < 0 {
-			return OrientNormal
+			return nil
 		}
 
-		if marker[1] == 0xE1 { // APP1
-			return parseAPP1(r, segLen)
+		// APP1 is also used for XMP, so keep looking past non-EXIF ones.
+		if marker[1] == 0xE1 {
+			data := make([]byte, segLen)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil
+			}
+			if len(data) >= len(exifHeader)+8 && string(data[:len(exifHeader)]) == exifHeader {
+				return data
+			}
+			continue
 		}
 
 		// Skip SOS marker — no more metadata after this.
 		if marker[1] == 0xDA {
-			return OrientNormal
+			return nil
 		}
 
 		// Skip this segment.
 		if _, err := r.Seek(int64(segLen), io.SeekCurrent); err != nil {
-			return OrientNormal
+			return nil
 		}
 	}
 }
 
-// parseAPP1 parses an APP1 segment for EXIF orientation.
-func parseAPP1(r io.ReadSeeker, segLen int) Orientation {
-	if segLen < 14 {
+// pngSignature starts every PNG file.
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// maxEXIFChunk bounds how much of a PNG eXIf chunk is read into memory.
+const maxEXIFChunk = 1 << 20
+
+// readPNGEXIF returns the EXIF data of a PNG stream positioned just after
+// its signature, as a payload in readEXIF's format, or nil if the PNG has
+// no eXIf chunk. The eXIf chunk holds a bare TIFF block.
+func readPNGEXIF(r io.ReadSeeker) []byte {
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil
+		}
+		length := int64(binary.BigEndian.Uint32(hdr[:4]))
+		switch string(hdr[4:]) {
+		case "eXIf":
+			if length > maxEXIFChunk {
+				return nil
+			}
+			data := make([]byte, len(exifHeader)+int(length))
+			copy(data, exifHeader)
+			if _, err := io.ReadFull(r, data[len(exifHeader):]); err != nil {
+				return nil
+			}
+			return data
+		case "IEND":
+			return nil
+		}
+		// Skip the chunk data and its CRC.
+		if _, err := r.Seek(length+4, io.SeekCurrent); err != nil {
+			return nil
+		}
+	}
+}
+
+// maxTIFFEntries bounds the IFD size readTIFFOrientation accepts.
+const maxTIFFEntries = 1024
+
+// readTIFFOrientation returns the orientation tag of a TIFF stream
+// positioned just after its 8-byte header, given that header. Only the
+// first IFD is read, not the whole file.
+func readTIFFOrientation(r io.ReadSeeker, header []byte) Orientation {
+	var bo binary.ByteOrder = binary.LittleEndian
+	if header[0] == 'M' {
+		bo = binary.BigEndian
+	}
+	ifdOffset := int64(bo.Uint32(header[4:8]))
+	if ifdOffset < 8 {
+		return OrientNormal
+	}
+	if _, err := r.Seek(ifdOffset-8, io.SeekCurrent); err != nil {
+		return OrientNormal
+	}
+	var countBuf [2]byte
+	if _, err := io.ReadFull(r, countBuf[:]); err != nil {
+		return OrientNormal
+	}
+	count := int(bo.Uint16(countBuf[:]))
+	if count > maxTIFFEntries {
 		return OrientNormal
 	}
 
-	data := make([]byte, segLen)
-	if _, err := io.ReadFull(r, data); err != nil {
+	// Rebuild a compact TIFF block holding just the header and IFD0, with
+	// the IFD moved to offset 8, so the EXIF code can read it.
+	tiff := make([]byte, 8+2+count*12)
+	copy(tiff, header[:4])
+	bo.PutUint32(tiff[4:8], 8)
+	copy(tiff[8:10], countBuf[:])
+	if _, err := io.ReadFull(r, tiff[10:]); err != nil {
 		return OrientNormal
 	}
+	return exifOrientation(append([]byte(exifHeader), tiff...))
+}
 
-	if len(data) < 6 || string(data[:4]) != "Exif" || data[4] != 0 || data[5] != 0 {
+// exifOrientation returns the orientation tag of an EXIF payload, or
+// OrientNormal if it has none.
+func exifOrientation(exif []byte) Orientation {
+	if len(exif) < len(exifHeader) {
+		return OrientNormal
+	}
+	tiff := exif[len(exifHeader):]
+	off, bo, ok := orientationEntry(tiff)
+	if !ok {
+		return OrientNormal
+	}
+	var val uint32
+	switch bo.Uint16(tiff[off+2 : off+4]) {
+	case exifShort:
+		val = uint32(bo.Uint16(tiff[off+8 : off+10]))
+	case exifLong: // Some cameras and editors write the spec's SHORT as LONG.
+		val = bo.Uint32(tiff[off+8 : off+12])
+	default:
 		return OrientNormal
 	}
+	if val >= 1 && val <= 8 {
+		return Orientation(val)
+	}
+	return OrientNormal
+}
+
+// TIFF field types the orientation tag is stored as.
+const (
+	exifShort = 3
+	exifLong  = 4
+)
 
-	return parseTIFFOrientation(data[6:])
+// withEXIFOrientation returns a copy of an EXIF payload with its orientation
+// tag set to o. Payloads without an orientation tag are copied unchanged.
+func withEXIFOrientation(exif []byte, o Orientation) []byte {
+	out := append([]byte(nil), exif...)
+	if len(out) < len(exifHeader) {
+		return out
+	}
+	tiff := out[len(exifHeader):]
+	off, bo, ok := orientationEntry(tiff)
+	if !ok {
+		return out
+	}
+	switch bo.Uint16(tiff[off+2 : off+4]) {
+	case exifShort:
+		bo.PutUint16(tiff[off+8:off+10], uint16(o))
+	case exifLong:
+		bo.PutUint32(tiff[off+8:off+12], uint32(o))
+	}
+	return out
 }
 
-func parseTIFFOrientation(tiff []byte) Orientation {
+// orientationEntry finds the orientation tag (0x0112) in the first IFD of a
+// TIFF block and returns the offset of its 12-byte entry and the block's
+// byte order.
+func orientationEntry(tiff []byte) (int, binary.ByteOrder, bool) {
 	if len(tiff) < 8 {
-		return OrientNormal
+		return 0, nil, false
 	}
 
 	var bo binary.ByteOrder
@@ -132,22 +274,18 @@ func parseTIFFOrientation(tiff []byte) Orientation {
 	case "MM":
 		bo = binary.BigEndian
 	default:
-		return OrientNormal
+		return 0, nil, false
 	}
 
 	if bo.Uint16(tiff[2:4]) != 42 {
-		return OrientNormal
+		return 0, nil, false
 	}
 
 	ifdOffset := int(bo.Uint32(tiff[4:8]))
 	if ifdOffset < 8 || ifdOffset+2 > len(tiff) {
-		return OrientNormal
+		return 0, nil, false
 	}
 
-	return scanIFDForOrientation(tiff, ifdOffset, bo)
-}
-
-func scanIFDForOrientation(tiff []byte, ifdOffset int, bo binary.ByteOrder) Orientation {
 	entryCount := int(bo.Uint16(tiff[ifdOffset : ifdOffset+2]))
 	ifdOffset += 2
 
@@ -156,21 +294,11 @@ func scanIFDForOrientation(tiff []byte, ifdOffset int, bo binary.ByteOrder) Orie
 		if entryOff+12 > len(tiff) {
 			break
 		}
-
-		tag := bo.Uint16(tiff[entryOff : entryOff+2])
-		if tag == 0x0112 { // Orientation tag
-			dataType := bo.Uint16(tiff[entryOff+2 : entryOff+4])
-			if dataType != 3 { // SHORT type
-				return OrientNormal
-			}
-			val := bo.Uint16(tiff[entryOff+8 : entryOff+10])
-			if val >= 1 && val <= 8 {
-				return Orientation(val)
-			}
-			return OrientNormal
+		if bo.Uint16(tiff[entryOff:entryOff+2]) == 0x0112 { // Orientation tag
+			return entryOff, bo, true
 		}
 	}
-	return OrientNormal
+	return 0, nil, false
 }
 
 // ApplyOrientation applies EXIF orientation to an NRGBA image,
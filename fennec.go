@@ -24,32 +24,100 @@ import (
 	"os"
 )
 
+// Compressor compresses images with one fixed set of Options. Build it
+// once with New and reuse it: the options are validated up front instead
+// of on every call. A Compressor is safe for concurrent use by multiple
+// goroutines; it holds no per-call state. Each Compressor keeps its own
+// pool of scratch buffers for resizing and SSIM, which its calls reuse and
+// no other Compressor touches. The package-level Compress functions are
+// wrappers that build a Compressor for each call.
+type Compressor struct {
+	opts Options
+}
+
+// New validates opts and returns a Compressor that uses them. Later
+// changes to FocusRegion's target do not affect it.
+func New(opts Options) (*Compressor, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.FocusRegion != nil {
+		focus := *opts.FocusRegion
+		opts.FocusRegion = &focus
+	}
+	// Every Compressor recycles its scratch buffers in a pool of its own.
+	opts.scratch = new(scratch)
+	return &Compressor{opts: opts}, nil
+}
+
+// Options returns the options c compresses with.
+func (c *Compressor) Options() Options {
+	opts := c.opts
+	opts.scratch = nil
+	if opts.FocusRegion != nil {
+		focus := *opts.FocusRegion
+		opts.FocusRegion = &focus
+	}
+	return opts
+}
+
 // CompressFile compresses an image file and writes the result to dst.
 // It reads EXIF orientation data and auto-rotates if opts.AutoOrient is true.
 // The context can be used to cancel long-running operations.
 func CompressFile(ctx context.Context, src, dst string, opts Options) (*Result, error) {
-	if err := opts.Validate(); err != nil {
+	c, err := New(opts)
+	if err != nil {
 		return nil, err
 	}
+	return c.CompressFile(ctx, src, dst)
+}
+
+// CompressFile is the Compressor form of the package-level CompressFile.
+func (c *Compressor) CompressFile(ctx context.Context, src, dst string) (*Result, error) {
+	result, _, err := compressFile(ctx, src, c.opts, func(Format) string { return dst })
+	return result, err
+}
+
+// CompressFileAuto is like CompressFile, but names the output after the
+// format Fennec chose: it writes to dstBase plus ".jpg", ".png", or ".gif"
+// and returns that path. Use it when Format is Auto or a target size is set,
+// where the output format isn't known in advance.
+func CompressFileAuto(ctx context.Context, src, dstBase string, opts Options) (*Result, string, error) {
+	c, err := New(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return c.CompressFileAuto(ctx, src, dstBase)
+}
+
+// CompressFileAuto is the Compressor form of the package-level
+// CompressFileAuto.
+func (c *Compressor) CompressFileAuto(ctx context.Context, src, dstBase string) (*Result, string, error) {
+	return compressFile(ctx, src, c.opts, func(f Format) string { return dstBase + f.extension() })
+}
 
+// compressFile compresses src and writes the result to the path dst
+// returns for the chosen output format. opts must be valid.
+func compressFile(ctx context.Context, src string, opts Options, dst func(Format) string) (*Result, string, error) {
 	if err := opts.reportProgress(ctx, StageAnalyzing, 0); err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	img, orient, fileSize, err := openWithOrientation(src)
+	img, meta, fileSize, err := openWithMeta(src, opts.losslessJPEG())
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
+	meta.size = fileSize
 
-	result, err := compressImageInternal(ctx, img, orient, opts)
+	result, err := compressImageInternal(ctx, img, meta, opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	result.OriginalSize = fileSize
 	result.computeStats()
 
 	if err := opts.reportProgress(ctx, StageWriting, 0.9); err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// Write the pre-computed compressed bytes directly.
@@ -57,54 +125,302 @@ func CompressFile(ctx context.Context, src, dst string, opts Options) (*Result,
 	if len(data) == 0 {
 		data, err = encodeToBytes(result.Image, result.Format, result.JPEGQuality)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		result.CompressedData = data
 		result.CompressedSize = int64(len(data))
 		result.computeStats()
 	}
 
-	if err := os.WriteFile(dst, data, 0644); err != nil {
-		return nil, fmt.Errorf("fennec: write %q: %w", dst, err)
+	path := dst(result.Format)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return nil, "", fmt.Errorf("fennec: write %q: %w", path, err)
 	}
 
 	if err := opts.reportProgress(ctx, StageWriting, 1.0); err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return result, nil
+	return result, path, nil
 }
 
 // CompressImage compresses an already-decoded image.
 // The context can be used to cancel long-running operations.
 func CompressImage(ctx context.Context, img image.Image, opts Options) (*Result, error) {
-	if err := opts.Validate(); err != nil {
+	c, err := New(opts)
+	if err != nil {
 		return nil, err
 	}
-	return compressImageInternal(ctx, img, OrientNormal, opts)
+	return c.CompressImage(ctx, img)
+}
+
+// CompressImage is the Compressor form of the package-level CompressImage.
+func (c *Compressor) CompressImage(ctx context.Context, img image.Image) (*Result, error) {
+	return compressImageInternal(ctx, img, inputMeta{}, c.opts)
 }
 
 // Compress reads an image from r and returns the optimally compressed version.
 // The context can be used to cancel long-running operations.
 func Compress(ctx context.Context, r io.Reader, opts Options) (*Result, error) {
-	if err := opts.Validate(); err != nil {
+	c, err := New(opts)
+	if err != nil {
 		return nil, err
 	}
-	img, _, err := image.Decode(r)
+	return c.CompressReader(ctx, r)
+}
+
+// CompressReader is the Compressor form of the package-level Compress.
+func (c *Compressor) CompressReader(ctx context.Context, r io.Reader) (*Result, error) {
+	// Keep what the decoder reads so the frame count can be checked after.
+	// A GIF's later frames come after the first one's pixels, where the
+	// decoder stops, so the check reads on into the rest of r.
+	var read bytes.Buffer
+	img, format, err := decodeImage(io.TeeReader(r, &read))
 	if err != nil {
-		return nil, fmt.Errorf("fennec: decode: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	if err := checkAnimated(io.MultiReader(&read, r)); err != nil {
+		return nil, err
 	}
-	return compressImageInternal(ctx, img, OrientNormal, opts)
+	return compressImageInternal(ctx, img, inputMeta{format: format}, c.opts)
 }
 
 // CompressBytes compresses image data from a byte slice and returns the result.
 // This is the most common API for server-side use: receive bytes → compress → return bytes.
+// OriginalSize is set to len(data) so Ratio and SavingsPercent are populated.
+// Like CompressFile, it reads the EXIF orientation (see ReadOrientationBytes)
+// and applies it when opts.AutoOrient is set, and honors opts.PreserveMetadata.
 func CompressBytes(ctx context.Context, data []byte, opts Options) (*Result, error) {
-	return Compress(ctx, bytes.NewReader(data), opts)
+	c, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.CompressBytes(ctx, data)
+}
+
+// CompressBytes is the Compressor form of the package-level CompressBytes,
+// the common server path: call it once per request on a shared Compressor.
+func (c *Compressor) CompressBytes(ctx context.Context, data []byte) (*Result, error) {
+	opts := c.opts
+	if err := checkAnimated(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	img, format, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	meta := readInputMeta(bytes.NewReader(data))
+	meta.format = format
+	meta.size = int64(len(data))
+	if opts.losslessJPEG() && format == "jpeg" {
+		meta.data = data
+	}
+	result, err := compressImageInternal(ctx, img, meta, opts)
+	if err != nil {
+		return nil, err
+	}
+	result.OriginalSize = int64(len(data))
+	result.computeStats()
+	return result, nil
+}
+
+// CompressPages compresses each page of a multi-page TIFF read from r on
+// its own and returns one Result per page, in file order, such as for
+// document scans that should become one file per page. Pages are decoded
+// one at a time, so they may differ in size and bit depth, and each page's
+// orientation tag is applied when opts.AutoOrient is set. OriginalSize is
+// the page's share of the file (its compressed strip bytes). Any other
+// format is a single page and gives one Result, as from CompressBytes.
+// TIFF pages can sit anywhere in the file, so r is read to the end first.
+func CompressPages(ctx context.Context, r io.Reader, opts Options) ([]*Result, error) {
+	c, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.CompressPages(ctx, r)
+}
+
+// CompressPages is the Compressor form of the package-level CompressPages.
+func (c *Compressor) CompressPages(ctx context.Context, r io.Reader) ([]*Result, error) {
+	opts := c.opts
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("fennec: read: %w", err)
+	}
+	if len(data) < 4 || (string(data[:4]) != "II*\x00" && string(data[:4]) != "MM\x00*") {
+		result, err := c.CompressBytes(ctx, data)
+		if err != nil {
+			return nil, err
+		}
+		return []*Result{result}, nil
+	}
+
+	pages, err := tiffPages(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	results := make([]*Result, len(pages))
+	for i, d := range pages {
+		img, err := decodeTIFFPage(data, d)
+		if err != nil {
+			return nil, fmt.Errorf("fennec: page %d: %w: %w", i, ErrDecode, err)
+		}
+		meta := inputMeta{orient: d.orientation(), format: "tiff"}
+		for _, n := range d.tags[tiffStripByteCounts] {
+			meta.size += int64(n)
+		}
+		result, err := compressImageInternal(ctx, img, meta, opts)
+		if err != nil {
+			return nil, fmt.Errorf("fennec: page %d: %w", i, err)
+		}
+		result.OriginalSize = meta.size
+		result.computeStats()
+		results[i] = result
+	}
+	return results, nil
+}
+
+// CompressTo compresses img and writes the encoded output to w, returning
+// the same statistics as CompressImage. The returned Result has a nil
+// CompressedData so large outputs aren't held twice; CompressedSize still
+// reports the bytes written. Use it to stream straight into an
+// http.ResponseWriter or an upload without keeping the result around.
+func CompressTo(ctx context.Context, w io.Writer, img image.Image, opts Options) (*Result, error) {
+	c, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.CompressTo(ctx, w, img)
+}
+
+// CompressTo is the Compressor form of the package-level CompressTo.
+func (c *Compressor) CompressTo(ctx context.Context, w io.Writer, img image.Image) (*Result, error) {
+	opts := c.opts
+	result, err := compressImageInternal(ctx, img, inputMeta{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.reportProgress(ctx, StageWriting, 0.9); err != nil {
+		return nil, err
+	}
+
+	data := result.CompressedData
+	if len(data) == 0 {
+		data, err = encodeToBytes(result.Image, result.Format, result.JPEGQuality)
+		if err != nil {
+			return nil, err
+		}
+		result.CompressedSize = int64(len(data))
+		result.computeStats()
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("fennec: write: %w", err)
+	}
+	result.CompressedData = nil
+
+	if err := opts.reportProgress(ctx, StageWriting, 1.0); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CompressVariants compresses img once per entry of variants and returns
+// the results in the same order, for producing several sizes, formats, or
+// qualities of one source. img is converted to NRGBA once, and variants
+// that agree on every resizing option (MaxWidth, MaxHeight, ExactSize,
+// ExactFit, AllowUpscale, Sharpen, StraightAlpha, LinearResize,
+// ResizeFilter) and on the pixel adjustments (Denoise, AutoLevels,
+// Brightness, Contrast) share those steps too, so variants differing only
+// in format, quality, or target cost one resize between them. Each
+// Result.Image still owns its pixels. All variants are validated before
+// any work starts, and the first error stops the run.
+func CompressVariants(ctx context.Context, img image.Image, variants []Options) ([]*Result, error) {
+	for i := range variants {
+		if err := variants[i].Validate(); err != nil {
+			return nil, fmt.Errorf("fennec: variant %d: %w", i, err)
+		}
+	}
+	if img == nil {
+		return nil, ErrNilImage
+	}
+	if b := img.Bounds(); b.Dx() <= 0 || b.Dy() <= 0 {
+		return nil, ErrEmptyImage
+	}
+
+	decoded := toNRGBA(img)
+	prepared := make(map[prepareKey]preparedImage)
+	results := make([]*Result, len(variants))
+	// The variants run one after another, so they can share a buffer pool.
+	s := new(scratch)
+	for i, opts := range variants {
+		if opts.scratch == nil {
+			opts.scratch = s
+		}
+		if err := opts.reportProgress(ctx, StageResizing, 0.1); err != nil {
+			return nil, err
+		}
+		opts.applyOptimizeOnly("")
+		key := opts.prepareKey()
+		p, ok := prepared[key]
+		if !ok {
+			p = prepareImage(decoded, inputMeta{}, opts)
+			prepared[key] = p
+		}
+		result, err := compressPrepared(ctx, img, inputMeta{}, p, opts)
+		if err != nil {
+			return nil, fmt.Errorf("fennec: variant %d: %w", i, err)
+		}
+		if ok && result.Image == p.src {
+			// An earlier variant's Image already holds these pixels.
+			result.Image = cloneNRGBA(p.src)
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
+// thumbnailSharpen is the Sharpen strength CompressWithThumbnail gives
+// thumbnails when opts.Sharpen is 0.
+const thumbnailSharpen = 0.3
+
+// CompressWithThumbnail compresses img per opts and also returns a
+// thumbnail thumbWidth pixels wide, the pair a CMS stores for an upload.
+// img is converted to NRGBA once, as CompressVariants does. The thumbnail
+// uses opts with MaxWidth set to thumbWidth and MaxHeight, ExactSize,
+// TargetSize, and TargetRatio cleared, so its quality comes from the SSIM
+// search rather than a byte budget meant for the full image; it is
+// sharpened at opts.Sharpen, or 0.3 if that is 0. A source no wider than
+// thumbWidth is not enlarged unless AllowUpscale is set.
+func CompressWithThumbnail(ctx context.Context, img image.Image, opts Options, thumbWidth int) (full, thumb *Result, err error) {
+	c, err := New(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.CompressWithThumbnail(ctx, img, thumbWidth)
+}
+
+// CompressWithThumbnail is the Compressor form of the package-level
+// CompressWithThumbnail.
+func (c *Compressor) CompressWithThumbnail(ctx context.Context, img image.Image, thumbWidth int) (full, thumb *Result, err error) {
+	if thumbWidth <= 0 {
+		return nil, nil, fmt.Errorf("%w: thumbnail width must be positive, got %d", ErrInvalidOptions, thumbWidth)
+	}
+	thumbOpts := c.opts
+	thumbOpts.MaxWidth, thumbOpts.MaxHeight = thumbWidth, 0
+	thumbOpts.ExactSize = image.Point{}
+	thumbOpts.TargetSize, thumbOpts.TargetRatio, thumbOpts.StrictTargetSize = 0, 0, false
+	if thumbOpts.Sharpen == 0 {
+		thumbOpts.Sharpen = thumbnailSharpen
+	}
+	results, err := CompressVariants(ctx, img, []Options{c.opts, thumbOpts})
+	if err != nil {
+		return nil, nil, err
+	}
+	return results[0], results[1], nil
 }
 
 // compressImageInternal is the shared compression pipeline.
-func compressImageInternal(ctx context.Context, img image.Image, orient Orientation, opts Options) (*Result, error) {
+func compressImageInternal(ctx context.Context, img image.Image, meta inputMeta, opts Options) (*Result, error) {
 	if img == nil {
 		return nil, ErrNilImage
 	}
@@ -112,32 +428,286 @@ func compressImageInternal(ctx context.Context, img image.Image, orient Orientat
 	if bounds.Dx() <= 0 || bounds.Dy() <= 0 {
 		return nil, ErrEmptyImage
 	}
+	if err := opts.reportProgress(ctx, StageResizing, 0.1); err != nil {
+		return nil, err
+	}
+	opts.applyOptimizeOnly(meta.format)
+	return compressPrepared(ctx, img, meta, prepareImage(toNRGBA(img), meta, opts), opts)
+}
+
+// cloneNRGBA returns a copy of img with its own pixels.
+func cloneNRGBA(img *image.NRGBA) *image.NRGBA {
+	return &image.NRGBA{
+		Pix:    append([]uint8(nil), img.Pix...),
+		Stride: img.Stride,
+		Rect:   img.Rect,
+	}
+}
+
+// preparedImage is the output of the pipeline steps that don't depend on
+// the output format: orientation, denoising, tone adjustments, and resizing.
+type preparedImage struct {
+	decoded  *image.NRGBA // the converted input, before any step
+	oriented image.Point  // dimensions after AutoOrient, before resizing
+	src      *image.NRGBA // the result; == decoded if no step changed pixels
+}
+
+// prepareKey holds the options prepareImage reads. Variants with equal keys
+// produce the same preparedImage.
+type prepareKey struct {
+	autoOrient          bool
+	denoise             float64
+	autoLevels          bool
+	brightness          float64
+	contrast            float64
+	exactSize           image.Point
+	exactFit            FitMode
+	maxWidth, maxHeight int
+	allowUpscale        bool
+	sharpen             float64
+	straightAlpha       bool
+	linearResize        bool
+	resizeFilter        ResizeFilter
+}
+
+func (o *Options) prepareKey() prepareKey {
+	return prepareKey{o.AutoOrient, o.Denoise, o.AutoLevels, o.Brightness, o.Contrast, o.ExactSize, o.ExactFit,
+		o.MaxWidth, o.MaxHeight, o.AllowUpscale, o.Sharpen, o.StraightAlpha,
+		o.LinearResize, o.ResizeFilter}
+}
 
-	result := &Result{OriginalDimensions: image.Pt(bounds.Dx(), bounds.Dy())}
-	src := toNRGBA(img)
+// prepareImage runs the format-independent steps on decoded, which it
+// never modifies: every pixel-changing step replaces src.
+func prepareImage(decoded *image.NRGBA, meta inputMeta, opts Options) preparedImage {
+	p := preparedImage{decoded: decoded, src: decoded}
+	if opts.AutoOrient && meta.orient > OrientNormal {
+		p.src = ApplyOrientation(p.src, meta.orient)
+	}
+	p.oriented = p.src.Bounds().Size()
 
-	if opts.AutoOrient && orient > OrientNormal {
-		src = ApplyOrientation(src, orient)
-		result.OriginalDimensions = image.Pt(src.Bounds().Dx(), src.Bounds().Dy())
+	if opts.Denoise > 0 {
+		p.src = Denoise(p.src, opts.Denoise)
 	}
-	if err := opts.reportProgress(ctx, StageResizing, 0.1); err != nil {
-		return nil, err
+	if opts.AutoLevels {
+		p.src = AutoLevels(p.src)
+	}
+	p.src = AdjustBrightnessContrast(p.src, opts.Brightness, opts.Contrast)
+
+	if opts.ExactSize != (image.Point{}) {
+		resized := exactResize(p.src, opts.ExactSize, opts.ExactFit, opts.resampling())
+		if resized != p.src {
+			resized = AdaptiveSharpen(resized, opts.Sharpen)
+		}
+		p.src = resized
+	} else if opts.MaxWidth > 0 || opts.MaxHeight > 0 {
+		resized := smartResize(p.src, opts.MaxWidth, opts.MaxHeight, opts.AllowUpscale, opts.resampling())
+		if resized != p.src {
+			resized = AdaptiveSharpen(resized, opts.Sharpen)
+		}
+		p.src = resized
+	}
+	return p
+}
+
+// keeps16Bit reports whether img, oriented to size, is encoded at 16 bits
+// per Preserve16Bit. Resizing, pixel adjustments, and the target-size
+// engine work at 8 bits, so they rule it out.
+func (o *Options) keeps16Bit(img image.Image, size image.Point) bool {
+	if !o.Preserve16Bit || !is16Bit(img) {
+		return false
+	}
+	if o.TargetSize != 0 || o.TargetBPP != 0 || o.TargetRatio != 0 {
+		return false
+	}
+	if o.Denoise != 0 || o.AutoLevels || o.Brightness != 0 || o.Contrast != 0 {
+		return false
+	}
+	return o.ExactSize == (image.Point{}) && !o.AllowUpscale && fitsWithin(size.X, size.Y, o.MaxWidth, o.MaxHeight)
+}
+
+// compressPrepared finishes the pipeline for p, which prepareImage built
+// from img with opts. It does not modify p's images.
+func compressPrepared(ctx context.Context, img image.Image, meta inputMeta, p preparedImage, opts Options) (*Result, error) {
+	result := &Result{OriginalDimensions: p.oriented, SourceFormat: sourceFormat(meta.format)}
+	src := p.src
+
+	// Keep a full-depth copy for lossless 16-bit PNG output.
+	var wide image.Image
+	if opts.keeps16Bit(img, p.oriented) {
+		o := meta.orient
+		if !opts.AutoOrient {
+			o = OrientNormal
+		}
+		wide = orient16(img, o)
 	}
 
-	if opts.MaxWidth > 0 || opts.MaxHeight > 0 {
-		src = smartResize(src, opts.MaxWidth, opts.MaxHeight)
+	// JPEG has no alpha: composite over the background instead of letting
+	// transparent areas come out black.
+	if opts.Format == JPEG && !isOpaque(src) {
+		src = flattenAlpha(src, opts.background())
 	}
 	result.Image = src
 	result.FinalDimensions = image.Pt(src.Bounds().Dx(), src.Bounds().Dy())
+	if opts.FocusRegion != nil && result.FinalDimensions != result.OriginalDimensions {
+		focus := scaleRect(*opts.FocusRegion, result.OriginalDimensions, result.FinalDimensions)
+		opts.FocusRegion = &focus
+	}
 
 	if err := opts.reportProgress(ctx, StageCompressing, 0.2); err != nil {
 		return nil, err
 	}
 
+	exif := opts.exifToEmbed(meta)
+	if meta.data != nil && src == p.decoded {
+		// Rewrite the coefficients as they are. Files the transcoder
+		// can't handle (progressive, CMYK, ...) take the pixel path.
+		data, err := transcodeJPEG(meta.data)
+		if err != nil {
+			opts.logf("lossless JPEG: %v; re-encoding pixels", err)
+		} else {
+			opts.logf("lossless JPEG: %d → %d bytes", len(meta.data), len(data))
+			result.Format = JPEG
+			result.SSIM, result.TargetMet = 1.0, true
+			result.CompressedData = data
+			result.CompressedSize = int64(len(data))
+			result.computeStats()
+			return result, result.embedMetadata(exif, &opts)
+		}
+	}
+	if opts.TargetRatio > 0 {
+		if meta.size == 0 {
+			return nil, fmt.Errorf("%w: TargetRatio needs the encoded input size; use CompressFile or CompressBytes", ErrInvalidOptions)
+		}
+		opts.TargetSize = max(minTargetSize, int(float64(meta.size)/opts.TargetRatio))
+		opts.logf("target size: 1/%g of %d bytes is %d bytes", opts.TargetRatio, meta.size, opts.TargetSize)
+	}
+	if opts.TargetBPP > 0 {
+		w, h := src.Bounds().Dx(), src.Bounds().Dy()
+		opts.TargetSize = max(minTargetSize, int(opts.TargetBPP*float64(w)*float64(h)/8))
+		opts.logf("target size: %.3f bpp at %dx%d is %d bytes", opts.TargetBPP, w, h, opts.TargetSize)
+	}
+	// skipped is a target so large that even the raw pixels fit: it can't
+	// steer anything, so the quality search runs and the output is only
+	// checked against it.
+	var skipped int
+	if opts.TargetSize >= len(src.Pix) {
+		opts.logf("target size: %d bytes is at least the uncompressed %d; using quality mode", opts.TargetSize, len(src.Pix))
+		skipped, opts.TargetSize = opts.TargetSize, 0
+	}
 	if opts.TargetSize > 0 {
-		return handleTargetSizeMode(ctx, src, opts, result)
+		target := opts.TargetSize
+		// Leave room for the EXIF segment, comment, and density added
+		// after encoding.
+		opts.TargetSize -= jpegSegmentSize(exif) + opts.commentSize() + opts.densitySize()
+		if opts.TargetSize < 1 {
+			opts.TargetSize = 1
+		}
+		result, err := handleTargetSizeMode(ctx, src, opts, result)
+		if err != nil {
+			return nil, err
+		}
+		if err := result.interlace(&opts, opts.TargetSize); err != nil {
+			return nil, err
+		}
+		if err := result.embedMetadata(exif, &opts); err != nil {
+			return nil, err
+		}
+		result.TargetMet = result.CompressedSize <= int64(target)
+		if opts.StrictTargetSize && !result.TargetMet {
+			return nil, fmt.Errorf("%w: best result is %d bytes, target %d",
+				ErrTargetUnreachable, result.CompressedSize, target)
+		}
+		return result, nil
 	}
-	return handleStandardMode(ctx, src, opts, result)
+	result, err := handleStandardMode(ctx, src, wide, opts, result)
+	if err != nil {
+		return nil, err
+	}
+	if err := result.interlace(&opts, 0); err != nil {
+		return nil, err
+	}
+	if err := result.embedMetadata(exif, &opts); err != nil {
+		return nil, err
+	}
+	if skipped > 0 {
+		result.TargetMet = result.CompressedSize <= int64(skipped)
+		if opts.StrictTargetSize && !result.TargetMet {
+			return nil, fmt.Errorf("%w: best result is %d bytes, target %d",
+				ErrTargetUnreachable, result.CompressedSize, skipped)
+		}
+	}
+	return result, nil
+}
+
+// interlace rewrites PNG output with Adam7 interlacing if opts.InterlacePNG
+// is set. A positive limit is the target-size budget: output that fits it
+// is left non-interlaced if interlacing would make it overflow.
+func (r *Result) interlace(opts *Options, limit int) error {
+	if !opts.InterlacePNG || r.Format != PNG {
+		return nil
+	}
+	data, err := interlacePNG(r.CompressedData)
+	if err != nil {
+		return err
+	}
+	if limit > 0 && len(data) > limit && len(r.CompressedData) <= limit {
+		opts.logf("interlace: %d → %d bytes overflows the %d-byte target; keeping non-interlaced output", len(r.CompressedData), len(data), limit)
+		return nil
+	}
+	opts.logf("interlace: %d → %d bytes", len(r.CompressedData), len(data))
+	r.CompressedData = data
+	r.CompressedSize = int64(len(data))
+	r.computeStats()
+	return nil
+}
+
+// embedMetadata adds the JPEGComment, if any, the EXIF APP1 segment
+// (JPEG only, nil for none), and the DPI density to the encoded output.
+// The JFIF header goes in last so it ends up directly after SOI, followed
+// by EXIF, as readers expect. GIF output carries none of them.
+func (r *Result) embedMetadata(exif []byte, opts *Options) error {
+	if r.Format == GIF {
+		return nil
+	}
+	if r.Format != JPEG {
+		exif = nil
+	}
+	if exif == nil && opts.JPEGComment == "" && opts.DPI == 0 {
+		return nil
+	}
+
+	data := r.CompressedData
+	var err error
+	switch {
+	case opts.JPEGComment == "":
+	case r.Format == JPEG:
+		data, err = insertJPEGSegment(data, 0xFE, []byte(opts.JPEGComment))
+	default:
+		text := append([]byte(opts.commentKeyword()+"\x00"), opts.JPEGComment...)
+		data, err = insertPNGChunk(data, "tEXt", text)
+	}
+	if err != nil {
+		return err
+	}
+	if exif != nil {
+		if data, err = insertJPEGSegment(data, 0xE1, exif); err != nil {
+			return err
+		}
+	}
+	switch {
+	case opts.DPI == 0:
+	case r.Format == JPEG:
+		data, err = setJPEGDensity(data, opts.DPI)
+	default:
+		data, err = insertPNGChunk(data, "pHYs", physChunk(opts.DPI))
+	}
+	if err != nil {
+		return err
+	}
+	r.CompressedData = data
+	r.CompressedSize = int64(len(data))
+	r.computeStats()
+	return nil
 }
 
 func handleTargetSizeMode(ctx context.Context, src *image.NRGBA, opts Options, result *Result) (*Result, error) {
@@ -150,18 +720,23 @@ func handleTargetSizeMode(ctx context.Context, src *image.NRGBA, opts Options, r
 	result.Format = sr.format
 	result.JPEGQuality = sr.quality
 	result.SSIM = sr.ssim
-	result.FinalDimensions = image.Pt(sr.finalW, sr.finalH)
-	if sr.img != nil {
-		result.Image = sr.img
-	}
+	result.Strategy = sr.strategy
+	// Every strategy reports the pixels it encoded, so Result.Image and
+	// FinalDimensions describe the output even when it was downscaled or
+	// quantized.
+	result.Image = sr.img
+	result.FinalDimensions = sr.img.Bounds().Size()
 	result.CompressedSize = int64(len(sr.data))
 	result.computeStats()
 	return result, nil
 }
 
-func handleStandardMode(ctx context.Context, src *image.NRGBA, opts Options, result *Result) (*Result, error) {
+// handleStandardMode runs quality-based compression. wide, if non-nil, is
+// the 16-bit version of src and is encoded instead when the output is PNG.
+func handleStandardMode(ctx context.Context, src *image.NRGBA, wide image.Image, opts Options, result *Result) (*Result, error) {
 	if opts.Format == Auto {
-		opts.Format = analyzeFormat(src)
+		opts.Format = analyzeFormat(src, opts.AnalysisSamples)
+		opts.logf("format: Auto chose %v", opts.Format)
 	}
 	result.Format = opts.Format
 
@@ -172,25 +747,58 @@ func handleStandardMode(ctx context.Context, src *image.NRGBA, opts Options, res
 	var compressed encodingBuffer
 	switch opts.Format {
 	case PNG:
-		if err := compressPNG(src, &compressed, opts); err != nil {
+		if wide != nil {
+			if err := compressPNG16(wide, &compressed); err != nil {
+				return nil, fmt.Errorf("fennec: PNG compression: %w", err)
+			}
+			result.SSIM, result.TargetMet = 1.0, true
+			break
+		}
+		ssim, err := compressPNG(src, &compressed, opts)
+		if err != nil {
 			return nil, fmt.Errorf("fennec: PNG compression: %w", err)
 		}
-		result.SSIM = 1.0
+		// PNG has no SSIM target: LossyPNG's palette size is the preset's.
+		result.SSIM, result.TargetMet = ssim, true
 	case JPEG:
+		if opts.ContentAware {
+			src = contentAwareSmooth(src, opts.scratch)
+			result.Image = src
+		}
 		target := opts.Quality.targetSSIM()
+		if opts.UseMSSSIM {
+			target = opts.Quality.targetMSSSIM()
+		}
 		if opts.TargetSSIM > 0 && opts.TargetSSIM <= 1.0 {
 			target = opts.TargetSSIM
 		}
 
-		q, ssim, cachedData, err := compressJPEGOptimal(src, &compressed, target, opts)
+		var trace *[]QualityProbe
+		if opts.CollectTrace {
+			trace = &result.Trace
+		}
+		q, ssim, cachedData, err := compressJPEGOptimal(src, &compressed, target, opts, trace)
 		if err != nil {
 			return nil, fmt.Errorf("fennec: JPEG compression: %w", err)
 		}
 		result.JPEGQuality, result.SSIM = q, ssim
+		result.TargetSSIM = target
+		if target >= 1.0 {
+			// compressJPEGOptimal searches for 0.999 instead.
+			result.TargetSSIM = 0.999
+		}
+		result.TargetMet = ssim >= result.TargetSSIM
 		if cachedData != nil {
 			compressed.Reset()
 			compressed.Write(cachedData)
 		}
+	case GIF:
+		ssim, err := compressGIF(src, &compressed, opts)
+		if err != nil {
+			return nil, fmt.Errorf("fennec: GIF compression: %w", err)
+		}
+		// Like PNG, GIF has no SSIM target: its palette size is the preset's.
+		result.SSIM, result.TargetMet = ssim, true
 	default:
 		return nil, ErrUnsupportedFormat
 	}
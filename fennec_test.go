@@ -3,16 +3,28 @@ package fennec
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"image"
 	"image/color"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
+	"io/fs"
 	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
 // ── Test Helpers ────────────────────────────────────────────────────────────
@@ -75,6 +87,19 @@ func makeStripedImage(w, h, stripeWidth int) *image.NRGBA {
 	return img
 }
 
+// writeTestJPEG encodes img as a high-quality JPEG at path.
+func writeTestJPEG(t *testing.T, path string, img image.Image) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := jpeg.Encode(f, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func ctx() context.Context { return context.Background() }
 
 // ── SSIM Tests ──────────────────────────────────────────────────────────────
@@ -120,6 +145,53 @@ func TestSSIMFast(t *testing.T) {
 	}
 }
 
+func TestSSIMFastProgressiveDownsample(t *testing.T) {
+	// A smooth 8000px image and a copy with fine vertical ringing, the kind
+	// of detail a single wide box pass smears away.
+	const w, h = 8000, 800
+	clean := image.NewNRGBA(image.Rect(0, 0, w, h))
+	ringing := image.NewNRGBA(clean.Rect)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(128 + 60*math.Sin(float64(x)/37)*math.Cos(float64(y)/23))
+			r := v - 10
+			if x%3 == 0 {
+				r = v + 20
+			}
+			off := y*clean.Stride + x*4
+			copy(clean.Pix[off:], []uint8{v, v, v, 255})
+			copy(ringing.Pix[off:], []uint8{r, r, r, 255})
+		}
+	}
+
+	if got := SSIMFast(clean, clean); got < 0.9999 {
+		t.Fatalf("identical images: SSIMFast = %f", got)
+	}
+	progressive := SSIMFast(clean, ringing)
+	sw, sh := 512, 51 // SSIMFast's working size for 8000x800
+	single := windowedSSIM(toLuminance(boxDownsample(clean, sw, sh), nil), toLuminance(boxDownsample(ringing, sw, sh), nil), sw, sh)
+	if progressive >= 1 || progressive > single {
+		t.Fatalf("progressive SSIM %.5f should flag the artifacts at least as strongly as a single pass (%.5f)",
+			progressive, single)
+	}
+}
+
+func TestSSIMRefMatchesSSIMFast(t *testing.T) {
+	for _, size := range []int{4, 100, 700} {
+		a := makeTestImage(size, size)
+		b := makeNoisyImage(size, size)
+		want := SSIMFast(a, b)
+
+		ref := newSSIMRef(a, new(scratch))
+		for i := 0; i < 2; i++ { // reuse must not change the result
+			if got := ref.compare(b); got != want {
+				t.Fatalf("%dpx: ref.compare = %f, SSIMFast = %f", size, got, want)
+			}
+		}
+		ref.release()
+	}
+}
+
 func TestSSIMSmallImage(t *testing.T) {
 	img := makeTestImage(4, 4)
 	ssim := SSIM(img, img)
@@ -128,6 +200,120 @@ func TestSSIMSmallImage(t *testing.T) {
 	}
 }
 
+func TestSSIMColor(t *testing.T) {
+	for _, size := range []int{4, 64} {
+		gray := image.NewNRGBA(image.Rect(0, 0, size, size))
+		tinted := image.NewNRGBA(image.Rect(0, 0, size, size))
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				v := uint8(60 + (x*7+y*3)%120)
+				i := gray.PixOffset(x, y)
+				copy(gray.Pix[i:i+4], []uint8{v, v, v, 255})
+				// Shift hue in a checkerboard at (near) constant luma:
+				// 0.299·20 − 0.587·14 + 0.114·20 ≈ 0.
+				if (x/2+y/2)%2 == 0 {
+					copy(tinted.Pix[i:i+4], []uint8{v + 20, v - 14, v + 20, 255})
+				} else {
+					copy(tinted.Pix[i:i+4], []uint8{v, v, v, 255})
+				}
+			}
+		}
+
+		if got := SSIMColor(gray, gray); got < 0.999 {
+			t.Fatalf("%dpx: SSIMColor of identical images = %f, want ~1.0", size, got)
+		}
+		luma := SSIM(gray, tinted)
+		chroma := SSIMColor(gray, tinted)
+		if luma < 0.98 {
+			t.Fatalf("%dpx: SSIM should ignore an equal-luma hue shift, got %f", size, luma)
+		}
+		if chroma > luma-0.05 {
+			t.Fatalf("%dpx: SSIMColor = %f should be well below SSIM = %f", size, chroma, luma)
+		}
+	}
+}
+
+func TestCompareIdentical(t *testing.T) {
+	img := makeTestImage(64, 64)
+	cr := Compare(img, img)
+	if !cr.Identical || cr.MaxDelta != 0 {
+		t.Fatalf("identical images: got Identical=%v MaxDelta=%d", cr.Identical, cr.MaxDelta)
+	}
+	if !math.IsInf(cr.PSNR, 1) {
+		t.Fatalf("PSNR of identical images should be +Inf, got %f", cr.PSNR)
+	}
+	if cr.SSIM < 0.999 {
+		t.Fatalf("SSIM of identical images should be ~1.0, got %f", cr.SSIM)
+	}
+}
+
+func TestCompareDelta(t *testing.T) {
+	img := makeTestImage(64, 64)
+	modified := image.NewNRGBA(img.Bounds())
+	copy(modified.Pix, img.Pix)
+	modified.Pix[3] = 200 // alpha-only change
+
+	cr := Compare(img, modified)
+	if cr.Identical {
+		t.Fatal("alpha difference should not be Identical")
+	}
+	if cr.MaxDelta != 55 {
+		t.Fatalf("MaxDelta = %d, want 55", cr.MaxDelta)
+	}
+	if math.IsInf(cr.PSNR, 1) || cr.PSNR < 40 {
+		t.Fatalf("PSNR for a single-channel change should be finite and high, got %f", cr.PSNR)
+	}
+}
+
+func TestCompareSizeMismatch(t *testing.T) {
+	a := makeSolidImage(64, 64, color.NRGBA{10, 20, 30, 255})
+	b := makeSolidImage(32, 32, color.NRGBA{10, 20, 30, 255})
+	cr := Compare(a, b)
+	if cr.Identical {
+		t.Fatal("images of different sizes should never be Identical")
+	}
+	if cr.SSIM < 0.99 {
+		t.Fatalf("solid images of the same colour should be similar, got SSIM %f", cr.SSIM)
+	}
+}
+
+func TestPSNR(t *testing.T) {
+	black := makeSolidImage(16, 16, color.NRGBA{0, 0, 0, 255})
+	white := makeSolidImage(16, 16, color.NRGBA{255, 255, 255, 255})
+	// RGB differ by 255, alpha matches: MSE = 255²·3/4.
+	want := 10 * math.Log10(4.0/3.0)
+	if got := PSNR(black, white); math.Abs(got-want) > 1e-9 {
+		t.Fatalf("PSNR = %f, want %f", got, want)
+	}
+}
+
+func TestSSIMFiles(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.jpg")
+	b := filepath.Join(dir, "b.jpg")
+	small := filepath.Join(dir, "small.jpg")
+	img := makeTestImage(64, 64)
+	writeTestJPEG(t, a, img)
+	writeTestJPEG(t, b, img)
+	writeTestJPEG(t, small, makeTestImage(32, 32))
+
+	ssim, err := SSIMFiles(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssim < 0.999 {
+		t.Fatalf("SSIM of identical files should be ~1.0, got %f", ssim)
+	}
+
+	if _, err := SSIMFiles(a, small); err != nil {
+		t.Fatalf("differing dimensions should be resized, got error: %v", err)
+	}
+
+	if _, err := SSIMFiles(a, filepath.Join(dir, "missing.jpg")); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
+
 func TestMSSSIM(t *testing.T) {
 	img := makeTestImage(128, 128)
 	msssim := MSSSIM(img, img)
@@ -207,695 +393,5447 @@ func TestCompressImagePNG(t *testing.T) {
 	}
 }
 
-func TestCompressAutoFormat(t *testing.T) {
-	opaqueImg := makeTestImage(200, 200)
+func TestCompressImageLossyPNG(t *testing.T) {
+	// Add deterministic noise so the image has many colors and poor
+	// lossless compression, like a photograph.
+	img := makeTestImage(200, 200)
+	seed := uint32(1)
+	for i := 0; i < len(img.Pix); i += 4 {
+		seed = seed*1664525 + 1013904223
+		n := uint8(seed >> 28)
+		img.Pix[i] += n
+		img.Pix[i+1] += n / 2
+	}
 	opts := DefaultOptions()
-	opts.Format = Auto
+	opts.Format = PNG
 
-	result, err := CompressImage(ctx(), opaqueImg, opts)
+	lossless, err := CompressImage(ctx(), img, opts)
 	if err != nil {
 		t.Fatalf("CompressImage failed: %v", err)
 	}
-	if result.Format != JPEG {
-		t.Fatalf("expected JPEG for opaque gradient, got %v", result.Format)
+
+	opts.LossyPNG = true
+	lossy, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if lossy.Format != PNG {
+		t.Fatalf("expected PNG format, got %v", lossy.Format)
+	}
+	if lossy.CompressedSize >= lossless.CompressedSize {
+		t.Fatalf("lossy PNG (%d bytes) should be smaller than lossless (%d bytes)",
+			lossy.CompressedSize, lossless.CompressedSize)
+	}
+	if lossy.SSIM >= 1.0 || lossy.SSIM < 0.8 {
+		t.Fatalf("lossy PNG SSIM should be high but below 1.0, got %f", lossy.SSIM)
+	}
+	decoded, err := png.Decode(bytes.NewReader(lossy.CompressedData))
+	if err != nil {
+		t.Fatalf("lossy output is not valid PNG: %v", err)
+	}
+	if _, ok := decoded.(*image.Paletted); !ok {
+		t.Fatalf("expected paletted PNG, got %T", decoded)
 	}
 
-	alphaImg := makeTestImageWithAlpha(100, 100)
-	result, err = CompressImage(ctx(), alphaImg, opts)
+	// The Lossless preset always wins over LossyPNG.
+	opts.Quality = Lossless
+	exact, err := CompressImage(ctx(), img, opts)
 	if err != nil {
 		t.Fatalf("CompressImage failed: %v", err)
 	}
-	if result.Format != PNG {
-		t.Fatalf("expected PNG for transparent image, got %v", result.Format)
+	if exact.SSIM != 1.0 {
+		t.Fatalf("Lossless preset should ignore LossyPNG, SSIM: %f", exact.SSIM)
 	}
 }
 
-func TestCompressQualityPresets(t *testing.T) {
+func TestCompressImageLossyPNGPresets(t *testing.T) {
 	img := makeTestImage(200, 200)
+	seed := uint32(7)
+	for i := 0; i < len(img.Pix); i += 4 {
+		seed = seed*1664525 + 1013904223
+		img.Pix[i+2] += uint8(seed >> 27)
+	}
+	opts := DefaultOptions()
+	opts.Format = PNG
+	opts.LossyPNG = true
 
-	presets := []Quality{Ultra, High, Balanced, Aggressive, Maximum}
-	var prevSSIM float64 = 2.0
-
-	for _, preset := range presets {
-		opts := DefaultOptions()
-		opts.Format = JPEG
-		opts.Quality = preset
-
+	encode := func(q Quality) (*Result, *image.Paletted) {
+		t.Helper()
+		opts.Quality = q
 		result, err := CompressImage(ctx(), img, opts)
 		if err != nil {
-			t.Fatalf("CompressImage (%s) failed: %v", preset, err)
+			t.Fatalf("%v: CompressImage failed: %v", q, err)
 		}
-
-		target := preset.targetSSIM()
-		if result.SSIM < target-0.02 {
-			t.Fatalf("%s: SSIM %f below target %f", preset, result.SSIM, target)
+		decoded, err := png.Decode(bytes.NewReader(result.CompressedData))
+		if err != nil {
+			t.Fatalf("%v: invalid PNG: %v", q, err)
 		}
+		p, ok := decoded.(*image.Paletted)
+		if !ok {
+			t.Fatalf("%v: expected paletted PNG, got %T", q, decoded)
+		}
+		return result, p
+	}
 
-		if result.SSIM > prevSSIM+0.01 {
-			t.Logf("Warning: %s SSIM (%f) higher than previous (%f)", preset, result.SSIM, prevSSIM)
+	high, highImg := encode(High)
+	maximum, maxImg := encode(Maximum)
+	if len(highImg.Palette) > 256 || len(maxImg.Palette) > 32 {
+		t.Fatalf("palette sizes: High %d (max 256), Maximum %d (max 32)",
+			len(highImg.Palette), len(maxImg.Palette))
+	}
+	if maximum.CompressedSize >= high.CompressedSize {
+		t.Fatalf("Maximum (%d bytes) should be smaller than High (%d bytes)",
+			maximum.CompressedSize, high.CompressedSize)
+	}
+	if maximum.SSIM > high.SSIM {
+		t.Fatalf("Maximum SSIM %.4f should not exceed High %.4f", maximum.SSIM, high.SSIM)
+	}
+}
+
+func TestKeeps16Bit(t *testing.T) {
+	wide := image.NewGray16(image.Rect(0, 0, 64, 48))
+	size := image.Pt(64, 48)
+	for _, tc := range []struct {
+		name string
+		set  func(*Options)
+		want bool
+	}{
+		{"plain", func(*Options) {}, true},
+		{"lossy PNG", func(o *Options) { o.LossyPNG = true }, true},
+		{"fits MaxWidth", func(o *Options) { o.MaxWidth = 64 }, true},
+		{"resize", func(o *Options) { o.MaxWidth = 32 }, false},
+		{"ExactSize", func(o *Options) { o.ExactSize = size }, false},
+		{"AllowUpscale", func(o *Options) { o.AllowUpscale = true }, false},
+		{"TargetSize", func(o *Options) { o.TargetSize = 10000 }, false},
+		{"AutoLevels", func(o *Options) { o.AutoLevels = true }, false},
+		{"off", func(o *Options) { o.Preserve16Bit = false }, false},
+	} {
+		opts := DefaultOptions()
+		opts.Preserve16Bit = true
+		tc.set(&opts)
+		if got := opts.keeps16Bit(wide, size); got != tc.want {
+			t.Errorf("%s: keeps16Bit = %v, want %v", tc.name, got, tc.want)
 		}
-		prevSSIM = result.SSIM
+	}
+	opts := DefaultOptions()
+	opts.Preserve16Bit = true
+	if opts.keeps16Bit(makeTestImage(64, 48), size) {
+		t.Error("8-bit input should not keep 16 bits")
 	}
 }
 
-func TestCompressWithResize(t *testing.T) {
-	img := makeTestImage(1000, 800)
+func TestCompressImagePreserve16Bit(t *testing.T) {
+	gray := image.NewGray16(image.Rect(0, 0, 64, 64))
+	for i := 0; i < len(gray.Pix); i += 2 {
+		v := uint16(i * 37)
+		gray.Pix[i], gray.Pix[i+1] = uint8(v>>8), uint8(v)
+	}
 	opts := DefaultOptions()
-	opts.Format = JPEG
-	opts.MaxWidth = 500
-	opts.MaxHeight = 500
+	opts.Format = PNG
 
-	result, err := CompressImage(ctx(), img, opts)
+	result, err := CompressImage(ctx(), gray, opts)
 	if err != nil {
 		t.Fatalf("CompressImage failed: %v", err)
 	}
-
-	if result.FinalDimensions.X > 500 || result.FinalDimensions.Y > 500 {
-		t.Fatalf("image not resized: %dx%d", result.FinalDimensions.X, result.FinalDimensions.Y)
+	decoded, err := png.Decode(bytes.NewReader(result.CompressedData))
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	originalRatio := 1000.0 / 800.0
-	newRatio := float64(result.FinalDimensions.X) / float64(result.FinalDimensions.Y)
-	if math.Abs(originalRatio-newRatio) > 0.02 {
-		t.Fatalf("aspect ratio not preserved: original %f, new %f", originalRatio, newRatio)
+	if is16Bit(decoded) {
+		t.Fatalf("default path should write 8-bit PNG, got %T", decoded)
 	}
-}
-
-func TestCompressTargetSize(t *testing.T) {
-	img := makeTestImage(300, 300)
-	opts := DefaultOptions()
-	opts.Format = JPEG
-	opts.TargetSize = 5000
 
-	result, err := CompressImage(ctx(), img, opts)
+	opts.Preserve16Bit = true
+	result, err = CompressImage(ctx(), gray, opts)
 	if err != nil {
 		t.Fatalf("CompressImage failed: %v", err)
 	}
+	decoded, err = png.Decode(bytes.NewReader(result.CompressedData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := decoded.(*image.Gray16)
+	if !ok {
+		t.Fatalf("expected *image.Gray16, got %T", decoded)
+	}
+	if !bytes.Equal(got.Pix, gray.Pix) {
+		t.Fatal("16-bit samples were not preserved")
+	}
+	if result.SSIM != 1.0 || result.Image == nil {
+		t.Fatalf("expected lossless result with 8-bit preview, got SSIM %f", result.SSIM)
+	}
 
-	if result.CompressedSize > int64(opts.TargetSize)*2 {
-		t.Fatalf("compressed size %d far exceeds target %d", result.CompressedSize, opts.TargetSize)
+	rgba := image.NewNRGBA64(image.Rect(0, 0, 32, 32))
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(i * 7)
+	}
+	result, err = CompressImage(ctx(), rgba, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	decoded, err = png.Decode(bytes.NewReader(result.CompressedData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := decoded.(*image.NRGBA64); !ok || !bytes.Equal(n.Pix, rgba.Pix) {
+		t.Fatalf("NRGBA64 samples were not preserved (%T)", decoded)
 	}
-}
 
-func TestCompressNilImage(t *testing.T) {
-	_, err := CompressImage(ctx(), nil, DefaultOptions())
-	if err == nil {
-		t.Fatal("should error on nil image")
+	// Resizing happens at 8 bits, so it disables the 16-bit path.
+	opts.MaxWidth = 16
+	result, err = CompressImage(ctx(), gray, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
 	}
-	if !errors.Is(err, ErrNilImage) {
-		t.Fatalf("expected ErrNilImage, got %v", err)
+	if result.FinalDimensions.X != 16 {
+		t.Fatalf("expected resize to 16px, got %d", result.FinalDimensions.X)
 	}
 }
 
-func TestCompressEmptyImage(t *testing.T) {
-	img := image.NewNRGBA(image.Rect(0, 0, 0, 0))
-	_, err := CompressImage(ctx(), img, DefaultOptions())
-	if err == nil {
-		t.Fatal("should error on empty image")
+func TestInterlacePNG(t *testing.T) {
+	grayRamp := image.NewNRGBA(image.Rect(0, 0, 45, 31))
+	for i := 0; i < len(grayRamp.Pix); i += 4 {
+		v := uint8(i * 13 / 4)
+		grayRamp.Pix[i], grayRamp.Pix[i+1], grayRamp.Pix[i+2], grayRamp.Pix[i+3] = v, v, v, 255
 	}
-	if !errors.Is(err, ErrEmptyImage) {
-		t.Fatalf("expected ErrEmptyImage, got %v", err)
+	fewColors := func(n int) *image.NRGBA {
+		img := image.NewNRGBA(image.Rect(0, 0, 37, 23))
+		for i := 0; i < len(img.Pix); i += 4 {
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = uint8(i/4*7%n*40), 90, 0, 255
+		}
+		return img
+	}
+	wide := image.NewNRGBA64(image.Rect(0, 0, 19, 11))
+	for i := range wide.Pix {
+		wide.Pix[i] = uint8(i * 7)
 	}
-}
 
-// ── Sentinel Error Tests ────────────────────────────────────────────────────
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"rgb", makeNoisyImage(67, 45)},
+		{"alpha", makeTestImageWithAlpha(50, 41)},
+		{"gray", grayRamp},
+		{"1-bit palette", fewColors(2)},
+		{"2-bit palette", fewColors(3)},
+		{"4-bit palette", fewColors(16)},
+		{"16-bit", wide},
+		{"1x1", makeSolidImage(1, 1, color.NRGBA{200, 10, 10, 255})},
+		{"3x2", makeNoisyImage(3, 2)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Format = PNG
+			opts.Preserve16Bit = true
+			plain, err := CompressImage(ctx(), tc.img, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.InterlacePNG = true
+			interlaced, err := CompressImage(ctx(), tc.img, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := interlaced.CompressedData[len(pngSignature)+8+12]; got != 1 {
+				t.Fatalf("IHDR interlace method = %d, want 1 (Adam7)", got)
+			}
+			if interlaced.SSIM != 1.0 || interlaced.CompressedSize != int64(len(interlaced.CompressedData)) {
+				t.Errorf("SSIM %v, CompressedSize %d for %d bytes", interlaced.SSIM, interlaced.CompressedSize, len(interlaced.CompressedData))
+			}
 
-func TestErrNoCompressedData(t *testing.T) {
-	r := &Result{}
-	var buf bytes.Buffer
-	_, err := r.WriteTo(&buf)
-	if !errors.Is(err, ErrNoCompressedData) {
-		t.Fatalf("expected ErrNoCompressedData, got %v", err)
+			want, err := png.Decode(bytes.NewReader(plain.CompressedData))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := png.Decode(bytes.NewReader(interlaced.CompressedData))
+			if err != nil {
+				t.Fatalf("interlaced output doesn't decode: %v", err)
+			}
+			if fmt.Sprintf("%T", got) != fmt.Sprintf("%T", want) || got.Bounds() != want.Bounds() {
+				t.Fatalf("decoded %T %v, want %T %v", got, got.Bounds(), want, want.Bounds())
+			}
+			b := want.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					if got.At(x, y) != want.At(x, y) {
+						t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got.At(x, y), want.At(x, y))
+					}
+				}
+			}
+		})
 	}
-}
 
-func TestErrUnsupportedFormat(t *testing.T) {
-	img := makeTestImage(100, 100)
+	// Encode honors the option too, and metadata still lands after IHDR.
 	var buf bytes.Buffer
-	err := Encode(&buf, img, Format(99), DefaultOptions())
-	if !errors.Is(err, ErrUnsupportedFormat) {
-		t.Fatalf("expected ErrUnsupportedFormat, got %v", err)
+	opts := DefaultOptions()
+	opts.InterlacePNG = true
+	if err := Encode(&buf, grayRamp, PNG, opts); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Bytes()[len(pngSignature)+8+12] != 1 {
+		t.Error("Encode: output is not interlaced")
+	}
+	opts.Format = PNG
+	opts.DPI = 300
+	result, err := CompressImage(ctx(), grayRamp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testPNGChunk(result.CompressedData, "pHYs") == nil {
+		t.Error("pHYs chunk missing from interlaced output")
+	}
+	if _, err := png.Decode(bytes.NewReader(result.CompressedData)); err != nil {
+		t.Errorf("interlaced output with pHYs doesn't decode: %v", err)
 	}
 }
 
-// ── Options.Validate Tests ──────────────────────────────────────────────────
-
-func TestOptionsValidate(t *testing.T) {
-	t.Run("valid_defaults", func(t *testing.T) {
-		opts := DefaultOptions()
-		if err := opts.Validate(); err != nil {
-			t.Fatalf("DefaultOptions should be valid: %v", err)
+func TestGIF(t *testing.T) {
+	// Four colors fit the palette exactly, so GIF round-trips them.
+	fourColors := image.NewNRGBA(image.Rect(0, 0, 33, 21))
+	for i := 0; i < len(fourColors.Pix); i += 4 {
+		v := uint8(i / 4 * 5 % 4 * 80)
+		fourColors.Pix[i], fourColors.Pix[i+1], fourColors.Pix[i+2], fourColors.Pix[i+3] = v, 255-v, 40, 255
+	}
+	opts := DefaultOptions()
+	opts.Format = GIF
+	result, err := CompressImage(ctx(), fourColors, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Format != GIF || result.SSIM != 1.0 || !result.TargetMet {
+		t.Fatalf("got %v, SSIM %v, TargetMet %v; want GIF, 1.0, true", result.Format, result.SSIM, result.TargetMet)
+	}
+	if format, err := DetectFormat(result.CompressedData); format != GIF || err != nil {
+		t.Fatalf("DetectFormat: got %v, %v", format, err)
+	}
+	decoded, err := gif.Decode(bytes.NewReader(result.CompressedData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 21; y++ {
+		for x := 0; x < 33; x++ {
+			if got, want := color.NRGBAModel.Convert(decoded.At(x, y)), fourColors.NRGBAAt(x, y); got != want {
+				t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
 		}
-	})
+	}
 
-	t.Run("negative_target_ssim", func(t *testing.T) {
-		opts := DefaultOptions()
-		opts.TargetSSIM = -0.5
-		if err := opts.Validate(); err == nil {
-			t.Fatal("negative TargetSSIM should be invalid")
+	// Alpha becomes on or off at half coverage.
+	alpha := makeTestImageWithAlpha(40, 10)
+	var buf bytes.Buffer
+	if err := Encode(&buf, alpha, GIF, DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = gif.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 40; x++ {
+		_, _, _, a := decoded.At(x, 5).RGBA()
+		if want := alpha.NRGBAAt(x, 5).A >= 128; (a == 0xffff) != want || (a != 0 && a != 0xffff) {
+			t.Fatalf("x=%d: alpha %d, source %d", x, a>>8, alpha.NRGBAAt(x, 5).A)
 		}
-	})
+	}
 
-	t.Run("target_ssim_over_1", func(t *testing.T) {
-		opts := DefaultOptions()
-		opts.TargetSSIM = 1.5
-		if err := opts.Validate(); err == nil {
-			t.Fatal("TargetSSIM > 1.0 should be invalid")
-		}
-	})
+	// Save picks GIF from the extension, and Open reads it back.
+	path := filepath.Join(t.TempDir(), "out.gif")
+	if err := Save(fourColors, path, DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := Open(path); err != nil || img.Bounds() != fourColors.Bounds() {
+		t.Fatalf("Open: got %v, %v", img, err)
+	}
 
-	t.Run("negative_target_size", func(t *testing.T) {
-		opts := DefaultOptions()
-		opts.TargetSize = -100
-		if err := opts.Validate(); err == nil {
-			t.Fatal("negative TargetSize should be invalid")
-		}
-	})
+	// A target size quantizes to a GIF palette.
+	opts = DefaultOptions()
+	opts.Format = GIF
+	opts.TargetSize = 4 << 10
+	result, err = CompressImage(ctx(), makeNoisyImage(64, 64), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Format != GIF || result.CompressedSize > int64(opts.TargetSize) || result.Strategy != "quantize-gif" {
+		t.Fatalf("got %v, %d bytes, strategy %q; want GIF under %d, quantize-gif",
+			result.Format, result.CompressedSize, result.Strategy, opts.TargetSize)
+	}
+	if _, err := gif.Decode(bytes.NewReader(result.CompressedData)); err != nil {
+		t.Fatal(err)
+	}
 
-	t.Run("negative_max_width", func(t *testing.T) {
-		opts := DefaultOptions()
-		opts.MaxWidth = -1
-		if err := opts.Validate(); err == nil {
-			t.Fatal("negative MaxWidth should be invalid")
-		}
-	})
+	var f Format
+	if err := json.Unmarshal([]byte(`"GIF"`), &f); err != nil || f != GIF {
+		t.Fatalf("Unmarshal: got %v, %v", f, err)
+	}
+}
 
-	t.Run("valid_custom", func(t *testing.T) {
-		opts := Options{
-			Quality:    High,
-			TargetSSIM: 0.98,
-			MaxWidth:   1920,
-			MaxHeight:  1080,
+func TestCompressTiled(t *testing.T) {
+	encode := func(img image.Image) []byte {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
 		}
-		if err := opts.Validate(); err != nil {
-			t.Fatalf("valid custom options should pass: %v", err)
+		return buf.Bytes()
+	}
+	decode := func(data []byte) *image.NRGBA {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("output doesn't decode: %v", err)
 		}
-	})
-}
-
-func TestCompressInvalidOptions(t *testing.T) {
-	img := makeTestImage(100, 100)
-	opts := DefaultOptions()
-	opts.TargetSSIM = -1
-	_, err := CompressImage(ctx(), img, opts)
-	if err == nil {
-		t.Fatal("should reject invalid options")
+		return toNRGBA(img)
 	}
-}
 
-// ── Context Cancellation Tests ──────────────────────────────────────────────
-
-func TestCompressContextCancelled(t *testing.T) {
-	img := makeTestImage(200, 200)
-	cancelledCtx, cancel := context.WithCancel(context.Background())
-	cancel() // Cancel immediately.
-
-	_, err := CompressImage(cancelledCtx, img, DefaultOptions())
-	if err == nil {
-		t.Fatal("should error on cancelled context")
+	gray16 := image.NewGray16(image.Rect(0, 0, 23, 17))
+	for i := range gray16.Pix {
+		gray16.Pix[i] = uint8(i * 37)
 	}
-}
-
-// ── CompressBytes Test ──────────────────────────────────────────────────────
-
-func TestCompressBytes(t *testing.T) {
-	img := makeTestImage(100, 100)
-	var buf bytes.Buffer
-	jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
-
-	result, err := CompressBytes(ctx(), buf.Bytes(), DefaultOptions())
+	twoColors := image.NewPaletted(image.Rect(0, 0, 29, 13), color.Palette{color.Black, color.White})
+	for i := range twoColors.Pix {
+		twoColors.Pix[i] = uint8(i % 3 % 2)
+	}
+	sixteen := image.NewPaletted(image.Rect(0, 0, 31, 11), nil)
+	for i := range 16 {
+		sixteen.Palette = append(sixteen.Palette, color.NRGBA{uint8(i * 16), 80, 200, uint8(i * 17)})
+	}
+	for i := range sixteen.Pix {
+		sixteen.Pix[i] = uint8(i * 7 % 16)
+	}
+	interlaced, err := interlacePNG(encode(makeNoisyImage(33, 21)))
 	if err != nil {
-		t.Fatalf("CompressBytes failed: %v", err)
+		t.Fatal(err)
 	}
-	if len(result.CompressedData) == 0 {
-		t.Fatal("CompressedData should not be empty")
+	var jpg bytes.Buffer
+	jpeg.Encode(&jpg, makeTestImage(40, 30), nil)
+
+	// Without a resize the pixels, color type, and bit depth are kept.
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		source Format
+	}{
+		{"gray", encode(toGray(makeTestImage(37, 19))), PNG},
+		{"gray16", encode(gray16), PNG},
+		{"1-bit palette", encode(twoColors), PNG},
+		{"4-bit palette with alpha", encode(sixteen), PNG},
+		{"rgb", encode(makeNoisyImage(41, 27)), PNG},
+		{"rgba", encode(makeTestImageWithAlpha(41, 27)), PNG},
+		{"interlaced", interlaced, PNG},
+		{"jpeg", jpg.Bytes(), JPEG},
+	} {
+		var out bytes.Buffer
+		result, err := CompressTiled(ctx(), bytes.NewReader(tc.data), &out, DefaultOptions())
+		if err != nil {
+			t.Fatalf("%s: CompressTiled failed: %v", tc.name, err)
+		}
+		want := decode(tc.data)
+		if got := decode(out.Bytes()); !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("%s: pixels differ from the input", tc.name)
+		}
+		if tc.source == PNG && tc.name != "interlaced" && !bytes.Equal(out.Bytes()[24:26], tc.data[24:26]) {
+			t.Errorf("%s: bit depth and color type %v, want %v", tc.name, out.Bytes()[24:26], tc.data[24:26])
+		}
+		size := want.Bounds().Size()
+		if result.Format != PNG || result.SourceFormat != tc.source || result.OriginalSize != int64(len(tc.data)) ||
+			result.CompressedSize != int64(out.Len()) || result.FinalDimensions != size || result.OriginalDimensions != size {
+			t.Errorf("%s: result %+v", tc.name, result)
+		}
 	}
-}
 
-// ── Compress from io.Reader ─────────────────────────────────────────────────
+	// Resizing in strips matches resizing the whole image.
+	for _, tc := range []struct {
+		name string
+		img  *image.NRGBA
+		rs   resampling
+	}{
+		{"rgb", makeNoisyImage(150, 97), resampling{}},
+		{"alpha", makeTestImageWithAlpha(150, 97), resampling{}},
+		{"straight", makeTestImageWithAlpha(150, 97), resampling{straight: true}},
+		{"linear mitchell", makeNoisyImage(150, 97), resampling{linear: true, filter: Mitchell}},
+	} {
+		opts := Options{MaxWidth: 61, StraightAlpha: tc.rs.straight, LinearResize: tc.rs.linear, ResizeFilter: tc.rs.filter}
+		var out bytes.Buffer
+		result, err := CompressTiled(ctx(), bytes.NewReader(encode(tc.img)), &out, opts)
+		if err != nil {
+			t.Fatalf("%s: CompressTiled failed: %v", tc.name, err)
+		}
+		want := lanczosResizeAlpha(tc.img, 61, 39, tc.rs)
+		got := decode(out.Bytes())
+		if result.FinalDimensions != image.Pt(61, 39) || got.Bounds() != want.Bounds() {
+			t.Fatalf("%s: got %v, want 61x39", tc.name, result.FinalDimensions)
+		}
+		for i := range got.Pix {
+			if d := int(got.Pix[i]) - int(want.Pix[i]); (d < -2 || d > 2) && (tc.rs.straight || want.Pix[i|3] > 8) {
+				t.Fatalf("%s: byte %d = %d, whole-image resize gives %d", tc.name, i, got.Pix[i], want.Pix[i])
+			}
+		}
+	}
 
-func TestCompressFromReader(t *testing.T) {
-	img := makeTestImage(100, 100)
-	var buf bytes.Buffer
-	png.Encode(&buf, img)
+	// A tall image streams through a few strips' worth of memory, far
+	// less than the 16 MB it takes as NRGBA.
+	tall := image.NewGray(image.Rect(0, 0, 256, 16384))
+	for y := range 16384 {
+		for x := range 256 {
+			tall.Pix[y*256+x] = uint8(x ^ y)
+		}
+	}
+	tallData := encode(tall)
+	for _, tc := range []struct {
+		maxWidth int
+		want     image.Point
+	}{{0, image.Pt(256, 16384)}, {128, image.Pt(128, 8192)}} {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		result, err := CompressTiled(ctx(), bytes.NewReader(tallData), io.Discard, Options{MaxWidth: tc.maxWidth})
+		runtime.ReadMemStats(&after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.FinalDimensions != tc.want {
+			t.Errorf("MaxWidth %d: got %v, want %v", tc.maxWidth, result.FinalDimensions, tc.want)
+		}
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 3<<20 {
+			t.Errorf("MaxWidth %d: allocated %d bytes for a 256x16384 image", tc.maxWidth, alloc)
+		}
+	}
 
-	result, err := Compress(ctx(), &buf, DefaultOptions())
-	if err != nil {
-		t.Fatalf("Compress failed: %v", err)
+	// Errors: options that need the whole image, bad data, animation,
+	// and cancellation.
+	small := encode(makeTestImage(20, 20))
+	for name, opts := range map[string]Options{
+		"jpeg":      {Format: JPEG},
+		"target":    {TargetSize: 1000},
+		"exact":     {ExactSize: image.Pt(10, 10)},
+		"interlace": {InterlacePNG: true},
+	} {
+		if _, err := CompressTiled(ctx(), bytes.NewReader(small), io.Discard, opts); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("%s: expected ErrInvalidOptions, got %v", name, err)
+		}
 	}
-	if len(result.CompressedData) == 0 {
-		t.Fatal("CompressedData should not be empty")
+	corrupt := bytes.Clone(small)
+	corrupt[len(corrupt)-20] ^= 0xff
+	for name, data := range map[string][]byte{
+		"garbage":   []byte("not an image"),
+		"truncated": small[:len(small)-30],
+		"corrupt":   corrupt,
+	} {
+		if _, err := CompressTiled(ctx(), bytes.NewReader(data), io.Discard, Options{}); !errors.Is(err, ErrDecode) {
+			t.Errorf("%s: expected ErrDecode, got %v", name, err)
+		}
 	}
-	if result.FinalDimensions.X != 100 || result.FinalDimensions.Y != 100 {
-		t.Fatalf("unexpected dimensions: %dx%d", result.FinalDimensions.X, result.FinalDimensions.Y)
+	apng, err := insertPNGChunk(small, "acTL", []byte{0, 0, 0, 2, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestCompressFromReaderInvalid(t *testing.T) {
-	r := bytes.NewReader([]byte("not an image"))
-	_, err := Compress(ctx(), r, DefaultOptions())
-	if err == nil {
-		t.Fatal("should error on invalid image data")
+	if _, err := CompressTiled(ctx(), bytes.NewReader(apng), io.Discard, Options{}); !errors.Is(err, ErrAnimated) {
+		t.Errorf("APNG: expected ErrAnimated, got %v", err)
+	}
+	canceled, cancel := context.WithCancel(ctx())
+	cancel()
+	if _, err := CompressTiled(canceled, bytes.NewReader(tallData), io.Discard, Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled: expected context.Canceled, got %v", err)
 	}
 }
 
-// ── Result.WriteTo Test ─────────────────────────────────────────────────────
-
-func TestResultWriteTo(t *testing.T) {
-	img := makeTestImage(100, 100)
+func TestCompressJPEGBackground(t *testing.T) {
+	img := makeSolidImage(64, 64, color.NRGBA{255, 0, 0, 128})
 	opts := DefaultOptions()
 	opts.Format = JPEG
+	opts.Quality = High
+
 	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(result.CompressedData))
 	if err != nil {
 		t.Fatal(err)
 	}
+	r, g, b, _ := decoded.At(32, 32).RGBA()
+	r, g, b = r>>8, g>>8, b>>8
+	if r < 240 || g < 100 || g > 155 || b < 100 || b > 155 {
+		t.Fatalf("50%% red over white should be pink, got (%d, %d, %d)", r, g, b)
+	}
 
-	var buf bytes.Buffer
-	n, err := result.WriteTo(&buf)
+	opts.Background = color.NRGBA{0, 0, 255, 255}
+	result, err = CompressImage(ctx(), img, opts)
 	if err != nil {
-		t.Fatalf("WriteTo failed: %v", err)
+		t.Fatalf("CompressImage failed: %v", err)
 	}
-	if n != int64(len(result.CompressedData)) {
-		t.Fatalf("WriteTo wrote %d bytes, expected %d", n, len(result.CompressedData))
+	decoded, err = jpeg.Decode(bytes.NewReader(result.CompressedData))
+	if err != nil {
+		t.Fatal(err)
 	}
-	if buf.Len() == 0 {
-		t.Fatal("WriteTo output should not be empty")
+	r, g, b, _ = decoded.At(32, 32).RGBA()
+	r, g, b = r>>8, g>>8, b>>8
+	if r < 100 || r > 155 || g > 30 || b < 100 || b > 155 {
+		t.Fatalf("50%% red over blue should be purple, got (%d, %d, %d)", r, g, b)
 	}
 }
 
-// ── Progress Callback Test ──────────────────────────────────────────────────
-
-func TestProgressCallback(t *testing.T) {
-	img := makeTestImage(100, 100)
-	var stages []ProgressStage
-
+func TestCompressGrayscaleJPEG(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 128, 128))
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 128; x++ {
+			v := uint8(x + y)
+			img.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+		}
+	}
 	opts := DefaultOptions()
 	opts.Format = JPEG
-	opts.OnProgress = func(stage ProgressStage, percent float64) error {
-		stages = append(stages, stage)
-		return nil
-	}
 
-	_, err := CompressImage(ctx(), img, opts)
+	result, err := CompressImage(ctx(), img, opts)
 	if err != nil {
 		t.Fatalf("CompressImage failed: %v", err)
 	}
-	if len(stages) == 0 {
-		t.Fatal("progress callback was never called")
+	decoded, err := jpeg.Decode(bytes.NewReader(result.CompressedData))
+	if err != nil {
+		t.Fatal(err)
 	}
-}
-
-// ── Resize Tests ────────────────────────────────────────────────────────────
-
-func TestLanczosResize(t *testing.T) {
-	img := makeTestImage(100, 100)
-
-	small := lanczosResize(img, 50, 50)
-	if small.Bounds().Dx() != 50 || small.Bounds().Dy() != 50 {
-		t.Fatalf("expected 50x50, got %dx%d", small.Bounds().Dx(), small.Bounds().Dy())
+	if _, ok := decoded.(*image.Gray); !ok {
+		t.Fatalf("grayscale source should decode as *image.Gray, got %T", decoded)
 	}
 
-	big := lanczosResize(img, 200, 200)
-	if big.Bounds().Dx() != 200 || big.Bounds().Dy() != 200 {
-		t.Fatalf("expected 200x200, got %dx%d", big.Bounds().Dx(), big.Bounds().Dy())
+	opts.ForceColor = true
+	result, err = CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
 	}
-
-	same := lanczosResize(img, 100, 100)
-	if same.Bounds().Dx() != 100 || same.Bounds().Dy() != 100 {
-		t.Fatalf("expected 100x100, got %dx%d", same.Bounds().Dx(), same.Bounds().Dy())
+	decoded, err = jpeg.Decode(bytes.NewReader(result.CompressedData))
+	if err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestLanczosResizeQuality(t *testing.T) {
-	img := makeTestImage(100, 100)
-	small := lanczosResize(img, 50, 50)
-	restored := lanczosResize(small, 100, 100)
-
-	ssim := SSIM(img, restored)
-	if ssim < 0.5 {
-		t.Fatalf("Lanczos round-trip quality too low: %f", ssim)
+	if _, ok := decoded.(*image.Gray); ok {
+		t.Fatal("ForceColor should keep a color JPEG")
 	}
-}
 
-func TestSmartResize(t *testing.T) {
-	img := makeTestImage(1000, 500)
-
-	resized := smartResize(img, 200, 200)
-	if resized.Bounds().Dx() > 200 || resized.Bounds().Dy() > 200 {
-		t.Fatalf("should fit in 200x200, got %dx%d", resized.Bounds().Dx(), resized.Bounds().Dy())
+	var gray, rgb bytes.Buffer
+	if err := encodeJPEG(&gray, img, 80, jpegEncoding{gray: true}); err != nil {
+		t.Fatal(err)
 	}
-
-	resized = smartResize(img, 2000, 2000)
-	if resized.Bounds().Dx() != 1000 || resized.Bounds().Dy() != 500 {
-		t.Fatal("should not resize when already fits")
+	if err := encodeJPEG(&rgb, img, 80, jpegEncoding{}); err != nil {
+		t.Fatal(err)
+	}
+	if gray.Len() >= rgb.Len() {
+		t.Fatalf("gray JPEG (%d bytes) should be smaller than RGB (%d bytes)", gray.Len(), rgb.Len())
 	}
 }
 
-func TestLanczosResizeZero(t *testing.T) {
-	img := makeTestImage(100, 100)
-	result := lanczosResize(img, 0, 50)
-	if result.Bounds().Dx() != 0 || result.Bounds().Dy() != 0 {
-		t.Fatal("resize with zero width should return empty image")
+// jpegDQT returns the first quantization table in JPEG data, in zig-zag
+// order, or nil if there is none.
+func jpegDQT(data []byte) []byte {
+	for i := 2; i+4 < len(data); {
+		if data[i] != 0xFF {
+			return nil
+		}
+		length := int(data[i+2])<<8 | int(data[i+3])
+		if data[i+1] == 0xDB && i+5+64 <= len(data) {
+			return data[i+5 : i+5+64]
+		}
+		i += 2 + length
 	}
+	return nil
 }
 
-// ── Analysis Tests ──────────────────────────────────────────────────────────
-
-func TestAnalyze(t *testing.T) {
-	t.Run("gradient", func(t *testing.T) {
-		img := makeTestImage(200, 200)
-		stats := Analyze(img)
-		if stats.Width != 200 || stats.Height != 200 {
-			t.Fatalf("wrong dimensions: %dx%d", stats.Width, stats.Height)
+func TestJPEGEncoderMatchesStdlib(t *testing.T) {
+	// Odd sizes exercise the edge padding of partial MCUs.
+	img := makeTestImage(77, 45)
+	for _, gray := range []bool{false, true} {
+		var std, own bytes.Buffer
+		if err := encodeJPEG(&std, img, 75, jpegEncoding{gray: gray}); err != nil {
+			t.Fatal(err)
 		}
-		if stats.HasAlpha {
-			t.Fatal("should not have alpha")
+		if err := writeJPEGTables(&own, img, 75, jpegEncoding{gray: gray}); err != nil {
+			t.Fatal(err)
 		}
-		if stats.Entropy < 1 {
-			t.Fatalf("entropy too low for gradient: %f", stats.Entropy)
+		if !bytes.Equal(jpegDQT(std.Bytes()), jpegDQT(own.Bytes())) {
+			t.Fatalf("gray=%v: standard tables should scale like image/jpeg", gray)
 		}
-	})
-
-	t.Run("solid_color", func(t *testing.T) {
-		img := makeSolidImage(100, 100, color.NRGBA{128, 128, 128, 255})
-		stats := Analyze(img)
-		if !stats.IsGrayscale {
-			t.Fatal("should be grayscale")
+		decoded, err := jpeg.Decode(bytes.NewReader(own.Bytes()))
+		if err != nil {
+			t.Fatalf("gray=%v: own encoder output does not decode: %v", gray, err)
 		}
-		if stats.Entropy > 0.01 {
-			t.Fatalf("entropy should be ~0 for solid color: %f", stats.Entropy)
+		if decoded.Bounds() != image.Rect(0, 0, 77, 45) {
+			t.Fatalf("gray=%v: decoded bounds %v", gray, decoded.Bounds())
 		}
-	})
-
-	t.Run("with_alpha", func(t *testing.T) {
-		img := makeTestImageWithAlpha(100, 100)
-		stats := Analyze(img)
-		if !stats.HasAlpha {
-			t.Fatal("should have alpha")
+		stdDecoded, _ := jpeg.Decode(bytes.NewReader(std.Bytes()))
+		a, b := SSIM(img, stdDecoded), SSIM(img, decoded)
+		if math.Abs(a-b) > 0.01 {
+			t.Fatalf("gray=%v: SSIM %.4f differs from image/jpeg's %.4f", gray, b, a)
 		}
-		if stats.RecommendedFormat != PNG {
-			t.Fatal("should recommend PNG for alpha image")
+		// image/jpeg also writes the unused chroma table for gray output.
+		if ratio := float64(own.Len()) / float64(std.Len()); ratio < 0.85 || ratio > 1.05 {
+			t.Fatalf("gray=%v: size %d vs image/jpeg %d", gray, own.Len(), std.Len())
 		}
-	})
+	}
+}
 
-	t.Run("empty", func(t *testing.T) {
-		img := image.NewNRGBA(image.Rect(0, 0, 0, 0))
-		stats := Analyze(img)
-		if stats.Width != 0 || stats.Height != 0 {
-			t.Fatal("empty image should have zero dimensions")
+func TestJPEGEncoderFullChroma(t *testing.T) {
+	// One-pixel red/blue columns: all the detail is in chroma, which 4:2:0
+	// averages away.
+	img := image.NewNRGBA(image.Rect(0, 0, 37, 29))
+	for y := 0; y < 29; y++ {
+		for x := 0; x < 37; x++ {
+			c := color.NRGBA{220, 30, 40, 255}
+			if x%2 == 1 {
+				c = color.NRGBA{30, 40, 220, 255}
+			}
+			img.SetNRGBA(x, y, c)
 		}
-	})
+	}
+	chromaError := func(fullChroma bool) float64 {
+		var buf bytes.Buffer
+		if err := encodeJPEG(&buf, img, 90, jpegEncoding{fullChroma: fullChroma}); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("fullChroma=%v: output does not decode: %v", fullChroma, err)
+		}
+		ycc, ok := decoded.(*image.YCbCr)
+		want := image.YCbCrSubsampleRatio420
+		if fullChroma {
+			want = image.YCbCrSubsampleRatio444
+		}
+		if !ok || ycc.SubsampleRatio != want {
+			t.Fatalf("fullChroma=%v: decoded %T, want %v", fullChroma, decoded, want)
+		}
+		out := toNRGBA(decoded)
+		var sum float64
+		for i := 0; i < len(img.Pix); i += 4 {
+			sum += math.Abs(float64(img.Pix[i]) - float64(out.Pix[i]))
+			sum += math.Abs(float64(img.Pix[i+2]) - float64(out.Pix[i+2]))
+		}
+		return sum / float64(len(img.Pix)/2)
+	}
+	sub, full := chromaError(false), chromaError(true)
+	if full > 10 || full > sub/4 {
+		t.Fatalf("4:4:4 chroma error %.1f should be far below 4:2:0's %.1f", full, sub)
+	}
 }
 
-// ── Effects Tests ───────────────────────────────────────────────────────────
+func TestFullChromaOption(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts Options
+		want image.YCbCrSubsampleRatio
+	}{
+		{"default", DefaultOptions(), image.YCbCrSubsampleRatio420},
+		{"zero value", Options{}, image.YCbCrSubsampleRatio420},
+		{"full chroma", Options{FullChroma: true}, image.YCbCrSubsampleRatio444},
+	} {
+		tc.opts.Format = JPEG
+		result, err := CompressImage(ctx(), makeTestImage(64, 48), tc.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(result.CompressedData))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ycc, ok := decoded.(*image.YCbCr); !ok || ycc.SubsampleRatio != tc.want {
+			t.Fatalf("%s: decoded %T, want %v", tc.name, decoded, tc.want)
+		}
+	}
+}
+
+func TestCompressNearLossless(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.Quality = NearLossless
+	// A flat image meets any SSIM target at every quality, so only the
+	// floor keeps the search from going lower.
+	opts.CollectTrace = true
+	result, err := CompressImage(ctx(), makeSolidImage(64, 64, color.NRGBA{90, 120, 200, 255}), opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	for _, p := range result.Trace {
+		if p.Quality < nearLosslessMinQuality {
+			t.Fatalf("probe at q=%d, below the floor %d", p.Quality, nearLosslessMinQuality)
+		}
+	}
+	opts.CollectTrace = false
+	decoded, err := jpeg.Decode(bytes.NewReader(result.CompressedData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ycc, ok := decoded.(*image.YCbCr); !ok || ycc.SubsampleRatio != image.YCbCrSubsampleRatio444 {
+		t.Fatalf("NearLossless output should be 4:4:4, got %T", decoded)
+	}
+
+	result, err = CompressImage(ctx(), makeTestImage(120, 90), opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if result.SSIM < 0.995 || result.JPEGQuality < nearLosslessMinQuality {
+		t.Fatalf("SSIM %.4f at q=%d, want >= 0.995 at q >= %d", result.SSIM, result.JPEGQuality, nearLosslessMinQuality)
+	}
+
+	var q Quality
+	if err := q.UnmarshalText([]byte("nearlossless")); err != nil || q != NearLossless {
+		t.Fatalf("UnmarshalText = %v, %v", q, err)
+	}
+}
+
+func TestCompressQuantTables(t *testing.T) {
+	img := makeTestImage(120, 90)
+	var standard []byte
+	for _, tables := range []QuantTables{TablesStandard, TablesPhotographic, TablesFlat} {
+		opts := DefaultOptions()
+		opts.Format = JPEG
+		opts.QuantTables = tables
+		result, err := CompressImage(ctx(), img, opts)
+		if err != nil {
+			t.Fatalf("%s: CompressImage failed: %v", tables, err)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(result.CompressedData)); err != nil {
+			t.Fatalf("%s: output does not decode: %v", tables, err)
+		}
+		if result.SSIM < opts.Quality.targetSSIM() {
+			t.Fatalf("%s: SSIM %.4f below target", tables, result.SSIM)
+		}
+		dqt := jpegDQT(result.CompressedData)
+		if tables == TablesStandard {
+			standard = dqt
+		} else if bytes.Equal(dqt, standard) {
+			t.Fatalf("%s: output uses the standard tables", tables)
+		}
+	}
+
+	if got := Analyze(makeSolidImage(8, 8, color.NRGBA{1, 2, 3, 255})).RecommendedTables; got == TablesFlat {
+		t.Fatal("a flat image has no edges to protect")
+	}
+	if got := Analyze(makeStripedImage(100, 100, 10)).RecommendedTables; got != TablesFlat {
+		t.Fatalf("striped graphic: got %s, want Flat", got)
+	}
+	if got := Analyze(img).RecommendedTables; got != TablesPhotographic {
+		t.Fatalf("photo-like image: got %s, want Photographic", got)
+	}
+}
+
+func TestOptimalHuffman(t *testing.T) {
+	// Fibonacci frequencies make the unconstrained tree as deep as
+	// possible, forcing the 16-bit length limit.
+	var freq [256]int
+	a, b := 1, 1
+	for i := 0; i < 40; i++ {
+		freq[i] = a
+		a, b = b, a+b
+	}
+	freq[200] = 7
+
+	spec := optimalHuffman(&freq)
+	if len(spec.values) != 41 {
+		t.Fatalf("got %d coded symbols, want 41", len(spec.values))
+	}
+	// Kraft: the codes must fit a binary tree with room for no all-ones
+	// code.
+	var kraft float64
+	n := 0
+	for i, c := range spec.counts {
+		kraft += float64(c) / float64(uint(1)<<(i+1))
+		n += int(c)
+	}
+	if n != len(spec.values) || kraft >= 1 {
+		t.Fatalf("invalid code lengths %v (Kraft sum %f)", spec.counts, kraft)
+	}
+}
+
+func TestCompressOptimizeHuffman(t *testing.T) {
+	img := makeTestImage(160, 120)
+	for _, gray := range []bool{false, true} {
+		var std, plain, opt bytes.Buffer
+		if err := encodeJPEG(&std, img, 80, jpegEncoding{gray: gray}); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeJPEGTables(&plain, img, 80, jpegEncoding{gray: gray}); err != nil {
+			t.Fatal(err)
+		}
+		if err := encodeJPEG(&opt, img, 80, jpegEncoding{gray: gray, optimizeHuffman: true}); err != nil {
+			t.Fatal(err)
+		}
+		if opt.Len() > std.Len() {
+			t.Fatalf("gray=%v: optimized %d bytes, baseline %d", gray, opt.Len(), std.Len())
+		}
+		a, err := jpeg.Decode(bytes.NewReader(plain.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := jpeg.Decode(bytes.NewReader(opt.Bytes()))
+		if err != nil {
+			t.Fatalf("gray=%v: optimized output does not decode: %v", gray, err)
+		}
+		if !bytes.Equal(toNRGBA(a).Pix, toNRGBA(b).Pix) {
+			t.Fatalf("gray=%v: Huffman optimization changed the pixels", gray)
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	base, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	opts.OptimizeHuffman = true
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if result.CompressedSize > base.CompressedSize {
+		t.Fatalf("optimized %d bytes, baseline %d", result.CompressedSize, base.CompressedSize)
+	}
+}
+
+func TestTranscodeJPEG(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"color", makeNoisyImage(37, 23)},
+		{"gray", toGray(makeTestImage(45, 31))},
+		{"smooth", makeTestImage(160, 120)},
+	} {
+		var src bytes.Buffer
+		if err := jpeg.Encode(&src, tc.img, &jpeg.Options{Quality: 90}); err != nil {
+			t.Fatal(err)
+		}
+		out, err := transcodeJPEG(src.Bytes())
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(out) >= src.Len() {
+			t.Fatalf("%s: transcoded %d bytes, original %d", tc.name, len(out), src.Len())
+		}
+		a, err := jpeg.Decode(bytes.NewReader(src.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := jpeg.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%s: transcoded output does not decode: %v", tc.name, err)
+		}
+		if !Compare(a, b).Identical {
+			t.Fatalf("%s: transcoding changed the pixels", tc.name)
+		}
+	}
+
+	// Progressive (SOF2) files aren't handled and must say so.
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, makeTestImage(16, 16), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	data[bytes.Index(data, []byte{0xFF, 0xC0})+1] = 0xC2
+	if _, err := transcodeJPEG(data); !errors.Is(err, errNotBaseline) {
+		t.Fatalf("progressive: got %v, want errNotBaseline", err)
+	}
+}
+
+func TestCompressLosslessJPEG(t *testing.T) {
+	img := makeNoisyImage(120, 80)
+	data := withEXIF(t, img, makeEXIF(binary.BigEndian, exifShort, OrientNormal))
+
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.Quality = Lossless
+	result, err := CompressBytes(ctx(), data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SSIM != 1.0 || result.JPEGQuality != 0 {
+		t.Fatalf("SSIM = %f, JPEGQuality = %d; want 1.0 and 0", result.SSIM, result.JPEGQuality)
+	}
+	if result.CompressedSize >= int64(len(data)) {
+		t.Fatalf("recompressed %d bytes, original %d", result.CompressedSize, len(data))
+	}
+	if readEXIF(bytes.NewReader(result.Bytes())) != nil {
+		t.Fatal("metadata should be stripped")
+	}
+	orig, _ := jpeg.Decode(bytes.NewReader(data))
+	got, err := jpeg.Decode(bytes.NewReader(result.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Compare(orig, got).Identical {
+		t.Fatal("lossless recompression changed the pixels")
+	}
+
+	opts.PreserveMetadata = true
+	result, err = CompressBytes(ctx(), data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readEXIF(bytes.NewReader(result.Bytes())) == nil {
+		t.Fatal("PreserveMetadata should keep EXIF")
+	}
+
+	// Resizing changes pixels, so the regular encoder runs instead.
+	opts.MaxWidth = 60
+	result, err = CompressBytes(ctx(), data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FinalDimensions != image.Pt(60, 40) || result.JPEGQuality == 0 {
+		t.Fatalf("resized: got %v at Q=%d", result.FinalDimensions, result.JPEGQuality)
+	}
+}
+
+func TestRecompressRegion(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+		mcu  int
+	}{
+		{"color", makeNoisyImage(200, 150), 16},
+		{"gray", toGray(makeTestImage(120, 90)), 8},
+	} {
+		var src bytes.Buffer
+		if err := jpeg.Encode(&src, tc.img, &jpeg.Options{Quality: 85}); err != nil {
+			t.Fatal(err)
+		}
+		original, err := insertJPEGSegment(src.Bytes(), 0xFE, []byte("kept"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		before, err := jpeg.Decode(bytes.NewReader(original))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		edited := toNRGBA(before)
+		region := image.Rect(50, 40, 70, 61)
+		for y := region.Min.Y; y < region.Max.Y; y++ {
+			for x := region.Min.X; x < region.Max.X; x++ {
+				edited.SetNRGBA(x, y, color.NRGBA{255, 255, 255, 255})
+			}
+		}
+		result, err := RecompressRegion(ctx(), original, edited, region, DefaultOptions())
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if result.Format != JPEG || result.SSIM < 0.9 || result.CompressedSize != int64(len(result.CompressedData)) {
+			t.Fatalf("%s: format %v, SSIM %.4f, size %d", tc.name, result.Format, result.SSIM, result.CompressedSize)
+		}
+		if string(testJPEGSegment(result.CompressedData, 0xFE)) != "kept" {
+			t.Errorf("%s: COM segment was not kept", tc.name)
+		}
+		after, err := jpeg.Decode(bytes.NewReader(result.CompressedData))
+		if err != nil {
+			t.Fatalf("%s: output does not decode: %v", tc.name, err)
+		}
+
+		// Pixels outside the touched MCUs are bit-identical; the edit
+		// itself shows up inside them.
+		touched := image.Rect(region.Min.X/tc.mcu*tc.mcu, region.Min.Y/tc.mcu*tc.mcu,
+			(region.Max.X+tc.mcu-1)/tc.mcu*tc.mcu, (region.Max.Y+tc.mcu-1)/tc.mcu*tc.mcu)
+		b := after.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if !image.Pt(x, y).In(touched) && after.At(x, y) != before.At(x, y) {
+					t.Fatalf("%s: pixel (%d,%d) outside %v changed", tc.name, x, y, touched)
+				}
+			}
+		}
+		if r, _, _, _ := after.At(60, 50).RGBA(); r>>8 < 230 {
+			t.Errorf("%s: edited pixel has red %d, want near 255", tc.name, r>>8)
+		}
+
+		// An empty region keeps every pixel.
+		result, err = RecompressRegion(ctx(), original, edited, image.Rectangle{}, DefaultOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		same, err := jpeg.Decode(bytes.NewReader(result.CompressedData))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !Compare(before, same).Identical {
+			t.Errorf("%s: empty region changed the pixels", tc.name)
+		}
+	}
+
+	img := makeTestImage(64, 48)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RecompressRegion(ctx(), buf.Bytes(), makeTestImage(32, 48), image.Rect(0, 0, 8, 8), DefaultOptions()); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("size mismatch: got %v, want ErrInvalidOptions", err)
+	}
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, img); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RecompressRegion(ctx(), pngData.Bytes(), img, image.Rect(0, 0, 8, 8), DefaultOptions()); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("PNG original: got %v, want ErrUnsupportedFormat", err)
+	}
+
+	// Progressive files fall back to a full re-encode.
+	data := bytes.Clone(buf.Bytes())
+	data[bytes.Index(data, []byte{0xFF, 0xC0})+1] = 0xC2
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	result, err := RecompressRegion(ctx(), data, img, image.Rect(0, 0, 8, 8), opts)
+	if err != nil {
+		t.Fatalf("progressive fallback: %v", err)
+	}
+	if result.FinalDimensions != image.Pt(64, 48) || result.OriginalSize != int64(len(data)) {
+		t.Errorf("progressive fallback: %v, OriginalSize %d", result.FinalDimensions, result.OriginalSize)
+	}
+}
+
+func TestCompressContentAware(t *testing.T) {
+	// Left half: a smooth sky with sensor grain. Right half: hard-edged
+	// 4-pixel checks.
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 128))
+	seed := uint32(1)
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 256; x++ {
+			var c color.NRGBA
+			seed = seed*1664525 + 1013904223
+			if x < 128 {
+				grain := uint8(seed>>24) % 9
+				c = color.NRGBA{100 + uint8(y/4) + grain, 150 + grain, 200 + grain, 255}
+			} else if (x/4+y/4)%2 == 0 {
+				c = color.NRGBA{20, 20, 20, 255}
+			} else {
+				c = color.NRGBA{240, 240, 240, 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	smoothed := contentAwareSmooth(img, nil)
+	for y := 20; y < 108; y++ {
+		for x := 168; x < 236; x++ {
+			if smoothed.NRGBAAt(x, y) != img.NRGBAAt(x, y) {
+				t.Fatalf("detailed tile changed at (%d,%d)", x, y)
+			}
+		}
+	}
+
+	var plain, aware bytes.Buffer
+	if err := encodeJPEG(&plain, img, 85, jpegEncoding{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := encodeJPEG(&aware, smoothed, 85, jpegEncoding{}); err != nil {
+		t.Fatal(err)
+	}
+	if aware.Len() >= plain.Len() {
+		t.Fatalf("smoothed JPEG (%d bytes) should be smaller than plain (%d bytes)", aware.Len(), plain.Len())
+	}
+
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.ContentAware = true
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if result.SSIM < opts.Quality.targetSSIM() {
+		t.Fatalf("SSIM %.4f below target %.4f", result.SSIM, opts.Quality.targetSSIM())
+	}
+
+	opts.TargetSize = 8000
+	result, err = CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage in target-size mode failed: %v", err)
+	}
+	if result.CompressedSize > int64(opts.TargetSize) {
+		t.Fatalf("output %d bytes exceeds target %d", result.CompressedSize, opts.TargetSize)
+	}
+}
+
+func TestCompressFocusRegion(t *testing.T) {
+	// Noisy detail on the left, a flat tone on the right.
+	img := makeSolidImage(256, 128, color.NRGBA{120, 140, 160, 255})
+	noisy := makeNoisyImage(128, 128)
+	for y := 0; y < 128; y++ {
+		copy(img.Pix[y*img.Stride:y*img.Stride+128*4], noisy.Pix[y*noisy.Stride:])
+	}
+	compress := func(focus *image.Rectangle, maxWidth int) *Result {
+		t.Helper()
+		opts := DefaultOptions()
+		opts.Format = JPEG
+		opts.FocusRegion = focus
+		opts.MaxWidth = maxWidth
+		result, err := CompressImage(ctx(), img, opts)
+		if err != nil {
+			t.Fatalf("CompressImage(focus %v) failed: %v", focus, err)
+		}
+		return result
+	}
+	detail := image.Rect(0, 0, 128, 128)
+	flat := image.Rect(128, 0, 256, 128)
+
+	plain := compress(nil, 0)
+	onDetail := compress(&detail, 0)
+	onFlat := compress(&flat, 0)
+	if onDetail.JPEGQuality <= plain.JPEGQuality {
+		t.Errorf("focus on detail: Q=%d, want above unfocused Q=%d", onDetail.JPEGQuality, plain.JPEGQuality)
+	}
+	if onFlat.CompressedSize >= plain.CompressedSize {
+		t.Errorf("focus on flat area: %d bytes, want below unfocused %d", onFlat.CompressedSize, plain.CompressedSize)
+	}
+
+	// The region follows the image through a resize.
+	if small, base := compress(&detail, 128), compress(nil, 128); small.JPEGQuality <= base.JPEGQuality {
+		t.Errorf("focus on detail after resize: Q=%d, want above unfocused Q=%d", small.JPEGQuality, base.JPEGQuality)
+	}
+
+	opts := DefaultOptions()
+	opts.FocusRegion = &image.Rectangle{}
+	if err := opts.Validate(); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("empty FocusRegion: expected ErrInvalidOptions, got %v", err)
+	}
+}
+
+func TestCompressUseMSSSIM(t *testing.T) {
+	img := makeTestImage(256, 256)
+	for _, q := range []Quality{Balanced, High} {
+		opts := DefaultOptions()
+		opts.Format = JPEG
+		opts.Quality = q
+		opts.UseMSSSIM = true
+		result, err := CompressImage(ctx(), img, opts)
+		if err != nil {
+			t.Fatalf("%v: CompressImage failed: %v", q, err)
+		}
+		if target := q.targetMSSSIM(); result.SSIM < target {
+			t.Errorf("%v: MS-SSIM %.4f below target %.4f", q, result.SSIM, target)
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(result.CompressedData))
+		if err != nil {
+			t.Fatalf("%v: output is not a valid JPEG: %v", q, err)
+		}
+		if got := decoded.Bounds().Size(); got != img.Bounds().Size() {
+			t.Errorf("%v: decoded size %v, want %v", q, got, img.Bounds().Size())
+		}
+	}
+}
+
+func TestCompressSharpenAfterResize(t *testing.T) {
+	img := makeTestImage(400, 400)
+	opts := DefaultOptions()
+	opts.Format = PNG
+	opts.MaxWidth = 100
+
+	soft, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+
+	opts.Sharpen = 1.0
+	sharp, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if bytes.Equal(soft.Image.Pix, sharp.Image.Pix) {
+		t.Fatal("Sharpen should change the downscaled image")
+	}
+
+	// No resize, no sharpening.
+	opts.MaxWidth = 0
+	full, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if !bytes.Equal(full.Image.Pix, img.Pix) {
+		t.Fatal("Sharpen should only apply after a downscale")
+	}
+}
+
+func TestCompressAutoFormat(t *testing.T) {
+	opaqueImg := makeTestImage(200, 200)
+	opts := DefaultOptions()
+	opts.Format = Auto
+
+	result, err := CompressImage(ctx(), opaqueImg, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if result.Format != JPEG {
+		t.Fatalf("expected JPEG for opaque gradient, got %v", result.Format)
+	}
+
+	alphaImg := makeTestImageWithAlpha(100, 100)
+	result, err = CompressImage(ctx(), alphaImg, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if result.Format != PNG {
+		t.Fatalf("expected PNG for transparent image, got %v", result.Format)
+	}
+}
+
+func TestCompressQualityPresets(t *testing.T) {
+	img := makeTestImage(200, 200)
+
+	presets := []Quality{Ultra, High, Balanced, Aggressive, Maximum}
+	var prevSSIM float64 = 2.0
+
+	for _, preset := range presets {
+		opts := DefaultOptions()
+		opts.Format = JPEG
+		opts.Quality = preset
+
+		result, err := CompressImage(ctx(), img, opts)
+		if err != nil {
+			t.Fatalf("CompressImage (%s) failed: %v", preset, err)
+		}
+
+		target := preset.targetSSIM()
+		if result.SSIM < target-0.02 {
+			t.Fatalf("%s: SSIM %f below target %f", preset, result.SSIM, target)
+		}
+
+		if result.SSIM > prevSSIM+0.01 {
+			t.Logf("Warning: %s SSIM (%f) higher than previous (%f)", preset, result.SSIM, prevSSIM)
+		}
+		prevSSIM = result.SSIM
+	}
+}
+
+func TestCompressWithResize(t *testing.T) {
+	img := makeTestImage(1000, 800)
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.MaxWidth = 500
+	opts.MaxHeight = 500
+
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+
+	if result.FinalDimensions.X > 500 || result.FinalDimensions.Y > 500 {
+		t.Fatalf("image not resized: %dx%d", result.FinalDimensions.X, result.FinalDimensions.Y)
+	}
+
+	originalRatio := 1000.0 / 800.0
+	newRatio := float64(result.FinalDimensions.X) / float64(result.FinalDimensions.Y)
+	if math.Abs(originalRatio-newRatio) > 0.02 {
+		t.Fatalf("aspect ratio not preserved: original %f, new %f", originalRatio, newRatio)
+	}
+}
+
+func TestCompressTargetSize(t *testing.T) {
+	img := makeTestImage(300, 300)
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.TargetSize = 5000
+
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+
+	if result.CompressedSize > int64(opts.TargetSize)*2 {
+		t.Fatalf("compressed size %d far exceeds target %d", result.CompressedSize, opts.TargetSize)
+	}
+}
+
+func TestCompressTargetBPP(t *testing.T) {
+	img := makeTestImage(400, 300)
+	for _, maxWidth := range []int{0, 200} {
+		opts := DefaultOptions()
+		opts.Format = JPEG
+		opts.TargetBPP = 1.5
+		opts.MaxWidth = maxWidth
+		result, err := CompressImage(ctx(), img, opts)
+		if err != nil {
+			t.Fatalf("CompressImage failed: %v", err)
+		}
+		// The budget follows the resized dimensions.
+		w, h := 400, 300
+		if maxWidth > 0 {
+			w, h = 200, 150
+		}
+		budget := int64(1.5 * float64(w*h) / 8)
+		if result.CompressedSize > budget {
+			t.Errorf("MaxWidth %d: %d bytes exceeds the %d-byte budget", maxWidth, result.CompressedSize, budget)
+		}
+		if result.Strategy == "" {
+			t.Errorf("MaxWidth %d: TargetBPP should run the target-size engine", maxWidth)
+		}
+	}
+}
+
+func TestCompressTargetRatio(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, makeNoisyImage(300, 200)); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	opts := DefaultOptions()
+	opts.TargetRatio = 10
+	result, err := CompressBytes(ctx(), data, opts)
+	if err != nil {
+		t.Fatalf("CompressBytes failed: %v", err)
+	}
+	if budget := int64(len(data)) / 10; result.CompressedSize > budget {
+		t.Errorf("%d bytes exceeds 1/10 of the %d-byte input", result.CompressedSize, len(data))
+	}
+	if result.Strategy == "" {
+		t.Error("TargetRatio should run the target-size engine")
+	}
+
+	// Without the encoded input there is nothing to take a ratio of.
+	if _, err := CompressImage(ctx(), makeTestImage(300, 200), opts); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("CompressImage with TargetRatio: expected ErrInvalidOptions, got %v", err)
+	}
+}
+
+func TestCompressTargetSizeTolerance(t *testing.T) {
+	img := makeTestImage(300, 300)
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.TargetSize = 8000
+	opts.TargetSizeTolerance = 0.25
+
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if result.CompressedSize > int64(opts.TargetSize) {
+		t.Fatalf("compressed size %d exceeds target %d", result.CompressedSize, opts.TargetSize)
+	}
+	// The target is well within reach, so the search must land inside the band.
+	if low := int64(float64(opts.TargetSize) * (1 - opts.TargetSizeTolerance)); result.CompressedSize < low {
+		t.Fatalf("compressed size %d below tolerance band [%d, %d]", result.CompressedSize, low, opts.TargetSize)
+	}
+}
+
+func TestTargetSizeExactSize(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.ExactSize = image.Pt(200, 150)
+	opts.TargetSize = 6000
+
+	result, err := CompressImage(ctx(), makeNoisyImage(400, 300), opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if result.FinalDimensions != opts.ExactSize {
+		t.Fatalf("dimensions %v, want %v", result.FinalDimensions, opts.ExactSize)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(result.CompressedData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decoded.Bounds().Size(); got != opts.ExactSize {
+		t.Fatalf("decoded dimensions %v, want %v", got, opts.ExactSize)
+	}
+
+	// Even quality 1 is bigger than this, and scaling is off the table.
+	opts.TargetSize = minTargetSize
+	if _, err := CompressImage(ctx(), makeNoisyImage(400, 300), opts); !errors.Is(err, ErrTargetUnreachable) {
+		t.Fatalf("unreachable target: err = %v, want ErrTargetUnreachable", err)
+	}
+}
+
+func TestTargetSizeAboveRawSize(t *testing.T) {
+	// Random RGBA doesn't compress: the PNG is bigger than the raw pixels,
+	// so a target of exactly the raw size skips the search and still misses.
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	seed := uint32(1)
+	for i := range img.Pix {
+		seed = seed*1664525 + 1013904223
+		img.Pix[i] = uint8(seed >> 24)
+	}
+	opts := DefaultOptions()
+	opts.Format = PNG
+	opts.TargetSize = len(img.Pix)
+
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if result.CompressedSize <= int64(opts.TargetSize) || result.TargetMet {
+		t.Fatalf("size %d, TargetMet %v; want a reported miss of %d", result.CompressedSize, result.TargetMet, opts.TargetSize)
+	}
+
+	opts.StrictTargetSize = true
+	if _, err := CompressImage(ctx(), img, opts); !errors.Is(err, ErrTargetUnreachable) {
+		t.Fatalf("strict: err = %v, want ErrTargetUnreachable", err)
+	}
+
+	opts.TargetSize = 4 * len(img.Pix)
+	result, err = CompressImage(ctx(), img, opts)
+	if err != nil || !result.TargetMet {
+		t.Fatalf("generous target: TargetMet %v, err %v", result != nil && result.TargetMet, err)
+	}
+}
+
+func TestQuantizeDeterministic(t *testing.T) {
+	img := makeNoisyImage(300, 200)
+
+	p1 := medianCut(img, 64)
+	p2 := medianCut(img, 64)
+	if len(p1) != len(p2) {
+		t.Fatalf("palette sizes differ: %d vs %d", len(p1), len(p2))
+	}
+	for i := range p1 {
+		if p1[i] != p2[i] {
+			t.Fatalf("palette entry %d differs: %v vs %v", i, p1[i], p2[i])
+		}
+	}
+
+	a := applyPalette(img, p1, false)
+	b := applyPalette(img, p1, false)
+	if !bytes.Equal(a.Pix, b.Pix) {
+		t.Error("applyPalette output differs between runs")
+	}
+}
+
+func TestQuantize(t *testing.T) {
+	img := makeStripedImage(64, 32, 4)
+
+	q := Quantize(img, 16)
+	if q.Bounds() != img.Bounds() {
+		t.Fatalf("bounds changed: %v", q.Bounds())
+	}
+	if len(q.Palette) > 16 {
+		t.Fatalf("palette has %d entries, want at most 16", len(q.Palette))
+	}
+	// Two exact colors should survive quantization unchanged.
+	if out := palettedToNRGBA(q); !bytes.Equal(out.Pix, img.Pix) {
+		t.Error("two-color image should quantize losslessly")
+	}
+
+	sub := img.SubImage(image.Rect(8, 8, 40, 24))
+	if qs := Quantize(sub, 16); qs.Bounds() != image.Rect(0, 0, 32, 16) {
+		t.Fatalf("sub-image should give a zero-origin result, got %v", qs.Bounds())
+	}
+}
+
+func TestBuildPaletteClampsColors(t *testing.T) {
+	img := makeNoisyImage(100, 100)
+	if n := len(BuildPalette(img, 1000)); n > 256 {
+		t.Fatalf("palette has %d entries, want at most 256", n)
+	}
+	if n := len(BuildPalette(img, 0)); n < 1 || n > 2 {
+		t.Fatalf("palette has %d entries, want 1 or 2", n)
+	}
+}
+
+func TestCIEDE2000(t *testing.T) {
+	// Reference pairs from Sharma, Wu and Dalal's CIEDE2000 test data.
+	for _, tc := range []struct {
+		p, q labColor
+		want float64
+	}{
+		{labColor{l: 50, a: 2.6772, b: -79.7751}, labColor{l: 50, a: 0, b: -82.7485}, 2.0425},
+		{labColor{l: 50, a: 0, b: 0}, labColor{l: 50, a: -1, b: 2}, 2.3669},
+		{labColor{l: 50, a: 2.5, b: 0}, labColor{l: 73, a: 25, b: -18}, 27.1492},
+		{labColor{l: 60.2574, a: -34.0099, b: 36.2677}, labColor{l: 60.4626, a: -34.1751, b: 39.4387}, 1.2644},
+		{labColor{l: 2.0776, a: 0.0795, b: -1.135}, labColor{l: 0.9033, a: -0.0636, b: -0.5514}, 0.9082},
+	} {
+		if got := ciede2000(tc.p, tc.q); math.Abs(got-tc.want) > 1e-4 {
+			t.Errorf("ciede2000(%v, %v) = %.4f, want %.4f", tc.p, tc.q, got, tc.want)
+		}
+	}
+
+	if white := toLab(255, 255, 255, 255); math.Abs(white.l-100) > 0.01 || math.Abs(white.a) > 0.01 || math.Abs(white.b) > 0.01 {
+		t.Errorf("white = %+v, want L=100, a=b=0", white)
+	}
+}
+
+func TestPerceptualQuantize(t *testing.T) {
+	img := makeTestImage(120, 80)
+	palette := medianCut(img, 16)
+
+	// Perceptual mapping should leave less perceived error than RGB
+	// mapping with the same palette.
+	meanDE := func(q *image.Paletted) float64 {
+		out := palettedToNRGBA(q)
+		var sum float64
+		for i := 0; i < len(img.Pix); i += 4 {
+			p := toLab(img.Pix[i], img.Pix[i+1], img.Pix[i+2], 255)
+			o := toLab(out.Pix[i], out.Pix[i+1], out.Pix[i+2], 255)
+			sum += ciede2000(p, o)
+		}
+		return sum / float64(len(img.Pix)/4)
+	}
+	rgb := meanDE(applyPalette(img, palette, false))
+	perceptual := meanDE(applyPalette(img, palette, true))
+	if perceptual >= rgb {
+		t.Fatalf("perceptual mean ΔE00 %.3f should beat RGB %.3f", perceptual, rgb)
+	}
+
+	alpha := makeTestImageWithAlpha(64, 64)
+	alpha.Pix[3] = 0
+	if q := palettedToNRGBA(applyPalette(alpha, medianCut(alpha, 32), true)); q.Pix[3] != 0 {
+		t.Fatalf("fully transparent pixel became alpha %d", q.Pix[3])
+	}
+
+	opts := DefaultOptions()
+	opts.Format = PNG
+	opts.LossyPNG = true
+	opts.Quality = Maximum
+	opts.PerceptualQuantize = true
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if _, err := png.Decode(bytes.NewReader(result.CompressedData)); err != nil {
+		t.Fatalf("invalid PNG: %v", err)
+	}
+}
+
+func TestQuantizePreservesAlpha(t *testing.T) {
+	img := makeTestImageWithAlpha(64, 64)
+	img.Pix[3] = 0 // one fully transparent pixel
+
+	quantized := palettedToNRGBA(applyPalette(img, medianCut(img, 64), false))
+	if isOpaque(quantized) {
+		t.Fatal("quantized image lost its transparency")
+	}
+	if quantized.Pix[3] != 0 {
+		t.Fatalf("fully transparent pixel became alpha %d", quantized.Pix[3])
+	}
+	for i := 3; i < len(img.Pix); i += 4 {
+		d := int(img.Pix[i]) - int(quantized.Pix[i])
+		if d < -32 || d > 32 {
+			t.Fatalf("alpha at byte %d drifted from %d to %d", i, img.Pix[i], quantized.Pix[i])
+		}
+	}
+}
+
+func TestCompressTargetSizePNGAlpha(t *testing.T) {
+	img := makeTestImageWithAlpha(200, 200)
+	opts := DefaultOptions()
+	opts.Format = PNG
+	opts.TargetSize = 20000
+
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(result.CompressedData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isOpaque(toNRGBA(decoded)) {
+		t.Fatal("target-size PNG output lost its transparency")
+	}
+}
+
+func TestCompressTargetSizeResultImage(t *testing.T) {
+	img := makeNoisyImage(200, 200)
+	tests := []struct {
+		strategy string
+		format   Format
+		target   int
+	}{
+		{strategyJPEGQuality, JPEG, 60000},
+		{strategyQuantizePNG, PNG, 60000},
+		{strategyJPEGScale, JPEG, 1000},
+		{strategyScaleSearch, PNG, 3000},
+		{strategyFallback, PNG, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Format = tt.format
+			opts.TargetSize = tt.target
+			opts.LossyPNG = true
+			result, err := CompressImage(ctx(), img, opts)
+			if err != nil {
+				t.Fatalf("CompressImage failed: %v", err)
+			}
+			if result.Strategy != tt.strategy {
+				t.Fatalf("strategy = %q, want %q", result.Strategy, tt.strategy)
+			}
+			if got := result.Image.Bounds().Size(); got != result.FinalDimensions {
+				t.Fatalf("Image is %v, FinalDimensions %v", got, result.FinalDimensions)
+			}
+			if result.Format != PNG {
+				return
+			}
+			// PNG is exact, so the image must match the encoded pixels.
+			decoded, err := png.Decode(bytes.NewReader(result.CompressedData))
+			if err != nil {
+				t.Fatalf("invalid PNG: %v", err)
+			}
+			if !bytes.Equal(toNRGBA(decoded).Pix, result.Image.Pix) {
+				t.Fatal("Result.Image differs from the encoded pixels")
+			}
+		})
+	}
+}
+
+func TestTargetMet(t *testing.T) {
+	noisy := makeNoisyImage(200, 200)
+	tests := []struct {
+		name       string
+		img        image.Image
+		opts       Options
+		targetSSIM float64
+		met        bool
+	}{
+		{"reachable SSIM", makeTestImage(128, 128), Options{Format: JPEG}, 0.94, true},
+		// Noise with subsampled chroma can't reach this even at quality 100.
+		{"unreachable SSIM", noisy, Options{Format: JPEG, TargetSSIM: 0.9999}, 0.9999, false},
+		{"lossless PNG", noisy, Options{Format: PNG, Quality: Lossless}, 0, true},
+		{"reachable size", noisy, Options{Format: JPEG, TargetSize: 60000}, 0, true},
+		{"unreachable size", noisy, Options{Format: PNG, TargetSize: 100}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := CompressImage(ctx(), tt.img, tt.opts)
+			if err != nil {
+				t.Fatalf("CompressImage failed: %v", err)
+			}
+			if result.TargetMet != tt.met || result.TargetSSIM != tt.targetSSIM {
+				t.Fatalf("TargetMet = %v, TargetSSIM = %v; want %v, %v (SSIM %.4f, %d bytes)",
+					result.TargetMet, result.TargetSSIM, tt.met, tt.targetSSIM, result.SSIM, result.CompressedSize)
+			}
+			if tt.targetSSIM > 0 && (result.SSIM >= tt.targetSSIM) != tt.met {
+				t.Fatalf("SSIM %.4f disagrees with TargetMet %v", result.SSIM, tt.met)
+			}
+			if tt.opts.TargetSize > 0 && (result.CompressedSize <= int64(tt.opts.TargetSize)) != tt.met {
+				t.Fatalf("%d bytes disagrees with TargetMet %v", result.CompressedSize, tt.met)
+			}
+			if !tt.met && tt.targetSSIM > 0 && (result.JPEGQuality != 100 || result.SSIM >= 1) {
+				t.Fatalf("missed SSIM target: got q=%d SSIM %.4f, want q=100 and the SSIM reached",
+					result.JPEGQuality, result.SSIM)
+			}
+		})
+	}
+
+	// The JPEG fallback reports the SSIM it reached, not a perfect score.
+	result, err := CompressImage(ctx(), noisy, Options{Format: JPEG, TargetSize: 100})
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if result.TargetMet || result.SSIM >= 1 {
+		t.Fatalf("over-target JPEG: TargetMet = %v, SSIM = %.4f (strategy %q, %d bytes)",
+			result.TargetMet, result.SSIM, result.Strategy, result.CompressedSize)
+	}
+}
+
+func TestCompressTargetSizeLimits(t *testing.T) {
+	img := makeNoisyImage(64, 64)
+
+	opts := DefaultOptions()
+	opts.TargetSize = 99
+	if _, err := CompressImage(ctx(), img, opts); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("target below the floor: expected ErrInvalidOptions, got %v", err)
+	}
+
+	// A target the raw pixels already fit in runs the quality search.
+	opts.TargetSize = 64 * 64 * 4
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if result.Strategy != "" {
+		t.Fatalf("oversized target should use quality mode, got strategy %q", result.Strategy)
+	}
+
+	// The smallest target scales no output below 8px.
+	opts.TargetSize = 100
+	opts.Format = PNG
+	result, err = CompressImage(ctx(), makeNoisyImage(400, 400), opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if d := result.FinalDimensions; d.X < 8 || d.Y < 8 {
+		t.Fatalf("output %v is smaller than 8px (%s)", d, result.Strategy)
+	}
+}
+
+func TestCompressTargetSizeRespectsMaxWidth(t *testing.T) {
+	big := makeTestImage(3000, 1500)
+	for _, format := range []Format{Auto, PNG} {
+		opts := DefaultOptions()
+		opts.Format = format
+		opts.TargetSize = 200 * 1024
+		opts.MaxWidth = 1000
+		result, err := CompressImage(ctx(), big, opts)
+		if err != nil {
+			t.Fatalf("%v: CompressImage failed: %v", format, err)
+		}
+		if result.FinalDimensions.X > 1000 || result.Image.Bounds().Dx() > 1000 {
+			t.Fatalf("%v: output %v (%s) exceeds MaxWidth 1000",
+				format, result.FinalDimensions, result.Strategy)
+		}
+	}
+
+	// A source already under the cap is never scaled up to reach it.
+	opts := DefaultOptions()
+	opts.TargetSize = 200 * 1024
+	opts.MaxWidth = 1000
+	result, err := CompressImage(ctx(), makeNoisyImage(600, 400), opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if result.FinalDimensions.X > 600 || result.FinalDimensions.Y > 400 {
+		t.Fatalf("output %v is larger than the 600x400 source", result.FinalDimensions)
+	}
+}
+
+func TestCompressTargetSizeStrategy(t *testing.T) {
+	known := map[string]bool{
+		strategyJPEGQuality: true, strategyQuantizePNG: true, strategyJPEGScale: true,
+		strategyScaleSearch: true, strategyFallback: true,
+	}
+
+	opts := DefaultOptions()
+	opts.TargetSize = 5000
+	result, err := CompressImage(ctx(), makeTestImage(300, 300), opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if !known[result.Strategy] {
+		t.Fatalf("unexpected strategy %q", result.Strategy)
+	}
+	if !strings.Contains(result.String(), "Strategy: "+result.Strategy) {
+		t.Fatalf("String() should include the strategy: %s", result)
+	}
+
+	// Alpha rules out JPEG, leaving the quantizer as the only candidate
+	// that keeps full size.
+	opts.Format = PNG
+	opts.TargetSize = 20000
+	result, err = CompressImage(ctx(), makeTestImageWithAlpha(200, 200), opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if result.Strategy != strategyQuantizePNG {
+		t.Fatalf("strategy = %q, want %q", result.Strategy, strategyQuantizePNG)
+	}
+
+	result, err = CompressImage(ctx(), makeTestImage(100, 100), DefaultOptions())
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if result.Strategy != "" {
+		t.Fatalf("standard mode should leave Strategy empty, got %q", result.Strategy)
+	}
+	if strings.Contains(result.String(), "Strategy") {
+		t.Fatalf("String() should omit an empty strategy: %s", result)
+	}
+}
+
+func TestCompressCollectTrace(t *testing.T) {
+	img := makeTestImage(120, 120)
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	plain, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.Trace != nil {
+		t.Fatal("Trace should be nil without CollectTrace")
+	}
+
+	opts.CollectTrace = true
+	traced, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain.Bytes(), traced.Bytes()) {
+		t.Fatal("tracing must not change the output")
+	}
+	if len(traced.Trace) < 2 {
+		t.Fatalf("expected several probes, got %v", traced.Trace)
+	}
+	found := false
+	for _, p := range traced.Trace {
+		if p.Quality < 1 || p.Quality > 100 || p.Size <= 0 || p.SSIM <= 0 {
+			t.Fatalf("implausible probe %+v", p)
+		}
+		if p.Quality == traced.JPEGQuality {
+			found = found || (p.SSIM == traced.SSIM && p.Size == int(traced.CompressedSize))
+		}
+	}
+	if !found {
+		t.Fatalf("chosen quality %d missing from trace %v", traced.JPEGQuality, traced.Trace)
+	}
+
+	opts.Format = PNG
+	r, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Trace != nil {
+		t.Fatalf("PNG output should have no trace, got %v", r.Trace)
+	}
+}
+
+func TestJPEGSearchStopsOnFlatSize(t *testing.T) {
+	// A flat image encodes to nearly the same size at every quality.
+	img := makeSolidImage(256, 256, color.NRGBA{90, 120, 150, 255})
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.CollectTrace = true
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The full search from the floor takes 7 probes; it stops early, but
+	// only once few qualities are left below the last pass.
+	target := opts.Quality.targetSSIM()
+	if n := len(result.Trace); n < 2 || n > 5 {
+		t.Fatalf("expected the search to stop after 2–5 probes, got %v", result.Trace)
+	}
+	last := result.Trace[len(result.Trace)-1]
+	if untried := last.Quality - jpegSearchFloor(target, opts); untried > jpegSearchStopSpan {
+		t.Fatalf("stopped with %d qualities untried below q=%d", untried, last.Quality)
+	}
+	if result.SSIM < target {
+		t.Fatalf("SSIM %.4f below target %.4f", result.SSIM, target)
+	}
+	for _, p := range result.Trace {
+		if int64(p.Size) < result.CompressedSize {
+			t.Fatalf("stopped on %d bytes but probe %+v was smaller", result.CompressedSize, p)
+		}
+	}
+}
+
+func TestCompressLogger(t *testing.T) {
+	var lines []string
+	opts := DefaultOptions()
+	opts.Logger = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	contains := func(prefix string) bool {
+		for _, l := range lines {
+			if strings.HasPrefix(l, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	img := makeTestImage(120, 120)
+	plain, err := CompressImage(ctx(), img, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	traced, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain.Bytes(), traced.Bytes()) {
+		t.Fatal("logging must not change the output")
+	}
+	if !contains("format: Auto chose JPEG") || !contains("jpeg search: q=") {
+		t.Fatalf("missing format or search trace in %q", lines)
+	}
+
+	lines = nil
+	opts.TargetSize = 5000
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains("target size: " + result.Strategy + " won") {
+		t.Fatalf("missing winning strategy %q in %q", result.Strategy, lines)
+	}
+}
+
+func TestScaleProbesMemoize(t *testing.T) {
+	probes := newScaleProbes(makeTestImage(200, 200), 5000, jpegEncoding{})
+	first := probes.jpeg(ctx(), 100, 100)
+
+	before := jpegEncodes.Load()
+	if again := probes.jpeg(ctx(), 100, 100); again != first {
+		t.Fatal("repeated probe should return the memoized result")
+	}
+	if n := jpegEncodes.Load() - before; n != 0 {
+		t.Fatalf("repeated probe re-encoded %d times", n)
+	}
+}
+
+func TestPredictJPEGScale(t *testing.T) {
+	img := makeTestImage(600, 450)
+	if s := predictJPEGScale(img, 100); s != 0 {
+		t.Fatalf("target below header size should give no prediction, got %f", s)
+	}
+
+	guess := predictJPEGScale(img, 4000)
+	probes := newScaleProbes(img, 4000, jpegEncoding{})
+	best := findBestScaleBinary(ctx(), nil, probes, 600, 450, 4000, scaleBinaryIterations, 0)
+	if best == nil {
+		t.Fatal("expected a fitting scale")
+	}
+	if ratio := guess / best.scale; ratio < 0.5 || ratio > 2 {
+		t.Fatalf("prediction %.3f too far from searched scale %.3f", guess, best.scale)
+	}
+	if best.size > 4000 {
+		t.Fatalf("seeded search returned an oversized probe: %d", best.size)
+	}
+}
+
+func TestSearchIterations(t *testing.T) {
+	img := makeTestImage(600, 450)
+	coarse := newScaleProbes(img, 4000, jpegEncoding{})
+	fine := newScaleProbes(img, 4000, jpegEncoding{})
+	a := findBestScaleBinary(ctx(), nil, coarse, 600, 450, 4000, 2, 0)
+	b := findBestScaleBinary(ctx(), nil, fine, 600, 450, 4000, scaleBinaryIterations, 0)
+	if a == nil || b == nil {
+		t.Fatal("expected a fitting scale from both searches")
+	}
+	if len(coarse.results) >= len(fine.results) {
+		t.Errorf("2 iterations probed %d sizes, default %d; want fewer", len(coarse.results), len(fine.results))
+	}
+	if a.scale > b.scale {
+		t.Errorf("coarse search found scale %.4f above the finer %.4f", a.scale, b.scale)
+	}
+
+	// End to end, a low cap still hits the target.
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.TargetSize = 4000
+	opts.SearchIterations = 3
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.CompressedSize > 4000 {
+		t.Errorf("SearchIterations 3: %d bytes, over the 4000-byte target", result.CompressedSize)
+	}
+}
+
+func TestBetterFitTolerance(t *testing.T) {
+	inBand := &sizeResult{data: make([]byte, 950), ssim: 0.90}
+	below := &sizeResult{data: make([]byte, 600), ssim: 0.95}
+
+	if betterFit(inBand, below, 1000, 0, false) {
+		t.Fatal("without tolerance, higher SSIM should win")
+	}
+	if !betterFit(inBand, below, 1000, 0.1, false) {
+		t.Fatal("with tolerance, in-band candidate should win")
+	}
+
+	top := &sizeResult{data: make([]byte, 990), ssim: 0.80}
+	if !betterFit(top, inBand, 1000, 0.1, false) {
+		t.Fatal("candidate closest to the top of the band should win")
+	}
+}
+
+func TestBetterFitPrefersPNGForGraphics(t *testing.T) {
+	jpgFit := &sizeResult{data: make([]byte, 900), format: JPEG, quality: 60, ssim: 0.955}
+	pngFit := &sizeResult{data: make([]byte, 800), format: PNG, ssim: 0.950}
+
+	if betterFit(pngFit, jpgFit, 1000, 0, false) {
+		t.Fatal("for photos, the higher-SSIM JPEG should win")
+	}
+	if !betterFit(pngFit, jpgFit, 1000, 0, true) || betterFit(jpgFit, pngFit, 1000, 0, true) {
+		t.Fatal("for graphics, a PNG within the SSIM margin should win")
+	}
+	jpgFit.ssim = pngFit.ssim + 2*graphicSSIMMargin
+	if betterFit(pngFit, jpgFit, 1000, 0, true) {
+		t.Fatal("a JPEG well above the margin should still win")
+	}
+}
+
+// makeScreenshot draws a UI-like image: a title bar, a sidebar, and rows
+// of colored "text" whose pixels are anti-aliased into about 200 shades.
+func makeScreenshot(w, h int) *image.NRGBA {
+	img := makeSolidImage(w, h, color.NRGBA{245, 245, 245, 255})
+	inks := []color.NRGBA{{30, 30, 30, 255}, {0, 102, 204, 255}, {220, 53, 69, 255}, {40, 167, 69, 255}}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			switch {
+			case y < 30:
+				img.SetNRGBA(x, y, color.NRGBA{52, 58, 64, 255})
+			case x < 120:
+				img.SetNRGBA(x, y, color.NRGBA{233, 236, 239, 255})
+			case y%14 < 9 && (x/6)%7 != 6 && (x*7+y*3)%11 < 6 && x < w-40:
+				c := inks[(y/14)%len(inks)]
+				k := int(uint32(x*2654435761^y*40503) >> 7 % 50)
+				c.R = uint8(int(c.R) + (245-int(c.R))*k/60)
+				c.G = uint8(int(c.G) + (245-int(c.G))*k/60)
+				c.B = uint8(int(c.B) + (245-int(c.B))*k/60)
+				img.SetNRGBA(x, y, c)
+			}
+		}
+	}
+	return img
+}
+
+func TestCompressTargetSizeScreenshotPrefersPNG(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TargetSize = 20000
+	result, err := CompressImage(ctx(), makeScreenshot(480, 320), opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if result.Format != PNG || result.CompressedSize > int64(opts.TargetSize) {
+		t.Fatalf("got %v %d bytes (%s), want an indexed PNG under %d",
+			result.Format, result.CompressedSize, result.Strategy, opts.TargetSize)
+	}
+}
+
+func TestCompressNilImage(t *testing.T) {
+	_, err := CompressImage(ctx(), nil, DefaultOptions())
+	if err == nil {
+		t.Fatal("should error on nil image")
+	}
+	if !errors.Is(err, ErrNilImage) {
+		t.Fatalf("expected ErrNilImage, got %v", err)
+	}
+}
+
+func TestCompressEmptyImage(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 0, 0))
+	_, err := CompressImage(ctx(), img, DefaultOptions())
+	if err == nil {
+		t.Fatal("should error on empty image")
+	}
+	if !errors.Is(err, ErrEmptyImage) {
+		t.Fatalf("expected ErrEmptyImage, got %v", err)
+	}
+}
+
+func TestCompressOptimizeOnly(t *testing.T) {
+	img := makeTestImage(300, 200)
+	var jpg, pngData bytes.Buffer
+	if err := jpeg.Encode(&jpg, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&pngData, makeSolidImage(300, 200, color.NRGBA{40, 90, 200, 255})); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.OptimizeOnly = true
+	opts.MaxWidth = 100
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want Format
+	}{
+		{"jpeg", jpg.Bytes(), JPEG},
+		{"png", pngData.Bytes(), PNG},
+	} {
+		result, err := CompressBytes(ctx(), tc.data, opts)
+		if err != nil {
+			t.Fatalf("%s: CompressBytes failed: %v", tc.name, err)
+		}
+		if result.Format != tc.want {
+			t.Errorf("%s: format = %v, want %v", tc.name, result.Format, tc.want)
+		}
+		if d := result.FinalDimensions; d != (image.Point{300, 200}) {
+			t.Errorf("%s: dimensions = %v, want 300x200 despite MaxWidth", tc.name, d)
+		}
+	}
+
+	// A size target may still downscale, but keeps the input format.
+	target := opts
+	target.TargetSize = 8 * 1024
+	result, err := CompressBytes(ctx(), pngData.Bytes(), target)
+	if err != nil {
+		t.Fatalf("target: CompressBytes failed: %v", err)
+	}
+	if result.Format != PNG {
+		t.Errorf("target: format = %v, want PNG", result.Format)
+	}
+
+	bad := opts
+	bad.Format = JPEG
+	if _, err := CompressBytes(ctx(), jpg.Bytes(), bad); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("OptimizeOnly with Format JPEG: expected ErrInvalidOptions, got %v", err)
+	}
+}
+
+// ── Sentinel Error Tests ────────────────────────────────────────────────────
+
+func TestErrNoCompressedData(t *testing.T) {
+	r := &Result{}
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	if !errors.Is(err, ErrNoCompressedData) {
+		t.Fatalf("expected ErrNoCompressedData, got %v", err)
+	}
+}
+
+func TestErrUnsupportedFormat(t *testing.T) {
+	img := makeTestImage(100, 100)
+	var buf bytes.Buffer
+	err := Encode(&buf, img, Format(99), DefaultOptions())
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("expected ErrUnsupportedFormat, got %v", err)
+	}
+}
+
+func TestErrDecode(t *testing.T) {
+	_, err := CompressBytes(context.Background(), []byte("not an image"), DefaultOptions())
+	if !errors.Is(err, ErrDecode) {
+		t.Fatalf("expected ErrDecode, got %v", err)
+	}
+	if _, _, _, err := DecodeConfig(bytes.NewReader([]byte("junk"))); !errors.Is(err, ErrDecode) {
+		t.Fatalf("DecodeConfig: expected ErrDecode, got %v", err)
+	}
+}
+
+func TestErrInvalidOptions(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxWidth = -1
+	if err := opts.Validate(); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("Validate: expected ErrInvalidOptions, got %v", err)
+	}
+	var q Quality
+	if err := q.UnmarshalText([]byte("superb")); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("UnmarshalText: expected ErrInvalidOptions, got %v", err)
+	}
+}
+
+func TestErrTargetUnreachable(t *testing.T) {
+	img := makeTestImage(64, 64)
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.TargetSize = 100
+
+	// Best effort by default: a result, just over the target.
+	result, err := CompressImage(context.Background(), img, opts)
+	if err != nil {
+		t.Fatalf("best-effort target size failed: %v", err)
+	}
+	if result.CompressedSize <= 100 {
+		t.Fatalf("expected a result over the 100-byte target, got %d bytes", result.CompressedSize)
+	}
+
+	opts.StrictTargetSize = true
+	if _, err := CompressImage(context.Background(), img, opts); !errors.Is(err, ErrTargetUnreachable) {
+		t.Fatalf("expected ErrTargetUnreachable, got %v", err)
+	}
+}
+
+func TestErrEmptyCrop(t *testing.T) {
+	img := makeTestImage(10, 10)
+	if _, err := Crop(img, image.Rect(5, 5, 5, 8)); !errors.Is(err, ErrEmptyImage) {
+		t.Fatalf("expected ErrEmptyImage, got %v", err)
+	}
+}
+
+// ── Options.Validate Tests ──────────────────────────────────────────────────
+
+func TestOptionsValidate(t *testing.T) {
+	t.Run("valid_defaults", func(t *testing.T) {
+		opts := DefaultOptions()
+		if err := opts.Validate(); err != nil {
+			t.Fatalf("DefaultOptions should be valid: %v", err)
+		}
+	})
+
+	t.Run("negative_target_ssim", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.TargetSSIM = -0.5
+		if err := opts.Validate(); err == nil {
+			t.Fatal("negative TargetSSIM should be invalid")
+		}
+	})
+
+	t.Run("target_ssim_over_1", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.TargetSSIM = 1.5
+		if err := opts.Validate(); err == nil {
+			t.Fatal("TargetSSIM > 1.0 should be invalid")
+		}
+	})
+
+	t.Run("negative_target_size", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.TargetSize = -100
+		if err := opts.Validate(); err == nil {
+			t.Fatal("negative TargetSize should be invalid")
+		}
+	})
+
+	t.Run("target_size_below_floor", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.TargetSize = minTargetSize - 1
+		if err := opts.Validate(); err == nil {
+			t.Fatal("TargetSize below the floor should be invalid")
+		}
+	})
+
+	t.Run("target_size_tolerance_out_of_range", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.TargetSizeTolerance = 1.0
+		if err := opts.Validate(); err == nil {
+			t.Fatal("TargetSizeTolerance >= 1.0 should be invalid")
+		}
+	})
+
+	t.Run("negative_search_iterations", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.SearchIterations = -1
+		if err := opts.Validate(); err == nil {
+			t.Fatal("negative SearchIterations should be invalid")
+		}
+	})
+
+	t.Run("brightness_contrast_out_of_range", func(t *testing.T) {
+		for _, v := range []float64{-1.5, 1.01, math.NaN()} {
+			opts := DefaultOptions()
+			opts.Brightness = v
+			if err := opts.Validate(); err == nil {
+				t.Fatalf("Brightness %v should be invalid", v)
+			}
+			opts = DefaultOptions()
+			opts.Contrast = v
+			if err := opts.Validate(); err == nil {
+				t.Fatalf("Contrast %v should be invalid", v)
+			}
+		}
+	})
+
+	t.Run("denoise_out_of_range", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.Denoise = -0.1
+		if err := opts.Validate(); err == nil {
+			t.Fatal("negative Denoise should be invalid")
+		}
+	})
+
+	t.Run("sharpen_out_of_range", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.Sharpen = 1.5
+		if err := opts.Validate(); err == nil {
+			t.Fatal("Sharpen > 1.0 should be invalid")
+		}
+	})
+
+	t.Run("negative_max_width", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.MaxWidth = -1
+		if err := opts.Validate(); err == nil {
+			t.Fatal("negative MaxWidth should be invalid")
+		}
+	})
+
+	t.Run("invalid_quant_tables", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.QuantTables = TablesFlat + 1
+		if err := opts.Validate(); err == nil {
+			t.Fatal("unknown QuantTables should be invalid")
+		}
+	})
+
+	t.Run("half_exact_size", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.ExactSize = image.Pt(100, 0)
+		if err := opts.Validate(); err == nil {
+			t.Fatal("ExactSize with one zero side should be invalid")
+		}
+	})
+
+	t.Run("conflicting_targets", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.TargetSize = 50000
+		opts.TargetBPP = 1.0
+		if err := opts.Validate(); !errors.Is(err, ErrInvalidOptions) {
+			t.Fatalf("TargetSize with TargetBPP should be invalid, got %v", err)
+		}
+		opts.TargetBPP = 0
+		opts.TargetSSIM = 0.95
+		if err := opts.Validate(); !errors.Is(err, ErrInvalidOptions) {
+			t.Fatalf("TargetSize with TargetSSIM should be invalid, got %v", err)
+		}
+	})
+
+	t.Run("target_ratio", func(t *testing.T) {
+		for _, ratio := range []float64{-2, 0.5, 1, math.NaN(), math.Inf(1)} {
+			opts := DefaultOptions()
+			opts.TargetRatio = ratio
+			if err := opts.Validate(); !errors.Is(err, ErrInvalidOptions) {
+				t.Fatalf("TargetRatio %v should be invalid, got %v", ratio, err)
+			}
+		}
+		opts := DefaultOptions()
+		opts.TargetRatio = 4
+		opts.TargetBPP = 1.0
+		if err := opts.Validate(); !errors.Is(err, ErrInvalidOptions) {
+			t.Fatalf("TargetRatio with TargetBPP should be invalid, got %v", err)
+		}
+	})
+
+	t.Run("negative_target_bpp", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.TargetBPP = -1
+		if err := opts.Validate(); err == nil {
+			t.Fatal("negative TargetBPP should be invalid")
+		}
+	})
+
+	t.Run("comment_with_nul", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.JPEGComment = "a\x00b"
+		if err := opts.Validate(); err == nil {
+			t.Fatal("JPEGComment with NUL should be invalid")
+		}
+	})
+
+	t.Run("bad_png_comment_keyword", func(t *testing.T) {
+		for _, k := range []string{" lead", "trail ", strings.Repeat("k", 80), "tab\t"} {
+			opts := DefaultOptions()
+			opts.PNGCommentKeyword = k
+			if err := opts.Validate(); err == nil {
+				t.Fatalf("PNGCommentKeyword %q should be invalid", k)
+			}
+		}
+	})
+
+	t.Run("valid_custom", func(t *testing.T) {
+		opts := Options{
+			Quality:    High,
+			TargetSSIM: 0.98,
+			MaxWidth:   1920,
+			MaxHeight:  1080,
+		}
+		if err := opts.Validate(); err != nil {
+			t.Fatalf("valid custom options should pass: %v", err)
+		}
+	})
+}
+
+func TestCompressInvalidOptions(t *testing.T) {
+	img := makeTestImage(100, 100)
+	opts := DefaultOptions()
+	opts.TargetSSIM = -1
+	_, err := CompressImage(ctx(), img, opts)
+	if err == nil {
+		t.Fatal("should reject invalid options")
+	}
+}
+
+// ── Context Cancellation Tests ──────────────────────────────────────────────
+
+func TestCompressContextCancelled(t *testing.T) {
+	img := makeTestImage(200, 200)
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel() // Cancel immediately.
+
+	_, err := CompressImage(cancelledCtx, img, DefaultOptions())
+	if err == nil {
+		t.Fatal("should error on cancelled context")
+	}
+}
+
+func TestCompressTargetSizeCancelledMidSearch(t *testing.T) {
+	img := makeNoisyImage(2000, 1500)
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.TargetSize = 20000
+
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var cancelledAt atomic.Value
+	opts.OnProgress = func(stage ProgressStage, _ float64) error {
+		if stage == StageCompressing {
+			time.AfterFunc(100*time.Millisecond, func() {
+				cancelledAt.Store(time.Now())
+				cancel()
+			})
+		}
+		return nil
+	}
+
+	_, err := CompressImage(cancelCtx, img, opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	at, ok := cancelledAt.Load().(time.Time)
+	if !ok {
+		t.Fatal("search finished before it could be cancelled")
+	}
+	if d := time.Since(at); d > 2*time.Second {
+		t.Fatalf("search kept running %v after cancellation", d)
+	}
+}
+
+// ── CompressBytes Test ──────────────────────────────────────────────────────
+
+func TestCompressBytes(t *testing.T) {
+	img := makeTestImage(100, 100)
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+
+	result, err := CompressBytes(ctx(), buf.Bytes(), DefaultOptions())
+	if err != nil {
+		t.Fatalf("CompressBytes failed: %v", err)
+	}
+	if len(result.CompressedData) == 0 {
+		t.Fatal("CompressedData should not be empty")
+	}
+	if result.OriginalSize != int64(buf.Len()) {
+		t.Fatalf("OriginalSize = %d, want %d", result.OriginalSize, buf.Len())
+	}
+}
+
+func TestCompressor(t *testing.T) {
+	img := makeTestImage(100, 100)
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+
+	opts := DefaultOptions()
+	opts.MaxWidth = 64
+	focus := image.Rect(0, 0, 50, 50)
+	opts.FocusRegion = &focus
+	c, err := New(opts)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	focus = image.Rectangle{} // Must not reach c.
+	if got := c.Options().FocusRegion; got == nil || got.Empty() {
+		t.Fatalf("Options().FocusRegion = %v, want the region at New", got)
+	}
+
+	opts.FocusRegion = &image.Rectangle{Max: image.Pt(50, 50)}
+	want, err := CompressBytes(ctx(), buf.Bytes(), opts)
+	if err != nil {
+		t.Fatalf("CompressBytes failed: %v", err)
+	}
+
+	// One Compressor shared by many goroutines matches the package-level call.
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := c.CompressBytes(ctx(), buf.Bytes())
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(result.CompressedData, want.CompressedData) {
+				errs <- fmt.Errorf("output differs from CompressBytes (%d vs %d bytes)",
+					result.CompressedSize, want.CompressedSize)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// The calls above drew on c's own pool, which no other Compressor shares.
+	pooled := 0
+	c.opts.scratch.pix.pools.Range(func(any, any) bool { pooled++; return true })
+	if pooled == 0 {
+		t.Error("Compressor calls left no buffers in its pool")
+	}
+	other, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.opts.scratch == nil || other.opts.scratch == c.opts.scratch {
+		t.Error("each Compressor should own a separate pool")
+	}
+	if c.Options().scratch != nil {
+		t.Error("Options() should not hand out the Compressor's pool")
+	}
+
+	bad := DefaultOptions()
+	bad.MaxWidth = -1
+	if _, err := New(bad); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("New with invalid options: expected ErrInvalidOptions, got %v", err)
+	}
+}
+
+func TestCompressTo(t *testing.T) {
+	img := makeTestImage(120, 80)
+	opts := DefaultOptions()
+	opts.Format = JPEG
+
+	want, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	result, err := CompressTo(ctx(), &buf, img, opts)
+	if err != nil {
+		t.Fatalf("CompressTo failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), want.CompressedData) {
+		t.Fatalf("streamed %d bytes, CompressImage produced %d", buf.Len(), len(want.CompressedData))
+	}
+	if result.CompressedData != nil {
+		t.Error("CompressedData should be nil after streaming")
+	}
+	if result.CompressedSize != int64(buf.Len()) {
+		t.Errorf("CompressedSize = %d, want %d", result.CompressedSize, buf.Len())
+	}
+	if result.SSIM != want.SSIM || result.JPEGQuality != want.JPEGQuality {
+		t.Errorf("stats differ: got SSIM %.4f Q=%d, want SSIM %.4f Q=%d",
+			result.SSIM, result.JPEGQuality, want.SSIM, want.JPEGQuality)
+	}
+
+	if _, err := CompressTo(ctx(), errWriter{}, img, opts); err == nil {
+		t.Fatal("expected the writer's error")
+	}
+}
+
+func TestCompressVariants(t *testing.T) {
+	img := makeTestImage(240, 160)
+	variant := func(format Format, quality Quality, maxWidth int) Options {
+		opts := DefaultOptions()
+		opts.Format, opts.Quality, opts.MaxWidth = format, quality, maxWidth
+		return opts
+	}
+	variants := []Options{
+		variant(JPEG, High, 120),
+		variant(PNG, Balanced, 120),
+		variant(JPEG, Aggressive, 0),
+		variant(JPEG, Maximum, 120),
+	}
+
+	results, err := CompressVariants(ctx(), img, variants)
+	if err != nil {
+		t.Fatalf("CompressVariants failed: %v", err)
+	}
+	if len(results) != len(variants) {
+		t.Fatalf("got %d results, want %d", len(results), len(variants))
+	}
+	for i, opts := range variants {
+		want, err := CompressImage(ctx(), img, opts)
+		if err != nil {
+			t.Fatalf("variant %d: CompressImage failed: %v", i, err)
+		}
+		got := results[i]
+		if !bytes.Equal(got.CompressedData, want.CompressedData) {
+			t.Errorf("variant %d: output differs from CompressImage (%d vs %d bytes)",
+				i, len(got.CompressedData), len(want.CompressedData))
+		}
+		if got.FinalDimensions != want.FinalDimensions || got.Format != want.Format {
+			t.Errorf("variant %d: got %v %v, want %v %v",
+				i, got.Format, got.FinalDimensions, want.Format, want.FinalDimensions)
+		}
+	}
+	for i := range results {
+		for j := range i {
+			if &results[i].Image.Pix[0] == &results[j].Image.Pix[0] {
+				t.Errorf("variants %d and %d share Image pixels", j, i)
+			}
+		}
+	}
+
+	bad := append([]Options{}, variants...)
+	bad[2].MaxWidth = -1
+	if _, err := CompressVariants(ctx(), img, bad); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected ErrInvalidOptions for an invalid variant, got %v", err)
+	}
+	if _, err := CompressVariants(ctx(), nil, variants); !errors.Is(err, ErrNilImage) {
+		t.Fatalf("expected ErrNilImage, got %v", err)
+	}
+}
+
+func TestCompressWithThumbnail(t *testing.T) {
+	img := makeTestImage(480, 320)
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.MaxHeight = 240
+	opts.TargetSize = 20 * 1024
+
+	full, thumb, err := CompressWithThumbnail(ctx(), img, opts, 120)
+	if err != nil {
+		t.Fatalf("CompressWithThumbnail failed: %v", err)
+	}
+	want, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if !bytes.Equal(full.CompressedData, want.CompressedData) {
+		t.Errorf("full output differs from CompressImage (%d vs %d bytes)",
+			len(full.CompressedData), len(want.CompressedData))
+	}
+	if full.FinalDimensions.Y > 240 {
+		t.Errorf("full dimensions = %v, want at most 240 high", full.FinalDimensions)
+	}
+	if thumb.FinalDimensions != image.Pt(120, 80) {
+		t.Errorf("thumbnail dimensions = %v, want 120x80", thumb.FinalDimensions)
+	}
+	if thumb.CompressedSize >= full.CompressedSize {
+		t.Errorf("thumbnail (%d bytes) not smaller than full image (%d bytes)",
+			thumb.CompressedSize, full.CompressedSize)
+	}
+	if thumb.Strategy != "" {
+		t.Errorf("thumbnail used the target-size engine (%q)", thumb.Strategy)
+	}
+
+	// The thumbnail is sharpened by default.
+	plain := opts
+	plain.MaxWidth, plain.MaxHeight, plain.TargetSize = 120, 0, 0
+	unsharpened, err := CompressImage(ctx(), img, plain)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if bytes.Equal(thumb.Image.Pix, unsharpened.Image.Pix) {
+		t.Error("thumbnail was not sharpened")
+	}
+
+	c, err := New(opts)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, _, err := c.CompressWithThumbnail(ctx(), img, 0); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("expected ErrInvalidOptions for width 0, got %v", err)
+	}
+	if _, _, err := c.CompressWithThumbnail(ctx(), nil, 120); !errors.Is(err, ErrNilImage) {
+		t.Errorf("expected ErrNilImage, got %v", err)
+	}
+}
+
+// errWriter fails every write.
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+// ── DecodeConfig Tests ──────────────────────────────────────────────────────
+
+func TestDecodeConfig(t *testing.T) {
+	img := makeTestImage(120, 80)
+	var jpg, pngBuf bytes.Buffer
+	jpeg.Encode(&jpg, img, nil)
+	png.Encode(&pngBuf, img)
+
+	for _, tc := range []struct {
+		data   []byte
+		format string
+	}{{jpg.Bytes(), "jpeg"}, {pngBuf.Bytes(), "png"}} {
+		w, h, format, err := DecodeConfig(bytes.NewReader(tc.data))
+		if err != nil {
+			t.Fatalf("%s: DecodeConfig failed: %v", tc.format, err)
+		}
+		if w != 120 || h != 80 || format != tc.format {
+			t.Fatalf("got %dx%d %q, want 120x80 %q", w, h, format, tc.format)
+		}
+	}
+
+	if _, _, _, err := DecodeConfig(bytes.NewReader([]byte("not an image"))); err == nil {
+		t.Fatal("should error on invalid image data")
+	}
+}
+
+func TestDimensionsOf(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "in.png")
+	if err := Save(makeTestImage(64, 32), path, DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	w, h, format, err := DimensionsOf(path)
+	if err != nil {
+		t.Fatalf("DimensionsOf failed: %v", err)
+	}
+	if w != 64 || h != 32 || format != "png" {
+		t.Fatalf("got %dx%d %q, want 64x32 \"png\"", w, h, format)
+	}
+
+	if _, _, _, err := DimensionsOf(filepath.Join(dir, "missing.png")); err == nil {
+		t.Fatal("should error on missing file")
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	img := makeTestImage(40, 30)
+	var jpg, pngBuf bytes.Buffer
+	jpeg.Encode(&jpg, img, nil)
+	png.Encode(&pngBuf, img)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want Format
+	}{
+		{"jpeg", jpg.Bytes(), JPEG},
+		{"png", pngBuf.Bytes(), PNG},
+		{"jpeg prefix", jpg.Bytes()[:4], JPEG},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), GIF},
+		{"tiff", encodeTestTIFF(img, tiffNone, false, 8), Auto},
+		{"bmp", encodeTestBMP(img), Auto},
+		{"registered", []byte(rawTestMagic + "\x01\x01\x00\x00\x00"), Auto},
+	} {
+		got, err := DetectFormat(tc.data)
+		if err != nil {
+			t.Fatalf("%s: DetectFormat failed: %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	for _, data := range [][]byte{nil, []byte("not an image")} {
+		got, err := DetectFormat(data)
+		if !errors.Is(err, ErrUnsupportedFormat) || got != Auto {
+			t.Fatalf("%q: got %v, %v; want Auto, ErrUnsupportedFormat", data, got, err)
+		}
+	}
+}
+
+func TestSourceFormat(t *testing.T) {
+	img := makeTestImage(40, 30)
+	var jpg, pngBuf, gifBuf bytes.Buffer
+	jpeg.Encode(&jpg, img, nil)
+	png.Encode(&pngBuf, img)
+	gif.Encode(&gifBuf, img, nil)
+
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want Format
+	}{
+		{"jpeg", jpg.Bytes(), JPEG},
+		{"png", pngBuf.Bytes(), PNG},
+		{"gif", gifBuf.Bytes(), GIF},
+		{"tiff", encodeTestTIFF(img, tiffNone, false, 8), OtherFormat},
+		{"bmp", encodeTestBMP(img), OtherFormat},
+	} {
+		result, err := CompressBytes(ctx(), tc.data, opts)
+		if err != nil {
+			t.Fatalf("%s: CompressBytes failed: %v", tc.name, err)
+		}
+		if result.SourceFormat != tc.want || result.Format != JPEG {
+			t.Errorf("%s: got %v → %v, want %v → JPEG", tc.name, result.SourceFormat, result.Format, tc.want)
+		}
+	}
+
+	// The file, reader, and TIFF page paths report it too.
+	path := filepath.Join(t.TempDir(), "in.png")
+	os.WriteFile(path, pngBuf.Bytes(), 0644)
+	if result, err := CompressFile(ctx(), path, path+".jpg", opts); err != nil || result.SourceFormat != PNG {
+		t.Errorf("CompressFile: got %v, %v; want PNG", result, err)
+	}
+	if result, err := Compress(ctx(), bytes.NewReader(gifBuf.Bytes()), opts); err != nil || result.SourceFormat != GIF {
+		t.Errorf("Compress: got %v, %v; want GIF", result, err)
+	}
+	pages, err := CompressPages(ctx(), bytes.NewReader(encodeTestTIFF(img, tiffNone, false, 8)), opts)
+	if err != nil || pages[0].SourceFormat != OtherFormat {
+		t.Errorf("CompressPages: got %v, %v; want Other", pages, err)
+	}
+
+	// An image.Image has no source format.
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SourceFormat != Auto {
+		t.Errorf("CompressImage: got %v, want Auto", result.SourceFormat)
+	}
+
+	data, err := json.Marshal(&Result{SourceFormat: OtherFormat})
+	if err != nil || !strings.Contains(string(data), `"source_format":"Other"`) {
+		t.Errorf("JSON: got %s, %v", data, err)
+	}
+	var f Format
+	if err := json.Unmarshal([]byte(`"other"`), &f); err != nil || f != OtherFormat {
+		t.Errorf("Unmarshal: got %v, %v", f, err)
+	}
+	if _, err := New(Options{Format: OtherFormat}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("Format OtherFormat: expected ErrInvalidOptions, got %v", err)
+	}
+}
+
+// ── TIFF and BMP Decode Tests ───────────────────────────────────────────────
+
+func TestDecodeTIFF(t *testing.T) {
+	rgb := makeNoisyImage(37, 23)
+	gray := toGray(rgb)
+	for _, compression := range []int{tiffNone, tiffLZW, tiffDeflate, tiffPackBits} {
+		for _, predictor := range []bool{false, true} {
+			for _, src := range []image.Image{rgb, gray} {
+				data := encodeTestTIFF(src, compression, predictor, 7)
+				img, format, err := decodeImage(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("compression %d, predictor %v: %v", compression, predictor, err)
+				}
+				if format != "tiff" {
+					t.Fatalf("format = %q, want tiff", format)
+				}
+				if cr := Compare(src, img); !cr.Identical {
+					t.Fatalf("compression %d, predictor %v, %T: max delta %d",
+						compression, predictor, src, cr.MaxDelta)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeTIFFLZWTableReset(t *testing.T) {
+	// Enough incompressible data to fill the 4096-entry LZW table, so the
+	// encoder has to emit clear codes mid-strip.
+	img := makeNoisyImage(200, 150)
+	data := encodeTestTIFF(img, tiffLZW, false, 150)
+	got, _, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr := Compare(img, got); !cr.Identical {
+		t.Fatalf("max delta %d", cr.MaxDelta)
+	}
+}
+
+func TestBuiltinDecodersNotRegistered(t *testing.T) {
+	// Fennec's TIFF and BMP decoders must not leak into image.Decode for
+	// the rest of the program.
+	img := makeTestImage(8, 8)
+	for name, data := range map[string][]byte{
+		"tiff": encodeTestTIFF(img, tiffNone, false, 8),
+		"bmp":  encodeTestBMP(img),
+	} {
+		if _, _, err := image.Decode(bytes.NewReader(data)); !errors.Is(err, image.ErrFormat) {
+			t.Errorf("%s: image.Decode err = %v, want image.ErrFormat", name, err)
+		}
+		if _, _, format, err := DecodeConfig(bytes.NewReader(data)); err != nil || format != name {
+			t.Errorf("%s: DecodeConfig = %q, %v", name, format, err)
+		}
+	}
+}
+
+func TestDecodeBMP(t *testing.T) {
+	img := makeNoisyImage(33, 17) // odd width exercises row padding
+	data := encodeTestBMP(img)
+
+	w, h, format, err := DecodeConfig(bytes.NewReader(data))
+	if err != nil || w != 33 || h != 17 || format != "bmp" {
+		t.Fatalf("DecodeConfig = %dx%d %q, %v", w, h, format, err)
+	}
+	got, _, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr := Compare(img, got); !cr.Identical {
+		t.Fatalf("max delta %d", cr.MaxDelta)
+	}
+
+	// Flip to top-down by negating the height and reversing the rows.
+	stride := (33*3 + 3) &^ 3
+	topDown := append([]byte(nil), data[:54]...)
+	binary.LittleEndian.PutUint32(topDown[22:], uint32(0xffffffff-17+1))
+	for y := 16; y >= 0; y-- {
+		topDown = append(topDown, data[54+y*stride:54+(y+1)*stride]...)
+	}
+	got, _, err = decodeImage(bytes.NewReader(topDown))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr := Compare(img, got); !cr.Identical {
+		t.Fatalf("top-down: max delta %d", cr.MaxDelta)
+	}
+}
+
+func TestDecodeTIFFRejectsTiles(t *testing.T) {
+	data := encodeTestTIFF(makeTestImage(8, 8), tiffNone, false, 8)
+	// Retag RowsPerStrip (278) as TileWidth (322). The IFD is no longer
+	// sorted, but the decoder doesn't depend on tag order.
+	i := bytes.Index(data, []byte{0x16, 0x01, 0x04, 0x00})
+	if i < 0 {
+		t.Fatal("RowsPerStrip entry not found")
+	}
+	binary.LittleEndian.PutUint16(data[i:], tiffTileWidth)
+	if _, _, err := decodeImage(bytes.NewReader(data)); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("tiled TIFF: got %v, want ErrUnsupportedFormat", err)
+	}
+}
+
+func TestCompressPages(t *testing.T) {
+	wide := image.NewGray16(image.Rect(0, 0, 50, 40))
+	for i := range wide.Pix {
+		wide.Pix[i] = uint8(i * 7)
+	}
+	pages := []image.Image{makeNoisyImage(120, 80), toGray(makeTestImage(60, 90)), wide}
+	data := encodeTestTIFFPages(pages, tiffLZW, false, 16)
+
+	if img, _, err := decodeImage(bytes.NewReader(data)); err != nil || img.Bounds().Size() != image.Pt(120, 80) {
+		t.Fatalf("decodeImage should read the first page: %v", err)
+	}
+
+	results, err := CompressPages(ctx(), bytes.NewReader(data), DefaultOptions())
+	if err != nil {
+		t.Fatalf("CompressPages failed: %v", err)
+	}
+	if len(results) != len(pages) {
+		t.Fatalf("got %d results, want %d", len(results), len(pages))
+	}
+	for i, r := range results {
+		if want := pages[i].Bounds().Size(); r.FinalDimensions != want {
+			t.Fatalf("page %d: got %v, want %v", i, r.FinalDimensions, want)
+		}
+		if r.OriginalSize <= 0 || len(r.CompressedData) == 0 {
+			t.Fatalf("page %d: OriginalSize %d, %d bytes of output", i, r.OriginalSize, len(r.CompressedData))
+		}
+	}
+
+	// A next-IFD pointer back to the first page must not loop forever.
+	single := encodeTestTIFF(makeTestImage(16, 16), tiffNone, false, 16)
+	ifd := binary.LittleEndian.Uint32(single[4:])
+	count := binary.LittleEndian.Uint16(single[ifd:])
+	binary.LittleEndian.PutUint32(single[int(ifd)+2+int(count)*12:], ifd)
+	if results, err := CompressPages(ctx(), bytes.NewReader(single), DefaultOptions()); err != nil || len(results) != 1 {
+		t.Fatalf("looping TIFF: got %d results, %v; want 1", len(results), err)
+	}
+
+	// Other formats are one page.
+	var pngBuf bytes.Buffer
+	png.Encode(&pngBuf, makeTestImage(30, 20))
+	if results, err := CompressPages(ctx(), &pngBuf, DefaultOptions()); err != nil || len(results) != 1 {
+		t.Fatalf("PNG: got %d results, %v; want 1", len(results), err)
+	}
+}
+
+func TestAnimatedInputRejected(t *testing.T) {
+	// A three-frame GIF, built by hand; the frame count is read before
+	// decoding.
+	gifData := []byte("GIF89a\x10\x00\x10\x00\x80\x00\x00\x00\x00\x00\xff\xff\xff")
+	for range 3 {
+		gifData = append(gifData, 0x21, 0xF9, 4, 0, 10, 0, 0, 0) // Graphic control extension.
+		gifData = append(gifData, 0x2C, 0, 0, 0, 0, 16, 0, 16, 0, 0, 2, 2, 0x4C, 0x01, 0)
+	}
+	gifData = append(gifData, 0x3B)
+	if format, n := animationFrames(bytes.NewReader(gifData)); format != "gif" || n != 3 {
+		t.Fatalf("GIF: got %s with %d frames, want gif with 3", format, n)
+	}
+
+	var pngBuf bytes.Buffer
+	png.Encode(&pngBuf, makeTestImage(16, 16))
+	apng, err := insertPNGChunk(pngBuf.Bytes(), "acTL", []byte{0, 0, 0, 2, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"gif": gifData, "apng": apng} {
+		if _, err := CompressBytes(ctx(), data, DefaultOptions()); !errors.Is(err, ErrAnimated) {
+			t.Errorf("%s: CompressBytes: expected ErrAnimated, got %v", name, err)
+		}
+		path := filepath.Join(t.TempDir(), "in")
+		os.WriteFile(path, data, 0644)
+		if _, err := CompressFile(ctx(), path, path+".out", DefaultOptions()); !errors.Is(err, ErrAnimated) {
+			t.Errorf("%s: CompressFile: expected ErrAnimated, got %v", name, err)
+		}
+		if _, err := Open(path); !errors.Is(err, ErrAnimated) || !strings.HasPrefix(err.Error(), "fennec: ") {
+			t.Errorf("%s: Open: expected ErrAnimated, got %v", name, err)
+		}
+	}
+	// Compress checks after decoding, from what the decoder read.
+	if _, err := Compress(ctx(), bytes.NewReader(apng), DefaultOptions()); !errors.Is(err, ErrAnimated) {
+		t.Errorf("apng: Compress: expected ErrAnimated, got %v", err)
+	}
+
+	// A still PNG, and an APNG whose only frame is the image, still compress.
+	still, _ := insertPNGChunk(pngBuf.Bytes(), "acTL", []byte{0, 0, 0, 1, 0, 0, 0, 0})
+	for name, data := range map[string][]byte{"png": pngBuf.Bytes(), "one-frame apng": still} {
+		if _, err := Compress(ctx(), bytes.NewReader(data), DefaultOptions()); err != nil {
+			t.Errorf("%s: Compress failed: %v", name, err)
+		}
+	}
+
+	// Animated WebP counts its ANMF chunks.
+	webp := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, chunk := range []string{"VP8X", "ANIM", "ANMF", "ANMF"} {
+		webp = append(webp, chunk...)
+		webp = append(webp, 3, 0, 0, 0, 1, 2, 3, 0) // Odd size, padded.
+	}
+	if format, n := animationFrames(bytes.NewReader(webp)); format != "webp" || n != 2 {
+		t.Errorf("animated WebP: got %s with %d frames, want webp with 2", format, n)
+	}
+}
+
+// ── Compress from io.Reader ─────────────────────────────────────────────────
+
+func TestCompressFromReader(t *testing.T) {
+	img := makeTestImage(100, 100)
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+
+	result, err := Compress(ctx(), &buf, DefaultOptions())
+	if err != nil {
+		t.Fatalf("Compress failed: %v", err)
+	}
+	if len(result.CompressedData) == 0 {
+		t.Fatal("CompressedData should not be empty")
+	}
+	if result.FinalDimensions.X != 100 || result.FinalDimensions.Y != 100 {
+		t.Fatalf("unexpected dimensions: %dx%d", result.FinalDimensions.X, result.FinalDimensions.Y)
+	}
+}
+
+func TestCompressFromReaderInvalid(t *testing.T) {
+	r := bytes.NewReader([]byte("not an image"))
+	_, err := Compress(ctx(), r, DefaultOptions())
+	if err == nil {
+		t.Fatal("should error on invalid image data")
+	}
+}
+
+// ── Result.WriteTo Test ─────────────────────────────────────────────────────
+
+func TestResultWriteTo(t *testing.T) {
+	img := makeTestImage(100, 100)
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := result.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if n != int64(len(result.CompressedData)) {
+		t.Fatalf("WriteTo wrote %d bytes, expected %d", n, len(result.CompressedData))
+	}
+	if buf.Len() == 0 {
+		t.Fatal("WriteTo output should not be empty")
+	}
+}
+
+// ── Progress Callback Test ──────────────────────────────────────────────────
+
+func TestProgressCallback(t *testing.T) {
+	img := makeTestImage(100, 100)
+	var stages []ProgressStage
+
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.OnProgress = func(stage ProgressStage, percent float64) error {
+		stages = append(stages, stage)
+		return nil
+	}
+
+	_, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if len(stages) == 0 {
+		t.Fatal("progress callback was never called")
+	}
+}
+
+func TestProgressTargetSizeSearch(t *testing.T) {
+	img := makeTestImage(300, 300)
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.TargetSize = 5000
+
+	var percents []float64
+	opts.OnProgress = func(stage ProgressStage, percent float64) error {
+		if stage == StageCompressing {
+			percents = append(percents, percent)
+		}
+		return nil
+	}
+
+	if _, err := CompressImage(ctx(), img, opts); err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if len(percents) < 5 {
+		t.Fatalf("expected incremental search progress, got %v", percents)
+	}
+	for i, p := range percents {
+		if p < 0.2 || p > 0.9 {
+			t.Fatalf("search progress %f outside [0.2, 0.9]", p)
+		}
+		if i > 0 && p < percents[i-1] {
+			t.Fatalf("search progress went backwards: %v", percents)
+		}
+	}
+}
+
+func TestProgressTargetSizeAbort(t *testing.T) {
+	img := makeTestImage(300, 300)
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.TargetSize = 5000
+
+	errStop := errors.New("stop")
+	calls := 0
+	opts.OnProgress = func(stage ProgressStage, percent float64) error {
+		if stage == StageCompressing && percent > 0.3 {
+			calls++
+			return errStop
+		}
+		return nil
+	}
+
+	_, err := CompressImage(ctx(), img, opts)
+	if !errors.Is(err, errStop) {
+		t.Fatalf("expected the callback's error, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("search kept reporting after the callback failed: %d calls", calls)
+	}
+}
+
+// ── Resize Tests ────────────────────────────────────────────────────────────
+
+func TestLanczosResize(t *testing.T) {
+	img := makeTestImage(100, 100)
+
+	small := lanczosResize(img, 50, 50)
+	if small.Bounds().Dx() != 50 || small.Bounds().Dy() != 50 {
+		t.Fatalf("expected 50x50, got %dx%d", small.Bounds().Dx(), small.Bounds().Dy())
+	}
+
+	big := lanczosResize(img, 200, 200)
+	if big.Bounds().Dx() != 200 || big.Bounds().Dy() != 200 {
+		t.Fatalf("expected 200x200, got %dx%d", big.Bounds().Dx(), big.Bounds().Dy())
+	}
+
+	same := lanczosResize(img, 100, 100)
+	if same.Bounds().Dx() != 100 || same.Bounds().Dy() != 100 {
+		t.Fatalf("expected 100x100, got %dx%d", same.Bounds().Dx(), same.Bounds().Dy())
+	}
+}
+
+func TestLanczosResizeQuality(t *testing.T) {
+	img := makeTestImage(100, 100)
+	small := lanczosResize(img, 50, 50)
+	restored := lanczosResize(small, 100, 100)
+
+	ssim := SSIM(img, restored)
+	if ssim < 0.5 {
+		t.Fatalf("Lanczos round-trip quality too low: %f", ssim)
+	}
+}
+
+func TestSmartResize(t *testing.T) {
+	img := makeTestImage(1000, 500)
+
+	resized := smartResize(img, 200, 200, false, resampling{})
+	if resized.Bounds().Dx() > 200 || resized.Bounds().Dy() > 200 {
+		t.Fatalf("should fit in 200x200, got %dx%d", resized.Bounds().Dx(), resized.Bounds().Dy())
+	}
+
+	resized = smartResize(img, 2000, 2000, false, resampling{})
+	if resized.Bounds().Dx() != 1000 || resized.Bounds().Dy() != 500 {
+		t.Fatal("should not resize when already fits")
+	}
+}
+
+func TestSmartResizeUpscale(t *testing.T) {
+	img := makeTestImage(100, 100)
+
+	resized := smartResize(img, 300, 300, true, resampling{})
+	if resized.Bounds().Dx() != 300 || resized.Bounds().Dy() != 300 {
+		t.Fatalf("should enlarge to 300x300, got %dx%d", resized.Bounds().Dx(), resized.Bounds().Dy())
+	}
+
+	// A zero dimension is unconstrained: only the width limits the scale.
+	resized = smartResize(makeTestImage(100, 50), 300, 0, true, resampling{})
+	if resized.Bounds().Dx() != 300 || resized.Bounds().Dy() != 150 {
+		t.Fatalf("should enlarge to 300x150, got %dx%d", resized.Bounds().Dx(), resized.Bounds().Dy())
+	}
+
+	result, err := CompressImage(ctx(), img, Options{
+		Quality: Balanced, Format: PNG, MaxWidth: 300, MaxHeight: 300, AllowUpscale: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FinalDimensions != image.Pt(300, 300) {
+		t.Fatalf("FinalDimensions = %v, want (300,300)", result.FinalDimensions)
+	}
+}
+
+func TestLinearResize(t *testing.T) {
+	// Every sRGB level survives the round trip through linear light.
+	for v := range 256 {
+		if got := linearToSRGB(srgbToLinear[v]); got != uint8(v) {
+			t.Fatalf("linearToSRGB(srgbToLinear[%d]) = %d", v, got)
+		}
+	}
+
+	// A 1px black/white checkerboard is half white's light: sRGB 188 when
+	// averaged in linear light, but about 128 when averaged in sRGB.
+	board := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := range 64 {
+		for x := range 64 {
+			v := uint8(255 * ((x + y) % 2))
+			board.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+		}
+	}
+	mean := func(img *image.NRGBA) float64 {
+		var sum float64
+		for i := 0; i < len(img.Pix); i += 4 {
+			sum += float64(img.Pix[i])
+		}
+		return sum / float64(len(img.Pix)/4)
+	}
+	if m := mean(lanczosResizeAlpha(board, 16, 16, resampling{})); math.Abs(m-128) > 4 {
+		t.Errorf("sRGB downscale mean = %.1f, want about 128", m)
+	}
+	for _, straight := range []bool{false, true} {
+		if m := mean(lanczosResizeAlpha(board, 16, 16, resampling{straight: straight, linear: true})); math.Abs(m-188) > 4 {
+			t.Errorf("linear downscale (straight %v) mean = %.1f, want about 188", straight, m)
+		}
+	}
+
+	// The option reaches the pipeline, and transparency is handled as in
+	// the sRGB path.
+	opts := Options{Format: PNG, Quality: Lossless, MaxWidth: 16, LinearResize: true}
+	result, err := CompressImage(ctx(), board, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if m := mean(result.Image); math.Abs(m-188) > 4 {
+		t.Errorf("LinearResize output mean = %.1f, want about 188", m)
+	}
+	alpha := makeTestImageWithAlpha(64, 64)
+	want := lanczosResizeAlpha(alpha, 16, 16, resampling{})
+	got := lanczosResizeAlpha(alpha, 16, 16, resampling{linear: true})
+	for i := 3; i < len(got.Pix); i += 4 {
+		if d := int(got.Pix[i]) - int(want.Pix[i]); d < -1 || d > 1 {
+			t.Fatalf("alpha at byte %d = %d, sRGB path gives %d", i, got.Pix[i], want.Pix[i])
+		}
+	}
+}
+
+func TestResizeFilter(t *testing.T) {
+	// Ringing shows as overshoot past a hard edge: deepest for Lanczos3,
+	// about half that for Lanczos2, and least for Mitchell.
+	edge := image.NewNRGBA(image.Rect(0, 0, 16, 4))
+	for y := range 4 {
+		for x := range 16 {
+			v := uint8(32)
+			if x >= 8 {
+				v = 223
+			}
+			edge.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+		}
+	}
+	overshoot := map[ResizeFilter]int{}
+	for _, f := range []ResizeFilter{Lanczos3, Lanczos2, Mitchell} {
+		up := lanczosResizeAlpha(edge, 64, 4, resampling{filter: f})
+		for i := 0; i < len(up.Pix); i += 4 {
+			overshoot[f] = max(overshoot[f], int(up.Pix[i])-223)
+		}
+	}
+	if !(overshoot[Lanczos3] > overshoot[Lanczos2] && overshoot[Lanczos2] > overshoot[Mitchell]) {
+		t.Errorf("overshoot Lanczos3 %d, Lanczos2 %d, Mitchell %d; want decreasing",
+			overshoot[Lanczos3], overshoot[Lanczos2], overshoot[Mitchell])
+	}
+
+	// Each filter reaches the pipeline and survives a down-and-up round trip.
+	src := makeTestImage(96, 64)
+	for _, f := range []ResizeFilter{Lanczos3, Lanczos2, Mitchell} {
+		opts := Options{Format: PNG, Quality: Lossless, MaxWidth: 48, ResizeFilter: f}
+		result, err := CompressImage(ctx(), src, opts)
+		if err != nil {
+			t.Fatalf("%v: CompressImage failed: %v", f, err)
+		}
+		if got := result.Image.Bounds().Size(); got != image.Pt(48, 32) {
+			t.Fatalf("%v: got %v, want 48x32", f, got)
+		}
+		up := lanczosResizeAlpha(result.Image, 96, 64, resampling{filter: f})
+		if ssim := SSIMFast(src, up); ssim < 0.9 {
+			t.Errorf("%v: round-trip SSIM = %.4f, want >= 0.9", f, ssim)
+		}
+	}
+
+	if _, err := New(Options{ResizeFilter: Mitchell + 1}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("invalid ResizeFilter: expected ErrInvalidOptions, got %v", err)
+	}
+}
+
+func TestSmartResizeRounding(t *testing.T) {
+	resized := smartResize(makeTestImage(1001, 1000), 500, 500, false, resampling{})
+	if got := resized.Bounds().Size(); got != image.Pt(500, 500) {
+		t.Fatalf("1001x1000 into 500x500 = %v, want 500x500", got)
+	}
+
+	// Sizes whose scaled sides land near .5, where rounding both sides
+	// independently drifts.
+	sizes := [][2]int{{1001, 1000}, {1000, 1001}, {999, 333}, {1023, 767}, {3, 1000}, {4000, 3}, {1919, 1081}, {641, 479}}
+	boxes := [][2]int{{500, 500}, {500, 0}, {0, 500}, {333, 250}, {101, 77}, {1, 1}, {1920, 0}, {640, 480}}
+	for _, s := range sizes {
+		for _, b := range boxes {
+			srcW, srcH, maxW, maxH := s[0], s[1], b[0], b[1]
+			w, h := fitBox(srcW, srcH, maxW, maxH)
+			if (maxW > 0 && w > maxW) || (maxH > 0 && h > maxH) || w < 1 || h < 1 {
+				t.Errorf("%dx%d into %dx%d = %dx%d, outside the box", srcW, srcH, maxW, maxH, w, h)
+				continue
+			}
+			if w != maxW && h != maxH {
+				t.Errorf("%dx%d into %dx%d = %dx%d, neither side meets the box", srcW, srcH, maxW, maxH, w, h)
+			}
+			// The side not at its limit is the nearest integer to the
+			// exact ratio, unless clamped to 1 or to the box.
+			if w == maxW && h > 1 && h != maxH {
+				if d := 2 * (h*srcW - srcH*w); d > srcW || d < -srcW {
+					t.Errorf("%dx%d into %dx%d = %dx%d, height drifts from the ratio", srcW, srcH, maxW, maxH, w, h)
+				}
+			} else if h == maxH && w > 1 && w != maxW {
+				if d := 2 * (w*srcH - srcW*h); d > srcH || d < -srcH {
+					t.Errorf("%dx%d into %dx%d = %dx%d, width drifts from the ratio", srcW, srcH, maxW, maxH, w, h)
+				}
+			}
+		}
+	}
+}
+
+func TestCompressExactSize(t *testing.T) {
+	img := makeTestImage(160, 90) // 16:9 into a 4:3 box
+	for _, fit := range []FitMode{FitContain, FitCover, FitStretch} {
+		opts := DefaultOptions()
+		opts.Format = JPEG
+		opts.ExactSize = image.Pt(80, 60)
+		opts.ExactFit = fit
+		result, err := CompressImage(ctx(), img, opts)
+		if err != nil {
+			t.Fatalf("%v: %v", fit, err)
+		}
+		if result.FinalDimensions != image.Pt(80, 60) {
+			t.Fatalf("%v: FinalDimensions = %v, want (80,60)", fit, result.FinalDimensions)
+		}
+		if fit == FitContain {
+			// Letterboxed: the top rows are padding, flattened to white.
+			if c := result.Image.NRGBAAt(40, 0); c != (color.NRGBA{255, 255, 255, 255}) {
+				t.Fatalf("padding = %v, want white", c)
+			}
+		}
+	}
+}
+
+func TestLanczosResizeZero(t *testing.T) {
+	img := makeTestImage(100, 100)
+	result := lanczosResize(img, 0, 50)
+	if result.Bounds().Dx() != 0 || result.Bounds().Dy() != 0 {
+		t.Fatal("resize with zero width should return empty image")
+	}
+}
+
+func TestDownsampleAndLuminance(t *testing.T) {
+	// Four 2×2 quadrants average to one pixel each. RGBA input is converted.
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	quad := []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 255, 255}}
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			img.Set(x, y, quad[y/2*2+x/2])
+		}
+	}
+	small := Downsample(img, 2, 2)
+	for i, want := range quad {
+		if got := small.NRGBAAt(i%2, i/2); got != (color.NRGBA{want.R, want.G, want.B, want.A}) {
+			t.Errorf("pixel %d = %v, want %v", i, got, want)
+		}
+	}
+	if got := Downsample(img, 0, 2).Bounds(); !got.Empty() {
+		t.Errorf("Downsample to width 0 = %v, want empty", got)
+	}
+
+	lum := Luminance(small)
+	want := []float64{0.299 * 255, 0.587 * 255, 0.114 * 255, 255}
+	if len(lum) != len(want) {
+		t.Fatalf("Luminance returned %d values, want %d", len(lum), len(want))
+	}
+	for i := range want {
+		if math.Abs(lum[i]-want[i]) > 1e-9 {
+			t.Errorf("luma %d = %f, want %f", i, lum[i], want[i])
+		}
+	}
+	// The slice belongs to the caller: a second call must not reuse it.
+	lum[0] = -1
+	if again := Luminance(small); again[0] == -1 {
+		t.Fatal("Luminance returned a shared buffer")
+	}
+}
+
+func TestParallelDoCost(t *testing.T) {
+	// Little work runs in order on the calling goroutine.
+	var order []int
+	parallelDoCost(0, 16, 64, func(i int) { order = append(order, i) })
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("small job: item %d ran as %d, want in-order serial run", i, got)
+		}
+	}
+	if len(order) != 16 {
+		t.Fatalf("small job: ran %d items, want 16", len(order))
+	}
+
+	// Lots of work still covers every item exactly once.
+	const n = 1024
+	var seen [n]atomic.Int32
+	parallelDoCost(0, n, minParallelWork, func(i int) { seen[i].Add(1) })
+	for i := range seen {
+		if c := seen[i].Load(); c != 1 {
+			t.Fatalf("large job: item %d ran %d times, want 1", i, c)
+		}
+	}
+}
+
+func TestResizeExact(t *testing.T) {
+	img := makeTestImage(400, 200)
+	cases := []struct {
+		mode FitMode
+		w, h int
+		want image.Point
+	}{
+		{FitContain, 100, 100, image.Pt(100, 50)},
+		{FitContain, 800, 800, image.Pt(800, 400)}, // upscales
+		{FitCover, 100, 100, image.Pt(100, 100)},
+		{FitCover, 50, 300, image.Pt(50, 300)},
+		{FitStretch, 120, 90, image.Pt(120, 90)},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%v_%dx%d", tc.mode, tc.w, tc.h), func(t *testing.T) {
+			out := ResizeExact(img, tc.w, tc.h, tc.mode)
+			if got := out.Bounds().Size(); got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	if out := ResizeExact(img, 0, 100, FitStretch); !out.Bounds().Empty() {
+		t.Fatalf("zero width should give an empty image, got %v", out.Bounds())
+	}
+}
+
+func TestResizeExactCoverCentersCrop(t *testing.T) {
+	// Left half red, right half blue: a square cover crop keeps both halves.
+	img := image.NewNRGBA(image.Rect(0, 0, 300, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 300; x++ {
+			c := color.NRGBA{255, 0, 0, 255}
+			if x >= 150 {
+				c = color.NRGBA{0, 0, 255, 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	out := ResizeExact(img, 100, 100, FitCover)
+	if l, r := out.NRGBAAt(5, 50), out.NRGBAAt(94, 50); l.R < 200 || r.B < 200 {
+		t.Fatalf("cover crop should be centered, got left %v right %v", l, r)
+	}
+}
+
+func TestCompressStraightAlpha(t *testing.T) {
+	// Left half opaque red; right half fully transparent but storing green,
+	// as a texture with a separate alpha mask would.
+	img := image.NewNRGBA(image.Rect(0, 0, 128, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 128; x++ {
+			c := color.NRGBA{255, 0, 0, 255}
+			if x >= 64 {
+				c = color.NRGBA{0, 200, 0, 0}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	for _, straight := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.Format = PNG
+		opts.Quality = Lossless
+		opts.MaxWidth = 64
+		opts.StraightAlpha = straight
+		result, err := CompressImage(ctx(), img, opts)
+		if err != nil {
+			t.Fatalf("straight=%v: CompressImage failed: %v", straight, err)
+		}
+		decoded, err := png.Decode(bytes.NewReader(result.CompressedData))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Bounds().Dx() != 64 {
+			t.Fatalf("straight=%v: width %d, want 64", straight, decoded.Bounds().Dx())
+		}
+		// NRGBAModel keeps the color of a transparent NRGBA pixel, which
+		// a premultiplied round trip would zero.
+		at := func(x, y int) color.NRGBA {
+			return color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+		}
+		c := at(48, 16)
+		if c.A != 0 {
+			t.Fatalf("straight=%v: transparent region got alpha %d", straight, c.A)
+		}
+		if got := c.G > 190 && c.R < 10; got != straight {
+			t.Fatalf("straight=%v: hidden color %v survived = %v", straight, c, got)
+		}
+		if edge := at(10, 16); edge.R < 250 || edge.A != 255 {
+			t.Fatalf("straight=%v: opaque region changed to %v", straight, edge)
+		}
+	}
+}
+
+// ── Analysis Tests ──────────────────────────────────────────────────────────
+
+func TestEstimate(t *testing.T) {
+	img := makeTestImage(400, 300)
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	est := Estimate(img, opts)
+	if est.Format != JPEG || est.Dimensions != image.Pt(400, 300) || len(est.Presets) != 7 {
+		t.Fatalf("Estimate = %v %v with %d presets", est.Format, est.Dimensions, len(est.Presets))
+	}
+	var prev int64
+	for _, p := range est.Presets[:5] { // Maximum through Ultra.
+		if p.Size < prev {
+			t.Errorf("%v: %d bytes, smaller than the preset below (%d)", p.Quality, p.Size, prev)
+		}
+		prev = p.Size
+		o := opts
+		o.Quality = p.Quality
+		r, err := CompressImage(ctx(), img, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ratio := float64(p.Size) / float64(r.CompressedSize); ratio < 0.5 || ratio > 2 {
+			t.Errorf("%v: estimated %d bytes, actual %d", p.Quality, p.Size, r.CompressedSize)
+		}
+		if math.Abs(p.SSIM-r.SSIM) > 0.05 || p.JPEGQuality < 1 || p.JPEGQuality > 100 {
+			t.Errorf("%v: estimated q=%d SSIM %.4f, actual q=%d SSIM %.4f", p.Quality, p.JPEGQuality, p.SSIM, r.JPEGQuality, r.SSIM)
+		}
+	}
+	if p, ok := est.Preset(NearLossless); !ok || p.JPEGQuality < nearLosslessMinQuality {
+		t.Errorf("NearLossless estimate %+v below the quality floor", p)
+	}
+
+	// Resizing options set the output size the estimate scales to.
+	opts.MaxWidth = 200
+	small := Estimate(img, opts)
+	if small.Dimensions != image.Pt(200, 150) {
+		t.Fatalf("MaxWidth 200: dimensions %v, want 200x150", small.Dimensions)
+	}
+	if a, b := small.Presets[2].Size, est.Presets[2].Size; a >= b {
+		t.Errorf("Balanced at 200px: %d bytes, want below %d at full size", a, b)
+	}
+
+	png := Estimate(makeScreenshot(300, 200), DefaultOptions())
+	if png.Format != PNG || png.Presets[0].SSIM != 1 || png.Presets[0].Size <= 0 || png.Presets[0].JPEGQuality != 0 {
+		t.Fatalf("screenshot estimate = %v %+v, want lossless PNG", png.Format, png.Presets[0])
+	}
+	if est := Estimate(nil, DefaultOptions()); est.Presets != nil {
+		t.Fatalf("nil image: got %+v", est)
+	}
+}
+
+func TestAnalyzeWithEdgeThreshold(t *testing.T) {
+	// Faint strokes, 6 levels darker than the page, with scanner noise:
+	// too many colors for a palette, too faint for the default threshold.
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 200; x++ {
+			v := uint8(200)
+			if x/2%2 == 1 {
+				v -= 6
+			}
+			n := uint32(x*73856093^y*19349663) * 2654435761 >> 20
+			img.SetNRGBA(x, y, color.NRGBA{v + uint8(n&7), v + uint8(n>>3&3), v + uint8(n>>5&7), 255})
+		}
+	}
+
+	def := Analyze(img)
+	if got := AnalyzeWith(img, AnalyzeOptions{}); got != def {
+		t.Fatalf("zero AnalyzeOptions = %+v, want Analyze's %+v", got, def)
+	}
+	if def.UniqueColors <= 256 || def.RecommendedFormat != JPEG {
+		t.Fatalf("default: %d colors, %v; want > 256 colors and JPEG", def.UniqueColors, def.RecommendedFormat)
+	}
+	faint := AnalyzeWith(img, AnalyzeOptions{EdgeThreshold: 15})
+	if faint.EdgeDensity <= def.EdgeDensity || faint.RecommendedFormat != PNG {
+		t.Fatalf("threshold 15: edge density %.3f (default %.3f), %v; want higher and PNG",
+			faint.EdgeDensity, def.EdgeDensity, faint.RecommendedFormat)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	t.Run("gradient", func(t *testing.T) {
+		img := makeTestImage(200, 200)
+		stats := Analyze(img)
+		if stats.Width != 200 || stats.Height != 200 {
+			t.Fatalf("wrong dimensions: %dx%d", stats.Width, stats.Height)
+		}
+		if stats.HasAlpha {
+			t.Fatal("should not have alpha")
+		}
+		if stats.Entropy < 1 {
+			t.Fatalf("entropy too low for gradient: %f", stats.Entropy)
+		}
+	})
+
+	t.Run("solid_color", func(t *testing.T) {
+		img := makeSolidImage(100, 100, color.NRGBA{128, 128, 128, 255})
+		stats := Analyze(img)
+		if !stats.IsGrayscale {
+			t.Fatal("should be grayscale")
+		}
+		if stats.Entropy > 0.01 {
+			t.Fatalf("entropy should be ~0 for solid color: %f", stats.Entropy)
+		}
+	})
+
+	t.Run("with_alpha", func(t *testing.T) {
+		img := makeTestImageWithAlpha(100, 100)
+		stats := Analyze(img)
+		if !stats.HasAlpha {
+			t.Fatal("should have alpha")
+		}
+		if stats.RecommendedFormat != PNG {
+			t.Fatal("should recommend PNG for alpha image")
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		img := image.NewNRGBA(image.Rect(0, 0, 0, 0))
+		stats := Analyze(img)
+		if stats.Width != 0 || stats.Height != 0 {
+			t.Fatal("empty image should have zero dimensions")
+		}
+	})
+
+	t.Run("bands_match_sequential", func(t *testing.T) {
+		img := makeNoisyImage(300, 200)
+		img.SetNRGBA(299, 199, color.NRGBA{10, 20, 30, 200})
+
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+		seq := Analyze(img)
+		runtime.GOMAXPROCS(7)
+		par := Analyze(img)
+
+		if par.UniqueColors != seq.UniqueColors || par.HasAlpha != seq.HasAlpha ||
+			par.IsGrayscale != seq.IsGrayscale || par.Entropy != seq.Entropy {
+			t.Fatalf("banded scan differs: %+v vs %+v", par, seq)
+		}
+		if math.Abs(par.MeanBrightness-seq.MeanBrightness) > 1e-9 {
+			t.Fatalf("brightness differs: %f vs %f", par.MeanBrightness, seq.MeanBrightness)
+		}
+		if !par.HasAlpha || par.UniqueColors != 1024 {
+			t.Fatalf("expected alpha and capped colors, got %+v", par)
+		}
+	})
+}
+
+func TestRecommendFormat(t *testing.T) {
+	if f := RecommendFormat(makeTestImageWithAlpha(100, 100)); f != PNG {
+		t.Fatalf("alpha image: got %s, want PNG", f)
+	}
+	if f := RecommendFormat(makeStripedImage(100, 100, 5)); f != PNG {
+		t.Fatalf("two-color image: got %s, want PNG", f)
+	}
+
+	img := makeTestImage(200, 200)
+	result, err := CompressImage(ctx(), img, DefaultOptions())
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if f := RecommendFormat(img); f != result.Format {
+		t.Fatalf("RecommendFormat = %s, but Auto compression chose %s", f, result.Format)
+	}
+}
+
+func TestRecommendQuality(t *testing.T) {
+	img := makeTestImage(200, 200)
+	if q, want := RecommendQuality(img), Analyze(img).RecommendedQuality; q != want {
+		t.Fatalf("RecommendQuality = %s, Analyze recommends %s", q, want)
+	}
+}
+
+func TestImageMetrics(t *testing.T) {
+	for _, img := range []*image.NRGBA{makeTestImage(300, 200), makeStripedImage(64, 64, 4), makeNoisyImage(120, 90)} {
+		stats := Analyze(img)
+		checks := []struct {
+			name      string
+			got, want float64
+		}{
+			{"Entropy", Entropy(img), stats.Entropy},
+			{"EdgeDensity", EdgeDensity(img), stats.EdgeDensity},
+			{"Contrast", Contrast(img), stats.Contrast},
+		}
+		for _, c := range checks {
+			if math.Abs(c.got-c.want) > 1e-9 {
+				t.Errorf("%v: %s = %f, Analyze reports %f", img.Bounds().Size(), c.name, c.got, c.want)
+			}
+		}
+	}
+
+	empty := image.NewNRGBA(image.Rect(0, 0, 0, 0))
+	if Entropy(empty) != 0 || EdgeDensity(empty) != 0 || Contrast(empty) != 0 {
+		t.Fatal("metrics of an empty image should be 0")
+	}
+}
+
+// ── Effects Tests ───────────────────────────────────────────────────────────
+
+func TestSharpen(t *testing.T) {
+	img := makeStripedImage(100, 100, 10)
+
+	sharpened := Sharpen(img, 0.8)
+	if sharpened.Bounds() != img.Bounds() {
+		t.Fatal("sharpen should preserve dimensions")
+	}
+
+	changed := false
+	for i := 0; i < len(img.Pix); i++ {
+		if img.Pix[i] != sharpened.Pix[i] {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		t.Fatal("sharpen should change some pixels")
+	}
+}
+
+func TestSharpenZeroStrength(t *testing.T) {
+	img := makeTestImage(100, 100)
+	result := Sharpen(img, 0)
+	// Should return the same pointer (no-op).
+	if result != img {
+		t.Fatal("Sharpen(0) should return original image unchanged")
+	}
+}
+
+func TestSharpenClampedStrength(t *testing.T) {
+	img := makeStripedImage(100, 100, 10)
+	// Strength > 1 should be clamped to 1.
+	result := Sharpen(img, 5.0)
+	if result.Bounds() != img.Bounds() {
+		t.Fatal("sharpen with high strength should preserve dimensions")
+	}
+}
+
+func TestSharpenTinyImage(t *testing.T) {
+	img := makeTestImage(2, 2)
+	result := Sharpen(img, 0.5)
+	// Image too small for sharpen, should return original.
+	if result != img {
+		t.Fatal("Sharpen on tiny image should return original")
+	}
+}
+
+func TestAdaptiveSharpen(t *testing.T) {
+	img := makeStripedImage(100, 100, 10)
+
+	sharpened := AdaptiveSharpen(img, 0.5)
+	if sharpened.Bounds() != img.Bounds() {
+		t.Fatal("adaptive sharpen should preserve dimensions")
+	}
+
+	// Should affect edge pixels more than smooth areas.
+	changed := false
+	for i := 0; i < len(img.Pix); i++ {
+		if img.Pix[i] != sharpened.Pix[i] {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		t.Fatal("adaptive sharpen should change some pixels")
+	}
+}
+
+func TestAdaptiveSharpenZero(t *testing.T) {
+	img := makeTestImage(100, 100)
+	result := AdaptiveSharpen(img, 0)
+	if result != img {
+		t.Fatal("AdaptiveSharpen(0) should return original image unchanged")
+	}
+}
+
+func TestAdaptiveSharpenTinyImage(t *testing.T) {
+	img := makeTestImage(2, 2)
+	result := AdaptiveSharpen(img, 0.5)
+	if result != img {
+		t.Fatal("AdaptiveSharpen on tiny image should return original")
+	}
+}
+
+func TestGaussianBlur(t *testing.T) {
+	img := makeTestImage(100, 100)
+	blurred := GaussianBlur(img, 2.0)
+	if blurred.Bounds() != img.Bounds() {
+		t.Fatal("blur should preserve dimensions")
+	}
+	ssim := SSIM(img, blurred)
+	if ssim < 0.3 {
+		t.Fatalf("blur changed image too much: SSIM %f", ssim)
+	}
+}
+
+func TestGaussianBlurZeroSigma(t *testing.T) {
+	img := makeTestImage(100, 100)
+	result := GaussianBlur(img, 0)
+	// Should return the same pointer (no-op).
+	if result != img {
+		t.Fatal("GaussianBlur(0) should return original image unchanged")
+	}
+}
+
+func TestGaussianBlurNegativeSigma(t *testing.T) {
+	img := makeTestImage(100, 100)
+	result := GaussianBlur(img, -1.0)
+	if result != img {
+		t.Fatal("GaussianBlur(negative) should return original image unchanged")
+	}
+}
+
+func TestGaussianBlurLargeSigma(t *testing.T) {
+	img := makeTestImage(100, 100)
+	blurred := GaussianBlur(img, 20.0)
+	if blurred.Bounds() != img.Bounds() {
+		t.Fatal("large sigma blur should preserve dimensions")
+	}
+	// Large blur should reduce SSIM compared to identity.
+	ssim := SSIM(img, blurred)
+	if ssim > 0.999 {
+		t.Fatalf("large blur should noticeably reduce SSIM, got %f", ssim)
+	}
+}
+
+func makeNoisyImage(w, h int) *image.NRGBA {
+	img := makeSolidImage(w, h, color.NRGBA{128, 128, 128, 255})
+	seed := uint32(7)
+	for i := 0; i < len(img.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			seed = seed*1664525 + 1013904223
+			img.Pix[i+c] = uint8(int(img.Pix[i+c]) + int(seed>>27) - 16)
+		}
+	}
+	return img
+}
+
+func TestAutoLevels(t *testing.T) {
+	// A dim, low-contrast image: values 40..100, with a warm tint.
+	dim := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			v := uint8(40 + x*60/63)
+			dim.SetNRGBA(x, y, color.NRGBA{v + 10, v, v - 10, 255})
+		}
+	}
+	leveled := AutoLevels(dim)
+	if leveled == dim {
+		t.Fatal("AutoLevels should adjust a dim image")
+	}
+	minLum, maxLum := 255.0, 0.0
+	for i := 0; i < len(leveled.Pix); i += 4 {
+		p := leveled.Pix[i : i+4]
+		lum := 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+		minLum, maxLum = math.Min(minLum, lum), math.Max(maxLum, lum)
+		// One map for every channel keeps the red-over-blue tint.
+		if p[0] < p[2] {
+			t.Fatalf("color cast at pixel %d: %v", i/4, p)
+		}
+	}
+	if maxLum-minLum < 220 {
+		t.Fatalf("luminance range %.0f..%.0f, want it stretched to about 0..255", minLum, maxLum)
+	}
+
+	full := makeSolidImage(64, 64, color.NRGBA{0, 0, 0, 255})
+	for i := len(full.Pix) / 2; i < len(full.Pix); i++ {
+		full.Pix[i] = 255 // bottom half white
+	}
+	if AutoLevels(full) != full {
+		t.Fatal("AutoLevels should return a full-range image unchanged")
+	}
+	flat := makeSolidImage(16, 16, color.NRGBA{90, 90, 90, 255})
+	if AutoLevels(flat) != flat {
+		t.Fatal("AutoLevels should return a flat image unchanged")
+	}
+
+	opts := DefaultOptions()
+	opts.Format = PNG
+	opts.AutoLevels = true
+	result, err := CompressImage(ctx(), dim, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if !bytes.Equal(result.Image.Pix, leveled.Pix) {
+		t.Fatal("Options.AutoLevels should level the image before encoding")
+	}
+}
+
+func TestAdjustBrightnessContrast(t *testing.T) {
+	img := makeSolidImage(8, 8, color.NRGBA{128, 100, 156, 200})
+	if AdjustBrightnessContrast(img, 0, 0) != img {
+		t.Fatal("zero adjustment should return the image unchanged")
+	}
+
+	// Brightness shifts midtones by brightness×255 and keeps alpha.
+	got := AdjustBrightnessContrast(img, 0.2, 0).Pix[:4]
+	if want := []uint8{179, 151, 207, 200}; !bytes.Equal(got, want) {
+		t.Errorf("brightness 0.2: %v, want %v", got, want)
+	}
+	// Contrast stretches values away from mid-gray, which stays put.
+	got = AdjustBrightnessContrast(img, 0, 0.5).Pix[:4]
+	if want := []uint8{128, 86, 170, 200}; !bytes.Equal(got, want) {
+		t.Errorf("contrast 0.5: %v, want %v", got, want)
+	}
+	got = AdjustBrightnessContrast(img, 0, -1).Pix[:4]
+	if want := []uint8{128, 128, 128, 200}; !bytes.Equal(got, want) {
+		t.Errorf("contrast -1: %v, want flat gray %v", got, want)
+	}
+	// Results saturate instead of wrapping.
+	got = AdjustBrightnessContrast(img, 1, 1).Pix[:4]
+	if want := []uint8{255, 255, 255, 200}; !bytes.Equal(got, want) {
+		t.Errorf("brightness 1, contrast 1: %v, want %v", got, want)
+	}
+	got = AdjustBrightnessContrast(img, -0.5, 0).Pix[:4]
+	if want := []uint8{1, 0, 29, 200}; !bytes.Equal(got, want) {
+		t.Errorf("brightness -0.5: %v, want %v", got, want)
+	}
+
+	src := makeTestImage(64, 48)
+	opts := DefaultOptions()
+	opts.Format = PNG
+	opts.Brightness, opts.Contrast = 0.1, 0.3
+	result, err := CompressImage(ctx(), src, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if !bytes.Equal(result.Image.Pix, AdjustBrightnessContrast(src, 0.1, 0.3).Pix) {
+		t.Fatal("Options.Brightness and Contrast should adjust the image before encoding")
+	}
+}
+
+func TestDenoise(t *testing.T) {
+	noisy := makeNoisyImage(100, 100)
+	if Denoise(noisy, 0) != noisy {
+		t.Fatal("Denoise(0) should return original image unchanged")
+	}
+
+	variance := func(img *image.NRGBA) float64 {
+		var sum, sq float64
+		for i := 0; i < len(img.Pix); i += 4 {
+			v := float64(img.Pix[i])
+			sum += v
+			sq += v * v
+		}
+		n := float64(len(img.Pix) / 4)
+		mean := sum / n
+		return sq/n - mean*mean
+	}
+	denoised := Denoise(noisy, 1.0)
+	if variance(denoised) >= variance(noisy)*0.7 {
+		t.Fatalf("Denoise should reduce noise variance: %f -> %f", variance(noisy), variance(denoised))
+	}
+
+	striped := makeStripedImage(100, 100, 10)
+	if ssim := SSIM(striped, Denoise(striped, 1.0)); ssim < 0.98 {
+		t.Fatalf("Denoise should preserve clean edges, SSIM %f", ssim)
+	}
+}
+
+func TestCompressDenoise(t *testing.T) {
+	noisy := makeNoisyImage(200, 200)
+	opts := DefaultOptions()
+	opts.Format = JPEG
+
+	plain, err := CompressImage(ctx(), noisy, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	opts.Denoise = 1.0
+	clean, err := CompressImage(ctx(), noisy, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if clean.CompressedSize >= plain.CompressedSize {
+		t.Fatalf("denoised output (%d bytes) should be smaller than noisy (%d bytes)",
+			clean.CompressedSize, plain.CompressedSize)
+	}
+}
+
+func TestBoxBlur(t *testing.T) {
+	img := makeTestImageWithAlpha(100, 100)
+	if BoxBlur(img, 0) != img {
+		t.Fatal("BoxBlur(0) should return original image unchanged")
+	}
+
+	blurred := BoxBlur(img, 5)
+	if blurred.Bounds() != img.Bounds() {
+		t.Fatal("blur should preserve dimensions")
+	}
+	for i := 3; i < len(img.Pix); i += 4 {
+		if blurred.Pix[i] != img.Pix[i] {
+			t.Fatal("BoxBlur should preserve alpha")
+		}
+	}
+
+	solid := makeSolidImage(50, 50, color.NRGBA{10, 200, 90, 255})
+	if !bytes.Equal(BoxBlur(solid, 7).Pix, solid.Pix) {
+		t.Fatal("blurring a solid image should not change it")
+	}
+
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 5, 0), image.Rect(0, 0, 0, 5)} {
+		empty := image.NewNRGBA(r)
+		if got := BoxBlur(empty, 3).Bounds(); got != r {
+			t.Fatalf("BoxBlur of %v returned %v", r, got)
+		}
+		if got := GaussianBlur(empty, 2*boxBlurSigma).Bounds(); got != r {
+			t.Fatalf("GaussianBlur of %v returned %v", r, got)
+		}
+	}
+}
+
+func TestBoxBlurApproximatesGaussian(t *testing.T) {
+	img := makeStripedImage(200, 200, 10)
+	exact := GaussianBlur(img, boxBlurSigma) // Largest sigma on the exact path.
+	approx := boxBlur3(img, boxesForGauss(boxBlurSigma), nil)
+	if ssim := SSIM(exact, approx); ssim < 0.98 {
+		t.Fatalf("box approximation differs from Gaussian: SSIM %f", ssim)
+	}
+
+	for _, sigma := range []float64{3, 10, 25, 60} {
+		var variance float64
+		for _, r := range boxesForGauss(sigma) {
+			d := float64(2*r + 1)
+			variance += (d*d - 1) / 12
+		}
+		if got := math.Sqrt(variance); math.Abs(got-sigma)/sigma > 0.1 {
+			t.Fatalf("boxes for sigma %.0f give sigma %.2f", sigma, got)
+		}
+	}
+}
+
+// ── Conversion Tests ────────────────────────────────────────────────────────
+
+func TestFormatAnalysis(t *testing.T) {
+	fewColors := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	for i := 0; i < len(fewColors.Pix); i += 4 {
+		fewColors.Pix[i] = 255
+		fewColors.Pix[i+3] = 255
+	}
+	if f := analyzeFormat(fewColors, 0); f != PNG {
+		t.Fatalf("expected PNG for few-color image, got %v", f)
+	}
+
+	manyColors := makeTestImage(200, 200)
+	if f := analyzeFormat(manyColors, 0); f != JPEG {
+		t.Fatalf("expected JPEG for gradient image, got %v", f)
+	}
+
+	alphaImg := makeTestImageWithAlpha(100, 100)
+	if f := analyzeFormat(alphaImg, 0); f != PNG {
+		t.Fatalf("expected PNG for alpha image, got %v", f)
+	}
+}
+
+func TestAnalysisSamples(t *testing.T) {
+	// A flat image with a photographic band in columns 1–15. The default
+	// 10,000-pixel sample of a 400×400 image reads every 16th pixel, which
+	// lands on the same flat columns in every row.
+	img := makeSolidImage(400, 400, color.NRGBA{90, 140, 200, 255})
+	noisy := makeNoisyImage(15, 400)
+	for y := 0; y < 400; y++ {
+		copy(img.Pix[y*img.Stride+4:y*img.Stride+16*4], noisy.Pix[y*noisy.Stride:])
+	}
+
+	if f := analyzeFormat(img, 0); f != PNG {
+		t.Fatalf("default sampling: got %v, expected the sparse sample to miss the band", f)
+	}
+	if f := analyzeFormat(img, 400*400); f != JPEG {
+		t.Fatalf("dense sampling: got %v, want JPEG", f)
+	}
+	if sparse, dense := AnalyzeSamples(img, 10000).UniqueColors, AnalyzeSamples(img, 400*400).UniqueColors; dense <= sparse {
+		t.Fatalf("denser sampling should find more colors: %d vs %d", dense, sparse)
+	}
+
+	opts := DefaultOptions()
+	opts.AnalysisSamples = 400 * 400
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	if result.Format != JPEG {
+		t.Fatalf("Auto with dense sampling chose %v, want JPEG", result.Format)
+	}
+
+	opts.AnalysisSamples = -1
+	if err := opts.Validate(); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("negative AnalysisSamples: expected ErrInvalidOptions, got %v", err)
+	}
+}
+
+func TestIsOpaque(t *testing.T) {
+	if !isOpaque(makeTestImage(10, 10)) {
+		t.Fatal("should be opaque")
+	}
+	if isOpaque(makeTestImageWithAlpha(10, 10)) {
+		t.Fatal("should not be opaque")
+	}
+}
+
+func TestIsGrayscale(t *testing.T) {
+	gray := makeSolidImage(10, 10, color.NRGBA{128, 128, 128, 255})
+	if !isGrayscale(gray) {
+		t.Fatal("should be grayscale")
+	}
+	if isGrayscale(makeTestImage(10, 10)) {
+		t.Fatal("should not be grayscale")
+	}
+}
+
+func TestCompressGrayWithAlpha(t *testing.T) {
+	// A gray circle, shaded left to right, fading to transparent at its
+	// edge: too many gray/alpha pairs for a palette.
+	const size = 128
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			d := math.Hypot(float64(x-size/2), float64(y-size/2)) / (size / 2)
+			a := uint8(255 * math.Max(0, math.Min(1, (1-d)*3)))
+			g := uint8(40 + x)
+			img.SetNRGBA(x, y, color.NRGBA{g, g, g, a})
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.Format = PNG
+	opts.Quality = Lossless
+	result, err := CompressImage(ctx(), img, opts)
+	if err != nil {
+		t.Fatalf("CompressImage failed: %v", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(result.CompressedData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []image.Point{{0, 0}, {size / 2, size / 2}, {size/2 + 38, size / 2}} {
+		want := img.NRGBAAt(p.X, p.Y)
+		got := color.NRGBAModel.Convert(decoded.At(p.X, p.Y)).(color.NRGBA)
+		if got.A != want.A || (want.A > 0 && got.R != want.R) {
+			t.Fatalf("pixel %v: got %v, want %v (decoded as %T)", p, got, want, decoded)
+		}
+	}
+}
+
+func TestTryPalettize(t *testing.T) {
+	fewColors := image.NewNRGBA(image.Rect(0, 0, 50, 50))
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 50; x++ {
+			off := y*fewColors.Stride + x*4
+			if x < 25 {
+				fewColors.Pix[off] = 255
+			}
+			fewColors.Pix[off+3] = 255
+		}
+	}
+	if tryPalettize(fewColors, 256) == nil {
+		t.Fatal("should palettize image with few colors")
+	}
+
+	if tryPalettize(makeTestImage(200, 200), 256) != nil {
+		t.Fatal("should not palettize gradient image")
+	}
+}
+
+func TestConvertYCbCrFastPath(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, makeTestImage(37, 23), &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoded.(*image.YCbCr); !ok {
+		t.Fatalf("expected *image.YCbCr, got %T", decoded)
+	}
+
+	fast := convertToNRGBA(decoded)
+	for y := 0; y < 23; y++ {
+		for x := 0; x < 37; x++ {
+			r, g, b, _ := decoded.At(x, y).RGBA()
+			want := color.NRGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255}
+			if got := fast.NRGBAAt(x, y); got != want {
+				t.Fatalf("pixel (%d,%d): got %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+// TestConvertFastPathsMatchAt checks the typed conversions against the
+// generic At path, on every chroma subsampling and on sub-images whose
+// origin isn't (0, 0).
+func TestConvertFastPathsMatchAt(t *testing.T) {
+	check := func(t *testing.T, img image.Image) {
+		t.Helper()
+		got := convertToNRGBA(img)
+		want := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		convertToNRGBAInto(want, struct{ image.Image }{img}) // hide the type
+		if !bytes.Equal(got.Pix, want.Pix) {
+			t.Fatalf("%T %v: fast path differs from At", img, img.Bounds())
+		}
+	}
+
+	ratios := []image.YCbCrSubsampleRatio{
+		image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio422, image.YCbCrSubsampleRatio420,
+		image.YCbCrSubsampleRatio440, image.YCbCrSubsampleRatio411, image.YCbCrSubsampleRatio410,
+	}
+	seed := uint32(7)
+	next := func() uint8 {
+		seed = seed*1664525 + 1013904223
+		return uint8(seed >> 24)
+	}
+	for _, ratio := range ratios {
+		ycc := image.NewYCbCr(image.Rect(-3, -5, 34, 22), ratio)
+		for _, plane := range [][]uint8{ycc.Y, ycc.Cb, ycc.Cr} {
+			for i := range plane {
+				plane[i] = next()
+			}
+		}
+		check(t, ycc)
+		check(t, ycc.SubImage(image.Rect(1, 3, 30, 17)))
+	}
+
+	pal := color.Palette{
+		color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 128, 255, 128},
+		color.NRGBA{10, 20, 30, 0}, color.RGBA{40, 40, 40, 80},
+	}
+	pm := image.NewPaletted(image.Rect(2, 2, 41, 29), pal)
+	for i := range pm.Pix {
+		pm.Pix[i] = next() % uint8(len(pal))
+	}
+	check(t, pm)
+	check(t, pm.SubImage(image.Rect(5, 7, 33, 20)))
+}
+
+func TestBufPoolZeroesReusedBuffers(t *testing.T) {
+	var p bufPool[byte]
+	b := p.get(64)
+	for i := range b {
+		b[i] = 0xff
+	}
+	p.put(b)
+
+	again := p.get(64)
+	if len(again) != 64 {
+		t.Fatalf("got length %d, want 64", len(again))
+	}
+	for _, v := range again {
+		if v != 0 {
+			t.Fatal("pooled buffer was not zeroed")
+		}
+	}
+}
+
+// ── EXIF Orientation Tests ──────────────────────────────────────────────────
+
+func TestApplyOrientation(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 50))
+	img.Pix[0] = 255
+	img.Pix[3] = 255
+
+	normal := ApplyOrientation(img, OrientNormal)
+	if normal.Bounds().Dx() != 100 || normal.Bounds().Dy() != 50 {
+		t.Fatal("normal should be 100x50")
+	}
+
+	rotated := ApplyOrientation(img, OrientRotate90CW)
+	if rotated.Bounds().Dx() != 50 || rotated.Bounds().Dy() != 100 {
+		t.Fatalf("90CW should be 50x100, got %dx%d", rotated.Bounds().Dx(), rotated.Bounds().Dy())
+	}
+
+	rot180 := ApplyOrientation(img, OrientRotate180)
+	if rot180.Bounds().Dx() != 100 || rot180.Bounds().Dy() != 50 {
+		t.Fatal("180 should be 100x50")
+	}
+}
+
+func TestOrientPointMatchesApplyOrientation(t *testing.T) {
+	const w, h = 5, 3
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < w*h; i++ {
+		img.Pix[i*4] = uint8(i)
+	}
+	for o := OrientNormal; o <= OrientRotate270CW; o++ {
+		want := ApplyOrientation(img, o)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				dx, dy := orientPoint(x, y, w, h, o)
+				if got := want.NRGBAAt(dx, dy).R; got != uint8(y*w+x) {
+					t.Fatalf("%v: pixel (%d,%d) maps to (%d,%d) holding %d", o, x, y, dx, dy, got)
+				}
+			}
+		}
+	}
+}
+
+func TestRotateAndFlip(t *testing.T) {
+	// 3×2 image with a marker in the top-left corner.
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	img.Pix[0] = 255
+
+	cases := []struct {
+		name   string
+		fn     func(image.Image) *image.NRGBA
+		w, h   int
+		mx, my int
+	}{
+		{"Rotate90", Rotate90, 2, 3, 1, 0},
+		{"Rotate180", Rotate180, 3, 2, 2, 1},
+		{"Rotate270", Rotate270, 2, 3, 0, 2},
+		{"FlipHorizontal", FlipHorizontal, 3, 2, 2, 0},
+		{"FlipVertical", FlipVertical, 3, 2, 0, 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := tc.fn(img)
+			if out.Bounds().Dx() != tc.w || out.Bounds().Dy() != tc.h {
+				t.Fatalf("got %dx%d, want %dx%d", out.Bounds().Dx(), out.Bounds().Dy(), tc.w, tc.h)
+			}
+			if out.NRGBAAt(tc.mx, tc.my).R != 255 {
+				t.Fatalf("marker not at (%d,%d)", tc.mx, tc.my)
+			}
+		})
+	}
+
+	// Non-NRGBA input is converted.
+	gray := image.NewGray(image.Rect(0, 0, 4, 2))
+	if out := Rotate90(gray); out.Bounds().Dx() != 2 || out.Bounds().Dy() != 4 {
+		t.Fatalf("Rotate90 on Gray: got %v", out.Bounds())
+	}
+	if img.Pix[0] != 255 {
+		t.Fatal("input image was modified")
+	}
+}
+
+func TestCrop(t *testing.T) {
+	img := makeTestImage(100, 80)
+
+	t.Run("full_image", func(t *testing.T) {
+		out, err := Crop(img, img.Bounds())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Pix, img.Pix) {
+			t.Fatal("full-image crop should match the source")
+		}
+		out.Pix[0]++
+		if out.Pix[0] == img.Pix[0] {
+			t.Fatal("crop should not share memory with the source")
+		}
+	})
+
+	t.Run("corner", func(t *testing.T) {
+		rect := image.Rect(60, 50, 100, 80)
+		out, err := Crop(img, rect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Bounds() != image.Rect(0, 0, 40, 30) {
+			t.Fatalf("expected zero-origin 40x30, got %v", out.Bounds())
+		}
+		if out.NRGBAAt(0, 0) != img.NRGBAAt(60, 50) || out.NRGBAAt(39, 29) != img.NRGBAAt(99, 79) {
+			t.Fatal("cropped pixels do not match the source region")
+		}
+	})
+
+	t.Run("non_nrgba", func(t *testing.T) {
+		gray := image.NewGray(image.Rect(0, 0, 10, 10))
+		gray.SetGray(5, 5, color.Gray{200})
+		out, err := Crop(gray, image.Rect(5, 5, 8, 8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.NRGBAAt(0, 0) != (color.NRGBA{200, 200, 200, 255}) {
+			t.Fatalf("unexpected pixel %v", out.NRGBAAt(0, 0))
+		}
+	})
+
+	t.Run("out_of_bounds", func(t *testing.T) {
+		if _, err := Crop(img, image.Rect(50, 50, 120, 70)); err == nil {
+			t.Fatal("expected error for rectangle outside the image")
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		if _, err := Crop(img, image.Rect(10, 10, 10, 20)); err == nil {
+			t.Fatal("expected error for empty rectangle")
+		}
+	})
+}
+
+func TestOrientationString(t *testing.T) {
+	cases := map[Orientation]string{
+		OrientNormal:      "Normal",
+		OrientFlipH:       "FlipHorizontal",
+		OrientRotate180:   "Rotate180",
+		OrientFlipV:       "FlipVertical",
+		OrientTranspose:   "Transpose",
+		OrientRotate90CW:  "Rotate90CW",
+		OrientTransverse:  "Transverse",
+		OrientRotate270CW: "Rotate270CW",
+		Orientation(99):   "Unknown",
+	}
+	for orient, want := range cases {
+		if got := orient.String(); got != want {
+			t.Fatalf("Orientation(%d).String() = %q, want %q", orient, got, want)
+		}
+	}
+}
+
+// makeOrientedJPEG encodes img as a JPEG carrying a minimal big-endian EXIF
+// APP1 segment with the given orientation tag and a Software tag of "fnc".
+func makeOrientedJPEG(t *testing.T, img image.Image, orient Orientation) []byte {
+	t.Helper()
+	return withEXIF(t, img, makeEXIF(binary.BigEndian, exifShort, orient))
+}
+
+// makeEXIF builds an EXIF APP1 payload whose first IFD holds an orientation
+// tag of the given TIFF type (SHORT or LONG) and a Software tag of "fnc".
+func makeEXIF(bo binary.ByteOrder, typ uint16, orient Orientation) []byte {
+	tiff := make([]byte, 8+2+2*12+4)
+	if bo == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	bo.PutUint16(tiff[2:], 42)
+	bo.PutUint32(tiff[4:], 8)
+	bo.PutUint16(tiff[8:], 2)
+
+	e := tiff[10:]
+	bo.PutUint16(e[0:], 0x0112)
+	bo.PutUint16(e[2:], typ)
+	bo.PutUint32(e[4:], 1)
+	if typ == exifLong {
+		bo.PutUint32(e[8:], uint32(orient))
+	} else {
+		bo.PutUint16(e[8:], uint16(orient))
+	}
+
+	e = tiff[22:]
+	bo.PutUint16(e[0:], 0x0131)
+	bo.PutUint16(e[2:], 2) // ASCII
+	bo.PutUint32(e[4:], 4)
+	copy(e[8:], "fnc\x00")
+
+	return append([]byte(exifHeader), tiff...)
+}
+
+// withEXIF encodes img as a JPEG with an APP1 segment holding exif.
+func withEXIF(t *testing.T, img image.Image, exif []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := insertJPEGSegment(buf.Bytes(), 0xE1, exif)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestReadOrientationBytes(t *testing.T) {
+	img := makeTestImage(40, 20)
+	if got := ReadOrientationBytes(makeOrientedJPEG(t, img, OrientRotate90CW)); got != OrientRotate90CW {
+		t.Fatalf("got %v, want Rotate90CW", got)
+	}
+
+	var plain bytes.Buffer
+	jpeg.Encode(&plain, img, nil)
+	if got := ReadOrientationBytes(plain.Bytes()); got != OrientNormal {
+		t.Fatalf("JPEG without EXIF: got %v, want Normal", got)
+	}
+	if got := ReadOrientationBytes([]byte("not an image")); got != OrientNormal {
+		t.Fatalf("garbage: got %v, want Normal", got)
+	}
+}
+
+func TestReadOrientationLongType(t *testing.T) {
+	img := makeTestImage(40, 20)
+	for _, bo := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		exif := makeEXIF(bo, exifLong, OrientRotate270CW)
+		if got := ReadOrientationBytes(withEXIF(t, img, exif)); got != OrientRotate270CW {
+			t.Fatalf("%v LONG tag: got %v, want Rotate270CW", bo, got)
+		}
+		if got := exifOrientation(withEXIFOrientation(exif, OrientNormal)); got != OrientNormal {
+			t.Fatalf("%v LONG tag rewrite: got %v, want Normal", bo, got)
+		}
+	}
+
+	// Other types are still rejected rather than misread.
+	if got := exifOrientation(makeEXIF(binary.BigEndian, 2, OrientRotate90CW)); got != OrientNormal {
+		t.Fatalf("ASCII-typed tag: got %v, want Normal", got)
+	}
+}
+
+// withPNGEXIF encodes img as a PNG with an eXIf chunk after IHDR holding
+// the TIFF block of exif.
+func withPNGEXIF(t *testing.T, img image.Image, exif []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	tiff := exif[len(exifHeader):]
+
+	chunk := make([]byte, 8, 12+len(tiff))
+	binary.BigEndian.PutUint32(chunk, uint32(len(tiff)))
+	copy(chunk[4:], "eXIf")
+	chunk = append(chunk, tiff...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	out := append([]byte{}, data[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, data[ihdrEnd:]...)
+}
+
+func TestReadOrientationPNGAndTIFF(t *testing.T) {
+	img := makeTestImage(40, 20)
+
+	t.Run("png_exif_chunk", func(t *testing.T) {
+		data := withPNGEXIF(t, img, makeEXIF(binary.BigEndian, exifShort, OrientRotate90CW))
+		if got := ReadOrientationBytes(data); got != OrientRotate90CW {
+			t.Fatalf("got %v, want Rotate90CW", got)
+		}
+		if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+			t.Fatalf("test PNG does not decode: %v", err)
+		}
+	})
+
+	t.Run("png_without_exif", func(t *testing.T) {
+		var buf bytes.Buffer
+		png.Encode(&buf, img)
+		if got := ReadOrientationBytes(buf.Bytes()); got != OrientNormal {
+			t.Fatalf("got %v, want Normal", got)
+		}
+	})
+
+	t.Run("tiff", func(t *testing.T) {
+		for _, bo := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+			// A bare TIFF header and IFD0 is all the reader looks at.
+			tiff := makeEXIF(bo, exifShort, OrientRotate270CW)[len(exifHeader):]
+			if got := ReadOrientationBytes(tiff); got != OrientRotate270CW {
+				t.Fatalf("%v: got %v, want Rotate270CW", bo, got)
+			}
+		}
+	})
+
+	t.Run("compress_png_auto_orient", func(t *testing.T) {
+		data := withPNGEXIF(t, makeTestImage(200, 100), makeEXIF(binary.LittleEndian, exifShort, OrientRotate90CW))
+		result, err := CompressBytes(ctx(), data, DefaultOptions())
+		if err != nil {
+			t.Fatalf("CompressBytes failed: %v", err)
+		}
+		if result.FinalDimensions != image.Pt(100, 200) {
+			t.Fatalf("expected rotated 100x200, got %v", result.FinalDimensions)
+		}
+	})
+}
+
+func TestCompressTiledAutoOrient(t *testing.T) {
+	data := makeOrientedJPEG(t, makeTestImage(200, 100), OrientRotate90CW)
+
+	var out bytes.Buffer
+	result, err := CompressTiled(ctx(), bytes.NewReader(data), &out, DefaultOptions())
+	if err != nil {
+		t.Fatalf("CompressTiled failed: %v", err)
+	}
+	if result.OriginalDimensions != image.Pt(100, 200) || result.FinalDimensions != image.Pt(100, 200) {
+		t.Fatalf("expected rotated 100x200, got %v -> %v", result.OriginalDimensions, result.FinalDimensions)
+	}
+	w, h, _, err := DecodeConfig(&out)
+	if err != nil || w != 100 || h != 200 {
+		t.Fatalf("output is %dx%d (%v), want 100x200", w, h, err)
+	}
+
+	opts := DefaultOptions()
+	opts.AutoOrient = false
+	opts.MaxWidth = 100
+	result, err = CompressTiled(ctx(), bytes.NewReader(data), io.Discard, opts)
+	if err != nil {
+		t.Fatalf("CompressTiled failed: %v", err)
+	}
+	if result.FinalDimensions != image.Pt(100, 50) {
+		t.Fatalf("AutoOrient off should keep the landscape shape, got %v", result.FinalDimensions)
+	}
+}
+
+func TestCompressBytesAutoOrient(t *testing.T) {
+	data := makeOrientedJPEG(t, makeTestImage(200, 100), OrientRotate90CW)
+
+	result, err := CompressBytes(ctx(), data, DefaultOptions())
+	if err != nil {
+		t.Fatalf("CompressBytes failed: %v", err)
+	}
+	if result.FinalDimensions != image.Pt(100, 200) {
+		t.Fatalf("expected rotated 100x200, got %v", result.FinalDimensions)
+	}
+
+	opts := DefaultOptions()
+	opts.AutoOrient = false
+	result, err = CompressBytes(ctx(), data, opts)
+	if err != nil {
+		t.Fatalf("CompressBytes failed: %v", err)
+	}
+	if result.FinalDimensions != image.Pt(200, 100) {
+		t.Fatalf("AutoOrient off should keep 200x100, got %v", result.FinalDimensions)
+	}
+}
+
+func TestPreserveMetadata(t *testing.T) {
+	data := makeOrientedJPEG(t, makeTestImage(200, 100), OrientRotate90CW)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "in.jpg")
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("auto_orient_resets_tag", func(t *testing.T) {
+		dst := filepath.Join(dir, "out.jpg")
+		opts := DefaultOptions()
+		opts.Format = JPEG
+		opts.PreserveMetadata = true
+		if _, err := CompressFile(ctx(), src, dst, opts); err != nil {
+			t.Fatalf("CompressFile failed: %v", err)
+		}
+
+		f, err := os.Open(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		exif := readEXIF(f)
+		if exif == nil {
+			t.Fatal("output should keep the EXIF block")
+		}
+		if o := exifOrientation(exif); o != OrientNormal {
+			t.Fatalf("orientation should be reset to Normal, got %v", o)
+		}
+		if !bytes.Contains(exif, []byte("fnc")) {
+			t.Error("other EXIF tags should survive")
+		}
+		img, err := OpenAndOrient(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Size() != image.Pt(100, 200) {
+			t.Fatalf("output should be rotated once, got %v", img.Bounds().Size())
+		}
+	})
+
+	t.Run("no_auto_orient_keeps_tag", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.Format = JPEG
+		opts.PreserveMetadata = true
+		opts.AutoOrient = false
+		result, err := CompressBytes(ctx(), data, opts)
+		if err != nil {
+			t.Fatalf("CompressBytes failed: %v", err)
+		}
+		if o := ReadOrientationBytes(result.CompressedData); o != OrientRotate90CW {
+			t.Fatalf("unrotated output should keep its orientation tag, got %v", o)
+		}
+	})
+
+	t.Run("off_by_default", func(t *testing.T) {
+		result, err := CompressBytes(ctx(), data, DefaultOptions())
+		if err != nil {
+			t.Fatalf("CompressBytes failed: %v", err)
+		}
+		if readEXIF(bytes.NewReader(result.CompressedData)) != nil {
+			t.Fatal("metadata should be dropped by default")
+		}
+	})
+
+	t.Run("target_size_counts_exif", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.Format = JPEG
+		opts.PreserveMetadata = true
+		opts.TargetSize = 3000
+		result, err := CompressBytes(ctx(), data, opts)
+		if err != nil {
+			t.Fatalf("CompressBytes failed: %v", err)
+		}
+		if result.CompressedSize > int64(opts.TargetSize) {
+			t.Fatalf("output %d bytes exceeds target %d", result.CompressedSize, opts.TargetSize)
+		}
+		if readEXIF(bytes.NewReader(result.CompressedData)) == nil {
+			t.Fatal("output should keep the EXIF block")
+		}
+	})
+}
+
+func TestJPEGComment(t *testing.T) {
+	img := makeTestImage(120, 80)
+	data := makeOrientedJPEG(t, img, OrientRotate90CW)
+	const comment = "processed by pipeline v2"
+
+	t.Run("jpeg_com_marker", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.Format = JPEG
+		opts.JPEGComment = comment
+		opts.PreserveMetadata = true
+		result, err := CompressBytes(ctx(), data, opts)
+		if err != nil {
+			t.Fatalf("CompressBytes failed: %v", err)
+		}
+		if got := testJPEGComment(result.CompressedData); got != comment {
+			t.Fatalf("COM marker = %q, want %q", got, comment)
+		}
+		if readEXIF(bytes.NewReader(result.CompressedData)) == nil {
+			t.Fatal("EXIF should still be found alongside the comment")
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(result.CompressedData)); err != nil {
+			t.Fatalf("output should decode: %v", err)
+		}
+	})
+
+	t.Run("png_text_chunk", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.Format = PNG
+		opts.JPEGComment = comment
+		opts.PNGCommentKeyword = "Software"
+		result, err := CompressImage(ctx(), img, opts)
+		if err != nil {
+			t.Fatalf("CompressImage failed: %v", err)
+		}
+		if got := testPNGText(result.CompressedData, "Software"); got != comment {
+			t.Fatalf("tEXt chunk = %q, want %q", got, comment)
+		}
+		if _, err := png.Decode(bytes.NewReader(result.CompressedData)); err != nil {
+			t.Fatalf("output should decode (chunk CRC): %v", err)
+		}
+	})
+
+	t.Run("target_size_counts_comment", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.Format = JPEG
+		opts.JPEGComment = strings.Repeat("x", 1000)
+		opts.TargetSize = 3000
+		result, err := CompressImage(ctx(), img, opts)
+		if err != nil {
+			t.Fatalf("CompressImage failed: %v", err)
+		}
+		if result.CompressedSize > int64(opts.TargetSize) {
+			t.Fatalf("output %d bytes exceeds target %d", result.CompressedSize, opts.TargetSize)
+		}
+	})
 
-func TestSharpen(t *testing.T) {
-	img := makeStripedImage(100, 100, 10)
+	t.Run("off_by_default", func(t *testing.T) {
+		result, err := CompressBytes(ctx(), data, DefaultOptions())
+		if err != nil {
+			t.Fatalf("CompressBytes failed: %v", err)
+		}
+		if got := testJPEGComment(result.CompressedData); got != "" {
+			t.Fatalf("default output should have no comment, got %q", got)
+		}
+	})
+}
 
-	sharpened := Sharpen(img, 0.8)
-	if sharpened.Bounds() != img.Bounds() {
-		t.Fatal("sharpen should preserve dimensions")
-	}
+// testJPEGComment returns the payload of the first COM segment before the
+// scan data, or "".
+func testJPEGComment(data []byte) string {
+	return string(testJPEGSegment(data, 0xFE))
+}
 
-	changed := false
-	for i := 0; i < len(img.Pix); i++ {
-		if img.Pix[i] != sharpened.Pix[i] {
-			changed = true
+// testJPEGSegment returns the payload of the first segment with the given
+// marker before the scan data, or nil.
+func testJPEGSegment(data []byte, want byte) []byte {
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || i+2+n > len(data) {
 			break
 		}
+		if marker == want {
+			return data[i+4 : i+2+n]
+		}
+		i += 2 + n
 	}
-	if !changed {
-		t.Fatal("sharpen should change some pixels")
+	return nil
+}
+
+// testPNGText returns the text of the tEXt chunk with the given keyword,
+// or "".
+func testPNGText(data []byte, keyword string) string {
+	for i := len(pngSignature); i+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		if i+12+n > len(data) {
+			break
+		}
+		if string(data[i+4:i+8]) == "tEXt" {
+			k, text, _ := bytes.Cut(data[i+8:i+8+n], []byte{0})
+			if string(k) == keyword {
+				return string(text)
+			}
+		}
+		i += 12 + n
 	}
+	return ""
 }
 
-func TestSharpenZeroStrength(t *testing.T) {
-	img := makeTestImage(100, 100)
-	result := Sharpen(img, 0)
-	// Should return the same pointer (no-op).
-	if result != img {
-		t.Fatal("Sharpen(0) should return original image unchanged")
+// testPNGChunk returns the payload of the first chunk of the given type,
+// or nil.
+func testPNGChunk(data []byte, typ string) []byte {
+	for i := len(pngSignature); i+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		if i+12+n > len(data) {
+			break
+		}
+		if string(data[i+4:i+8]) == typ {
+			return data[i+8 : i+8+n]
+		}
+		i += 12 + n
 	}
+	return nil
 }
 
-func TestSharpenClampedStrength(t *testing.T) {
-	img := makeStripedImage(100, 100, 10)
-	// Strength > 1 should be clamped to 1.
-	result := Sharpen(img, 5.0)
-	if result.Bounds() != img.Bounds() {
-		t.Fatal("sharpen with high strength should preserve dimensions")
+func TestDPI(t *testing.T) {
+	img := makeTestImage(120, 80)
+
+	t.Run("jpeg_jfif_density", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.Format = JPEG
+		opts.DPI = 300
+		opts.PreserveMetadata = true
+		result, err := CompressBytes(ctx(), makeOrientedJPEG(t, img, OrientRotate90CW), opts)
+		if err != nil {
+			t.Fatalf("CompressBytes failed: %v", err)
+		}
+		data := result.CompressedData
+		if data[2] != 0xFF || data[3] != 0xE0 {
+			t.Fatalf("JFIF APP0 should follow SOI, found marker %X%X", data[2], data[3])
+		}
+		jfif := testJPEGSegment(data, 0xE0)
+		if len(jfif) < 12 || string(jfif[:5]) != "JFIF\x00" {
+			t.Fatalf("APP0 = %q, want a JFIF header", jfif)
+		}
+		unit, x, y := jfif[7], binary.BigEndian.Uint16(jfif[8:]), binary.BigEndian.Uint16(jfif[10:])
+		if unit != 1 || x != 300 || y != 300 {
+			t.Fatalf("density = unit %d, %dx%d; want inches, 300x300", unit, x, y)
+		}
+		if readEXIF(bytes.NewReader(data)) == nil {
+			t.Fatal("EXIF should still be found after the JFIF header")
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+			t.Fatalf("output should decode: %v", err)
+		}
+	})
+
+	t.Run("png_phys_chunk", func(t *testing.T) {
+		opts := DefaultOptions()
+		opts.Format = PNG
+		opts.DPI = 72
+		result, err := CompressImage(ctx(), img, opts)
+		if err != nil {
+			t.Fatalf("CompressImage failed: %v", err)
+		}
+		phys := testPNGChunk(result.CompressedData, "pHYs")
+		if len(phys) != 9 {
+			t.Fatalf("pHYs chunk = %v, want 9 bytes", phys)
+		}
+		x, y := binary.BigEndian.Uint32(phys), binary.BigEndian.Uint32(phys[4:])
+		if x != 2835 || y != 2835 || phys[8] != 1 {
+			t.Fatalf("pHYs = %dx%d unit %d, want 2835x2835 per meter", x, y, phys[8])
+		}
+		if _, err := png.Decode(bytes.NewReader(result.CompressedData)); err != nil {
+			t.Fatalf("output should decode (chunk CRC): %v", err)
+		}
+	})
+
+	t.Run("off_by_default", func(t *testing.T) {
+		for _, f := range []Format{JPEG, PNG} {
+			opts := DefaultOptions()
+			opts.Format = f
+			result, err := CompressImage(ctx(), img, opts)
+			if err != nil {
+				t.Fatalf("CompressImage(%v) failed: %v", f, err)
+			}
+			if testJPEGSegment(result.CompressedData, 0xE0) != nil || testPNGChunk(result.CompressedData, "pHYs") != nil {
+				t.Fatalf("%v: default output should carry no density", f)
+			}
+		}
+	})
+
+	opts := DefaultOptions()
+	opts.DPI = 70000
+	if err := opts.Validate(); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("DPI 70000: expected ErrInvalidOptions, got %v", err)
 	}
 }
 
-func TestSharpenTinyImage(t *testing.T) {
-	img := makeTestImage(2, 2)
-	result := Sharpen(img, 0.5)
-	// Image too small for sharpen, should return original.
-	if result != img {
-		t.Fatal("Sharpen on tiny image should return original")
+// ── Batch Tests ─────────────────────────────────────────────────────────────
+
+func TestCompressBatchEmpty(t *testing.T) {
+	results := CompressBatch(ctx(), nil, BatchOptions{})
+	if results != nil {
+		t.Fatal("empty batch should return nil")
 	}
 }
 
-func TestAdaptiveSharpen(t *testing.T) {
-	img := makeStripedImage(100, 100, 10)
+func TestCompressBatchWithFiles(t *testing.T) {
+	// Create temp input files.
+	tmpDir := t.TempDir()
 
-	sharpened := AdaptiveSharpen(img, 0.5)
-	if sharpened.Bounds() != img.Bounds() {
-		t.Fatal("adaptive sharpen should preserve dimensions")
+	img := makeTestImage(100, 100)
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		path := filepath.Join(tmpDir, name)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jpeg.Encode(f, img, &jpeg.Options{Quality: 95})
+		f.Close()
 	}
 
-	// Should affect edge pixels more than smooth areas.
-	changed := false
-	for i := 0; i < len(img.Pix); i++ {
-		if img.Pix[i] != sharpened.Pix[i] {
-			changed = true
-			break
+	items := []BatchItem{
+		{Src: filepath.Join(tmpDir, "a.jpg"), Dst: filepath.Join(tmpDir, "a_out.jpg")},
+		{Src: filepath.Join(tmpDir, "b.jpg"), Dst: filepath.Join(tmpDir, "b_out.jpg")},
+	}
+
+	var progressCalls int32 // Change this to int32 for atomic operations
+
+	results := CompressBatch(ctx(), items, BatchOptions{
+		Workers:     2,
+		DefaultOpts: DefaultOptions(),
+		OnItem: func(completed, total int) {
+			atomic.AddInt32(&progressCalls, 1) // Safely increment the counter
+		},
+	})
+
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+
+	for i, r := range results {
+		if r.Err != nil {
+			t.Fatalf("item %d failed: %v", i, r.Err)
+		}
+		if r.Result == nil {
+			t.Fatalf("item %d has nil result", i)
+		}
+		if r.Index != i {
+			t.Fatalf("item %d has wrong index %d", i, r.Index)
 		}
 	}
-	if !changed {
-		t.Fatal("adaptive sharpen should change some pixels")
+
+	if atomic.LoadInt32(&progressCalls) != 2 { // Safely read the counter
+		t.Fatalf("expected 2 progress calls, got %d", atomic.LoadInt32(&progressCalls))
 	}
 }
 
-func TestAdaptiveSharpenZero(t *testing.T) {
-	img := makeTestImage(100, 100)
-	result := AdaptiveSharpen(img, 0)
-	if result != img {
-		t.Fatal("AdaptiveSharpen(0) should return original image unchanged")
+func TestCompressBatchOnResult(t *testing.T) {
+	tmpDir := t.TempDir()
+	var items []BatchItem
+	for i := range 4 {
+		src := filepath.Join(tmpDir, fmt.Sprintf("in%d.jpg", i))
+		f, err := os.Create(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jpeg.Encode(f, makeTestImage(60+i*10, 50), &jpeg.Options{Quality: 95})
+		f.Close()
+		items = append(items, BatchItem{Src: src, Dst: filepath.Join(tmpDir, fmt.Sprintf("out%d.jpg", i))})
 	}
-}
+	items = append(items, BatchItem{Src: filepath.Join(tmpDir, "missing.jpg"), Dst: filepath.Join(tmpDir, "x.jpg")})
 
-func TestAdaptiveSharpenTinyImage(t *testing.T) {
-	img := makeTestImage(2, 2)
-	result := AdaptiveSharpen(img, 0.5)
-	if result != img {
-		t.Fatal("AdaptiveSharpen on tiny image should return original")
+	var counts []int
+	seen := map[int]BatchResult{}
+	CompressBatch(ctx(), items, BatchOptions{
+		Workers:     3,
+		DefaultOpts: DefaultOptions(),
+		OnResult: func(r BatchResult, completed, total int) {
+			// Calls are serialized, so no locking is needed here.
+			counts = append(counts, completed)
+			seen[r.Index] = r
+			if total != len(items) {
+				t.Errorf("total = %d, want %d", total, len(items))
+			}
+		},
+	})
+
+	for i, c := range counts {
+		if c != i+1 {
+			t.Fatalf("completed counts %v should rise by one per call", counts)
+		}
+	}
+	if len(seen) != len(items) {
+		t.Fatalf("OnResult saw %d items, want %d", len(seen), len(items))
+	}
+	for i, item := range items {
+		r := seen[i]
+		if r.Item.Src != item.Src {
+			t.Errorf("index %d reported %q, want %q", i, r.Item.Src, item.Src)
+		}
+		if failed := i == len(items)-1; (r.Err != nil) != failed {
+			t.Errorf("index %d: err = %v", i, r.Err)
+		}
+	}
+
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, makeTestImage(40, 40), &jpeg.Options{Quality: 95})
+	inputs := [][]byte{buf.Bytes(), []byte("junk")}
+	var bytesSeen []int
+	CompressBatchBytes(ctx(), inputs, BatchOptions{
+		Workers:     1,
+		DefaultOpts: DefaultOptions(),
+		OnResult: func(r BatchResult, completed, total int) {
+			bytesSeen = append(bytesSeen, r.Index)
+			if (r.Err != nil) != (r.Index == 1) || (r.Result != nil) != (r.Index == 0) {
+				t.Errorf("bytes item %d: Result %v, Err %v", r.Index, r.Result, r.Err)
+			}
+		},
+	})
+	if len(bytesSeen) != 2 {
+		t.Fatalf("CompressBatchBytes: OnResult called %d times, want 2", len(bytesSeen))
 	}
 }
 
-func TestGaussianBlur(t *testing.T) {
-	img := makeTestImage(100, 100)
-	blurred := GaussianBlur(img, 2.0)
-	if blurred.Bounds() != img.Bounds() {
-		t.Fatal("blur should preserve dimensions")
+func TestCompressBatchMaxInFlightBytes(t *testing.T) {
+	tmpDir := t.TempDir()
+	img := makeTestImage(64, 64)
+	var items []BatchItem
+	for i := range 6 {
+		src := filepath.Join(tmpDir, fmt.Sprintf("in%d.jpg", i))
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(src, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, BatchItem{Src: src, Dst: filepath.Join(tmpDir, fmt.Sprintf("out%d.jpg", i))})
 	}
-	ssim := SSIM(img, blurred)
-	if ssim < 0.3 {
-		t.Fatalf("blur changed image too much: SSIM %f", ssim)
+
+	// The cap fits one 64×64 image at a time, whatever the worker count.
+	var inFlight, peak atomic.Int32
+	opts := DefaultOptions()
+	opts.OnProgress = func(stage ProgressStage, percent float64) error {
+		switch {
+		case stage == StageAnalyzing && percent == 0:
+			n := inFlight.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+		case stage == StageWriting && percent == 1:
+			inFlight.Add(-1)
+		}
+		return nil
+	}
+	results := CompressBatch(ctx(), items, BatchOptions{
+		Workers:          4,
+		MaxInFlightBytes: 64 * 64 * 4,
+		DefaultOpts:      opts,
+	})
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("%s: %v", r.Item.Src, r.Err)
+		}
+	}
+	if p := peak.Load(); p != 1 {
+		t.Fatalf("peak in-flight items = %d, want 1", p)
 	}
 }
 
-func TestGaussianBlurZeroSigma(t *testing.T) {
-	img := makeTestImage(100, 100)
-	result := GaussianBlur(img, 0)
-	// Should return the same pointer (no-op).
-	if result != img {
-		t.Fatal("GaussianBlur(0) should return original image unchanged")
+func TestMemLimiter(t *testing.T) {
+	l := newMemLimiter(100)
+	a, err := l.acquire(ctx(), 60)
+	if err != nil || a != 60 {
+		t.Fatalf("acquire(60) = %d, %v", a, err)
 	}
-}
 
-func TestGaussianBlurNegativeSigma(t *testing.T) {
-	img := makeTestImage(100, 100)
-	result := GaussianBlur(img, -1.0)
-	if result != img {
-		t.Fatal("GaussianBlur(negative) should return original image unchanged")
+	// Over the cap: clamped to it, so it waits for everything else.
+	granted := make(chan int64)
+	go func() {
+		n, _ := l.acquire(context.Background(), 500)
+		granted <- n
+	}()
+
+	// A cancelled waiter gives up without taking bytes.
+	cctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(cctx, 50); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("queued acquire: expected DeadlineExceeded, got %v", err)
+	}
+
+	l.release(a)
+	if n := <-granted; n != 100 {
+		t.Fatalf("oversized acquire granted %d, want the cap 100", n)
+	}
+	l.release(100)
+	if l.used != 0 || len(l.waiters) != 0 {
+		t.Fatalf("limiter not drained: used %d, %d waiters", l.used, len(l.waiters))
 	}
+
+	var none *memLimiter
+	if n, err := none.acquire(ctx(), 1<<40); n != 0 || err != nil {
+		t.Fatalf("nil limiter acquire = %d, %v", n, err)
+	}
+	none.release(0)
 }
 
-func TestGaussianBlurLargeSigma(t *testing.T) {
-	img := makeTestImage(100, 100)
-	blurred := GaussianBlur(img, 20.0)
-	if blurred.Bounds() != img.Bounds() {
-		t.Fatal("large sigma blur should preserve dimensions")
+func TestCompressBatchChan(t *testing.T) {
+	tmpDir := t.TempDir()
+	img := makeTestImage(64, 64)
+
+	var items []BatchItem
+	for _, name := range []string{"a", "b", "c"} {
+		src := filepath.Join(tmpDir, name+".jpg")
+		writeTestJPEG(t, src, img)
+		items = append(items, BatchItem{Src: src, Dst: filepath.Join(tmpDir, name+"_out.jpg")})
 	}
-	// Large blur should reduce SSIM compared to identity.
-	ssim := SSIM(img, blurred)
-	if ssim > 0.999 {
-		t.Fatalf("large blur should noticeably reduce SSIM, got %f", ssim)
+
+	seen := make(map[int]bool)
+	for r := range CompressBatchChan(ctx(), items, BatchOptions{Workers: 2, DefaultOpts: DefaultOptions()}) {
+		if r.Err != nil {
+			t.Fatalf("item %d failed: %v", r.Index, r.Err)
+		}
+		if seen[r.Index] {
+			t.Fatalf("item %d delivered twice", r.Index)
+		}
+		seen[r.Index] = true
+	}
+	if len(seen) != len(items) {
+		t.Fatalf("expected %d results, got %d", len(items), len(seen))
+	}
+
+	if _, ok := <-CompressBatchChan(ctx(), nil, BatchOptions{}); ok {
+		t.Fatal("empty batch channel should be closed immediately")
 	}
 }
 
-// ── Conversion Tests ────────────────────────────────────────────────────────
+func TestCompressBatchChanCancel(t *testing.T) {
+	tmpDir := t.TempDir()
+	img := makeTestImage(32, 32)
 
-func TestFormatAnalysis(t *testing.T) {
-	fewColors := image.NewNRGBA(image.Rect(0, 0, 100, 100))
-	for i := 0; i < len(fewColors.Pix); i += 4 {
-		fewColors.Pix[i] = 255
-		fewColors.Pix[i+3] = 255
+	var items []BatchItem
+	for i := range 16 {
+		src := filepath.Join(tmpDir, fmt.Sprintf("%d.jpg", i))
+		writeTestJPEG(t, src, img)
+		items = append(items, BatchItem{Src: src, Dst: filepath.Join(tmpDir, fmt.Sprintf("%d_out.jpg", i))})
 	}
-	if f := analyzeFormat(fewColors); f != PNG {
-		t.Fatalf("expected PNG for few-color image, got %v", f)
+
+	c, cancel := context.WithCancel(ctx())
+	ch := CompressBatchChan(c, items, BatchOptions{Workers: 2, DefaultOpts: DefaultOptions()})
+	<-ch
+	cancel()
+
+	// Items already started are still reported, and nothing new starts:
+	// at most the two in flight plus the two buffered.
+	n := 0
+	for r := range ch {
+		n++
+		if r.Err == nil {
+			if _, err := os.Stat(r.Item.Dst); err != nil {
+				t.Errorf("result %d reports success but %v", r.Index, err)
+			}
+		}
+	}
+	if n > 4 {
+		t.Errorf("got %d results after cancel, want at most 4", n)
+	}
+
+	results := CompressBatch(c, items, BatchOptions{Workers: 2, DefaultOpts: DefaultOptions()})
+	for i, r := range results {
+		if r.Index != i || r.Item.Src != items[i].Src || r.Err == nil {
+			t.Fatalf("result %d = %+v, want cancelled item", i, r)
+		}
 	}
+}
+
+func TestCompressBatchKeepsFinishedResults(t *testing.T) {
+	tmpDir := t.TempDir()
+	img := makeTestImage(32, 32)
 
-	manyColors := makeTestImage(200, 200)
-	if f := analyzeFormat(manyColors); f != JPEG {
-		t.Fatalf("expected JPEG for gradient image, got %v", f)
+	var items []BatchItem
+	for i := range 8 {
+		src := filepath.Join(tmpDir, fmt.Sprintf("%d.jpg", i))
+		writeTestJPEG(t, src, img)
+		items = append(items, BatchItem{Src: src, Dst: filepath.Join(tmpDir, fmt.Sprintf("%d_out.jpg", i))})
 	}
 
-	alphaImg := makeTestImageWithAlpha(100, 100)
-	if f := analyzeFormat(alphaImg); f != PNG {
-		t.Fatalf("expected PNG for alpha image, got %v", f)
+	// Cancel as the first item finishes; its result must survive.
+	c, cancel := context.WithCancel(ctx())
+	defer cancel()
+	results := CompressBatch(c, items, BatchOptions{
+		Workers:     1,
+		DefaultOpts: DefaultOptions(),
+		OnResult:    func(BatchResult, int, int) { cancel() },
+	})
+	if results[0].Err != nil || results[0].Result == nil {
+		t.Fatalf("finished item reported as %v", results[0].Err)
+	}
+	for _, r := range results[1:] {
+		if !errors.Is(r.Err, context.Canceled) {
+			t.Fatalf("item %d: err = %v, want context.Canceled", r.Index, r.Err)
+		}
 	}
 }
 
-func TestIsOpaque(t *testing.T) {
-	if !isOpaque(makeTestImage(10, 10)) {
-		t.Fatal("should be opaque")
+func TestCompressDir(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := filepath.Join(t.TempDir(), "out")
+	img := makeTestImage(64, 64)
+
+	if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
 	}
-	if isOpaque(makeTestImageWithAlpha(10, 10)) {
-		t.Fatal("should not be opaque")
+	writeTestJPEG(t, filepath.Join(srcDir, "a.jpg"), img)
+	writeTestJPEG(t, filepath.Join(srcDir, "sub", "b.jpg"), img)
+	if err := os.WriteFile(filepath.Join(srcDir, "notes.txt"), []byte("skip me"), 0644); err != nil {
+		t.Fatal(err)
 	}
-}
 
-func TestIsGrayscale(t *testing.T) {
-	gray := makeSolidImage(10, 10, color.NRGBA{128, 128, 128, 255})
-	if !isGrayscale(gray) {
-		t.Fatal("should be grayscale")
+	results, err := CompressDir(ctx(), srcDir, dstDir, "*.jpg", BatchOptions{DefaultOpts: DefaultOptions()})
+	if err != nil {
+		t.Fatalf("CompressDir: %v", err)
 	}
-	if isGrayscale(makeTestImage(10, 10)) {
-		t.Fatal("should not be grayscale")
+	if len(results) != 1 {
+		t.Fatalf("non-recursive walk should find 1 file, got %d", len(results))
 	}
-}
 
-func TestTryPalettize(t *testing.T) {
-	fewColors := image.NewNRGBA(image.Rect(0, 0, 50, 50))
-	for y := 0; y < 50; y++ {
-		for x := 0; x < 50; x++ {
-			off := y*fewColors.Stride + x*4
-			if x < 25 {
-				fewColors.Pix[off] = 255
-			}
-			fewColors.Pix[off+3] = 255
+	results, err = CompressDir(ctx(), srcDir, dstDir, "*.jpg", BatchOptions{DefaultOpts: DefaultOptions(), Recursive: true})
+	if err != nil {
+		t.Fatalf("CompressDir recursive: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("recursive walk should find 2 files, got %d", len(results))
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("item %s failed: %v", r.Item.Src, r.Err)
 		}
 	}
-	if tryPalettize(fewColors, 256) == nil {
-		t.Fatal("should palettize image with few colors")
+	if _, err := os.Stat(filepath.Join(dstDir, "sub", "b.jpg")); err != nil {
+		t.Fatalf("mirrored output missing: %v", err)
 	}
 
-	if tryPalettize(makeTestImage(200, 200), 256) != nil {
-		t.Fatal("should not palettize gradient image")
+	if _, err := CompressDir(ctx(), srcDir, dstDir, "[", BatchOptions{}); err == nil {
+		t.Fatal("malformed pattern should return an error")
 	}
 }
 
-// ── EXIF Orientation Tests ──────────────────────────────────────────────────
-
-func TestApplyOrientation(t *testing.T) {
-	img := image.NewNRGBA(image.Rect(0, 0, 100, 50))
-	img.Pix[0] = 255
-	img.Pix[3] = 255
-
-	normal := ApplyOrientation(img, OrientNormal)
-	if normal.Bounds().Dx() != 100 || normal.Bounds().Dy() != 50 {
-		t.Fatal("normal should be 100x50")
+func TestIsSupportedInput(t *testing.T) {
+	for name, want := range map[string]bool{
+		"a.jpg": true, "a.JPEG": true, "a.png": true, "a.gif": true,
+		"a.tif": true, "a.TIFF": true, "a.bmp": true,
+		"a.webp": false, "a.txt": false, "a": false,
+	} {
+		if got := isSupportedInput(name); got != want {
+			t.Errorf("isSupportedInput(%q) = %v, want %v", name, got, want)
+		}
 	}
+}
 
-	rotated := ApplyOrientation(img, OrientRotate90CW)
-	if rotated.Bounds().Dx() != 50 || rotated.Bounds().Dy() != 100 {
-		t.Fatalf("90CW should be 50x100, got %dx%d", rotated.Bounds().Dx(), rotated.Bounds().Dy())
+func TestCompressDirReadOnlyFormats(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	img := makeTestImage(64, 64)
+	if err := os.WriteFile(filepath.Join(srcDir, "scan.tiff"), encodeTestTIFF(img, 1, false, 16), 0644); err != nil {
+		t.Fatal(err)
 	}
-
-	rot180 := ApplyOrientation(img, OrientRotate180)
-	if rot180.Bounds().Dx() != 100 || rot180.Bounds().Dy() != 50 {
-		t.Fatal("180 should be 100x50")
+	if err := os.WriteFile(filepath.Join(srcDir, "icon.BMP"), encodeTestBMP(img), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"scan.tiff", "icon.BMP"} {
+		if err := os.Chtimes(filepath.Join(srcDir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
 	}
-}
 
-func TestOrientationString(t *testing.T) {
-	cases := map[Orientation]string{
-		OrientNormal:      "Normal",
-		OrientFlipH:       "FlipHorizontal",
-		OrientRotate180:   "Rotate180",
-		OrientFlipV:       "FlipVertical",
-		OrientTranspose:   "Transpose",
-		OrientRotate90CW:  "Rotate90CW",
-		OrientTransverse:  "Transverse",
-		OrientRotate270CW: "Rotate270CW",
-		Orientation(99):   "Unknown",
+	opts := DefaultOptions()
+	opts.Format = PNG
+	batchOpts := BatchOptions{DefaultOpts: opts, SkipUpToDate: true}
+	results, err := CompressDir(ctx(), srcDir, dstDir, "", batchOpts)
+	if err != nil {
+		t.Fatalf("CompressDir: %v", err)
 	}
-	for orient, want := range cases {
-		if got := orient.String(); got != want {
-			t.Fatalf("Orientation(%d).String() = %q, want %q", orient, got, want)
+	if len(results) != 2 {
+		t.Fatalf("expected the TIFF and BMP inputs, got %d results", len(results))
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("item %s failed: %v", r.Item.Src, r.Err)
+		}
+		// The output is named for the format written, not the input's.
+		base := strings.TrimSuffix(filepath.Base(r.Item.Src), filepath.Ext(r.Item.Src))
+		if want := filepath.Join(dstDir, base+".png"); r.Item.Dst != want {
+			t.Fatalf("Dst = %q, want %q", r.Item.Dst, want)
+		}
+		if _, err := os.Stat(r.Item.Dst); err != nil {
+			t.Fatal(err)
 		}
 	}
-}
-
-// ── Batch Tests ─────────────────────────────────────────────────────────────
 
-func TestCompressBatchEmpty(t *testing.T) {
-	results := CompressBatch(ctx(), nil, BatchOptions{})
-	if results != nil {
-		t.Fatal("empty batch should return nil")
+	results, err = CompressDir(ctx(), srcDir, dstDir, "", batchOpts)
+	if err != nil {
+		t.Fatalf("CompressDir again: %v", err)
+	}
+	for _, r := range results {
+		if !r.Skipped || filepath.Ext(r.Item.Dst) != ".png" {
+			t.Fatalf("second run: %s skipped=%v dst=%q, want skipped .png", r.Item.Src, r.Skipped, r.Item.Dst)
+		}
 	}
 }
 
-func TestCompressBatchWithFiles(t *testing.T) {
-	// Create temp input files.
+func TestCompressBatchSkipUpToDate(t *testing.T) {
 	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "a.jpg")
+	dst := filepath.Join(tmpDir, "a_out.jpg")
+	writeTestJPEG(t, src, makeTestImage(64, 64))
 
-	img := makeTestImage(100, 100)
-	for _, name := range []string{"a.jpg", "b.jpg"} {
-		path := filepath.Join(tmpDir, name)
-		f, err := os.Create(path)
-		if err != nil {
-			t.Fatal(err)
-		}
-		jpeg.Encode(f, img, &jpeg.Options{Quality: 95})
-		f.Close()
+	items := []BatchItem{{Src: src, Dst: dst}}
+	bo := BatchOptions{DefaultOpts: DefaultOptions(), SkipUpToDate: true}
+
+	first := CompressBatch(ctx(), items, bo)
+	if first[0].Err != nil || first[0].Skipped {
+		t.Fatalf("first run should compress: err=%v skipped=%v", first[0].Err, first[0].Skipped)
 	}
 
-	items := []BatchItem{
-		{Src: filepath.Join(tmpDir, "a.jpg"), Dst: filepath.Join(tmpDir, "a_out.jpg")},
-		{Src: filepath.Join(tmpDir, "b.jpg"), Dst: filepath.Join(tmpDir, "b_out.jpg")},
+	// Make sure dst is strictly newer than src regardless of timestamp granularity.
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(dst, future, future); err != nil {
+		t.Fatal(err)
 	}
 
-	var progressCalls int32 // Change this to int32 for atomic operations
+	second := CompressBatch(ctx(), items, bo)
+	if !second[0].Skipped {
+		t.Fatal("second run should skip up-to-date output")
+	}
+	summary := Summarize(second)
+	if summary.Skipped != 1 || summary.Succeeded != 0 || summary.Failed != 0 {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+}
 
-	results := CompressBatch(ctx(), items, BatchOptions{
+func TestCompressBatchBytes(t *testing.T) {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, makeTestImage(64, 64), &jpeg.Options{Quality: 95})
+	inputs := [][]byte{buf.Bytes(), []byte("not an image"), buf.Bytes()}
+
+	var calls int32
+	results := CompressBatchBytes(ctx(), inputs, BatchOptions{
 		Workers:     2,
 		DefaultOpts: DefaultOptions(),
 		OnItem: func(completed, total int) {
-			atomic.AddInt32(&progressCalls, 1) // Safely increment the counter
+			atomic.AddInt32(&calls, 1)
 		},
 	})
 
-	if len(results) != 2 {
-		t.Fatalf("expected 2 results, got %d", len(results))
+	if len(results) != len(inputs) {
+		t.Fatalf("expected %d results, got %d", len(inputs), len(results))
 	}
-
-	for i, r := range results {
-		if r.Err != nil {
-			t.Fatalf("item %d failed: %v", i, r.Err)
-		}
-		if r.Result == nil {
-			t.Fatalf("item %d has nil result", i)
-		}
-		if r.Index != i {
-			t.Fatalf("item %d has wrong index %d", i, r.Index)
-		}
+	if results[0].Err != nil || len(results[0].Data) == 0 || results[0].Result == nil {
+		t.Fatalf("item 0 should succeed: %v", results[0].Err)
 	}
-
-	if atomic.LoadInt32(&progressCalls) != 2 { // Safely read the counter
-		t.Fatalf("expected 2 progress calls, got %d", atomic.LoadInt32(&progressCalls))
+	if results[1].Err == nil {
+		t.Fatal("item 1 should fail to decode")
+	}
+	if atomic.LoadInt32(&calls) != int32(len(inputs)) {
+		t.Fatalf("expected %d progress calls, got %d", len(inputs), atomic.LoadInt32(&calls))
+	}
+	if CompressBatchBytes(ctx(), nil, BatchOptions{}) != nil {
+		t.Fatal("empty input should return nil")
 	}
 }
 
@@ -933,6 +5871,72 @@ func TestCompressBatchBadInput(t *testing.T) {
 	}
 }
 
+func TestCompressBatchRetries(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "in.png")
+	if err := Save(makeTestImage(40, 40), src, DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory in the way of Dst fails the write; it is cleared just
+	// before the second write, so one retry succeeds.
+	dst := filepath.Join(tmpDir, "out.png")
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var writes atomic.Int32
+	opts := DefaultOptions()
+	opts.OnProgress = func(stage ProgressStage, percent float64) error {
+		if stage == StageWriting && percent < 1 && writes.Add(1) == 2 {
+			return os.Remove(dst)
+		}
+		return nil
+	}
+	results := CompressBatch(ctx(), []BatchItem{{Src: src, Dst: dst}}, BatchOptions{
+		DefaultOpts: opts,
+		MaxRetries:  3,
+	})
+	if r := results[0]; r.Err != nil || r.Retries != 1 {
+		t.Fatalf("got err %v after %d retries, want success after 1", r.Err, r.Retries)
+	}
+
+	// Bad data fails at once, however many retries are allowed.
+	bad := filepath.Join(tmpDir, "bad.png")
+	if err := os.WriteFile(bad, []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	results = CompressBatch(ctx(), []BatchItem{
+		{Src: bad, Dst: filepath.Join(tmpDir, "bad_out.png")},
+		{Src: filepath.Join(tmpDir, "missing.png"), Dst: filepath.Join(tmpDir, "missing_out.png")},
+	}, BatchOptions{DefaultOpts: DefaultOptions(), MaxRetries: 3})
+	for _, r := range results {
+		if r.Err == nil || r.Retries != 0 {
+			t.Fatalf("%s: got err %v after %d retries, want an immediate error", r.Item.Src, r.Err, r.Retries)
+		}
+	}
+}
+
+func TestIsTransientIOError(t *testing.T) {
+	eio := &fs.PathError{Op: "read", Path: "x", Err: syscall.EIO}
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("fennec: write %q: %w", "x", eio), true},
+		{fmt.Errorf("%w %q: %w", ErrDecode, "x", eio), true},
+		{fmt.Errorf("%w %q: %w", ErrDecode, "x", image.ErrFormat), false},
+		{&fs.PathError{Op: "open", Path: "x", Err: fs.ErrNotExist}, false},
+		{&fs.PathError{Op: "open", Path: "x", Err: fs.ErrPermission}, false},
+		{ErrInvalidOptions, false},
+		{context.Canceled, false},
+	}
+	for _, tc := range cases {
+		if got := isTransientIOError(tc.err); got != tc.want {
+			t.Errorf("isTransientIOError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
 func TestSummarize(t *testing.T) {
 	results := []BatchResult{
 		{
@@ -989,12 +5993,13 @@ func TestSummarizeEmpty(t *testing.T) {
 
 func TestQualityString(t *testing.T) {
 	presets := map[Quality]string{
-		Lossless:   "Lossless",
-		Ultra:      "Ultra",
-		High:       "High",
-		Balanced:   "Balanced",
-		Aggressive: "Aggressive",
-		Maximum:    "Maximum",
+		Lossless:     "Lossless",
+		NearLossless: "NearLossless",
+		Ultra:        "Ultra",
+		High:         "High",
+		Balanced:     "Balanced",
+		Aggressive:   "Aggressive",
+		Maximum:      "Maximum",
 	}
 	for q, name := range presets {
 		if q.String() != name {
@@ -1062,6 +6067,58 @@ func TestResultString(t *testing.T) {
 	}
 }
 
+func TestResultMarshalJSON(t *testing.T) {
+	r := Result{
+		Format:             JPEG,
+		CompressedData:     []byte{1, 2, 3},
+		OriginalDimensions: image.Pt(1000, 800),
+		FinalDimensions:    image.Pt(500, 400),
+		SSIM:               0.95,
+	}
+	data, err := json.Marshal(&r)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["format"] != "JPEG" {
+		t.Fatalf("format should marshal as a string, got %v", got["format"])
+	}
+	dims, ok := got["final_dimensions"].(map[string]any)
+	if !ok || dims["width"] != 500.0 || dims["height"] != 400.0 {
+		t.Fatalf("unexpected final_dimensions: %v", got["final_dimensions"])
+	}
+	if _, ok := got["CompressedData"]; ok {
+		t.Fatal("compressed bytes should not be serialized")
+	}
+}
+
+func TestImageStatsMarshalJSON(t *testing.T) {
+	stats := ImageStats{Width: 10, Height: 20, RecommendedFormat: PNG, RecommendedQuality: High}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["recommended_format"] != "PNG" || got["recommended_quality"] != "High" {
+		t.Fatalf("enums should marshal as names: %s", data)
+	}
+
+	var back ImageStats
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if back.RecommendedFormat != PNG || back.RecommendedQuality != High {
+		t.Fatalf("round-trip mismatch: %+v", back)
+	}
+}
+
 func TestResultBytes(t *testing.T) {
 	r := Result{CompressedData: []byte{1, 2, 3}}
 	if len(r.Bytes()) != 3 {
@@ -1162,12 +6219,113 @@ func BenchmarkCompressJPEG(b *testing.B) {
 	}
 }
 
-func BenchmarkAnalyze(b *testing.B) {
-	img := makeTestImage(1000, 1000)
+// BenchmarkCompressJPEGFlat reports JPEG encodes per run on a low-entropy
+// image, where the search stops once the size stops shrinking.
+func BenchmarkCompressJPEGFlat(b *testing.B) {
+	img := makeSolidImage(500, 500, color.NRGBA{90, 120, 150, 255})
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	b.ResetTimer()
+	b.ReportAllocs()
+	start := jpegEncodes.Load()
+	for i := 0; i < b.N; i++ {
+		CompressImage(ctx(), img, opts)
+	}
+	b.ReportMetric(float64(jpegEncodes.Load()-start)/float64(b.N), "encodes/op")
+}
+
+// BenchmarkCompressTargetSize reports JPEG encodes per run, which the
+// scale-probe cache keeps down when the scale searches revisit a size.
+func BenchmarkCompressTargetSize(b *testing.B) {
+	img := makeNoisyImage(400, 400)
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	opts.TargetSize = 4000
+	b.ResetTimer()
+	b.ReportAllocs()
+	start := jpegEncodes.Load()
+	for i := 0; i < b.N; i++ {
+		CompressImage(ctx(), img, opts)
+	}
+	b.ReportMetric(float64(jpegEncodes.Load()-start)/float64(b.N), "encodes/op")
+}
+
+func BenchmarkJPEGScaleSearch(b *testing.B) {
+	for _, tc := range []struct {
+		name string
+		img  *image.NRGBA
+	}{
+		{"gradient", makeTestImage(1200, 900)},
+		{"stripes", makeStripedImage(1200, 900, 3)},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			start := jpegEncodes.Load()
+			for i := 0; i < b.N; i++ {
+				probes := newScaleProbes(tc.img, 6000, jpegEncoding{})
+				jpegQualityScaleSearch(ctx(), nil, tc.img, probes, 6000, scaleBinaryIterations, 0, 0, resampling{})
+			}
+			b.ReportMetric(float64(jpegEncodes.Load()-start)/float64(b.N), "encodes/op")
+		})
+	}
+}
+
+// BenchmarkConvertJPEG converts a decoded JPEG, the *image.YCbCr every
+// JPEG input arrives as, to NRGBA.
+func BenchmarkConvertJPEG(b *testing.B) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, makeNoisyImage(1000, 1000), &jpeg.Options{Quality: 90}); err != nil {
+		b.Fatal(err)
+	}
+	img, err := jpeg.Decode(&buf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		toNRGBA(img)
+	}
+}
+
+func BenchmarkMedianCut(b *testing.B) {
+	img := makeNoisyImage(1000, 1000)
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		medianCut(img, 256)
+	}
+}
+
+func BenchmarkApplyPalette(b *testing.B) {
+	img := makeNoisyImage(1000, 1000)
+	palette := medianCut(img, 256)
 	b.ResetTimer()
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		Analyze(img)
+		applyPalette(img, palette, false)
+	}
+}
+
+func BenchmarkApplyPalettePerceptual(b *testing.B) {
+	img := makeNoisyImage(1000, 1000)
+	palette := medianCut(img, 256)
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		applyPalette(img, palette, true)
+	}
+}
+
+func BenchmarkAnalyze(b *testing.B) {
+	for _, size := range []image.Point{{1000, 1000}, {4000, 3000}} {
+		img := makeTestImage(size.X, size.Y)
+		b.Run(fmt.Sprintf("%dx%d", size.X, size.Y), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				Analyze(img)
+			}
+		})
 	}
 }
 
@@ -1180,6 +6338,19 @@ func BenchmarkGaussianBlur(b *testing.B) {
 	}
 }
 
+// BenchmarkBoxBlur shows the running-sum blur costs the same at any radius.
+func BenchmarkBoxBlur(b *testing.B) {
+	img := makeTestImage(500, 500)
+	for _, r := range []int{2, 8, 32, 128} {
+		b.Run(fmt.Sprintf("radius=%d", r), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				BoxBlur(img, r)
+			}
+		})
+	}
+}
+
 func BenchmarkAdaptiveSharpen(b *testing.B) {
 	img := makeStripedImage(500, 500, 10)
 	b.ResetTimer()
@@ -0,0 +1,75 @@
+package fennec
+
+import (
+	"image"
+	"image/gif"
+	"io"
+)
+
+// ── GIF Output ──────────────────────────────────────────────────────────────
+//
+// GIF stores at most 256 colors, like an indexed PNG, but compresses with
+// LZW instead of Deflate and has no partial transparency: one palette entry
+// may be fully transparent, every other is opaque. Fennec writes it for
+// places that still want it, such as email clients and ad networks, with
+// the median-cut quantizer the PNG paths use. Its fixed overhead is smaller
+// than PNG's, so for tiny graphics it can also be the smaller file.
+
+// encodeGIF writes img to w as a GIF of at most maxColors colors and
+// returns the pixels it stored. Images that already have few enough colors
+// keep them exactly; others are quantized with median cut. Alpha is
+// reduced to GIF's on or off at half coverage.
+func encodeGIF(w io.Writer, img *image.NRGBA, maxColors int, perceptual bool) (*image.NRGBA, error) {
+	src := gifAlpha(img)
+	paletted := tryPalettize(src, maxColors)
+	if paletted == nil {
+		paletted = applyPalette(src, medianCut(src, maxColors), perceptual)
+	}
+	if err := gif.Encode(w, paletted, nil); err != nil {
+		return nil, err
+	}
+	return palettedToNRGBA(paletted), nil
+}
+
+// compressGIF is compressPNG for GIF output: it encodes img with the
+// quality preset's palette size (LossyPNG's sizes; 256 from High up) and
+// returns the SSIM of the stored pixels against img.
+func compressGIF(img *image.NRGBA, w io.Writer, opts Options) (float64, error) {
+	stored, err := encodeGIF(w, img, opts.Quality.paletteColors(), opts.PerceptualQuantize)
+	if err != nil {
+		return 0, err
+	}
+	return SSIMFast(img, stored), nil
+}
+
+// gifAlpha returns img with every pixel fully transparent or fully opaque,
+// split at half coverage, and transparent pixels cleared to one color so
+// they share a palette entry. Opaque images are returned as they are.
+func gifAlpha(img *image.NRGBA) *image.NRGBA {
+	if isOpaque(img) {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		src := img.Pix[y*img.Stride : y*img.Stride+b.Dx()*4]
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+b.Dx()*4]
+		for i := 0; i < len(src); i += 4 {
+			if src[i+3] >= 128 {
+				row[i], row[i+1], row[i+2], row[i+3] = src[i], src[i+1], src[i+2], 255
+			}
+		}
+	}
+	return dst
+}
+
+// binaryAlpha reports whether every pixel of img is fully opaque or fully
+// transparent, so GIF loses none of its transparency.
+func binaryAlpha(img *image.NRGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if a := img.Pix[i]; a != 0 && a != 0xff {
+			return false
+		}
+	}
+	return true
+}
@@ -1,18 +1,21 @@
 package fennec
 
 import (
+	"bytes"
 	"context"
+	"image"
+	"image/color"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
-// ensureTestdata skips the test if fixture images don't exist.
+// ensureTestdata generates any fixture images missing from testdata.
 func ensureTestdata(t *testing.T) {
 	t.Helper()
-	if _, err := os.Stat("testdata/gradient.jpg"); os.IsNotExist(err) {
-		t.Skip("Testdata missing. Run: make fixtures")
-	}
+	generateTestData(t)
 }
 
 // \u2500\u2500 Integration Tests \u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500\u2500
@@ -89,6 +92,35 @@ func TestIntegrationCompressFewColorsPNG(t *testing.T) {
 	}
 }
 
+func TestIntegrationCompressFileAuto(t *testing.T) {
+	ensureTestdata(t)
+	tmpDir := t.TempDir()
+
+	for _, tc := range []struct {
+		src, ext string
+		want     Format
+	}{
+		{"testdata/fewcolors.png", ".png", PNG},
+		{"testdata/gradient.jpg", ".jpg", JPEG},
+	} {
+		base := filepath.Join(tmpDir, strings.TrimSuffix(filepath.Base(tc.src), filepath.Ext(tc.src)))
+		result, path, err := CompressFileAuto(context.Background(), tc.src, base, DefaultOptions())
+		if err != nil {
+			t.Fatalf("%s: CompressFileAuto: %v", tc.src, err)
+		}
+		if result.Format != tc.want || path != base+tc.ext {
+			t.Fatalf("%s: got %v at %q, want %v at %q", tc.src, result.Format, path, tc.want, base+tc.ext)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, result.CompressedData) {
+			t.Fatalf("%s: written file differs from CompressedData", tc.src)
+		}
+	}
+}
+
 func TestIntegrationResizeAndCompress(t *testing.T) {
 	ensureTestdata(t)
 	tmpDir := t.TempDir()
@@ -223,3 +255,114 @@ func TestIntegrationBatchCompress(t *testing.T) {
 		t.Fatalf("expected 2 succeeded, got %d (failed: %d)", summary.Succeeded, summary.Failed)
 	}
 }
+
+// rawTestMagic starts a toy image format the integration tests register
+// with the image package: the magic, one byte each of width and height,
+// then opaque RGB pixels. It stands in for a third-party decoder such as
+// golang.org/x/image/webp.
+const rawTestMagic = "FNRAW"
+
+func init() {
+	image.RegisterFormat("fnraw", rawTestMagic, decodeRawTest, decodeRawTestConfig)
+}
+
+func decodeRawTestConfig(r io.Reader) (image.Config, error) {
+	var hdr [len(rawTestMagic) + 2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return image.Config{}, err
+	}
+	w, h := int(hdr[len(rawTestMagic)]), int(hdr[len(rawTestMagic)+1])
+	return image.Config{ColorModel: color.NRGBAModel, Width: w, Height: h}, nil
+}
+
+func decodeRawTest(r io.Reader) (image.Image, error) {
+	cfg, err := decodeRawTestConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		if _, err := io.ReadFull(r, img.Pix[i:i+3]); err != nil {
+			return nil, err
+		}
+		img.Pix[i+3] = 255
+	}
+	return img, nil
+}
+
+func TestIntegrationRegisteredInputFormat(t *testing.T) {
+	const w, h = 64, 48
+	data := []byte(rawTestMagic)
+	data = append(data, w, h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			data = append(data, uint8(x*4), uint8(y*5), 128)
+		}
+	}
+
+	gotW, gotH, format, err := DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeConfig: %v", err)
+	}
+	if gotW != w || gotH != h || format != "fnraw" {
+		t.Fatalf("DecodeConfig = %dx%d %q, want %dx%d \"fnraw\"", gotW, gotH, format, w, h)
+	}
+
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	result, err := CompressBytes(context.Background(), data, opts)
+	if err != nil {
+		t.Fatalf("CompressBytes: %v", err)
+	}
+	if result.FinalDimensions != image.Pt(w, h) {
+		t.Fatalf("FinalDimensions = %v, want (%d,%d)", result.FinalDimensions, w, h)
+	}
+	if _, format, err := image.Decode(bytes.NewReader(result.Bytes())); err != nil || format != "jpeg" {
+		t.Fatalf("output should decode as jpeg, got %q (%v)", format, err)
+	}
+
+	src := filepath.Join(t.TempDir(), "input.fnraw")
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(src); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+}
+
+func TestIntegrationCompressTIFF(t *testing.T) {
+	ensureTestdata(t)
+	dst := filepath.Join(t.TempDir(), "scan.jpg")
+
+	opts := DefaultOptions()
+	opts.Format = JPEG
+	result, err := CompressFile(context.Background(), "testdata/scan.tif", dst, opts)
+	if err != nil {
+		t.Fatalf("CompressFile: %v", err)
+	}
+	if result.FinalDimensions != image.Pt(240, 320) {
+		t.Fatalf("FinalDimensions = %v, want (240,320)", result.FinalDimensions)
+	}
+	if result.SSIM < 0.90 {
+		t.Fatalf("SSIM too low: %f", result.SSIM)
+	}
+	if result.Format != JPEG {
+		t.Fatalf("expected JPEG, got %v", result.Format)
+	}
+}
+
+func TestIntegrationCompressBMP(t *testing.T) {
+	ensureTestdata(t)
+	dst := filepath.Join(t.TempDir(), "bitmap.png")
+
+	result, err := CompressFile(context.Background(), "testdata/bitmap.bmp", dst, DefaultOptions())
+	if err != nil {
+		t.Fatalf("CompressFile: %v", err)
+	}
+	if result.FinalDimensions != image.Pt(150, 100) {
+		t.Fatalf("FinalDimensions = %v, want (150,100)", result.FinalDimensions)
+	}
+	if result.SavingsPercent <= 50 {
+		t.Fatalf("an uncompressed BMP should shrink a lot, saved %.1f%%", result.SavingsPercent)
+	}
+}
@@ -0,0 +1,5 @@
+// Package webptest checks that Fennec reads WebP through a decoder
+// registered with the image package, as its docs promise. It is a
+// separate module so that Fennec itself keeps no dependencies: only these
+// tests import golang.org/x/image/webp.
+package webptest
@@ -0,0 +1,10 @@
+module github.com/shamspias/fennec/internal/webptest
+
+go 1.25.5
+
+require (
+	github.com/shamspias/fennec v0.0.0
+	golang.org/x/image v0.34.0
+)
+
+replace github.com/shamspias/fennec => ../..
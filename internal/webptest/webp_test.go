@@ -0,0 +1,133 @@
+package webptest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shamspias/fennec"
+	_ "golang.org/x/image/webp"
+)
+
+// lossyWebP is a 16×16 VP8 image of four flat 8×8 quadrants:
+// quadColors, left to right and top to bottom.
+const lossyWebP = "" +
+	"\x52\x49\x46\x46\x42\x00\x00\x00\x57\x45\x42\x50\x56\x50\x38\x20" +
+	"\x36\x00\x00\x00\xd0\x01\x00\x9d\x01\x2a\x10\x00\x10\x00\x00\xc0" +
+	"\x12\x25\xa0\x02\x74\xba\x01\xf8\x00\x03\xb0\x00\xe4\x3f\xff\xd1" +
+	"\x75\xff\xf8\x46\x2f\xff\xf3\x12\x37\xff\x46\x1f\xd5\xa1\xfa\xed" +
+	"\x87\xff\xb5\x2c\xfc\xd7\x5c\xe0\x00\x00"
+
+var quadColors = [4]color.NRGBA{
+	{200, 40, 40, 255}, {40, 180, 60, 255},
+	{50, 70, 210, 255}, {230, 230, 230, 255},
+}
+
+// losslessWebP is a 4×3 VP8L image holding losslessPix, whose first
+// pixel is half transparent.
+const losslessWebP = "" +
+	"\x52\x49\x46\x46\x52\x00\x00\x00\x57\x45\x42\x50\x56\x50\x38\x4c" +
+	"\x45\x00\x00\x00\x2f\x03\x80\x00\x10\x5f\xa0\x98\x91\x24\x48\x60" +
+	"\x00\xae\x7e\xae\xbf\xe4\x4a\x10\x69\xdb\xc6\xd0\xd9\xd0\x71\x09" +
+	"\xb2\x6d\x63\x02\x43\x28\xc1\x05\x2e\x20\x28\x7a\xce\xf4\x2a\x78" +
+	"\xfb\xfe\x80\x0a\x50\x01\x7f\x00\x04\x01\x24\x16\xb1\xc4\x32\xc5" +
+	"\x2c\xb3\x0c\x1b\xd1\xff\xe8\x8e\x01\x00"
+
+var losslessPix = []uint8{
+	5, 24, 42, 128, 159, 196, 233, 255, 51, 88, 125, 255, 199, 236, 17, 255,
+	91, 128, 165, 255, 239, 20, 57, 255, 131, 168, 205, 255, 23, 60, 97, 255,
+	171, 208, 245, 255, 63, 100, 137, 255, 211, 248, 29, 255, 103, 140, 177, 255,
+}
+
+// openWebP writes data to a file and loads it with fennec.Open.
+func openWebP(t *testing.T, data string) image.Image {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "input.webp")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	img, err := fennec.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return img
+}
+
+func TestLossyWebP(t *testing.T) {
+	w, h, format, err := fennec.DecodeConfig(bytes.NewReader([]byte(lossyWebP)))
+	if err != nil || w != 16 || h != 16 || format != "webp" {
+		t.Fatalf("DecodeConfig = %dx%d %q, %v; want 16x16 webp", w, h, format, err)
+	}
+
+	img := openWebP(t, lossyWebP)
+	if got := img.Bounds().Size(); got != image.Pt(16, 16) {
+		t.Fatalf("decoded size %v, want 16x16", got)
+	}
+	// Lossy coding shifts the flat colors a little; each quadrant still
+	// decodes to its own hue.
+	for i, want := range quadColors {
+		x, y := 4+8*(i%2), 4+8*(i/2)
+		got := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+		for _, d := range [3]int{int(got.R) - int(want.R), int(got.G) - int(want.G), int(got.B) - int(want.B)} {
+			if d < -24 || d > 24 {
+				t.Fatalf("pixel (%d,%d) = %v, want about %v", x, y, got, want)
+			}
+		}
+	}
+
+	opts := fennec.DefaultOptions()
+	opts.Format = fennec.JPEG
+	result, err := fennec.CompressBytes(context.Background(), []byte(lossyWebP), opts)
+	if err != nil {
+		t.Fatalf("CompressBytes: %v", err)
+	}
+	if result.SourceFormat != fennec.OtherFormat || result.FinalDimensions != image.Pt(16, 16) {
+		t.Fatalf("SourceFormat %v, FinalDimensions %v", result.SourceFormat, result.FinalDimensions)
+	}
+}
+
+func TestLosslessWebP(t *testing.T) {
+	img := openWebP(t, losslessWebP)
+	if got := img.Bounds().Size(); got != image.Pt(4, 3) {
+		t.Fatalf("decoded size %v, want 4x3", got)
+	}
+	for i := 0; i < len(losslessPix); i += 4 {
+		x, y := i/4%4, i/4/4
+		want := color.NRGBA{losslessPix[i], losslessPix[i+1], losslessPix[i+2], losslessPix[i+3]}
+		if got := color.NRGBAModel.Convert(img.At(x, y)); got != want {
+			t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got, want)
+		}
+	}
+
+	opts := fennec.DefaultOptions()
+	opts.Format = fennec.PNG
+	result, err := fennec.CompressBytes(context.Background(), []byte(losslessWebP), opts)
+	if err != nil {
+		t.Fatalf("CompressBytes: %v", err)
+	}
+	// Lossless PNG output keeps every pixel, alpha included.
+	out := result.Image
+	for i := 0; i < len(losslessPix); i += 4 {
+		x, y := i/4%4, i/4/4
+		want := color.NRGBA{losslessPix[i], losslessPix[i+1], losslessPix[i+2], losslessPix[i+3]}
+		if got := color.NRGBAModel.Convert(out.At(x, y)); got != want {
+			t.Fatalf("output pixel (%d,%d) = %v, want %v", x, y, got, want)
+		}
+	}
+}
+
+func TestAnimatedWebPRejected(t *testing.T) {
+	// A VP8X header with the animation flag and two ANMF chunks.
+	data := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	for range 2 {
+		data = append(data, "ANMF\x00\x00\x00\x00"...)
+	}
+	if _, err := fennec.CompressBytes(context.Background(), data, fennec.DefaultOptions()); !errors.Is(err, fennec.ErrAnimated) {
+		t.Fatalf("animated WebP: err = %v, want ErrAnimated", err)
+	}
+}
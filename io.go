@@ -1,6 +1,9 @@
 package fennec
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
@@ -9,25 +12,88 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 )
 
 // Open loads an image from a file path.
 // If the file is a JPEG, the EXIF orientation is read (but not applied).
 // Use OpenAndOrient to automatically correct orientation.
+//
+// JPEG, PNG, GIF, TIFF (baseline, strip-based), and BMP (uncompressed)
+// decode out of the box; TIFF and BMP are input only. Any other format
+// whose decoder is registered with the image package is accepted too, by
+// Open and by Compress, CompressBytes, and CompressFile, and is
+// recompressed to JPEG, PNG, or GIF. Fennec has no dependencies, so it
+// bundles no WebP or AVIF decoder; blank-import one to enable it:
+//
+//	import _ "golang.org/x/image/webp"
+//
+// Animated inputs (GIF, APNG, animated WebP) are rejected with ErrAnimated
+// here and by the Compress functions that read encoded data, rather than
+// reduced to their first frame.
 func Open(filename string) (image.Image, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("fennec: open %q: %w", filename, err)
 	}
 	defer f.Close()
+	if err := checkAnimatedFile(f, filename); err != nil {
+		return nil, err
+	}
 
-	img, _, err := image.Decode(f)
+	img, _, err := decodeImage(f)
 	if err != nil {
-		return nil, fmt.Errorf("fennec: decode %q: %w", filename, err)
+		return nil, fmt.Errorf("%w %q: %w", ErrDecode, filename, err)
 	}
 	return img, nil
 }
 
+// decodeImage is image.Decode plus Fennec's built-in TIFF and BMP
+// decoders. Those are picked by signature here rather than registered
+// with the image package, so importing Fennec doesn't change what
+// image.Decode reads elsewhere in the program.
+func decodeImage(r io.Reader) (image.Image, string, error) {
+	br := bufio.NewReader(r)
+	switch format := builtinFormat(br); format {
+	case "tiff":
+		img, err := decodeTIFF(br)
+		return img, format, err
+	case "bmp":
+		img, err := decodeBMP(br)
+		return img, format, err
+	}
+	return image.Decode(br)
+}
+
+// decodeImageConfig is image.DecodeConfig with decodeImage's built-in
+// formats.
+func decodeImageConfig(r io.Reader) (image.Config, string, error) {
+	br := bufio.NewReader(r)
+	switch format := builtinFormat(br); format {
+	case "tiff":
+		cfg, err := decodeTIFFConfig(br)
+		return cfg, format, err
+	case "bmp":
+		cfg, err := decodeBMPConfig(br)
+		return cfg, format, err
+	}
+	return image.DecodeConfig(br)
+}
+
+// builtinFormat names the built-in input format whose signature br starts
+// with, or returns "" for any other data.
+func builtinFormat(br *bufio.Reader) string {
+	magic, _ := br.Peek(4)
+	switch {
+	case string(magic) == "II*\x00" || string(magic) == "MM\x00*":
+		return "tiff"
+	case len(magic) >= 2 && string(magic[:2]) == "BM":
+		return "bmp"
+	default:
+		return ""
+	}
+}
+
 // OpenAndOrient loads an image and corrects its orientation using EXIF data.
 // For JPEG files with orientation metadata, the returned image will be
 // rotated/flipped so that it displays correctly regardless of camera orientation.
@@ -38,6 +104,10 @@ func OpenAndOrient(filename string) (image.Image, error) {
 	}
 	defer f.Close()
 
+	if err := checkAnimatedFile(f, filename); err != nil {
+		return nil, err
+	}
+
 	// Read EXIF orientation first.
 	orient := ReadOrientation(f)
 
@@ -46,9 +116,9 @@ func OpenAndOrient(filename string) (image.Image, error) {
 		return nil, fmt.Errorf("fennec: seek %q: %w", filename, err)
 	}
 
-	img, _, err := image.Decode(f)
+	img, _, err := decodeImage(f)
 	if err != nil {
-		return nil, fmt.Errorf("fennec: decode %q: %w", filename, err)
+		return nil, fmt.Errorf("%w %q: %w", ErrDecode, filename, err)
 	}
 
 	if orient <= OrientNormal {
@@ -60,31 +130,145 @@ func OpenAndOrient(filename string) (image.Image, error) {
 	return ApplyOrientation(nrgba, orient), nil
 }
 
-// openWithOrientation opens a file and returns the image, its EXIF orientation,
-// and the file size. Used internally by CompressFile.
-func openWithOrientation(filename string) (image.Image, Orientation, int64, error) {
+// DecodeConfig reads just the header of an encoded image and returns its
+// dimensions and format name ("jpeg", "png", "gif", "tiff", "bmp", or that of
+// another registered decoder; see Open), without decoding any pixels. Use
+// it to route or reject uploads before paying for a full decode.
+// Dimensions are as stored; EXIF orientation is not applied.
+func DecodeConfig(r io.Reader) (width, height int, format string, err error) {
+	cfg, format, err := decodeImageConfig(r)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("%w config: %w", ErrDecode, err)
+	}
+	return cfg.Width, cfg.Height, format, nil
+}
+
+// DetectFormat sniffs the leading bytes of encoded image data and reports
+// the Format they would compress from. JPEG, PNG, and GIF are recognized by
+// their signatures alone. Any other format Open can decode (TIFF, BMP, or one
+// whose decoder is registered, such as WebP) returns Auto, since Fennec
+// reads it but writes JPEG, PNG, or GIF. Data Open can't decode returns Auto
+// and an error wrapping ErrUnsupportedFormat.
+func DetectFormat(data []byte) (Format, error) {
+	switch {
+	case len(data) >= 2 && data[0] == 0xFF && data[1] == 0xD8:
+		return JPEG, nil
+	case len(data) >= 8 && string(data[:8]) == pngSignature:
+		return PNG, nil
+	case len(data) >= 6 && (string(data[:6]) == "GIF87a" || string(data[:6]) == "GIF89a"):
+		return GIF, nil
+	}
+	// Other formats go through the built-in decoders and the image
+	// package's registry, which read only as far as each format's header.
+	if _, _, err := decodeImageConfig(bytes.NewReader(data)); errors.Is(err, image.ErrFormat) {
+		return Auto, fmt.Errorf("%w: unrecognized image data", ErrUnsupportedFormat)
+	}
+	return Auto, nil
+}
+
+// sourceFormat maps a decoder's format name, as decodeImage returns it, to
+// the Format reported in Result.SourceFormat.
+func sourceFormat(name string) Format {
+	switch name {
+	case "":
+		return Auto
+	case "jpeg":
+		return JPEG
+	case "png":
+		return PNG
+	case "gif":
+		return GIF
+	default:
+		return OtherFormat
+	}
+}
+
+// DimensionsOf is DecodeConfig for a file path.
+func DimensionsOf(filename string) (width, height int, format string, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("fennec: open %q: %w", filename, err)
+	}
+	defer f.Close()
+
+	cfg, format, err := decodeImageConfig(f)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("%w config %q: %w", ErrDecode, filename, err)
+	}
+	return cfg.Width, cfg.Height, format, nil
+}
+
+// openWithMeta opens a file and returns the image, its metadata (EXIF
+// orientation and block), and the file size. With keepData set, the encoded
+// file is kept in the metadata too. Used internally by CompressFile.
+func openWithMeta(filename string, keepData bool) (image.Image, inputMeta, int64, error) {
 	f, err := os.Open(filename)
 	if err != nil {
-		return nil, OrientNormal, 0, fmt.Errorf("fennec: open %q: %w", filename, err)
+		return nil, inputMeta{}, 0, fmt.Errorf("fennec: open %q: %w", filename, err)
 	}
 	defer f.Close()
 
 	stat, err := f.Stat()
 	if err != nil {
-		return nil, OrientNormal, 0, fmt.Errorf("fennec: stat %q: %w", filename, err)
+		return nil, inputMeta{}, 0, fmt.Errorf("fennec: stat %q: %w", filename, err)
 	}
 
-	orient := ReadOrientation(f)
+	if err := checkAnimatedFile(f, filename); err != nil {
+		return nil, inputMeta{}, 0, err
+	}
+	meta := readInputMeta(f)
 	if _, err := f.Seek(0, io.SeekStart); err != nil {
-		return nil, OrientNormal, 0, fmt.Errorf("fennec: seek %q: %w", filename, err)
+		return nil, inputMeta{}, 0, fmt.Errorf("fennec: seek %q: %w", filename, err)
 	}
 
-	img, _, err := image.Decode(f)
+	img, format, err := decodeImage(f)
 	if err != nil {
-		return nil, OrientNormal, 0, fmt.Errorf("fennec: decode %q: %w", filename, err)
+		return nil, inputMeta{}, 0, fmt.Errorf("%w %q: %w", ErrDecode, filename, err)
+	}
+	meta.format = format
+
+	if keepData && format == "jpeg" {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, inputMeta{}, 0, fmt.Errorf("fennec: seek %q: %w", filename, err)
+		}
+		if meta.data, err = io.ReadAll(f); err != nil {
+			return nil, inputMeta{}, 0, fmt.Errorf("fennec: read %q: %w", filename, err)
+		}
+	}
+	return img, meta, stat.Size(), nil
+}
+
+// checkAnimatedFile runs checkAnimated on f and seeks it back to the start.
+func checkAnimatedFile(f io.ReadSeeker, filename string) error {
+	if err := checkAnimated(f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("fennec: seek %q: %w", filename, err)
 	}
+	return nil
+}
 
-	return img, orient, stat.Size(), nil
+// isSupportedInput reports whether the file extension names a format that
+// Open can decode.
+func isSupportedInput(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".tif", ".tiff", ".bmp":
+		return true
+	default:
+		return isWritableExt(filename)
+	}
+}
+
+// isWritableExt reports whether the file extension names a format Fennec
+// also writes, so an output can keep the input's name.
+func isWritableExt(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	default:
+		return false
+	}
 }
 
 // Save saves the image to a file, auto-detecting format from extension.
@@ -96,8 +280,10 @@ func Save(img image.Image, filename string, opts Options) error {
 		format = JPEG
 	case ".png":
 		format = PNG
+	case ".gif":
+		format = GIF
 	default:
-		return fmt.Errorf("fennec: unsupported extension %q (use .jpg or .png)", ext)
+		return fmt.Errorf("%w: extension %q (use .jpg, .png, or .gif)", ErrUnsupportedFormat, ext)
 	}
 
 	f, err := os.Create(filename)
@@ -115,16 +301,38 @@ func Encode(w io.Writer, img image.Image, format Format, opts Options) error {
 
 	switch format {
 	case JPEG:
+		if !isOpaque(src) {
+			src = flattenAlpha(src, opts.background())
+		}
 		targetSSIM := opts.Quality.targetSSIM()
+		if opts.UseMSSSIM {
+			targetSSIM = opts.Quality.targetMSSSIM()
+		}
 		if opts.TargetSSIM > 0 {
 			targetSSIM = opts.TargetSSIM
 		}
-		_, _, _, err := compressJPEGOptimal(src, w, targetSSIM, opts)
+		_, _, _, err := compressJPEGOptimal(src, w, targetSSIM, opts, nil)
 		return err
 	case PNG:
-		return compressPNG(src, w, opts)
+		if !opts.InterlacePNG {
+			_, err := compressPNG(src, w, opts)
+			return err
+		}
+		var buf bytes.Buffer
+		if _, err := compressPNG(src, &buf, opts); err != nil {
+			return err
+		}
+		data, err := interlacePNG(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	case GIF:
+		_, err := compressGIF(src, w, opts)
+		return err
 	default:
-		return fmt.Errorf("fennec: %w for Encode (use JPEG or PNG)", ErrUnsupportedFormat)
+		return fmt.Errorf("fennec: %w for Encode (use JPEG, PNG, or GIF)", ErrUnsupportedFormat)
 	}
 }
 
@@ -134,7 +342,7 @@ func encodeToBytes(img *image.NRGBA, format Format, quality int) ([]byte, error)
 	var buf encodingBuffer
 	switch format {
 	case JPEG:
-		if err := encodeJPEG(&buf, img, quality, false); err != nil {
+		if err := encodeJPEG(&buf, img, quality, jpegEncoding{}); err != nil {
 			return nil, fmt.Errorf("fennec: JPEG encode: %w", err)
 		}
 	case PNG:
@@ -142,21 +350,41 @@ func encodeToBytes(img *image.NRGBA, format Format, quality int) ([]byte, error)
 		if err := encoder.Encode(&buf, img); err != nil {
 			return nil, fmt.Errorf("fennec: PNG encode: %w", err)
 		}
+	case GIF:
+		if _, err := encodeGIF(&buf, img, 256, false); err != nil {
+			return nil, fmt.Errorf("fennec: GIF encode: %w", err)
+		}
 	default:
 		return nil, ErrUnsupportedFormat
 	}
 	return buf.Bytes(), nil
 }
 
+// jpegEncodes counts encodeJPEG calls. Benchmarks report it to show how many
+// encodes the quality and scale searches need.
+var jpegEncodes atomic.Int64
+
+// jpegEncoding holds the encoder settings every JPEG encode of one image
+// shares. Callers derive it once per image with Options.jpegEncoding.
+type jpegEncoding struct {
+	gray            bool // single-channel output from the red channel
+	fullChroma      bool // 4:4:4 instead of 4:2:0 chroma
+	tables          QuantTables
+	optimizeHuffman bool
+}
+
 // encodeJPEG handles JPEG encoding, using RGBA for opaque images (faster path).
-//
-// The subsample parameter is accepted for API forward-compatibility but currently
-// has no effect: Go's stdlib image/jpeg encoder always uses 4:2:0 chroma
-// subsampling and does not expose a toggle. When a custom encoder is added in a
-// future version, this parameter will control the subsampling mode.
-func encodeJPEG(w io.Writer, img *image.NRGBA, quality int, subsample bool) error {
-	_ = subsample // Reserved for future custom encoder; stdlib always uses 4:2:0.
+// Settings the stdlib encoder can't express, such as 4:4:4 chroma, route to
+// writeJPEGTables.
+func encodeJPEG(w io.Writer, img *image.NRGBA, quality int, enc jpegEncoding) error {
+	jpegEncodes.Add(1)
 
+	if enc.tables != TablesStandard || enc.optimizeHuffman || enc.fullChroma {
+		return writeJPEGTables(w, img, quality, enc)
+	}
+	if enc.gray {
+		return jpeg.Encode(w, toGray(img), &jpeg.Options{Quality: quality})
+	}
 	if isOpaque(img) {
 		rgba := &image.RGBA{
 			Pix:    img.Pix,
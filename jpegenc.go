@@ -0,0 +1,667 @@
+package fennec
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// ── Baseline JPEG Encoder ───────────────────────────────────────────────────
+//
+// Go's image/jpeg encoder has fixed quantization and Huffman tables. This is
+// a baseline (sequential, Huffman-coded) encoder with the same output layout
+// — 4:2:0 YCbCr or single-channel gray — whose quantization tables can be
+// chosen, whose Huffman tables can be fitted to the image, and which can
+// also keep full-resolution (4:4:4) chroma. It works
+// in two steps: the image is transformed and quantized into a jpegFrame of
+// DCT coefficients, which is then entropy-coded. encodeJPEG only routes here
+// when an option needs it, so default output is unchanged.
+
+// quantTableData holds the unscaled luminance and chrominance tables for
+// each QuantTables choice, in natural (row-major) order.
+var quantTableData = [...][2][64]uint16{
+	TablesStandard: {
+		// ITU T.81 Annex K.1.
+		{
+			16, 11, 10, 16, 24, 40, 51, 61,
+			12, 12, 14, 19, 26, 58, 60, 55,
+			14, 13, 16, 24, 40, 57, 69, 56,
+			14, 17, 22, 29, 51, 87, 80, 62,
+			18, 22, 37, 56, 68, 109, 103, 77,
+			24, 35, 55, 64, 81, 104, 113, 92,
+			49, 64, 78, 87, 103, 121, 120, 101,
+			72, 92, 95, 98, 112, 100, 103, 99,
+		},
+		{
+			17, 18, 24, 47, 99, 99, 99, 99,
+			18, 21, 26, 66, 99, 99, 99, 99,
+			24, 26, 56, 99, 99, 99, 99, 99,
+			47, 66, 99, 99, 99, 99, 99, 99,
+			99, 99, 99, 99, 99, 99, 99, 99,
+			99, 99, 99, 99, 99, 99, 99, 99,
+			99, 99, 99, 99, 99, 99, 99, 99,
+			99, 99, 99, 99, 99, 99, 99, 99,
+		},
+	},
+	TablesPhotographic: {
+		// Fine, nearly uniform steps at low frequencies and a smooth,
+		// steep ramp at high ones (N. Robidoux's table, which MozJPEG and
+		// ImageMagick also use), for both planes. Photos keep their
+		// gradients and lose sensor-level detail, which SSIM barely
+		// registers. Entries over 255 are clamped once scaled.
+		robidouxQuantTable,
+		robidouxQuantTable,
+	},
+	TablesFlat: {
+		// One step for every frequency: hard edges in text and UI keep
+		// their high-frequency coefficients instead of ringing.
+		flatQuantTable,
+		flatQuantTable,
+	},
+}
+
+var robidouxQuantTable = [64]uint16{
+	16, 16, 16, 18, 25, 37, 56, 85,
+	16, 17, 20, 27, 34, 40, 53, 75,
+	16, 20, 24, 31, 43, 62, 91, 135,
+	18, 27, 31, 40, 53, 74, 106, 156,
+	25, 34, 43, 53, 69, 94, 131, 189,
+	37, 40, 62, 74, 94, 124, 169, 238,
+	56, 53, 91, 106, 131, 169, 226, 311,
+	85, 75, 135, 156, 189, 238, 311, 418,
+}
+
+var flatQuantTable = [64]uint16{
+	16, 16, 16, 16, 16, 16, 16, 16,
+	16, 16, 16, 16, 16, 16, 16, 16,
+	16, 16, 16, 16, 16, 16, 16, 16,
+	16, 16, 16, 16, 16, 16, 16, 16,
+	16, 16, 16, 16, 16, 16, 16, 16,
+	16, 16, 16, 16, 16, 16, 16, 16,
+	16, 16, 16, 16, 16, 16, 16, 16,
+	16, 16, 16, 16, 16, 16, 16, 16,
+}
+
+// zigzag maps a zig-zag index to its natural-order index.
+var zigzag = [64]uint8{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// scaledQuant returns the tables scaled for quality (1–100) with the
+// libjpeg formula, in zig-zag order, as image/jpeg does.
+func scaledQuant(tables QuantTables, quality int) [2][64]uint8 {
+	quality = max(1, min(quality, 100))
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	var q [2][64]uint8
+	for t := range q {
+		for zig, nat := range zigzag {
+			x := (int(quantTableData[tables][t][nat])*scale + 50) / 100
+			q[t][zig] = uint8(max(1, min(x, 255)))
+		}
+	}
+	return q
+}
+
+// jpegFrame is a baseline JPEG in coefficient form: one or three components
+// of quantized DCT blocks, ready for entropy coding.
+type jpegFrame struct {
+	width, height int
+	quant         [2][64]uint8 // zig-zag order
+	comps         []jpegComponent
+}
+
+// jpegComponent is one color plane of a jpegFrame.
+type jpegComponent struct {
+	h, v   int // sampling factors
+	tq     int // quantization and Huffman table index: 0 luma, 1 chroma
+	bw, bh int // size of the block grid, padded to whole MCUs
+	blocks [][64]int32
+}
+
+// mcus returns the frame's MCU grid size. A single-component scan is not
+// interleaved, so its MCU is one block.
+func (f *jpegFrame) mcus() (int, int) {
+	if len(f.comps) == 1 {
+		return (f.width + 7) / 8, (f.height + 7) / 8
+	}
+	hmax, vmax := f.maxSampling()
+	return (f.width + 8*hmax - 1) / (8 * hmax), (f.height + 8*vmax - 1) / (8 * vmax)
+}
+
+// maxSampling returns the largest horizontal and vertical sampling factors
+// among the frame's components.
+func (f *jpegFrame) maxSampling() (int, int) {
+	hmax, vmax := 1, 1
+	for _, c := range f.comps {
+		hmax, vmax = max(hmax, c.h), max(vmax, c.v)
+	}
+	return hmax, vmax
+}
+
+// newJPEGFrame transforms and quantizes img with enc's tables. With
+// enc.gray set, the red channel is encoded as a single luminance plane;
+// otherwise the image is converted to YCbCr with 4:2:0 chroma subsampling,
+// or none with enc.fullChroma. Transparent pixels are encoded by their
+// color alone, as for opaque images.
+func newJPEGFrame(img *image.NRGBA, quality int, enc jpegEncoding) *jpegFrame {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	f := &jpegFrame{width: w, height: h, quant: scaledQuant(enc.tables, quality)}
+	gray := enc.gray
+	if gray {
+		f.comps = []jpegComponent{{h: 1, v: 1, tq: 0, bw: (w + 7) / 8, bh: (h + 7) / 8}}
+	} else if enc.fullChroma {
+		bw, bh := (w+7)/8, (h+7)/8
+		f.comps = []jpegComponent{
+			{h: 1, v: 1, tq: 0, bw: bw, bh: bh},
+			{h: 1, v: 1, tq: 1, bw: bw, bh: bh},
+			{h: 1, v: 1, tq: 1, bw: bw, bh: bh},
+		}
+	} else {
+		mx, my := (w+15)/16, (h+15)/16
+		f.comps = []jpegComponent{
+			{h: 2, v: 2, tq: 0, bw: 2 * mx, bh: 2 * my},
+			{h: 1, v: 1, tq: 1, bw: mx, bh: my},
+			{h: 1, v: 1, tq: 1, bw: mx, bh: my},
+		}
+	}
+
+	for i := range f.comps {
+		c := &f.comps[i]
+		c.blocks = make([][64]int32, c.bw*c.bh)
+	}
+	mx, my := f.mcus()
+	hmax, vmax := f.maxSampling()
+	parallelDoCost(0, my, mx*64*hmax*vmax*len(f.comps), func(y int) {
+		f.encodeMCUs(img, image.Rect(0, y, mx, y+1))
+	})
+	return f
+}
+
+// encodeMCUs computes the blocks of the MCUs in mcus (in MCU units) from
+// img, which has the frame's dimensions, with the frame's sampling and
+// quantization tables. Each MCU is sampled once into a small buffer, so
+// no plane larger than an MCU is held; samples past the image edge repeat
+// the last row and column. A subsampled chroma sample averages the
+// pixels it covers, 2×2 for 4:2:0. A single-component frame encodes the
+// red channel.
+func (f *jpegFrame) encodeMCUs(img *image.NRGBA, mcus image.Rectangle) {
+	hmax, vmax := f.maxSampling()
+	sw, sh := 8*hmax, 8*vmax
+	gray := len(f.comps) == 1
+	var px [3][256]float64 // one MCU of samples per component, sw wide
+	var blk [64]float64
+	for my := mcus.Min.Y; my < mcus.Max.Y; my++ {
+		for mx := mcus.Min.X; mx < mcus.Max.X; mx++ {
+			for y := 0; y < sh; y++ {
+				row := min(my*sh+y, f.height-1) * img.Stride
+				for x := 0; x < sw; x++ {
+					p := img.Pix[row+min(mx*sw+x, f.width-1)*4:]
+					if gray {
+						px[0][y*sw+x] = float64(p[0])
+						continue
+					}
+					yy, cb, cr := color.RGBToYCbCr(p[0], p[1], p[2])
+					px[0][y*sw+x] = float64(yy)
+					px[1][y*sw+x] = float64(cb)
+					px[2][y*sw+x] = float64(cr)
+				}
+			}
+
+			for ci := range f.comps {
+				c := &f.comps[ci]
+				sx, sy := hmax/c.h, vmax/c.v
+				q := &f.quant[c.tq]
+				for v := 0; v < c.v; v++ {
+					for u := 0; u < c.h; u++ {
+						samples := &px[ci]
+						for y := 0; y < 8; y++ {
+							if sx == 1 && sy == 1 {
+								row := samples[(v*8+y)*sw+u*8:]
+								for x := 0; x < 8; x++ {
+									blk[8*y+x] = row[x] - 128
+								}
+								continue
+							}
+							for x := 0; x < 8; x++ {
+								var sum float64
+								for dy := 0; dy < sy; dy++ {
+									off := ((v*8+y)*sy+dy)*sw + (u*8+x)*sx
+									for dx := 0; dx < sx; dx++ {
+										sum += samples[off+dx]
+									}
+								}
+								blk[8*y+x] = sum/float64(sx*sy) - 128
+							}
+						}
+						fdct8x8(&blk)
+						out := &c.blocks[(my*c.v+v)*c.bw+mx*c.h+u]
+						for zig, nat := range zigzag {
+							out[zig] = int32(math.Round(blk[nat] / float64(q[zig])))
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// dctCos[u][x] is C(u)/2·cos((2x+1)uπ/16), so the 2-D DCT of a block is
+// dctCos · block · dctCosᵀ, scaled as T.81 defines it.
+var dctCos = func() (c [8][8]float64) {
+	for u := 0; u < 8; u++ {
+		cu := 0.5
+		if u == 0 {
+			cu = 0.5 / math.Sqrt2
+		}
+		for x := 0; x < 8; x++ {
+			c[u][x] = cu * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return c
+}()
+
+// fdct8x8 applies the forward DCT to a level-shifted block in place, one
+// dimension at a time.
+func fdct8x8(b *[64]float64) {
+	var tmp [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			var s float64
+			for x := 0; x < 8; x++ {
+				s += dctCos[u][x] * b[8*y+x]
+			}
+			tmp[8*y+u] = s
+		}
+	}
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			var s float64
+			for y := 0; y < 8; y++ {
+				s += dctCos[v][y] * tmp[8*y+u]
+			}
+			b[8*v+u] = s
+		}
+	}
+}
+
+// ── Entropy Coding ──────────────────────────────────────────────────────────
+
+// huffSpec is a Huffman table as a DHT segment stores it: the number of
+// codes of each length 1–16, and the symbols in code order.
+type huffSpec struct {
+	counts [16]uint8
+	values []uint8
+}
+
+// stdHuffman are the T.81 Annex K.3 tables image/jpeg always uses: luma DC,
+// luma AC, chroma DC, chroma AC.
+var stdHuffman = [4]huffSpec{
+	{
+		[16]uint8{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]uint8{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]uint8{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]uint8{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]uint8{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]uint8{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]uint8{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]uint8{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// huffCode is a compiled Huffman table: the code and its length for each
+// symbol. A zero length means the symbol has no code.
+type huffCode struct {
+	code [256]uint16
+	size [256]uint8
+}
+
+func newHuffCode(s *huffSpec) *huffCode {
+	hc := &huffCode{}
+	code, k := uint16(0), 0
+	for n := 0; n < 16; n++ {
+		for j := 0; j < int(s.counts[n]); j++ {
+			hc.code[s.values[k]] = code
+			hc.size[s.values[k]] = uint8(n + 1)
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return hc
+}
+
+// bitCategory returns the number of bits needed to hold |v|, which is the
+// JPEG magnitude category of v.
+func bitCategory(v int32) uint8 {
+	if v < 0 {
+		v = -v
+	}
+	n := uint8(0)
+	for v > 0 {
+		n++
+		v >>= 1
+	}
+	return n
+}
+
+// scan walks the frame's blocks in MCU order and reports each Huffman symbol
+// to sym, along with the extra bits that follow it. table indexes stdHuffman:
+// 2*tq for DC and 2*tq+1 for AC.
+func (f *jpegFrame) scan(sym func(table int, symbol uint8, extra uint32, extraBits uint8)) {
+	mx, my := f.mcus()
+	prevDC := make([]int32, len(f.comps))
+	block := func(ci int, b *[64]int32) {
+		tq := f.comps[ci].tq
+		diff := b[0] - prevDC[ci]
+		prevDC[ci] = b[0]
+		cat := bitCategory(diff)
+		sym(2*tq, cat, magnitudeBits(diff, cat), cat)
+
+		run := uint8(0)
+		for k := 1; k < 64; k++ {
+			ac := b[k]
+			if ac == 0 {
+				run++
+				continue
+			}
+			for run > 15 {
+				sym(2*tq+1, 0xF0, 0, 0)
+				run -= 16
+			}
+			cat := bitCategory(ac)
+			sym(2*tq+1, run<<4|cat, magnitudeBits(ac, cat), cat)
+			run = 0
+		}
+		if run > 0 {
+			sym(2*tq+1, 0x00, 0, 0)
+		}
+	}
+	for y := 0; y < my; y++ {
+		for x := 0; x < mx; x++ {
+			for ci := range f.comps {
+				c := &f.comps[ci]
+				for v := 0; v < c.v; v++ {
+					for h := 0; h < c.h; h++ {
+						block(ci, &c.blocks[(y*c.v+v)*c.bw+x*c.h+h])
+					}
+				}
+			}
+		}
+	}
+}
+
+// magnitudeBits returns the extra bits JPEG stores after a symbol of
+// category cat: v itself if positive, v-1 in one's complement if negative.
+func magnitudeBits(v int32, cat uint8) uint32 {
+	if v < 0 {
+		v--
+	}
+	return uint32(v) & (1<<cat - 1)
+}
+
+// bitWriter writes an entropy-coded segment, stuffing a zero byte after
+// every 0xFF.
+type bitWriter struct {
+	w     *bufio.Writer
+	bits  uint32
+	nBits uint8
+}
+
+func (b *bitWriter) emit(code uint32, n uint8) {
+	b.bits = b.bits<<n | code&(1<<n-1)
+	b.nBits += n
+	for b.nBits >= 8 {
+		c := byte(b.bits >> (b.nBits - 8))
+		b.w.WriteByte(c)
+		if c == 0xFF {
+			b.w.WriteByte(0)
+		}
+		b.nBits -= 8
+	}
+}
+
+// flush pads the final byte with 1 bits.
+func (b *bitWriter) flush() {
+	if b.nBits > 0 {
+		b.emit(1<<(8-b.nBits)-1, 8-b.nBits)
+	}
+}
+
+// errImageTooLarge is returned for images JPEG's 16-bit dimensions can't
+// describe.
+var errImageTooLarge = errors.New("fennec: image too large for JPEG")
+
+// write encodes the frame as a complete baseline JPEG with the given Huffman
+// tables (luma DC, luma AC, chroma DC, chroma AC).
+func (f *jpegFrame) write(w io.Writer, tables *[4]huffSpec) error {
+	if f.width >= 1<<16 || f.height >= 1<<16 {
+		return errImageTooLarge
+	}
+	bw := bufio.NewWriter(w)
+	marker := func(m byte, length int) {
+		bw.Write([]byte{0xFF, m, byte(length >> 8), byte(length)})
+	}
+	nTables := 1
+	if len(f.comps) > 1 {
+		nTables = 2
+	}
+
+	bw.Write([]byte{0xFF, 0xD8})
+
+	marker(0xDB, 2+nTables*65)
+	for t := 0; t < nTables; t++ {
+		bw.WriteByte(byte(t))
+		bw.Write(f.quant[t][:])
+	}
+
+	marker(0xC0, 8+3*len(f.comps))
+	bw.Write([]byte{8, byte(f.height >> 8), byte(f.height), byte(f.width >> 8), byte(f.width), byte(len(f.comps))})
+	for i, c := range f.comps {
+		bw.Write([]byte{byte(i + 1), byte(c.h<<4 | c.v), byte(c.tq)})
+	}
+
+	length := 2
+	for t := 0; t < 2*nTables; t++ {
+		length += 17 + len(tables[t].values)
+	}
+	marker(0xC4, length)
+	for t := 0; t < 2*nTables; t++ {
+		bw.WriteByte(byte((t&1)<<4 | t>>1))
+		bw.Write(tables[t].counts[:])
+		bw.Write(tables[t].values)
+	}
+
+	marker(0xDA, 6+2*len(f.comps))
+	bw.WriteByte(byte(len(f.comps)))
+	for i, c := range f.comps {
+		bw.Write([]byte{byte(i + 1), byte(c.tq<<4 | c.tq)})
+	}
+	bw.Write([]byte{0, 63, 0})
+
+	var codes [4]*huffCode
+	for t := 0; t < 2*nTables; t++ {
+		codes[t] = newHuffCode(&tables[t])
+	}
+	bits := &bitWriter{w: bw}
+	f.scan(func(table int, symbol uint8, extra uint32, extraBits uint8) {
+		hc := codes[table]
+		bits.emit(uint32(hc.code[symbol]), hc.size[symbol])
+		if extraBits > 0 {
+			bits.emit(extra, extraBits)
+		}
+	})
+	bits.flush()
+
+	bw.Write([]byte{0xFF, 0xD9})
+	return bw.Flush()
+}
+
+// optimalHuffman builds the Huffman table that codes symbols with the given
+// frequencies in the fewest bits, limited to 16-bit codes, following T.81
+// Annex K.2 as libjpeg does. Symbols with zero frequency get no code.
+func optimalHuffman(freq *[256]int) huffSpec {
+	const maxLen = 32
+	var f [257]int
+	copy(f[:], freq[:])
+	f[256] = 1 // reserved, so no real code is all ones
+	var codeSize [257]int
+	var others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+
+	for {
+		// Merge the two least frequent remaining subtrees, c1 and c2.
+		c1, c2 := -1, -1
+		for i, v := range f {
+			if v == 0 {
+				continue
+			}
+			if c1 < 0 || v <= f[c1] {
+				c2, c1 = c1, i
+			} else if c2 < 0 || v <= f[c2] {
+				c2 = i
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+		f[c1] += f[c2]
+		f[c2] = 0
+		for codeSize[c1]++; others[c1] >= 0; codeSize[c1]++ {
+			c1 = others[c1]
+		}
+		others[c1] = c2
+		for codeSize[c2]++; others[c2] >= 0; codeSize[c2]++ {
+			c2 = others[c2]
+		}
+	}
+
+	var bits [maxLen + 1]int
+	for _, n := range codeSize {
+		if n > 0 {
+			bits[n]++
+		}
+	}
+	// Shorten codes over 16 bits: move pairs up the tree (K.3 Adjust_BITS).
+	for i := maxLen; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+	// Drop the reserved code, which is the longest.
+	i := 16
+	for bits[i] == 0 {
+		i--
+	}
+	bits[i]--
+
+	var spec huffSpec
+	for n := 1; n <= 16; n++ {
+		spec.counts[n-1] = uint8(bits[n])
+	}
+	for n := 1; n <= maxLen; n++ {
+		for sym := 0; sym < 256; sym++ {
+			if codeSize[sym] == n {
+				spec.values = append(spec.values, uint8(sym))
+			}
+		}
+	}
+	return spec
+}
+
+// optimalTables counts the symbols the frame's scan emits and returns the
+// optimal Huffman tables for it.
+func (f *jpegFrame) optimalTables() [4]huffSpec {
+	var freq [4][256]int
+	f.scan(func(table int, symbol uint8, _ uint32, _ uint8) {
+		freq[table][symbol]++
+	})
+	var tables [4]huffSpec
+	for t := 0; t < 2*min(len(f.comps), 2); t++ {
+		tables[t] = optimalHuffman(&freq[t])
+	}
+	return tables
+}
+
+// writeJPEGTables encodes img with Fennec's encoder, for the settings
+// image/jpeg can't express: custom quantization tables, optimized Huffman
+// tables, and 4:4:4 chroma. It is called by encodeJPEG.
+func writeJPEGTables(w io.Writer, img *image.NRGBA, quality int, enc jpegEncoding) error {
+	f := newJPEGFrame(img, quality, enc)
+	if enc.optimizeHuffman {
+		tables := f.optimalTables()
+		return f.write(w, &tables)
+	}
+	return f.write(w, &stdHuffman)
+}
@@ -0,0 +1,430 @@
+package fennec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ── Lossless JPEG Recompression ─────────────────────────────────────────────
+//
+// A JPEG's quantized DCT coefficients are its image; everything after them
+// is lossless entropy coding. Decoding a JPEG to pixels and encoding it again
+// loses quality a second time, but rewriting the same coefficients with
+// Huffman tables fitted to them (and without APPn/COM metadata) shrinks the
+// file with every pixel unchanged, as jpegtran -optimize does. This parses
+// a baseline JPEG's entropy-coded data into a jpegFrame, which the encoder in
+// jpegenc.go then writes out.
+
+// errNotBaseline is returned for JPEGs transcodeJPEG can't rewrite:
+// progressive, arithmetic-coded, 12-bit, CMYK, or RGB-transformed files.
+// The caller falls back to the pixel pipeline.
+var errNotBaseline = errors.New("fennec: not a baseline YCbCr or gray JPEG")
+
+var errJPEGData = errors.New("fennec: invalid JPEG data")
+
+// transcodeJPEG losslessly recompresses a baseline JPEG: the coefficients
+// are kept and re-entropy-coded with optimal Huffman tables, and all
+// metadata segments are dropped.
+func transcodeJPEG(data []byte) ([]byte, error) {
+	f, err := decodeJPEGFrame(data)
+	if err != nil {
+		return nil, err
+	}
+	tables := f.optimalTables()
+	var buf bytes.Buffer
+	if err := f.write(&buf, &tables); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// huffDecoder decodes one Huffman table with the MAXCODE/VALPTR method of
+// T.81 Annex F.2.2.3.
+type huffDecoder struct {
+	maxCode [17]int32 // -1 if no codes of that length
+	valPtr  [17]int32
+	minCode [17]int32
+	values  []uint8
+}
+
+func newHuffDecoder(s *huffSpec) *huffDecoder {
+	d := &huffDecoder{values: s.values}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(s.counts[l-1])
+		d.maxCode[l] = -1
+		if n > 0 {
+			d.valPtr[l] = k
+			d.minCode[l] = code
+			code += n
+			k += n
+			d.maxCode[l] = code - 1
+		}
+		code <<= 1
+	}
+	return d
+}
+
+// jpegBitReader reads an entropy-coded segment, removing stuffed zero
+// bytes. At a marker it stops advancing and supplies zero bits, so the
+// caller finds the marker at pos.
+type jpegBitReader struct {
+	data  []byte
+	pos   int
+	acc   uint64
+	nBits uint
+}
+
+func (b *jpegBitReader) fill() {
+	for b.nBits <= 56 {
+		c := byte(0)
+		if b.pos < len(b.data) {
+			c = b.data[b.pos]
+			if c != 0xFF {
+				b.pos++
+			} else if b.pos+1 < len(b.data) && b.data[b.pos+1] == 0 {
+				b.pos += 2
+			} else {
+				c = 0 // marker: pad with zeros
+			}
+		}
+		b.acc |= uint64(c) << (56 - b.nBits)
+		b.nBits += 8
+	}
+}
+
+func (b *jpegBitReader) bits(n uint) uint32 {
+	if n == 0 {
+		return 0
+	}
+	if b.nBits < n {
+		b.fill()
+	}
+	v := uint32(b.acc >> (64 - n))
+	b.acc <<= n
+	b.nBits -= n
+	return v
+}
+
+// reset discards buffered bits at a restart marker and skips the marker.
+func (b *jpegBitReader) reset() error {
+	b.acc, b.nBits = 0, 0
+	if b.pos+1 >= len(b.data) || b.data[b.pos] != 0xFF || b.data[b.pos+1] < 0xD0 || b.data[b.pos+1] > 0xD7 {
+		return fmt.Errorf("%w: missing restart marker", errJPEGData)
+	}
+	b.pos += 2
+	return nil
+}
+
+func (b *jpegBitReader) decode(d *huffDecoder) (uint8, error) {
+	code := int32(0)
+	for l := 1; l <= 16; l++ {
+		code = code<<1 | int32(b.bits(1))
+		if code <= d.maxCode[l] {
+			i := d.valPtr[l] + code - d.minCode[l]
+			if int(i) >= len(d.values) {
+				break
+			}
+			return d.values[i], nil
+		}
+	}
+	return 0, fmt.Errorf("%w: bad Huffman code", errJPEGData)
+}
+
+// extend turns the n extra bits after a symbol back into a signed value.
+func extend(v uint32, n uint8) int32 {
+	if n == 0 {
+		return 0
+	}
+	if v < 1<<(n-1) {
+		return int32(v) - (1 << n) + 1
+	}
+	return int32(v)
+}
+
+// decodeJPEGFrame parses a baseline JPEG into coefficient form. The frame's
+// two quantization slots hold the luma table and the table shared by both
+// chroma components; files that don't fit that shape return errNotBaseline.
+func decodeJPEGFrame(data []byte) (*jpegFrame, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errJPEGData
+	}
+
+	var (
+		quant    [4][64]uint16
+		haveQ    [4]bool
+		dc, ac   [4]*huffDecoder
+		f        *jpegFrame
+		compIDs  []byte
+		compTQ   []int
+		interval int
+		adobeRGB bool
+		scanned  bool
+	)
+
+	pos := 2
+	for {
+		// Find the next marker, skipping fill bytes.
+		for pos < len(data) && data[pos] != 0xFF {
+			pos++
+		}
+		for pos < len(data) && data[pos] == 0xFF {
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, fmt.Errorf("%w: no EOI", errJPEGData)
+		}
+		m := data[pos]
+		pos++
+		if m == 0xD9 {
+			break
+		}
+		if m >= 0xD0 && m <= 0xD7 || m == 0x01 || m == 0x00 {
+			continue // RSTn, TEM, or stuffed data left over from a scan
+		}
+		if pos+2 > len(data) {
+			return nil, errJPEGData
+		}
+		length := int(data[pos])<<8 | int(data[pos+1])
+		if length < 2 || pos+length > len(data) {
+			return nil, errJPEGData
+		}
+		seg := data[pos+2 : pos+length]
+		pos += length
+
+		switch {
+		case m == 0xC0 || m == 0xC1:
+			if f != nil || len(seg) < 6 || seg[0] != 8 {
+				return nil, errNotBaseline
+			}
+			h := int(seg[1])<<8 | int(seg[2])
+			w := int(seg[3])<<8 | int(seg[4])
+			n := int(seg[5])
+			if w == 0 || h == 0 || (n != 1 && n != 3) || len(seg) < 6+3*n {
+				return nil, errNotBaseline
+			}
+			f = &jpegFrame{width: w, height: h}
+			for i := 0; i < n; i++ {
+				c := seg[6+3*i:]
+				hs, vs := int(c[1]>>4), int(c[1]&15)
+				if hs < 1 || hs > 4 || vs < 1 || vs > 4 || c[2] > 3 {
+					return nil, errJPEGData
+				}
+				if n == 1 {
+					hs, vs = 1, 1 // a lone component is never interleaved
+				}
+				f.comps = append(f.comps, jpegComponent{h: hs, v: vs, tq: min(i, 1)})
+				compIDs = append(compIDs, c[0])
+				compTQ = append(compTQ, int(c[2]))
+			}
+			if n == 3 && (compTQ[1] != compTQ[2] || f.comps[1].h != 1 || f.comps[1].v != 1 ||
+				f.comps[2].h != 1 || f.comps[2].v != 1) {
+				return nil, errNotBaseline
+			}
+			if n == 3 && string(compIDs) == "RGB" {
+				adobeRGB = true
+			}
+			mx, my := f.mcus()
+			for i := range f.comps {
+				c := &f.comps[i]
+				c.bw, c.bh = mx*c.h, my*c.v
+				if c.bw*c.bh > maxDecodePixels/64 {
+					return nil, errJPEGData
+				}
+				c.blocks = make([][64]int32, c.bw*c.bh)
+			}
+
+		case m >= 0xC2 && m <= 0xCF && m != 0xC4 && m != 0xC8 && m != 0xCC:
+			return nil, errNotBaseline
+
+		case m == 0xC4:
+			for len(seg) >= 17 {
+				class, id := seg[0]>>4, seg[0]&15
+				var s huffSpec
+				copy(s.counts[:], seg[1:17])
+				total := 0
+				for _, c := range s.counts {
+					total += int(c)
+				}
+				if class > 1 || id > 3 || total > 256 || len(seg) < 17+total {
+					return nil, errJPEGData
+				}
+				s.values = append([]uint8(nil), seg[17:17+total]...)
+				if class == 0 {
+					dc[id] = newHuffDecoder(&s)
+				} else {
+					ac[id] = newHuffDecoder(&s)
+				}
+				seg = seg[17+total:]
+			}
+
+		case m == 0xDB:
+			for len(seg) >= 65 {
+				prec, id := seg[0]>>4, seg[0]&15
+				if id > 3 || prec > 1 || len(seg) < 1+64*(int(prec)+1) {
+					return nil, errJPEGData
+				}
+				for k := 0; k < 64; k++ {
+					if prec == 0 {
+						quant[id][k] = uint16(seg[1+k])
+					} else {
+						quant[id][k] = uint16(seg[1+2*k])<<8 | uint16(seg[2+2*k])
+					}
+				}
+				haveQ[id] = true
+				seg = seg[1+64*(int(prec)+1):]
+			}
+
+		case m == 0xDD:
+			if len(seg) < 2 {
+				return nil, errJPEGData
+			}
+			interval = int(seg[0])<<8 | int(seg[1])
+
+		case m == 0xEE:
+			// Adobe APP14: transform 0 means the components are RGB.
+			if len(seg) >= 12 && string(seg[:5]) == "Adobe" && seg[11] == 0 {
+				adobeRGB = true
+			}
+
+		case m == 0xDA:
+			if f == nil || adobeRGB {
+				return nil, errNotBaseline
+			}
+			end, err := decodeJPEGScan(data, pos, seg, f, compIDs, &dc, &ac, interval)
+			if err != nil {
+				return nil, err
+			}
+			pos = end
+			scanned = true
+		}
+	}
+
+	if f == nil || !scanned {
+		return nil, fmt.Errorf("%w: no image data", errJPEGData)
+	}
+	for slot := 0; slot < min(len(f.comps), 2); slot++ {
+		id := compTQ[slot]
+		if !haveQ[id] {
+			return nil, fmt.Errorf("%w: missing quantization table %d", errJPEGData, id)
+		}
+		for k, q := range quant[id] {
+			if q == 0 || q > 255 {
+				return nil, errNotBaseline
+			}
+			f.quant[slot][k] = uint8(q)
+		}
+	}
+	return f, nil
+}
+
+// decodeJPEGScan decodes one scan, whose entropy-coded data starts at pos,
+// into f's blocks, and returns the position just past that data.
+func decodeJPEGScan(data []byte, pos int, sos []byte, f *jpegFrame, ids []byte, dc, ac *[4]*huffDecoder, interval int) (int, error) {
+	if len(sos) < 1 {
+		return 0, errJPEGData
+	}
+	ns := int(sos[0])
+	if ns < 1 || ns > len(f.comps) || len(sos) < 1+2*ns+3 {
+		return 0, errJPEGData
+	}
+	if ss, se, a := sos[1+2*ns], sos[2+2*ns], sos[3+2*ns]; ss != 0 || se != 63 || a != 0 {
+		return 0, errNotBaseline
+	}
+
+	type scanComp struct {
+		ci     int
+		dc, ac *huffDecoder
+	}
+	comps := make([]scanComp, ns)
+	for i := range comps {
+		sel, tables := sos[1+2*i], sos[2+2*i]
+		ci := bytes.IndexByte(ids, sel)
+		if ci < 0 {
+			return 0, fmt.Errorf("%w: unknown component %d", errJPEGData, sel)
+		}
+		td, ta := tables>>4, tables&15
+		if td > 3 || ta > 3 || dc[td] == nil || ac[ta] == nil {
+			return 0, fmt.Errorf("%w: missing Huffman table", errJPEGData)
+		}
+		comps[i] = scanComp{ci, dc[td], ac[ta]}
+	}
+
+	br := &jpegBitReader{data: data, pos: pos}
+	pred := make([]int32, len(f.comps))
+
+	block := func(sc scanComp, b *[64]int32) error {
+		cat, err := br.decode(sc.dc)
+		if err != nil {
+			return err
+		}
+		if cat > 11 {
+			return fmt.Errorf("%w: DC category %d", errJPEGData, cat)
+		}
+		pred[sc.ci] += extend(br.bits(uint(cat)), cat)
+		b[0] = pred[sc.ci]
+		for k := 1; k < 64; {
+			rs, err := br.decode(sc.ac)
+			if err != nil {
+				return err
+			}
+			run, size := int(rs>>4), rs&15
+			if size == 0 {
+				if run != 15 {
+					break // EOB
+				}
+				k += 16
+				continue
+			}
+			k += run
+			if k > 63 || size > 10 {
+				return fmt.Errorf("%w: AC coefficient out of range", errJPEGData)
+			}
+			b[k] = extend(br.bits(uint(size)), size)
+			k++
+		}
+		return nil
+	}
+
+	// A single-component scan is not interleaved: its blocks cover just the
+	// component's own (unpadded) extent, one per MCU, in raster order.
+	var units, unitsX int
+	if ns == 1 {
+		c := &f.comps[comps[0].ci]
+		hmax, vmax := f.maxSampling()
+		unitsX = ((f.width*c.h+hmax-1)/hmax + 7) / 8
+		units = unitsX * (((f.height*c.v+vmax-1)/vmax + 7) / 8)
+	} else {
+		mx, my := f.mcus()
+		unitsX, units = mx, mx*my
+	}
+
+	for u := 0; u < units; u++ {
+		if interval > 0 && u > 0 && u%interval == 0 {
+			if err := br.reset(); err != nil {
+				return 0, err
+			}
+			clear(pred)
+		}
+		ux, uy := u%unitsX, u/unitsX
+		if ns == 1 {
+			c := &f.comps[comps[0].ci]
+			if err := block(comps[0], &c.blocks[uy*c.bw+ux]); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		for _, sc := range comps {
+			c := &f.comps[sc.ci]
+			for v := 0; v < c.v; v++ {
+				for h := 0; h < c.h; h++ {
+					if err := block(sc, &c.blocks[(uy*c.v+v)*c.bw+ux*c.h+h]); err != nil {
+						return 0, err
+					}
+				}
+			}
+		}
+	}
+	return br.pos, nil
+}
@@ -0,0 +1,85 @@
+package fennec
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// MarshalText encodes the format as its name ("JPEG", "PNG", "GIF", "Auto",
+// or "Other"), so Format serializes as a string in JSON.
+func (f Format) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText parses a format name (case-insensitive).
+func (f *Format) UnmarshalText(text []byte) error {
+	switch strings.ToUpper(string(text)) {
+	case "AUTO":
+		*f = Auto
+	case "JPEG", "JPG":
+		*f = JPEG
+	case "PNG":
+		*f = PNG
+	case "GIF":
+		*f = GIF
+	case "OTHER":
+		*f = OtherFormat
+	default:
+		return fmt.Errorf("%w %q", ErrUnsupportedFormat, text)
+	}
+	return nil
+}
+
+// MarshalText encodes the quality preset as its name (e.g. "Balanced").
+func (q Quality) MarshalText() ([]byte, error) {
+	return []byte(q.String()), nil
+}
+
+// UnmarshalText parses a quality preset name (case-insensitive).
+func (q *Quality) UnmarshalText(text []byte) error {
+	for _, p := range []Quality{Balanced, Lossless, NearLossless, Ultra, High, Aggressive, Maximum} {
+		if strings.EqualFold(p.String(), string(text)) {
+			*q = p
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: unknown quality %q", ErrInvalidOptions, text)
+}
+
+// MarshalText encodes the table set as its name (e.g. "Photographic").
+func (t QuantTables) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText parses a table set name (case-insensitive).
+func (t *QuantTables) UnmarshalText(text []byte) error {
+	for _, v := range []QuantTables{TablesStandard, TablesPhotographic, TablesFlat} {
+		if strings.EqualFold(v.String(), string(text)) {
+			*t = v
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: unknown quantization tables %q", ErrInvalidOptions, text)
+}
+
+// dimensionsJSON is the JSON shape of an image.Point used as a size.
+type dimensionsJSON struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// MarshalJSON implements json.Marshaler. Format is written as its name and
+// dimensions as {"width": w, "height": h}. Image and CompressedData are omitted.
+func (r Result) MarshalJSON() ([]byte, error) {
+	type plain Result
+	return json.Marshal(struct {
+		plain
+		OriginalDimensions dimensionsJSON `json:"original_dimensions"`
+		FinalDimensions    dimensionsJSON `json:"final_dimensions"`
+	}{
+		plain:              plain(r),
+		OriginalDimensions: dimensionsJSON{r.OriginalDimensions.X, r.OriginalDimensions.Y},
+		FinalDimensions:    dimensionsJSON{r.FinalDimensions.X, r.FinalDimensions.Y},
+	})
+}
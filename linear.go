@@ -0,0 +1,116 @@
+package fennec
+
+import (
+	"image"
+	"math"
+)
+
+// ── Linear-Light Resizing ───────────────────────────────────────────────────
+//
+// sRGB values are gamma-encoded: 128 is about 22% of white's light, not
+// 50%. Averaging them, as a resize filter does, darkens anything that mixes
+// bright and dark pixels, so thin bright lines and fine text dim when an
+// image is downscaled. The passes below convert each sample to linear
+// light through srgbToLinear, filter there, and convert back through a
+// second lookup table, keeping the intermediate in float32 so dark tones
+// don't band.
+
+// linearLevels is the size of the linear-to-sRGB table. At 2^14 steps the
+// table's coarsest step, near black, is under a quarter of an sRGB level.
+const linearLevels = 1 << 14
+
+// linearToSRGBTable maps linear light, quantized to linearLevels steps,
+// to the nearest sRGB byte. It inverts srgbToLinear.
+var linearToSRGBTable = func() []uint8 {
+	t := make([]uint8, linearLevels)
+	for i := range t {
+		l := float64(i) / (linearLevels - 1)
+		if l <= 0.0031308 {
+			l *= 12.92
+		} else {
+			l = 1.055*math.Pow(l, 1/2.4) - 0.055
+		}
+		t[i] = clampF(l * 255)
+	}
+	return t
+}()
+
+// linearToSRGB converts linear light to an sRGB byte, clamping values
+// outside [0, 1] that Lanczos ringing produces.
+func linearToSRGB(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 1 {
+		return 255
+	}
+	return linearToSRGBTable[int(v*(linearLevels-1)+0.5)]
+}
+
+// resizeLinearH resamples src horizontally to dstW columns in linear light
+// and returns the rows as float32 RGBA, four values per pixel. Color is
+// premultiplied by alpha unless rs.straight is set; alpha is in [0, 1].
+func resizeLinearH(src *image.NRGBA, dstW int, rs resampling) []float32 {
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := make([]float32, dstW*srcH*4)
+	weights := resizeWeights(dstW, srcW, rs.filter)
+	straight := rs.straight
+
+	parallelDoCost(0, srcH, dstW*len(weights[0]), func(y int) {
+		row := src.Pix[y*src.Stride:]
+		for dx := 0; dx < dstW; dx++ {
+			var r, g, b, a float64
+			for _, we := range weights[dx] {
+				p := row[we.index*4 : we.index*4+4]
+				sa := float64(p[3]) / 255
+				aw := sa * we.weight
+				if straight {
+					aw = we.weight
+				}
+				r += srgbToLinear[p[0]] * aw
+				g += srgbToLinear[p[1]] * aw
+				b += srgbToLinear[p[2]] * aw
+				a += sa * we.weight
+			}
+			o := (y*dstW + dx) * 4
+			dst[o], dst[o+1], dst[o+2], dst[o+3] = float32(r), float32(g), float32(b), float32(a)
+		}
+	})
+	return dst
+}
+
+// resizeLinearV resamples resizeLinearH's w×srcH output vertically to
+// dstH rows and converts it back to sRGB.
+func resizeLinearV(src []float32, w, srcH, dstH int, rs resampling) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, w, dstH))
+	weights := resizeWeights(dstH, srcH, rs.filter)
+	straight := rs.straight
+
+	parallelDoCost(0, w, dstH*len(weights[0]), func(x int) {
+		for dy := 0; dy < dstH; dy++ {
+			var r, g, b, a float64
+			for _, we := range weights[dy] {
+				p := src[(we.index*w+x)*4 : (we.index*w+x)*4+4]
+				r += float64(p[0]) * we.weight
+				g += float64(p[1]) * we.weight
+				b += float64(p[2]) * we.weight
+				a += float64(p[3]) * we.weight
+			}
+
+			// Like resizeV, leave pixels under half an alpha level
+			// fully transparent.
+			if !straight {
+				if a*255 <= 0.5 {
+					continue
+				}
+				r, g, b = r/a, g/a, b/a
+			}
+			off := dy*dst.Stride + x*4
+			dst.Pix[off] = linearToSRGB(r)
+			dst.Pix[off+1] = linearToSRGB(g)
+			dst.Pix[off+2] = linearToSRGB(b)
+			dst.Pix[off+3] = clampF(a * 255)
+		}
+	})
+	return dst
+}
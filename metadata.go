@@ -0,0 +1,180 @@
+package fennec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// inputMeta is what the pipeline knows about an encoded input beyond its
+// pixels. CompressImage and Compress have no seekable source and use the
+// zero value.
+type inputMeta struct {
+	orient Orientation
+	exif   []byte // EXIF payload, see readEXIF; nil if absent
+	format string // image package name of the input format; "" if unknown
+	size   int64  // encoded input size in bytes; 0 if unknown
+
+	// data is the encoded input, kept only when Options.losslessJPEG
+	// may recompress it directly.
+	data []byte
+}
+
+// readInputMeta reads the metadata of an encoded image from r, starting at
+// its current position. JPEG is checked first as the common case; PNG
+// carries EXIF in an eXIf chunk, and TIFF keeps orientation in its own IFD
+// (with no separate EXIF block to preserve).
+func readInputMeta(r io.ReadSeeker) inputMeta {
+	var sig [8]byte
+	n, _ := io.ReadFull(r, sig[:])
+	switch {
+	case n >= 2 && sig[0] == 0xFF && sig[1] == 0xD8:
+		if _, err := r.Seek(int64(-n), io.SeekCurrent); err != nil {
+			return inputMeta{orient: OrientNormal}
+		}
+		exif := readEXIF(r)
+		return inputMeta{orient: exifOrientation(exif), exif: exif}
+	case n == 8 && string(sig[:]) == pngSignature:
+		exif := readPNGEXIF(r)
+		return inputMeta{orient: exifOrientation(exif), exif: exif}
+	case n == 8 && (string(sig[:4]) == "II*\x00" || string(sig[:4]) == "MM\x00*"):
+		return inputMeta{orient: readTIFFOrientation(r, sig[:])}
+	}
+	return inputMeta{orient: OrientNormal}
+}
+
+// exifToEmbed returns the EXIF payload to write into JPEG output, or nil.
+// When AutoOrient has already rotated the pixels, the orientation tag is
+// reset to normal so viewers don't rotate them a second time.
+func (o *Options) exifToEmbed(meta inputMeta) []byte {
+	// A PNG's eXIf chunk can exceed what one APP1 segment holds; such a
+	// block is dropped rather than failing the compression.
+	if !o.PreserveMetadata || meta.exif == nil || jpegSegmentSize(meta.exif) > maxJPEGSegment {
+		return nil
+	}
+	if o.AutoOrient && meta.orient > OrientNormal {
+		return withEXIFOrientation(meta.exif, OrientNormal)
+	}
+	return meta.exif
+}
+
+// jpegSegmentSize is the encoded size of a JPEG marker segment carrying
+// payload, or 0 for an empty payload.
+func jpegSegmentSize(payload []byte) int {
+	if len(payload) == 0 {
+		return 0
+	}
+	return 4 + len(payload)
+}
+
+// maxJPEGSegment is the largest encoded marker segment: a 2-byte marker
+// plus a length field that counts itself and the payload.
+const maxJPEGSegment = 2 + 0xFFFF
+
+// insertJPEGSegment returns a copy of the JPEG data with a marker segment
+// inserted right after SOI. Payloads too large for one segment are an error.
+func insertJPEGSegment(data []byte, marker byte, payload []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, fmt.Errorf("fennec: insert JPEG segment: not a JPEG")
+	}
+	segLen := len(payload) + 2
+	if jpegSegmentSize(payload) > maxJPEGSegment {
+		return nil, fmt.Errorf("fennec: insert JPEG segment: payload of %d bytes too large", len(payload))
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data) + 2 + segLen)
+	buf.Write(data[:2])
+	buf.Write([]byte{0xFF, marker, byte(segLen >> 8), byte(segLen)})
+	buf.Write(payload)
+	buf.Write(data[2:])
+	return buf.Bytes(), nil
+}
+
+// insertPNGChunk returns a copy of the PNG data with a chunk inserted right
+// after IHDR, which the PNG format requires to come first.
+func insertPNGChunk(data []byte, typ string, payload []byte) ([]byte, error) {
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	if len(data) < ihdrEnd || string(data[:len(pngSignature)]) != pngSignature ||
+		string(data[len(pngSignature)+4:len(pngSignature)+8]) != "IHDR" {
+		return nil, fmt.Errorf("fennec: insert PNG chunk: not a PNG")
+	}
+
+	chunk := appendPNGChunk(nil, typ, payload)
+	out := make([]byte, 0, len(data)+len(chunk))
+	out = append(out, data[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, data[ihdrEnd:]...), nil
+}
+
+// jfifSegment is the JFIF APP0 payload recording dpi dots per inch in
+// both directions, with no thumbnail.
+func jfifSegment(dpi int) []byte {
+	return []byte{'J', 'F', 'I', 'F', 0, 1, 1, 1, byte(dpi >> 8), byte(dpi), byte(dpi >> 8), byte(dpi), 0, 0}
+}
+
+// setJPEGDensity returns a copy of the JPEG data whose JFIF header records
+// dpi. An existing JFIF APP0 segment right after SOI is rewritten in
+// place; otherwise one is inserted there.
+func setJPEGDensity(data []byte, dpi int) ([]byte, error) {
+	if len(data) >= 18 && data[2] == 0xFF && data[3] == 0xE0 && string(data[6:11]) == "JFIF\x00" {
+		out := bytes.Clone(data)
+		out[13] = 1 // Units: dots per inch.
+		binary.BigEndian.PutUint16(out[14:], uint16(dpi))
+		binary.BigEndian.PutUint16(out[16:], uint16(dpi))
+		return out, nil
+	}
+	return insertJPEGSegment(data, 0xE0, jfifSegment(dpi))
+}
+
+// physChunk is the pHYs payload recording dpi in pixels per meter, the
+// only physical unit PNG has.
+func physChunk(dpi int) []byte {
+	ppm := uint32(math.Round(float64(dpi) / 0.0254))
+	payload := binary.BigEndian.AppendUint32(nil, ppm)
+	payload = binary.BigEndian.AppendUint32(payload, ppm)
+	return append(payload, 1) // Unit: meter.
+}
+
+// validPNGKeyword reports whether k is a PNG text keyword: 1–79 printable
+// ASCII characters with no leading or trailing space.
+func validPNGKeyword(k string) bool {
+	if len(k) == 0 || len(k) > 79 || k[0] == ' ' || k[len(k)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		if k[i] < 0x20 || k[i] > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+// commentKeyword returns the tEXt keyword for JPEGComment in PNG output.
+func (o *Options) commentKeyword() string {
+	if o.PNGCommentKeyword == "" {
+		return "Comment"
+	}
+	return o.PNGCommentKeyword
+}
+
+// commentSize is the most bytes JPEGComment adds to the output: the size
+// of its PNG tEXt chunk, which is larger than the JPEG COM segment. It is
+// 0 when no comment is set.
+func (o *Options) commentSize() int {
+	if o.JPEGComment == "" {
+		return 0
+	}
+	return 12 + len(o.commentKeyword()) + 1 + len(o.JPEGComment)
+}
+
+// densitySize is the most bytes DPI adds to the output: a 21-byte pHYs
+// chunk, which is larger than the JFIF segment. It is 0 when DPI is unset.
+func (o *Options) densitySize() int {
+	if o.DPI == 0 {
+		return 0
+	}
+	return 12 + 9
+}
@@ -0,0 +1,305 @@
+package fennec
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// ── Adam7 PNG Interlacing ───────────────────────────────────────────────────
+//
+// image/png only writes non-interlaced PNGs. Rather than duplicate its
+// color-type and bit-depth choices, interlacePNG rewrites the encoder's
+// output: it inflates the image data, undoes the row filters, splits the
+// pixels into the seven Adam7 passes, and filters and deflates them again.
+// Every other chunk is copied unchanged.
+
+// adam7 lists each pass's starting column and row and its column and row
+// steps, from the PNG specification.
+var adam7 = [7]struct{ x, y, dx, dy int }{
+	{0, 0, 8, 8},
+	{4, 0, 8, 8},
+	{0, 4, 4, 8},
+	{2, 0, 4, 4},
+	{0, 2, 2, 4},
+	{1, 0, 2, 2},
+	{0, 1, 1, 2},
+}
+
+// pngChannels is the number of samples per pixel for each PNG color type.
+var pngChannels = map[byte]int{0: 1, 2: 3, 3: 1, 4: 2, 6: 4}
+
+var errPNGData = errors.New("fennec: interlace PNG: malformed PNG data")
+
+// interlacePNG returns the PNG data rewritten with Adam7 interlacing, so
+// browsers can show a coarse preview after the first few percent of the
+// file arrives. The pixels are unchanged. Data that is already interlaced
+// is returned as it is.
+func interlacePNG(data []byte) ([]byte, error) {
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	if len(data) < ihdrEnd || string(data[:len(pngSignature)]) != pngSignature ||
+		string(data[len(pngSignature)+4:len(pngSignature)+8]) != "IHDR" {
+		return nil, errPNGData
+	}
+	ihdr := data[len(pngSignature)+8 : ihdrEnd-4]
+	w := int(binary.BigEndian.Uint32(ihdr[0:4]))
+	h := int(binary.BigEndian.Uint32(ihdr[4:8]))
+	depth, colorType := int(ihdr[8]), ihdr[9]
+	if ihdr[12] == 1 {
+		return data, nil
+	}
+	channels, ok := pngChannels[colorType]
+	if !ok || w <= 0 || h <= 0 {
+		return nil, errPNGData
+	}
+	bitsPerPixel := channels * depth
+
+	// Split the chunks around the image data.
+	var before, after [][]byte
+	var zdata bytes.Buffer
+	seenIDAT := false
+	for off := ihdrEnd; off < len(data); {
+		if len(data)-off < 12 {
+			return nil, errPNGData
+		}
+		n := int(binary.BigEndian.Uint32(data[off:]))
+		end := off + 12 + n
+		if end > len(data) {
+			return nil, errPNGData
+		}
+		switch typ := string(data[off+4 : off+8]); {
+		case typ == "IDAT":
+			zdata.Write(data[off+8 : off+8+n])
+			seenIDAT = true
+		case seenIDAT:
+			after = append(after, data[off:end])
+		default:
+			before = append(before, data[off:end])
+		}
+		off = end
+	}
+
+	zr, err := zlib.NewReader(&zdata)
+	if err != nil {
+		return nil, errPNGData
+	}
+	rowBytes := (w*bitsPerPixel + 7) / 8
+	raw := make([]byte, (rowBytes+1)*h)
+	if _, err := io.ReadFull(zr, raw); err != nil {
+		return nil, errPNGData
+	}
+	pix, err := unfilterPNG(raw, rowBytes, h, max(bitsPerPixel/8, 1))
+	if err != nil {
+		return nil, err
+	}
+
+	// Palette and sub-byte images stay unfiltered, as image/png writes
+	// them; the others get a filter chosen per row.
+	filter := colorType != 3 && depth >= 8
+	var passes bytes.Buffer
+	zw, _ := zlib.NewWriterLevel(&passes, zlib.BestCompression)
+	for _, p := range adam7 {
+		pw := (w - p.x + p.dx - 1) / p.dx
+		ph := (h - p.y + p.dy - 1) / p.dy
+		if pw <= 0 || ph <= 0 {
+			continue
+		}
+		passRow := (pw*bitsPerPixel + 7) / 8
+		prev := make([]byte, passRow)
+		cur := make([]byte, passRow)
+		out := make([]byte, passRow+1)
+		for y := p.y; y < h; y += p.dy {
+			src := pix[y*rowBytes : (y+1)*rowBytes]
+			clear(cur)
+			for i, x := 0, p.x; x < w; i, x = i+1, x+p.dx {
+				copyPNGPixel(cur, i, src, x, bitsPerPixel)
+			}
+			if filter {
+				filterPNGRow(out, cur, prev, bitsPerPixel/8)
+			} else {
+				out[0] = 0
+				copy(out[1:], cur)
+			}
+			if _, err := zw.Write(out); err != nil {
+				return nil, err
+			}
+			prev, cur = cur, prev
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(data)+passes.Len())
+	out = append(out, data[:ihdrEnd]...)
+	ihdrOut := out[len(pngSignature)+4 : ihdrEnd-4]
+	ihdrOut[4+12] = 1 // Interlace method: Adam7.
+	binary.BigEndian.PutUint32(out[ihdrEnd-4:], crc32.ChecksumIEEE(ihdrOut))
+	for _, c := range before {
+		out = append(out, c...)
+	}
+	out = binary.BigEndian.AppendUint32(out, uint32(passes.Len()))
+	start := len(out)
+	out = append(out, "IDAT"...)
+	out = append(out, passes.Bytes()...)
+	out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+	for _, c := range after {
+		out = append(out, c...)
+	}
+	return out, nil
+}
+
+// appendPNGChunk appends a chunk of type typ holding payload to dst.
+func appendPNGChunk(dst []byte, typ string, payload []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(payload)))
+	start := len(dst)
+	dst = append(dst, typ...)
+	dst = append(dst, payload...)
+	return binary.BigEndian.AppendUint32(dst, crc32.ChecksumIEEE(dst[start:]))
+}
+
+// unfilterPNG reverses the per-row filters of h filtered rows of rowBytes
+// bytes each and returns the pixel rows without their filter bytes. bpp is
+// the filter's byte distance to the left neighbor.
+func unfilterPNG(raw []byte, rowBytes, h, bpp int) ([]byte, error) {
+	pix := make([]byte, rowBytes*h)
+	prev := make([]byte, rowBytes)
+	for y := range h {
+		row := pix[y*rowBytes : (y+1)*rowBytes]
+		copy(row, raw[y*(rowBytes+1)+1:(y+1)*(rowBytes+1)])
+		if !unfilterPNGRow(raw[y*(rowBytes+1)], row, prev, bpp) {
+			return nil, errPNGData
+		}
+		prev = row
+	}
+	return pix, nil
+}
+
+// unfilterPNGRow reverses filter type ft on row in place, given the
+// unfiltered row above it, and reports whether ft is a valid filter type.
+func unfilterPNGRow(ft byte, row, prev []byte, bpp int) bool {
+	switch ft {
+	case 0:
+	case 1:
+		for i := bpp; i < len(row); i++ {
+			row[i] += row[i-bpp]
+		}
+	case 2:
+		for i := range row {
+			row[i] += prev[i]
+		}
+	case 3:
+		for i := range row {
+			left := 0
+			if i >= bpp {
+				left = int(row[i-bpp])
+			}
+			row[i] += byte((left + int(prev[i])) / 2)
+		}
+	case 4:
+		for i := range row {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = row[i-bpp], prev[i-bpp]
+			}
+			row[i] += paeth(left, prev[i], upLeft)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// copyPNGPixel copies pixel x of the packed row src to pixel i of dst.
+func copyPNGPixel(dst []byte, i int, src []byte, x, bitsPerPixel int) {
+	if bitsPerPixel >= 8 {
+		n := bitsPerPixel / 8
+		copy(dst[i*n:(i+1)*n], src[x*n:(x+1)*n])
+		return
+	}
+	// Sub-byte pixels are packed from the most significant bit.
+	mask := byte(1<<bitsPerPixel - 1)
+	sbit, dbit := x*bitsPerPixel, i*bitsPerPixel
+	v := src[sbit/8] >> (8 - bitsPerPixel - sbit%8) & mask
+	dst[dbit/8] |= v << (8 - bitsPerPixel - dbit%8)
+}
+
+// filterPNGRow writes cur to out with the filter that minimizes the sum of
+// absolute filtered values, the heuristic image/png uses, preceded by the
+// filter type byte. prev is the row above (zeros for the first row of a
+// pass) and bpp the byte distance to the left neighbor.
+func filterPNGRow(out, cur, prev []byte, bpp int) {
+	// Score every filter in one pass, then write the winner, so no
+	// candidate rows are allocated.
+	var sums [5]int
+	for i := range cur {
+		var left, upLeft byte
+		if i >= bpp {
+			left, upLeft = cur[i-bpp], prev[i-bpp]
+		}
+		sums[0] += abs8(int8(cur[i]))
+		sums[1] += abs8(int8(cur[i] - left))
+		sums[2] += abs8(int8(cur[i] - prev[i]))
+		sums[3] += abs8(int8(cur[i] - byte((int(left)+int(prev[i]))/2)))
+		sums[4] += abs8(int8(cur[i] - paeth(left, prev[i], upLeft)))
+	}
+	ft := 0
+	for f := 1; f < 5; f++ {
+		if sums[f] < sums[ft] {
+			ft = f
+		}
+	}
+
+	out[0] = byte(ft)
+	for i := range cur {
+		var left, upLeft byte
+		if i >= bpp {
+			left, upLeft = cur[i-bpp], prev[i-bpp]
+		}
+		switch ft {
+		case 0:
+			out[i+1] = cur[i]
+		case 1:
+			out[i+1] = cur[i] - left
+		case 2:
+			out[i+1] = cur[i] - prev[i]
+		case 3:
+			out[i+1] = cur[i] - byte((int(left)+int(prev[i]))/2)
+		case 4:
+			out[i+1] = cur[i] - paeth(left, prev[i], upLeft)
+		}
+	}
+}
+
+// abs8 returns |v| as an int.
+func abs8(v int8) int {
+	if v < 0 {
+		return -int(v)
+	}
+	return int(v)
+}
+
+// paeth is the PNG Paeth predictor for left a, above b, and upper-left c.
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := p-int(a), p-int(b), p-int(c)
+	if pa < 0 {
+		pa = -pa
+	}
+	if pb < 0 {
+		pb = -pb
+	}
+	if pc < 0 {
+		pc = -pc
+	}
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
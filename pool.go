@@ -0,0 +1,80 @@
+package fennec
+
+import (
+	"image"
+	"sync"
+)
+
+// bufPool recycles slices bucketed by exact length. The SSIM search, resize
+// passes, and blurs allocate the same few sizes over and over (one set per
+// image dimension), so exact-size buckets get a high hit rate without any
+// size-class bookkeeping.
+type bufPool[T any] struct {
+	pools sync.Map // int → *sync.Pool of *[]T
+}
+
+// get returns a zeroed slice of length n.
+func (p *bufPool[T]) get(n int) []T {
+	if sp, ok := p.pools.Load(n); ok {
+		if b, ok := sp.(*sync.Pool).Get().(*[]T); ok {
+			clear(*b)
+			return *b
+		}
+	}
+	return make([]T, n)
+}
+
+// put returns b to the pool. The caller must not use b afterwards.
+func (p *bufPool[T]) put(b []T) {
+	if len(b) == 0 {
+		return
+	}
+	sp, _ := p.pools.LoadOrStore(len(b), &sync.Pool{})
+	sp.(*sync.Pool).Put(&b)
+}
+
+// scratch holds the pixel and float buffers one Compressor recycles across
+// its calls. Each Compressor owns its own, so separate Compressors never
+// share memory. A nil *scratch allocates fresh buffers, which is what the
+// standalone functions outside a Compressor use.
+type scratch struct {
+	pix   bufPool[byte]
+	float bufPool[float64]
+}
+
+// floats returns a zeroed slice of n float64s. Hand it back with putFloats.
+func (s *scratch) floats(n int) []float64 {
+	if s == nil {
+		return make([]float64, n)
+	}
+	return s.float.get(n)
+}
+
+// putFloats returns a slice from floats. The caller must not use b
+// afterwards.
+func (s *scratch) putFloats(b []float64) {
+	if s != nil {
+		s.float.put(b)
+	}
+}
+
+// tempNRGBA returns a zeroed w×h image backed by a pooled buffer. Use it
+// only for intermediates that never escape the caller, and hand it back
+// with releaseNRGBA when done. Never return one in a Result.
+func (s *scratch) tempNRGBA(w, h int) *image.NRGBA {
+	if s == nil {
+		return image.NewNRGBA(image.Rect(0, 0, w, h))
+	}
+	return &image.NRGBA{
+		Pix:    s.pix.get(w * h * 4),
+		Stride: w * 4,
+		Rect:   image.Rect(0, 0, w, h),
+	}
+}
+
+// releaseNRGBA returns the pixel buffer of a tempNRGBA image to the pool.
+func (s *scratch) releaseNRGBA(img *image.NRGBA) {
+	if s != nil && img != nil {
+		s.pix.put(img.Pix)
+	}
+}
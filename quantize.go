@@ -0,0 +1,200 @@
+package fennec
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// BuildPalette returns a palette of at most maxColors colors that represents
+// img, using the same median-cut quantizer as target-size mode and LossyPNG.
+// maxColors is clamped to [2, 256]. If img has fully transparent pixels, one
+// entry is a reserved transparent color. Images over 100,000 pixels are
+// sampled rather than scanned in full, so building a palette stays fast on
+// large photos.
+func BuildPalette(img image.Image, maxColors int) color.Palette {
+	return medianCut(quantizeSource(img), clampColors(maxColors))
+}
+
+// Quantize reduces img to at most maxColors colors (clamped to [2, 256])
+// and returns it as a zero-origin paletted image, ready for GIF or indexed
+// PNG encoding. The palette comes from BuildPalette; each pixel maps to its
+// nearest entry.
+func Quantize(img image.Image, maxColors int) *image.Paletted {
+	src := quantizeSource(img)
+	return applyPalette(src, medianCut(src, clampColors(maxColors)), false)
+}
+
+// quantizeSource returns img as a zero-origin NRGBA with contiguous rows,
+// as the quantizer expects, copying only when needed.
+func quantizeSource(img image.Image) *image.NRGBA {
+	if n, ok := img.(*image.NRGBA); ok && n.Rect.Min == (image.Point{}) && n.Stride == 4*n.Rect.Dx() {
+		return n
+	}
+	return convertToNRGBA(img)
+}
+
+func clampColors(n int) int {
+	if n < 2 {
+		return 2
+	}
+	if n > 256 {
+		return 256
+	}
+	return n
+}
+
+// ── Perceptual Palette Mapping ──────────────────────────────────────────────
+
+// labColor is a color in CIE L*a*b* (D65 white) with its 8-bit alpha.
+type labColor struct{ l, a, b, alpha float64 }
+
+// srgbToLinear maps an 8-bit sRGB channel to linear light in [0, 1].
+var srgbToLinear = func() (t [256]float64) {
+	for i := range t {
+		c := float64(i) / 255
+		if c <= 0.04045 {
+			t[i] = c / 12.92
+		} else {
+			t[i] = math.Pow((c+0.055)/1.055, 2.4)
+		}
+	}
+	return t
+}()
+
+// toLab converts a non-premultiplied 8-bit color to labColor.
+func toLab(r, g, b, a uint8) labColor {
+	lr, lg, lb := srgbToLinear[r], srgbToLinear[g], srgbToLinear[b]
+	// XYZ relative to the D65 white point, so white maps to (1, 1, 1).
+	x := (0.4124564*lr + 0.3575761*lg + 0.1804375*lb) / 0.95047
+	y := 0.2126729*lr + 0.7151522*lg + 0.0721750*lb
+	z := (0.0193339*lr + 0.1191920*lg + 0.9503041*lb) / 1.08883
+	fx, fy, fz := labF(x), labF(y), labF(z)
+	return labColor{l: 116*fy - 16, a: 500 * (fx - fy), b: 200 * (fy - fz), alpha: float64(a)}
+}
+
+func labF(t float64) float64 {
+	const delta = 6.0 / 29
+	if t > delta*delta*delta {
+		return math.Cbrt(t)
+	}
+	return t/(3*delta*delta) + 4.0/29
+}
+
+// ciede2000 returns the CIEDE2000 color difference between two Lab colors,
+// following Sharma, Wu and Dalal (2005) with unit weighting factors.
+func ciede2000(p, q labColor) float64 {
+	const pow25To7 = 6103515625 // 25^7
+
+	cBar := (math.Hypot(p.a, p.b) + math.Hypot(q.a, q.b)) / 2
+	cBar7 := math.Pow(cBar, 7)
+	g := 0.5 * (1 - math.Sqrt(cBar7/(cBar7+pow25To7)))
+	a1, a2 := p.a*(1+g), q.a*(1+g)
+	c1, c2 := math.Hypot(a1, p.b), math.Hypot(a2, q.b)
+	h1, h2 := hueDegrees(p.b, a1), hueDegrees(q.b, a2)
+
+	dL := q.l - p.l
+	dC := c2 - c1
+	dh := 0.0
+	if c1*c2 != 0 {
+		dh = h2 - h1
+		if dh > 180 {
+			dh -= 360
+		} else if dh < -180 {
+			dh += 360
+		}
+	}
+	dH := 2 * math.Sqrt(c1*c2) * math.Sin(dh*math.Pi/360)
+
+	lMean := (p.l + q.l) / 2
+	cMean := (c1 + c2) / 2
+	hMean := h1 + h2
+	if c1*c2 != 0 {
+		if math.Abs(h1-h2) > 180 {
+			if hMean < 360 {
+				hMean += 360
+			} else {
+				hMean -= 360
+			}
+		}
+		hMean /= 2
+	}
+
+	cos := func(deg float64) float64 { return math.Cos(deg * math.Pi / 180) }
+	t := 1 - 0.17*cos(hMean-30) + 0.24*cos(2*hMean) + 0.32*cos(3*hMean+6) - 0.20*cos(4*hMean-63)
+	dTheta := 30 * math.Exp(-math.Pow((hMean-275)/25, 2))
+	cMean7 := math.Pow(cMean, 7)
+	rc := 2 * math.Sqrt(cMean7/(cMean7+pow25To7))
+	l50 := (lMean - 50) * (lMean - 50)
+	sl := 1 + 0.015*l50/math.Sqrt(20+l50)
+	sc := 1 + 0.045*cMean
+	sh := 1 + 0.015*cMean*t
+	rt := -math.Sin(2*dTheta*math.Pi/180) * rc
+
+	l, c, h := dL/sl, dC/sc, dH/sh
+	return math.Sqrt(l*l + c*c + h*h + rt*c*h)
+}
+
+// hueDegrees is the hue angle of (a, b) in [0, 360), 0 for a neutral color.
+func hueDegrees(b, a float64) float64 {
+	if a == 0 && b == 0 {
+		return 0
+	}
+	h := math.Atan2(b, a) * 180 / math.Pi
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+// perceptualCandidates is how many palette entries, nearest by plain Lab
+// distance, nearestEntryPerceptual scores with CIEDE2000. The two metrics
+// agree on the neighborhood, and scoring only a few keeps the slow formula
+// off the other ~250 entries.
+const perceptualCandidates = 8
+
+// labAlphaScale puts an alpha difference (0–255) on the same footing as a
+// Lab difference (roughly 0–100).
+const labAlphaScale = 100.0 / 255
+
+// nearestEntryPerceptual returns the index of the palette entry closest to
+// p by CIEDE2000, with alpha as an extra axis. The color difference is
+// weighted by p's opacity, since the color of a transparent pixel doesn't
+// show. Ties go to the lowest index, as in nearestEntry.
+func nearestEntryPerceptual(pal []labColor, p labColor) uint8 {
+	type candidate struct {
+		dist float64
+		idx  int
+	}
+	var best [perceptualCandidates]candidate
+	n := 0
+	vis := p.alpha / 255
+	for i, q := range pal {
+		dl, da, db := p.l-q.l, p.a-q.a, p.b-q.b
+		dAlpha := (p.alpha - q.alpha) * labAlphaScale
+		d := vis*vis*(dl*dl+da*da+db*db) + dAlpha*dAlpha
+		if n == len(best) && d >= best[n-1].dist {
+			continue
+		}
+		// Insert into the sorted candidate list, dropping the worst.
+		j := min(n, len(best)-1)
+		for j > 0 && best[j-1].dist > d {
+			best[j] = best[j-1]
+			j--
+		}
+		best[j] = candidate{d, i}
+		n = min(n+1, len(best))
+	}
+
+	bestIdx, bestDist := 0, math.Inf(1)
+	for _, c := range best[:n] {
+		q := pal[c.idx]
+		de := vis * ciede2000(p, q)
+		dAlpha := (p.alpha - q.alpha) * labAlphaScale
+		d := de*de + dAlpha*dAlpha
+		if d < bestDist || (d == bestDist && c.idx < bestIdx) {
+			bestDist, bestIdx = d, c.idx
+		}
+	}
+	return uint8(bestIdx)
+}
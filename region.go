@@ -0,0 +1,157 @@
+package fennec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+)
+
+// ── Region Recompression ────────────────────────────────────────────────────
+//
+// An editor that saves a JPEG after touching a small area would normally
+// decode it, edit the pixels, and encode everything again, so the whole
+// image loses quality with every save. Because a JPEG is a grid of
+// independently quantized blocks, only the MCUs (minimum coded units: one
+// 8×8 block per component, or 16×16 pixels with 4:2:0 chroma) the edit
+// touches need new coefficients. RecompressRegion parses the original with
+// the lossless recompressor's decoder, recomputes just those MCUs from the
+// edited pixels with the original's sampling and quantization tables, and
+// writes the frame back out.
+
+// RecompressRegion saves an edit to a JPEG by re-encoding only the MCUs
+// that region touches. original is the JPEG as it was; edited is the image
+// after editing, with the original's stored dimensions (decode it with
+// AutoOrient off); region bounds the change, in edited's coordinates.
+// Every other block keeps its coefficients, so pixels outside the touched
+// MCUs decode exactly as before, however often the file is saved. The file
+// is re-entropy-coded with optimized Huffman tables, and its APPn and COM
+// segments (EXIF, ICC profile, comments) are kept. An empty region leaves
+// every block as it was.
+//
+// This works on baseline JPEGs that lossless recompression can parse.
+// Others, such as progressive or CMYK files, fall back to compressing all of
+// edited with opts, as CompressImage does. Otherwise the only option used is
+// Background, for transparent pixels in edited. Result.SSIM compares the
+// output with edited.
+func RecompressRegion(ctx context.Context, original []byte, edited *image.NRGBA, region image.Rectangle, opts Options) (*Result, error) {
+	c, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.RecompressRegion(ctx, original, edited, region)
+}
+
+// RecompressRegion is the Compressor form of the package-level
+// RecompressRegion.
+func (c *Compressor) RecompressRegion(ctx context.Context, original []byte, edited *image.NRGBA, region image.Rectangle) (*Result, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if edited == nil {
+		return nil, ErrNilImage
+	}
+	if len(original) < 2 || original[0] != 0xFF || original[1] != 0xD8 {
+		return nil, fmt.Errorf("%w: RecompressRegion needs a JPEG original", ErrUnsupportedFormat)
+	}
+	opts := c.opts
+
+	f, err := decodeJPEGFrame(original)
+	if errors.Is(err, errNotBaseline) {
+		opts.logf("region: %v; re-encoding the whole image", err)
+		result, err := c.CompressImage(ctx, edited)
+		if err != nil {
+			return nil, err
+		}
+		result.OriginalSize = int64(len(original))
+		result.computeStats()
+		return result, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+
+	b := edited.Bounds()
+	size := image.Pt(f.width, f.height)
+	if b.Size() != size {
+		return nil, fmt.Errorf("%w: edited image is %dx%d, original is %dx%d",
+			ErrInvalidOptions, b.Dx(), b.Dy(), f.width, f.height)
+	}
+	src := toNRGBARef(edited)
+	if !isOpaque(src) {
+		src = flattenAlpha(src, opts.background())
+	}
+
+	// Widen the region to whole MCUs.
+	hmax, vmax := f.maxSampling()
+	mw, mh := 8*hmax, 8*vmax
+	region = region.Sub(b.Min).Intersect(image.Rectangle{Max: size})
+	mcus := image.Rect(region.Min.X/mw, region.Min.Y/mh, (region.Max.X+mw-1)/mw, (region.Max.Y+mh-1)/mh)
+	if !region.Empty() {
+		f.encodeMCUs(src, mcus)
+	}
+	mx, my := f.mcus()
+	opts.logf("region: re-encoded %d of %d MCUs", mcus.Dx()*mcus.Dy(), mx*my)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tables := f.optimalTables()
+	var frame bytes.Buffer
+	if err := f.write(&frame, &tables); err != nil {
+		return nil, err
+	}
+	// Put the original's metadata between SOI and the frame's tables.
+	apps := jpegAppSegments(original)
+	data := make([]byte, 0, frame.Len()+len(apps))
+	data = append(data, frame.Bytes()[:2]...)
+	data = append(data, apps...)
+	data = append(data, frame.Bytes()[2:]...)
+
+	result := &Result{
+		Image:              src,
+		CompressedData:     data,
+		Format:             JPEG,
+		SourceFormat:       JPEG,
+		OriginalSize:       int64(len(original)),
+		CompressedSize:     int64(len(data)),
+		OriginalDimensions: size,
+		FinalDimensions:    size,
+		TargetMet:          true,
+	}
+	if decoded, err := jpeg.Decode(bytes.NewReader(data)); err == nil {
+		result.SSIM = computeSSIMNRGBA(src, toNRGBARef(decoded), opts.scratch)
+	}
+	result.computeStats()
+	return result, nil
+}
+
+// jpegAppSegments returns the APPn and COM segments before a JPEG's first
+// scan, markers included, in file order.
+func jpegAppSegments(data []byte) []byte {
+	var out []byte
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xFF; {
+		m := data[pos+1]
+		if m == 0xFF {
+			pos++ // Fill byte.
+			continue
+		}
+		if m == 0xDA || m == 0xD9 {
+			break
+		}
+		end := pos + 2 + (int(data[pos+2])<<8 | int(data[pos+3]))
+		if end > len(data) {
+			break
+		}
+		if m >= 0xE0 && m <= 0xEF || m == 0xFE {
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	return out
+}
@@ -4,37 +4,233 @@ import (
 	"image"
 	"math"
 	"runtime"
+	"slices"
 	"sync"
 )
 
 // smartResize resizes the image to fit within maxW x maxH while preserving
 // aspect ratio. Uses Lanczos-3 interpolation for superior quality.
-func smartResize(img *image.NRGBA, maxW, maxH int) *image.NRGBA {
+// Images that already fit are returned unchanged unless upscale is set, in
+// which case they are enlarged until one side meets the box. A zero
+// dimension is unconstrained. rs selects how pixels are interpolated.
+func smartResize(img *image.NRGBA, maxW, maxH int, upscale bool, rs resampling) *image.NRGBA {
 	srcW := img.Bounds().Dx()
 	srcH := img.Bounds().Dy()
 
-	if maxW <= 0 {
-		maxW = srcW
+	if srcW == 0 || srcH == 0 || (maxW <= 0 && maxH <= 0) {
+		return img
 	}
-	if maxH <= 0 {
-		maxH = srcH
+	if !upscale && fitsWithin(srcW, srcH, maxW, maxH) {
+		return img
 	}
 
-	if srcW <= maxW && srcH <= maxH {
+	dstW, dstH := fitBox(srcW, srcH, maxW, maxH)
+	if dstW == srcW && dstH == srcH {
 		return img
 	}
+	return lanczosResizeAlpha(img, dstW, dstH, rs)
+}
+
+// fitBox returns the largest size with srcW:srcH's aspect ratio that fits
+// within maxW×maxH, where a non-positive limit is unconstrained and at
+// least one must be positive. The limiting side meets its limit exactly and
+// the other is rounded from it in integer arithmetic, so the result never
+// exceeds the box and is the closest pixel approximation of the source
+// ratio: scaling both sides by a rounded float ratio can drift by a pixel
+// and overshoot the box. Neither side is less than 1.
+func fitBox(srcW, srcH, maxW, maxH int) (w, h int) {
+	// Width limits when maxW/srcW <= maxH/srcH, compared cross-multiplied.
+	if maxW > 0 && (maxH <= 0 || maxW*srcH <= maxH*srcW) {
+		h = max(1, (2*srcH*maxW+srcW)/(2*srcW))
+		if maxH > 0 {
+			h = min(h, maxH)
+		}
+		return maxW, h
+	}
+	w = max(1, (2*srcW*maxH+srcH)/(2*srcH))
+	if maxW > 0 {
+		w = min(w, maxW)
+	}
+	return w, maxH
+}
+
+// FitMode controls how ResizeExact maps an image onto the requested size.
+type FitMode int
+
+const (
+	// FitContain scales the image to fit within the box, preserving aspect
+	// ratio. One side matches the box; the other may be smaller.
+	FitContain FitMode = iota
+	// FitCover scales the image to fill the box, preserving aspect ratio,
+	// then center-crops the overflow. The result is exactly w×h.
+	FitCover
+	// FitStretch scales each axis independently, ignoring aspect ratio.
+	// The result is exactly w×h.
+	FitStretch
+)
+
+func (m FitMode) String() string {
+	switch m {
+	case FitContain:
+		return "Contain"
+	case FitCover:
+		return "Cover"
+	case FitStretch:
+		return "Stretch"
+	default:
+		return "Unknown"
+	}
+}
+
+// ResizeFilter selects the kernel that resizing interpolates with. Wider
+// kernels with deeper negative lobes keep more fine detail but overshoot
+// beside hard edges, which shows as a faint light or dark halo (ringing).
+type ResizeFilter int
+
+const (
+	// Lanczos3 is a three-lobe Lanczos filter: the sharpest choice, with
+	// the most ringing. It is the default.
+	Lanczos3 ResizeFilter = iota
+	// Lanczos2 is a two-lobe Lanczos filter: slightly softer than
+	// Lanczos3, with about half its ringing, and faster.
+	Lanczos2
+	// Mitchell is the Mitchell-Netravali cubic (B = C = 1/3): softer
+	// still, with barely visible ringing. It suits upscaling and smooth
+	// gradients.
+	Mitchell
+)
+
+func (f ResizeFilter) String() string {
+	switch f {
+	case Lanczos3:
+		return "Lanczos3"
+	case Lanczos2:
+		return "Lanczos2"
+	case Mitchell:
+		return "Mitchell"
+	default:
+		return "Unknown"
+	}
+}
+
+// support returns f's radius in source pixels when not downscaling.
+func (f ResizeFilter) support() float64 {
+	if f == Lanczos3 {
+		return 3
+	}
+	return 2
+}
 
-	ratio := math.Min(float64(maxW)/float64(srcW), float64(maxH)/float64(srcH))
-	dstW := int(math.Max(1, math.Round(float64(srcW)*ratio)))
-	dstH := int(math.Max(1, math.Round(float64(srcH)*ratio)))
+// kernel evaluates f at distance x.
+func (f ResizeFilter) kernel(x float64) float64 {
+	if f == Mitchell {
+		return mitchellKernel(x)
+	}
+	return lanczosKernel(x, f.support())
+}
+
+// ResizeExact resizes img to a w×h box using Lanczos-3 and the given fit
+// mode. Unlike the MaxWidth/MaxHeight options it also upscales. If w or h
+// is not positive, an empty image is returned.
+func ResizeExact(img image.Image, w, h int, mode FitMode) *image.NRGBA {
+	return resizeExact(toNRGBARef(img), w, h, mode, resampling{})
+}
+
+// Downsample shrinks img to w×h with a box filter: each output pixel is
+// the plain average of the source pixels it covers. It is the fast
+// reduction SSIM uses, not a quality resize; use ResizeExact for output
+// meant to be seen. The aspect ratio is not preserved, and sizes above the
+// source repeat pixels. If w or h is not positive, an empty image is
+// returned.
+func Downsample(img image.Image, w, h int) *image.NRGBA {
+	return boxDownsample(toNRGBARef(img), w, h)
+}
+
+// resizeExact is ResizeExact with a choice of interpolation.
+func resizeExact(src *image.NRGBA, w, h int, mode FitMode, rs resampling) *image.NRGBA {
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= 0 || h <= 0 || srcW <= 0 || srcH <= 0 {
+		return image.NewNRGBA(image.Rect(0, 0, 0, 0))
+	}
+
+	switch mode {
+	case FitCover:
+		ratio := math.Max(float64(w)/float64(srcW), float64(h)/float64(srcH))
+		rw := max(w, int(math.Round(float64(srcW)*ratio)))
+		rh := max(h, int(math.Round(float64(srcH)*ratio)))
+		resized := lanczosResizeAlpha(src, rw, rh, rs)
+		x0, y0 := (rw-w)/2, (rh-h)/2
+		cropped, _ := Crop(resized, image.Rect(x0, y0, x0+w, y0+h))
+		return cropped
+	case FitStretch:
+		return lanczosResizeAlpha(src, w, h, rs)
+	default:
+		dstW, dstH := fitBox(srcW, srcH, w, h)
+		return lanczosResizeAlpha(src, dstW, dstH, rs)
+	}
+}
+
+// exactResize maps img onto exactly size for Options.ExactSize. It is
+// ResizeExact, except that FitContain pads the result to the full box,
+// centered on a transparent canvas. Images already at size are returned
+// unchanged.
+func exactResize(img *image.NRGBA, size image.Point, mode FitMode, rs resampling) *image.NRGBA {
+	if img.Bounds().Size() == size {
+		return img
+	}
+	resized := resizeExact(img, size.X, size.Y, mode, rs)
+	rw, rh := resized.Bounds().Dx(), resized.Bounds().Dy()
+	if rw == size.X && rh == size.Y {
+		return resized
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+	x0, y0 := (size.X-rw)/2, (size.Y-rh)/2
+	for y := 0; y < rh; y++ {
+		copy(dst.Pix[(y0+y)*dst.Stride+x0*4:], resized.Pix[y*resized.Stride:y*resized.Stride+rw*4])
+	}
+	return dst
+}
 
-	return lanczosResize(img, dstW, dstH)
+// scaleRect maps r from an image of size from to the same relative place
+// in an image of size to, rounding outward so the result never shrinks.
+func scaleRect(r image.Rectangle, from, to image.Point) image.Rectangle {
+	sx := float64(to.X) / float64(from.X)
+	sy := float64(to.Y) / float64(from.Y)
+	return image.Rect(
+		int(math.Floor(float64(r.Min.X)*sx)), int(math.Floor(float64(r.Min.Y)*sy)),
+		int(math.Ceil(float64(r.Max.X)*sx)), int(math.Ceil(float64(r.Max.Y)*sy)),
+	)
 }
 
 // lanczosResize performs high-quality Lanczos-3 interpolation.
 // Two-pass separable filter: horizontal then vertical.
 // Uses pre-multiplied alpha to prevent color fringing at transparency edges.
 func lanczosResize(img *image.NRGBA, dstW, dstH int) *image.NRGBA {
+	return lanczosResizeAlpha(img, dstW, dstH, resampling{})
+}
+
+// resampling selects how lanczosResizeAlpha interpolates.
+type resampling struct {
+	// straight interpolates straight (non-premultiplied) RGBA. It keeps
+	// the color stored under transparent pixels, at the cost of dark or
+	// off-color fringes where opaque and transparent areas meet.
+	straight bool
+	// linear interpolates in linear light rather than on sRGB values.
+	linear bool
+	// filter is the interpolation kernel.
+	filter ResizeFilter
+	// s pools the intermediate images; nil allocates them.
+	s *scratch
+}
+
+// resampling returns the interpolation the options ask for.
+func (o *Options) resampling() resampling {
+	return resampling{straight: o.StraightAlpha, linear: o.LinearResize, filter: o.ResizeFilter, s: o.scratch}
+}
+
+// lanczosResizeAlpha is lanczosResize with the interpolation rs selects.
+func lanczosResizeAlpha(img *image.NRGBA, dstW, dstH int, rs resampling) *image.NRGBA {
 	srcW := img.Bounds().Dx()
 	srcH := img.Bounds().Dy()
 
@@ -48,24 +244,44 @@ func lanczosResize(img *image.NRGBA, dstW, dstH int) *image.NRGBA {
 		return dst
 	}
 
-	tmp := resizeH(img, dstW, srcH)
-	return resizeV(tmp, dstW, dstH)
+	if rs.linear {
+		return resizeLinearV(resizeLinearH(img, dstW, rs), dstW, srcH, dstH, rs)
+	}
+	tmp := resizeH(img, dstW, srcH, rs)
+	dst := resizeV(tmp, dstW, dstH, rs)
+	rs.s.releaseNRGBA(tmp)
+	return dst
 }
 
-const lanczosA = 3.0
-
-func lanczosKernel(x float64) float64 {
+// lanczosKernel evaluates the Lanczos filter with a lobes at x.
+func lanczosKernel(x, a float64) float64 {
 	if x == 0 {
 		return 1.0
 	}
 	if x < 0 {
 		x = -x
 	}
-	if x >= lanczosA {
+	if x >= a {
 		return 0.0
 	}
 	xpi := x * math.Pi
-	return (lanczosA * math.Sin(xpi) * math.Sin(xpi/lanczosA)) / (xpi * xpi)
+	return (a * math.Sin(xpi) * math.Sin(xpi/a)) / (xpi * xpi)
+}
+
+// mitchellKernel evaluates the Mitchell-Netravali cubic with
+// B = C = 1/3 at x.
+func mitchellKernel(x float64) float64 {
+	if x < 0 {
+		x = -x
+	}
+	switch {
+	case x < 1:
+		return (7*x*x*x - 12*x*x + 16.0/3) / 6
+	case x < 2:
+		return (-7.0/3*x*x*x + 12*x*x - 20*x + 32.0/3) / 6
+	default:
+		return 0
+	}
 }
 
 type weightEntry struct {
@@ -73,22 +289,19 @@ type weightEntry struct {
 	weight float64
 }
 
-// resizeH performs horizontal Lanczos resize with pre-multiplied alpha.
-func resizeH(src *image.NRGBA, dstW, dstH int) *image.NRGBA {
+// resizeH performs a horizontal resize with rs's filter and pre-multiplied
+// alpha, or straight alpha if rs.straight is set.
+// The result is a pooled intermediate; release it with rs.s.releaseNRGBA.
+func resizeH(src *image.NRGBA, dstW, dstH int, rs resampling) *image.NRGBA {
 	srcW := src.Bounds().Dx()
-	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	dst := rs.s.tempNRGBA(dstW, dstH)
+	straight := rs.straight
 
-	ratio := float64(srcW) / float64(dstW)
-	support := lanczosA
-	if ratio > 1 {
-		support = lanczosA * ratio
-	}
+	weights := resizeWeights(dstW, srcW, rs.filter)
 
-	weights := precomputeWeights(dstW, srcW, ratio, support)
-
-	parallelDo(0, dstH, func(y int) {
+	parallelDoCost(0, dstH, dstW*len(weights[0]), func(y int) {
 		for dx := 0; dx < dstW; dx++ {
-			var r, g, b, a float64
+			var r, g, b, a, cw float64
 
 			for _, we := range weights[dx] {
 				off := y*src.Stride + we.index*4
@@ -97,15 +310,19 @@ func resizeH(src *image.NRGBA, dstW, dstH int) *image.NRGBA {
 
 				// Pre-multiply alpha for correct interpolation.
 				aw := sa * w
+				if straight {
+					aw = w
+				}
 				r += float64(src.Pix[off]) * aw
 				g += float64(src.Pix[off+1]) * aw
 				b += float64(src.Pix[off+2]) * aw
-				a += aw
+				a += sa * w
+				cw += aw
 			}
 
 			dstOff := y*dst.Stride + dx*4
-			if a > 0.5 {
-				inv := 1.0 / a
+			if cw > 0 && (straight || a > 0.5) {
+				inv := 1.0 / cw
 				dst.Pix[dstOff] = clampF(r * inv)
 				dst.Pix[dstOff+1] = clampF(g * inv)
 				dst.Pix[dstOff+2] = clampF(b * inv)
@@ -117,22 +334,18 @@ func resizeH(src *image.NRGBA, dstW, dstH int) *image.NRGBA {
 	return dst
 }
 
-// resizeV performs vertical Lanczos resize with pre-multiplied alpha.
-func resizeV(src *image.NRGBA, dstW, dstH int) *image.NRGBA {
+// resizeV performs a vertical resize with rs's filter and pre-multiplied
+// alpha, or straight alpha if rs.straight is set.
+func resizeV(src *image.NRGBA, dstW, dstH int, rs resampling) *image.NRGBA {
 	srcH := src.Bounds().Dy()
 	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	straight := rs.straight
 
-	ratio := float64(srcH) / float64(dstH)
-	support := lanczosA
-	if ratio > 1 {
-		support = lanczosA * ratio
-	}
-
-	weights := precomputeWeights(dstH, srcH, ratio, support)
+	weights := resizeWeights(dstH, srcH, rs.filter)
 
-	parallelDo(0, dstW, func(x int) {
+	parallelDoCost(0, dstW, dstH*len(weights[0]), func(x int) {
 		for dy := 0; dy < dstH; dy++ {
-			var r, g, b, a float64
+			var r, g, b, a, cw float64
 
 			for _, we := range weights[dy] {
 				off := we.index*src.Stride + x*4
@@ -140,15 +353,19 @@ func resizeV(src *image.NRGBA, dstW, dstH int) *image.NRGBA {
 				w := we.weight
 
 				aw := sa * w
+				if straight {
+					aw = w
+				}
 				r += float64(src.Pix[off]) * aw
 				g += float64(src.Pix[off+1]) * aw
 				b += float64(src.Pix[off+2]) * aw
-				a += aw
+				a += sa * w
+				cw += aw
 			}
 
 			dstOff := dy*dst.Stride + x*4
-			if a > 0.5 {
-				inv := 1.0 / a
+			if cw > 0 && (straight || a > 0.5) {
+				inv := 1.0 / cw
 				dst.Pix[dstOff] = clampF(r * inv)
 				dst.Pix[dstOff+1] = clampF(g * inv)
 				dst.Pix[dstOff+2] = clampF(b * inv)
@@ -160,44 +377,69 @@ func resizeV(src *image.NRGBA, dstW, dstH int) *image.NRGBA {
 	return dst
 }
 
-// precomputeWeights builds filter weight tables for a single dimension.
-func precomputeWeights(dstSize, srcSize int, ratio, support float64) [][]weightEntry {
+// resizeWeights returns f's weight tables for resampling one dimension
+// from srcSize to dstSize; the filter widens when downscaling.
+func resizeWeights(dstSize, srcSize int, f ResizeFilter) [][]weightEntry {
 	weights := make([][]weightEntry, dstSize)
+	for d := range weights {
+		weights[d] = appendResizeWeights(nil, d, dstSize, srcSize, f)
+	}
+	return weights
+}
+
+// appendResizeWeights appends entry d of resizeWeights' tables to dst, for
+// callers that don't keep a whole dimension's.
+func appendResizeWeights(dst []weightEntry, d, dstSize, srcSize int, f ResizeFilter) []weightEntry {
+	ratio := float64(srcSize) / float64(dstSize)
+	support := f.support()
+	if ratio > 1 {
+		support *= ratio
+	}
 	filterScale := math.Max(ratio, 1.0)
 
-	for d := 0; d < dstSize; d++ {
-		center := (float64(d)+0.5)*ratio - 0.5
-		left := int(math.Ceil(center - support))
-		right := int(math.Floor(center + support))
+	center := (float64(d)+0.5)*ratio - 0.5
+	left := int(math.Ceil(center - support))
+	right := int(math.Floor(center + support))
 
-		if left < 0 {
-			left = 0
-		}
-		if right >= srcSize {
-			right = srcSize - 1
-		}
+	if left < 0 {
+		left = 0
+	}
+	if right >= srcSize {
+		right = srcSize - 1
+	}
 
-		var wsum float64
-		entries := make([]weightEntry, 0, right-left+1)
-		for s := left; s <= right; s++ {
-			w := lanczosKernel((float64(s) - center) / filterScale)
-			if w != 0 {
-				wsum += w
-				entries = append(entries, weightEntry{s, w})
-			}
+	var wsum float64
+	entries := slices.Grow(dst, right-left+1)
+	for s := left; s <= right; s++ {
+		w := f.kernel((float64(s) - center) / filterScale)
+		if w != 0 {
+			wsum += w
+			entries = append(entries, weightEntry{s, w})
 		}
-		if wsum != 0 {
-			for i := range entries {
-				entries[i].weight /= wsum
-			}
+	}
+	if wsum != 0 {
+		for i := range entries {
+			entries[i].weight /= wsum
 		}
-		weights[d] = entries
 	}
-	return weights
+	return entries
 }
 
+// minParallelWork is the least work, in parallelDoCost's units, worth
+// handing to a goroutine. Below it the scheduling overhead outweighs the
+// work, so small images stay on the calling goroutine.
+const minParallelWork = 1 << 15
+
 // parallelDo executes fn(i) for i in [start, stop) across multiple goroutines.
 func parallelDo(start, stop int, fn func(i int)) {
+	parallelDoCost(start, stop, 0, fn)
+}
+
+// parallelDoCost is parallelDo for loops whose items each cost about
+// itemCost units of work (roughly, pixel operations). It starts no more
+// goroutines than there are minParallelWork chunks of total work. An
+// itemCost of 0 means unknown and parallelizes as widely as parallelDo.
+func parallelDoCost(start, stop, itemCost int, fn func(i int)) {
 	count := stop - start
 	if count <= 0 {
 		return
@@ -207,6 +449,9 @@ func parallelDo(start, stop int, fn func(i int)) {
 	if procs > count {
 		procs = count
 	}
+	if itemCost > 0 {
+		procs = min(procs, count*itemCost/minParallelWork)
+	}
 	if procs <= 1 {
 		for i := start; i < stop; i++ {
 			fn(i)
@@ -36,49 +36,148 @@ func SSIM(img1, img2 image.Image) float64 {
 		return pixelSSIM(a, b)
 	}
 
-	lumA := toLuminance(a)
-	lumB := toLuminance(b)
+	return windowedSSIM(toLuminance(a, nil), toLuminance(b, nil), w, h)
+}
+
+// Channel weights for SSIMColor: luma carries most of the perceived
+// structure, and the two chroma planes share the rest.
+const (
+	ssimColorWeightY = 0.8
+	ssimColorWeightC = 0.1
+)
+
+// SSIMColor computes SSIM on each of the Y, Cb, and Cr planes (BT.601) and
+// combines them as 0.8·Y + 0.1·Cb + 0.1·Cr. Unlike SSIM, which sees only
+// luminance, it drops when hue changes at equal brightness, so it catches
+// color bleeding from chroma subsampling. It costs about three times as
+// much as SSIM.
+func SSIMColor(img1, img2 image.Image) float64 {
+	a := toNRGBARef(img1)
+	b := toNRGBARef(img2)
+
+	w := a.Bounds().Dx()
+	h := a.Bounds().Dy()
+
+	if w != b.Bounds().Dx() || h != b.Bounds().Dy() {
+		b = lanczosResize(b, w, h)
+	}
 
-	return windowedSSIM(lumA, lumB, w, h)
+	planesA := toYCbCrPlanes(a, nil)
+	planesB := toYCbCrPlanes(b, nil)
+	weights := [3]float64{ssimColorWeightY, ssimColorWeightC, ssimColorWeightC}
+
+	var result float64
+	for i := range planesA {
+		if w < 8 || h < 8 {
+			result += weights[i] * planeSSIM(planesA[i], planesB[i])
+		} else {
+			result += weights[i] * windowedSSIM(planesA[i], planesB[i], w, h)
+		}
+	}
+	return result
 }
 
 // SSIMFast computes a faster approximation of SSIM using downsampled images.
 // Phase 2: increased max dimension from 256 to 512 for better artifact detection.
 // 512px catches subtle blocking artifacts that 256px misses, while staying fast (~20ms).
 func SSIMFast(img1, img2 *image.NRGBA) float64 {
-	w := img1.Bounds().Dx()
-	h := img1.Bounds().Dy()
+	ref := newSSIMRef(img1, nil)
+	defer ref.release()
+	return ref.compare(img2)
+}
+
+// ssimFastMaxDim is the largest dimension SSIMFast works at.
+const ssimFastMaxDim = 512
+
+// ssimRef holds the SSIMFast preprocessing (downsample and luminance) of a
+// reference image, so repeated comparisons against the same source — as in
+// the JPEG quality search — only process each candidate.
+type ssimRef struct {
+	w, h  int          // working size after downsampling
+	small *image.NRGBA // working image, kept only for the pixelSSIM path
+	down  *image.NRGBA // pooled downsample to release, if any
+	lum   []float64    // pooled luminance, nil on the pixelSSIM path
+	focus image.Rectangle
+	s     *scratch // pool of down and lum, and of compare's buffers
+}
 
-	maxDim := 512
-	if w > maxDim || h > maxDim {
-		scale := float64(maxDim) / math.Max(float64(w), float64(h))
-		newW := int(math.Max(8, math.Round(float64(w)*scale)))
-		newH := int(math.Max(8, math.Round(float64(h)*scale)))
-		img1 = boxDownsample(img1, newW, newH)
-		img2 = boxDownsample(img2, newW, newH)
-		w, h = newW, newH
+// newSSIMRef prepares img as a reference, pooling its buffers in s.
+func newSSIMRef(img *image.NRGBA, s *scratch) *ssimRef {
+	r := &ssimRef{w: img.Bounds().Dx(), h: img.Bounds().Dy(), s: s}
+	if r.w > ssimFastMaxDim || r.h > ssimFastMaxDim {
+		scale := float64(ssimFastMaxDim) / math.Max(float64(r.w), float64(r.h))
+		r.w = int(math.Max(8, math.Round(float64(r.w)*scale)))
+		r.h = int(math.Max(8, math.Round(float64(r.h)*scale)))
+		r.down = progressiveDownsampleInto(s.tempNRGBA(r.w, r.h), img, s)
+		img = r.down
 	}
+	if r.w < 8 || r.h < 8 {
+		r.small = img
+		return r
+	}
+	r.lum = toLuminance(img, s)
+	return r
+}
 
-	if w < 8 || h < 8 {
-		return pixelSSIM(img1, img2)
+// setFocus makes compare weight SSIM inside focus, given in the reference's
+// original coordinates, by focusSSIMWeight. The pixelSSIM path used for
+// tiny images ignores it.
+func (r *ssimRef) setFocus(focus image.Rectangle, origW, origH int) {
+	if focus.Empty() || origW == 0 || origH == 0 {
+		r.focus = image.Rectangle{}
+		return
 	}
+	r.focus = scaleRect(focus, image.Pt(origW, origH), image.Pt(r.w, r.h))
+}
 
-	lumA := toLuminance(img1)
-	lumB := toLuminance(img2)
+// compare returns SSIMFast(reference, img). img must have the reference's
+// original dimensions.
+func (r *ssimRef) compare(img *image.NRGBA) float64 {
+	if r.down != nil {
+		tmp := progressiveDownsampleInto(r.s.tempNRGBA(r.w, r.h), img, r.s)
+		defer r.s.releaseNRGBA(tmp)
+		img = tmp
+	}
+	if r.lum == nil {
+		return pixelSSIM(r.small, img)
+	}
+	lum := toLuminance(img, r.s)
+	defer r.s.putFloats(lum)
+	return windowedSSIMFocus(r.lum, lum, r.w, r.h, r.focus)
+}
 
-	return windowedSSIM(lumA, lumB, w, h)
+// release returns the reference's pooled buffers. The ref must not be used
+// afterwards.
+func (r *ssimRef) release() {
+	r.s.releaseNRGBA(r.down)
+	if r.lum != nil {
+		r.s.putFloats(r.lum)
+	}
+	r.down, r.small, r.lum = nil, nil, nil
 }
 
 // windowedSSIM computes SSIM using an 8x8 sliding window with Gaussian weighting.
 func windowedSSIM(lumA, lumB []float64, w, h int) float64 {
+	return windowedSSIMFocus(lumA, lumB, w, h, image.Rectangle{})
+}
+
+// focusSSIMWeight is the share of the score windowedSSIMFocus gives to
+// windows inside the focus region; the rest of the image gets the remainder.
+const focusSSIMWeight = 0.75
+
+// windowedSSIMFocus is windowedSSIM with the windows centered inside focus
+// averaged separately and weighted by focusSSIMWeight, so artifacts there
+// cost more than the same artifacts elsewhere. An empty focus, or one that
+// covers every window or none, gives plain windowedSSIM.
+func windowedSSIMFocus(lumA, lumB []float64, w, h int, focus image.Rectangle) float64 {
 	const windowSize = 8
 	half := windowSize / 2
 
 	kernel := gaussianKernel(windowSize, 1.5)
 
 	type ssimResult struct {
-		sum   float64
-		count int
+		sum, focusSum     float64
+		count, focusCount int
 	}
 
 	procs := runtime.GOMAXPROCS(0)
@@ -104,8 +203,7 @@ func windowedSSIM(lumA, lumB []float64, w, h int) float64 {
 				endY = h - half
 			}
 
-			var localSum float64
-			var localCount int
+			var local ssimResult
 
 			for y := startY; y < endY; y++ {
 				for x := half; x < w-half; x++ {
@@ -142,27 +240,39 @@ func windowedSSIM(lumA, lumB []float64, w, h int) float64 {
 					num := (2*muA*muB + ssimC1) * (2*sigAB + ssimC2)
 					den := (muA*muA + muB*muB + ssimC1) * (sigAA + sigBB + ssimC2)
 
-					localSum += num / den
-					localCount++
+					if (image.Point{x, y}).In(focus) {
+						local.focusSum += num / den
+						local.focusCount++
+					} else {
+						local.sum += num / den
+						local.count++
+					}
 				}
 			}
 
-			results[proc] = ssimResult{localSum, localCount}
+			results[proc] = local
 		}(p)
 	}
 	wg.Wait()
 
-	var totalSum float64
-	var totalCount int
+	var total ssimResult
 	for _, r := range results {
-		totalSum += r.sum
-		totalCount += r.count
+		total.sum += r.sum
+		total.count += r.count
+		total.focusSum += r.focusSum
+		total.focusCount += r.focusCount
 	}
 
-	if totalCount == 0 {
+	switch {
+	case total.count == 0 && total.focusCount == 0:
 		return 1.0
+	case total.focusCount == 0:
+		return total.sum / float64(total.count)
+	case total.count == 0:
+		return total.focusSum / float64(total.focusCount)
 	}
-	return totalSum / float64(totalCount)
+	return focusSSIMWeight*total.focusSum/float64(total.focusCount) +
+		(1-focusSSIMWeight)*total.sum/float64(total.count)
 }
 
 // pixelSSIM computes a simple pixel-level SSIM for very small images.
@@ -203,11 +313,64 @@ func pixelSSIM(a, b *image.NRGBA) float64 {
 	return num / den
 }
 
+// planeSSIM computes SSIM over two whole planes as a single window, for
+// images too small for windowedSSIM.
+func planeSSIM(a, b []float64) float64 {
+	n := float64(len(a))
+	if n == 0 {
+		return 1.0
+	}
+	var muA, muB float64
+	for i := range a {
+		muA += a[i]
+		muB += b[i]
+	}
+	muA /= n
+	muB /= n
+
+	var sigAA, sigBB, sigAB float64
+	for i := range a {
+		da := a[i] - muA
+		db := b[i] - muB
+		sigAA += da * da
+		sigBB += db * db
+		sigAB += da * db
+	}
+	sigAA /= n
+	sigBB /= n
+	sigAB /= n
+
+	num := (2*muA*muB + ssimC1) * (2*sigAB + ssimC2)
+	den := (muA*muA + muB*muB + ssimC1) * (sigAA + sigBB + ssimC2)
+	return num / den
+}
+
+// toYCbCrPlanes converts an NRGBA image to full-range BT.601 Y, Cb, and Cr
+// float64 planes. The slices come from s; return them with s.putFloats.
+func toYCbCrPlanes(img *image.NRGBA, s *scratch) [3][]float64 {
+	w := img.Bounds().Dx()
+	h := img.Bounds().Dy()
+	planes := [3][]float64{s.floats(w * h), s.floats(w * h), s.floats(w * h)}
+
+	for y := 0; y < h; y++ {
+		off := y * img.Stride
+		for x := 0; x < w; x++ {
+			i := off + x*4
+			r, g, b := float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2])
+			planes[0][y*w+x] = 0.299*r + 0.587*g + 0.114*b
+			planes[1][y*w+x] = 128 - 0.168736*r - 0.331264*g + 0.5*b
+			planes[2][y*w+x] = 128 + 0.5*r - 0.418688*g - 0.081312*b
+		}
+	}
+	return planes
+}
+
 // toLuminance converts an NRGBA image to a float64 luminance array.
-func toLuminance(img *image.NRGBA) []float64 {
+// The slice comes from s; return it with s.putFloats.
+func toLuminance(img *image.NRGBA, s *scratch) []float64 {
 	w := img.Bounds().Dx()
 	h := img.Bounds().Dy()
-	lum := make([]float64, w*h)
+	lum := s.floats(w * h)
 
 	for y := 0; y < h; y++ {
 		off := y * img.Stride
@@ -219,6 +382,13 @@ func toLuminance(img *image.NRGBA) []float64 {
 	return lum
 }
 
+// Luminance returns the BT.601 luma of img (0.299 R + 0.587 G + 0.114 B,
+// on a 0–255 scale) as a row-major slice of width×height values, the plane
+// SSIM is computed on. Alpha is ignored.
+func Luminance(img image.Image) []float64 {
+	return toLuminance(toNRGBARef(img), nil)
+}
+
 // gaussianKernel creates a normalized 2D Gaussian kernel.
 func gaussianKernel(size int, sigma float64) []float64 {
 	kernel := make([]float64, size*size)
@@ -247,7 +417,48 @@ func boxDownsample(img *image.NRGBA, dstW, dstH int) *image.NRGBA {
 		return image.NewNRGBA(image.Rect(0, 0, 0, 0))
 	}
 
-	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	return boxDownsampleInto(image.NewNRGBA(image.Rect(0, 0, dstW, dstH)), img)
+}
+
+// ssimHalvingRatio is the downscale factor past which
+// progressiveDownsampleInto halves a dimension before the final box pass.
+const ssimHalvingRatio = 4
+
+// progressiveDownsampleInto box-filters img down to the size of dst and
+// returns dst, like boxDownsampleInto. While a dimension is more than
+// ssimHalvingRatio times its target it is first halved, so the last pass
+// averages small, evenly sized blocks rather than wide, uneven ones: a
+// 12000px image reaches 512px through 6000, 3000, and 1500. The
+// intermediate images are pooled in s and released.
+func progressiveDownsampleInto(dst, img *image.NRGBA, s *scratch) *image.NRGBA {
+	dstW, dstH := dst.Bounds().Dx(), dst.Bounds().Dy()
+	cur := img
+	var tmp *image.NRGBA
+	for {
+		w, h := cur.Bounds().Dx(), cur.Bounds().Dy()
+		nw, nh := w, h
+		if w > ssimHalvingRatio*dstW {
+			nw = (w + 1) / 2
+		}
+		if h > ssimHalvingRatio*dstH {
+			nh = (h + 1) / 2
+		}
+		if nw == w && nh == h {
+			break
+		}
+		next := boxDownsampleInto(s.tempNRGBA(nw, nh), cur)
+		s.releaseNRGBA(tmp)
+		tmp, cur = next, next
+	}
+	boxDownsampleInto(dst, cur)
+	s.releaseNRGBA(tmp)
+	return dst
+}
+
+// boxDownsampleInto box-filters img down to the size of dst and returns dst.
+func boxDownsampleInto(dst, img *image.NRGBA) *image.NRGBA {
+	srcW, srcH := img.Bounds().Dx(), img.Bounds().Dy()
+	dstW, dstH := dst.Bounds().Dx(), dst.Bounds().Dy()
 	xRatio := float64(srcW) / float64(dstW)
 	yRatio := float64(srcH) / float64(dstH)
 
@@ -308,6 +519,10 @@ func averageBoxPixel(img, dst *image.NRGBA, dx, dy, sx0, sx1, sy0, sy1 int) {
 	}
 }
 
+// msssimWeights are the per-scale exponents of MS-SSIM (Wang et al.),
+// finest scale first.
+var msssimWeights = [...]float64{0.0448, 0.2856, 0.3001, 0.2363, 0.1333}
+
 // MSSSIM computes Multi-Scale SSIM, which better correlates with
 // human perception than single-scale SSIM.
 func MSSSIM(img1, img2 image.Image) float64 {
@@ -321,7 +536,8 @@ func MSSSIM(img1, img2 image.Image) float64 {
 		b = lanczosResize(b, w, h)
 	}
 
-	weights := []float64{0.0448, 0.2856, 0.3001, 0.2363, 0.1333}
+	all := msssimWeights
+	weights := all[:]
 	levels := len(weights)
 
 	for i := 0; i < levels-1; i++ {
@@ -363,3 +579,94 @@ func MSSSIM(img1, img2 image.Image) float64 {
 
 	return math.Exp(result)
 }
+
+// msssimRef is the MS-SSIM counterpart of ssimRef, for the JPEG quality
+// search with Options.UseMSSSIM: the reference is reduced to the SSIMFast
+// working size and its luminance pyramid built once, and each comparison
+// scores every scale of the candidate's pyramid against it.
+type msssimRef struct {
+	base    *ssimRef
+	levels  []lumLevel // reference pyramid, finest first; nil on the pixelSSIM path
+	weights []float64  // msssimWeights for len(levels), renormalized
+}
+
+// lumLevel is one scale of a luminance pyramid.
+type lumLevel struct {
+	lum  []float64
+	w, h int
+}
+
+// newMSSSIMRef prepares img as an MS-SSIM reference, pooling its buffers
+// in s.
+func newMSSSIMRef(img *image.NRGBA, s *scratch) *msssimRef {
+	r := &msssimRef{base: newSSIMRef(img, s)}
+	if r.base.lum == nil {
+		return r
+	}
+	r.levels = lumPyramid(r.base.lum, r.base.w, r.base.h)
+	all := msssimWeights
+	r.weights = all[:len(r.levels)]
+	var sum float64
+	for _, wt := range r.weights {
+		sum += wt
+	}
+	for i := range r.weights {
+		r.weights[i] /= sum
+	}
+	return r
+}
+
+// halvePlane averages 2×2 pixels of a w×h plane (both even).
+func halvePlane(src []float64, w, h int) []float64 {
+	hw, hh := w/2, h/2
+	dst := make([]float64, hw*hh)
+	parallelDoCost(0, hh, hw, func(y int) {
+		a, b := src[2*y*w:], src[(2*y+1)*w:]
+		for x := 0; x < hw; x++ {
+			dst[y*hw+x] = (a[2*x] + a[2*x+1] + b[2*x] + b[2*x+1]) / 4
+		}
+	})
+	return dst
+}
+
+// lumPyramid halves lum (w×h) by 2×2 averaging for up to len(msssimWeights)
+// scales, stopping before a side drops below the 8px SSIM window.
+func lumPyramid(lum []float64, w, h int) []lumLevel {
+	levels := []lumLevel{{lum, w, h}}
+	for len(levels) < len(msssimWeights) && w/2 >= 8 && h/2 >= 8 {
+		lum = halvePlane(lum, w, h)
+		w, h = w/2, h/2
+		levels = append(levels, lumLevel{lum, w, h})
+	}
+	return levels
+}
+
+// compare returns the MS-SSIM of img against the reference. img must have
+// the reference's original dimensions.
+func (r *msssimRef) compare(img *image.NRGBA) float64 {
+	if r.base.down != nil {
+		s := r.base.s
+		tmp := progressiveDownsampleInto(s.tempNRGBA(r.base.w, r.base.h), img, s)
+		defer s.releaseNRGBA(tmp)
+		img = tmp
+	}
+	if r.levels == nil {
+		return pixelSSIM(r.base.small, img)
+	}
+	lum := toLuminance(img, r.base.s)
+	defer r.base.s.putFloats(lum)
+
+	var result float64
+	for i, l := range lumPyramid(lum, r.base.w, r.base.h) {
+		ref := r.levels[i]
+		ssim := windowedSSIM(ref.lum, l.lum, ref.w, ref.h)
+		result += r.weights[i] * math.Log(math.Max(ssim, 1e-10))
+	}
+	return math.Exp(result)
+}
+
+// release returns the reference's pooled buffers.
+func (r *msssimRef) release() {
+	r.base.release()
+	r.levels = nil
+}
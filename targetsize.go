@@ -6,9 +6,10 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"image/jpeg"
 	"image/png"
 	"math"
-	"sort"
+	"runtime"
 )
 
 const minJPEGQuality = 20
@@ -21,34 +22,116 @@ type sizeResult struct {
 	finalW  int
 	finalH  int
 	img     *image.NRGBA
+
+	// strategy is reported as Result.Strategy; hitTargetSize sets it.
+	strategy string
 }
 
+// Names of the target-size strategies, as reported in Result.Strategy.
+const (
+	strategyJPEGQuality = "jpeg-quality"
+	strategyQuantizePNG = "quantize-png"
+	strategyQuantizeGIF = "quantize-gif"
+	strategyJPEGScale   = "jpeg-scale"
+	strategyScaleSearch = "scale-search"
+	strategyFallback    = "fallback"
+)
+
+// gifCandidateMaxBytes is the largest target for which Format Auto tries a
+// GIF alongside the quantized PNG. Above it PNG's better compression
+// outweighs GIF's smaller header.
+const gifCandidateMaxBytes = 8 << 10
+
+// hitTargetSize runs the target-size strategies on original, which is
+// already resized to the caller's MaxWidth/MaxHeight or ExactSize. Every
+// strategy works at scales in (0, 1] of original, so the output never
+// exceeds those bounds and is never upscaled past them. With ExactSize the
+// dimensions are fixed: only the quality and palette strategies run, and
+// ErrTargetUnreachable is returned if neither fits.
 func hitTargetSize(ctx context.Context, original *image.NRGBA, targetBytes int, opts Options) (*sizeResult, error) {
 	wantPNG := opts.Format == PNG
 	wantJPEG := opts.Format == JPEG
-	canUseJPEG := !wantPNG && isOpaque(original)
+	wantGIF := opts.Format == GIF
+	canUseJPEG := !wantPNG && !wantGIF && isOpaque(original)
+	tol := opts.TargetSizeTolerance
+	enc := opts.jpegEncoding(original)
+	fixedSize := opts.ExactSize != (image.Point{})
+
+	// The JPEG strategies encode jpegSrc. It only differs from original
+	// when JPEG is possible, and PNG output never sees the smoothing.
+	jpegSrc := original
+	if opts.ContentAware && (canUseJPEG || wantJPEG) {
+		jpegSrc = contentAwareSmooth(original, opts.scratch)
+	}
+	probes := newScaleProbes(jpegSrc, targetBytes, enc)
+
+	// An error from the progress callback cancels ctx, which stops the
+	// strategies the same way caller cancellation does.
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	prog := &searchProgress{ctx: parent, opts: &opts, cancel: cancel}
 
 	var candidates []*sizeResult
 
-	if (canUseJPEG || wantJPEG) && ctx.Err() == nil {
-		if r, err := jpegQualitySearch(original, targetBytes); err == nil && r != nil && r.quality >= minJPEGQuality {
+	// Each strategy stops at its next iteration once ctx is done; the
+	// checks between them make sure a cancelled run returns instead of
+	// falling through to the next strategy or the fallback encode.
+	if canUseJPEG || wantJPEG {
+		prog.begin(0, jpegSearchSteps)
+		r, err := jpegQualitySearch(ctx, prog, jpegSrc, targetBytes, tol, enc, opts.scratch)
+		if ctx.Err() != nil {
+			return nil, prog.abortErr()
+		}
+		// At a fixed size quality is the only lever, so any fit counts.
+		if err == nil && r != nil && (r.quality >= minJPEGQuality || fixedSize) {
+			r.strategy = strategyJPEGQuality
 			candidates = append(candidates, r)
 		}
 	}
 
-	if !wantJPEG && ctx.Err() == nil {
-		if r, err := quantizeStrategy(original, targetBytes); err == nil && r != nil {
-			candidates = append(candidates, r)
+	if !wantJPEG {
+		formats := []Format{PNG}
+		if wantGIF {
+			formats = []Format{GIF}
+		} else if opts.Format == Auto && targetBytes <= gifCandidateMaxBytes && binaryAlpha(original) {
+			formats = append(formats, GIF)
+		}
+		prog.begin(1, len(formats)*len(quantizeColorCounts))
+		for _, format := range formats {
+			r, err := quantizeStrategy(ctx, prog, original, targetBytes, format, opts.PerceptualQuantize, opts.scratch)
+			if ctx.Err() != nil {
+				return nil, prog.abortErr()
+			}
+			if err == nil && r != nil {
+				r.strategy = strategyQuantizePNG
+				if format == GIF {
+					r.strategy = strategyQuantizeGIF
+				}
+				candidates = append(candidates, r)
+			}
 		}
 	}
 
-	if (canUseJPEG || wantJPEG) && ctx.Err() == nil {
-		if r, err := jpegQualityScaleSearch(ctx, original, targetBytes); err == nil && r != nil {
+	if fixedSize {
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("%w: %d bytes not reachable at the fixed %dx%d without scaling",
+				ErrTargetUnreachable, targetBytes, original.Bounds().Dx(), original.Bounds().Dy())
+		}
+	} else if canUseJPEG || wantJPEG {
+		iters := opts.searchIterations(scaleBinaryIterations)
+		prog.begin(2, iters+2+len(fixedScales)+jpegSearchSteps)
+		r, err := jpegQualityScaleSearch(ctx, prog, jpegSrc, probes, targetBytes, iters, tol, opts.Sharpen, opts.resampling())
+		if ctx.Err() != nil {
+			return nil, prog.abortErr()
+		}
+		if err == nil && r != nil {
+			r.strategy = strategyJPEGScale
 			candidates = append(candidates, r)
 		}
 	}
 
-	if len(candidates) == 0 && ctx.Err() == nil {
+	if len(candidates) == 0 {
 		format := opts.Format
 		if format == Auto {
 			format = PNG
@@ -56,40 +139,189 @@ func hitTargetSize(ctx context.Context, original *image.NRGBA, targetBytes int,
 				format = JPEG
 			}
 		}
-		if r, err := scaleSearch(ctx, original, targetBytes, format); err == nil && r != nil {
+		scaleSrc := original
+		if format == JPEG {
+			scaleSrc = jpegSrc
+		}
+		iters := opts.searchIterations(scaleSearchIterations)
+		prog.begin(3, iters)
+		r, err := scaleSearch(ctx, prog, scaleSrc, probes, targetBytes, iters, format, tol, opts.Sharpen, opts.resampling())
+		if ctx.Err() != nil {
+			return nil, prog.abortErr()
+		}
+		if err == nil && r != nil {
+			r.strategy = strategyScaleSearch
 			candidates = append(candidates, r)
 		}
 	}
 
 	if len(candidates) == 0 {
-		return fallbackTargetSizeEncode(original, targetBytes, canUseJPEG || wantJPEG, opts)
+		opts.logf("target size: no strategy fit %d bytes; using fallback", targetBytes)
+		return fallbackTargetSizeEncode(jpegSrc, targetBytes, canUseJPEG || wantJPEG, enc, opts)
+	}
+
+	// On graphics, JPEG's ringing around edges shows more than SSIM says,
+	// so a PNG candidate with nearly the same SSIM wins. The analysis only
+	// matters when both formats are in the running.
+	preferPNG := false
+	for _, c := range candidates {
+		if c.format != candidates[0].format {
+			preferPNG = analyzeFormat(original, opts.AnalysisSamples) == PNG
+			break
+		}
 	}
 
 	var best *sizeResult
 	for _, c := range candidates {
-		if best == nil || betterFit(c, best, targetBytes) {
+		opts.logf("target size: %s gave %v %d bytes at q=%d, %dx%d, ssim=%.4f (target %d)",
+			c.strategy, c.format, len(c.data), c.quality, c.finalW, c.finalH, c.ssim, targetBytes)
+		if best == nil || betterFit(c, best, targetBytes, tol, preferPNG) {
 			best = c
 		}
 	}
+	opts.logf("target size: %s won", best.strategy)
 	return best, nil
 }
 
-func fallbackTargetSizeEncode(original *image.NRGBA, target int, useJPEG bool, opts Options) (*sizeResult, error) {
+// Progress through the target-size search is reported as StageCompressing,
+// spread over [searchProgressStart, searchProgressEnd]. Each of the four
+// strategies owns an equal share, whether or not it runs.
+const (
+	searchProgressStart = 0.2
+	searchProgressEnd   = 0.9
+	searchStrategies    = 4
+)
+
+// jpegSearchSteps is the expected iteration count of a JPEG quality
+// search, used to turn loop steps into a fraction of a strategy's share.
+// Overshooting it only pins progress at the share's end.
+const jpegSearchSteps = 7
+
+// Default iteration caps for the scale binary searches of strategies 3 and
+// 4; Options.SearchIterations overrides both. Either search also stops
+// once its bracket is narrower than a pixel, so small images need fewer.
+const (
+	scaleBinaryIterations = 10
+	scaleSearchIterations = 12
+)
+
+// searchIterations is the iteration cap for a scale search whose default
+// is def.
+func (o *Options) searchIterations(def int) int {
+	if o.SearchIterations > 0 {
+		return o.SearchIterations
+	}
+	return def
+}
+
+// subpixel reports whether the scales in (lo, hi) all give a w×h image
+// the same size to within a pixel, so probing between them is pointless.
+func subpixel(lo, hi float64, w, h int) bool {
+	return (hi-lo)*float64(max(w, h)) < 1
+}
+
+// searchProgress reports target-size search progress through the options'
+// callback. A nil *searchProgress reports nothing, so inner searches that
+// run as part of a bigger step can pass nil.
+type searchProgress struct {
+	ctx    context.Context
+	opts   *Options
+	cancel context.CancelFunc
+	err    error
+
+	start, end  float64
+	done, total int
+}
+
+// begin starts strategy index (0-based) with an expected total of steps.
+func (p *searchProgress) begin(index, total int) {
+	if p == nil {
+		return
+	}
+	share := (searchProgressEnd - searchProgressStart) / searchStrategies
+	p.start = searchProgressStart + share*float64(index)
+	p.end = p.start + share
+	p.done, p.total = 0, total
+	p.report(p.start)
+}
+
+// step records one finished iteration of the current strategy.
+func (p *searchProgress) step() {
+	if p == nil {
+		return
+	}
+	p.done++
+	frac := 1.0
+	if p.done < p.total {
+		frac = float64(p.done) / float64(p.total)
+	}
+	p.report(p.start + (p.end-p.start)*frac)
+}
+
+func (p *searchProgress) report(percent float64) {
+	if p.err != nil {
+		return
+	}
+	if err := p.opts.reportProgress(p.ctx, StageCompressing, percent); err != nil {
+		p.err = err
+		p.cancel()
+	}
+}
+
+// abortErr is the error to return once the search's context is done: the
+// callback's error if it aborted the search, otherwise the caller's.
+func (p *searchProgress) abortErr() error {
+	if p.err != nil {
+		return p.err
+	}
+	return p.ctx.Err()
+}
+
+func fallbackTargetSizeEncode(original *image.NRGBA, target int, useJPEG bool, enc jpegEncoding, opts Options) (*sizeResult, error) {
 	w, h := original.Bounds().Dx(), original.Bounds().Dy()
 	var buf bytes.Buffer
 	if useJPEG {
-		if err := encodeJPEG(&buf, original, 1, false); err != nil {
+		if err := encodeJPEG(&buf, original, 1, enc); err != nil {
 			return nil, fmt.Errorf("fennec: fallback JPEG encode: %w", err)
 		}
-		return &sizeResult{data: buf.Bytes(), format: JPEG, quality: 1, ssim: computeSSIMNRGBA(original, original), finalW: w, finalH: h, img: original}, nil
+		var ssim float64
+		if decoded, err := jpeg.Decode(bytes.NewReader(buf.Bytes())); err == nil {
+			ssim = computeSSIMNRGBA(original, toNRGBARef(decoded), opts.scratch)
+		}
+		return &sizeResult{data: buf.Bytes(), format: JPEG, quality: 1, ssim: ssim, finalW: w, finalH: h, img: original, strategy: strategyFallback}, nil
+	}
+	if opts.Format == GIF {
+		// The fewest colors the quantize strategy tries.
+		stored, err := encodeGIF(&buf, original, quantizeColorCounts[len(quantizeColorCounts)-1], opts.PerceptualQuantize)
+		if err != nil {
+			return nil, fmt.Errorf("fennec: fallback GIF encode: %w", err)
+		}
+		return &sizeResult{data: buf.Bytes(), format: GIF, ssim: computeSSIMNRGBA(original, stored, opts.scratch), finalW: w, finalH: h, img: stored, strategy: strategyFallback}, nil
 	}
-	if err := compressPNG(original, &buf, opts); err != nil {
+	ssim, err := compressPNG(original, &buf, opts)
+	if err != nil {
 		return nil, fmt.Errorf("fennec: fallback PNG encode: %w", err)
 	}
-	return &sizeResult{data: buf.Bytes(), format: PNG, ssim: 1.0, finalW: w, finalH: h, img: original}, nil
+	// LossyPNG may have quantized the output; report the pixels that were
+	// actually written.
+	img := original
+	if ssim < 1.0 {
+		decoded, err := png.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return nil, fmt.Errorf("fennec: fallback PNG decode: %w", err)
+		}
+		img = toNRGBA(decoded)
+	}
+	return &sizeResult{data: buf.Bytes(), format: PNG, ssim: ssim, finalW: w, finalH: h, img: img, strategy: strategyFallback}, nil
 }
 
-func betterFit(candidate, current *sizeResult, target int) bool {
+// betterFit reports whether candidate is a better answer than current.
+// Results under the target beat results over it. With a tolerance band,
+// results inside the band beat those below it, and the larger one (closest
+// to the top of the band) wins. Otherwise higher SSIM, then higher quality.
+// With preferPNG, set for graphic content, a PNG or GIF beats a JPEG whose
+// SSIM is at most graphicSSIMMargin higher.
+func betterFit(candidate, current *sizeResult, target int, tol float64, preferPNG bool) bool {
 	cSize := int64(len(candidate.data))
 	bSize := int64(len(current.data))
 	t := int64(target)
@@ -104,6 +336,20 @@ func betterFit(candidate, current *sizeResult, target int) bool {
 		return false
 	}
 	if cUnder && bUnder {
+		if tol > 0 {
+			cIn := inToleranceBand(cSize, target, tol)
+			bIn := inToleranceBand(bSize, target, tol)
+			if cIn != bIn {
+				return cIn
+			}
+			if cIn && cSize != bSize {
+				return cSize > bSize
+			}
+		}
+		if preferPNG && (candidate.format == JPEG) != (current.format == JPEG) &&
+			math.Abs(candidate.ssim-current.ssim) <= graphicSSIMMargin {
+			return candidate.format != JPEG
+		}
 		if candidate.ssim != current.ssim {
 			return candidate.ssim > current.ssim
 		}
@@ -112,17 +358,33 @@ func betterFit(candidate, current *sizeResult, target int) bool {
 	return cSize < bSize
 }
 
+// graphicSSIMMargin is how much higher a JPEG's SSIM must be to beat a PNG
+// candidate on graphic content (see betterFit).
+const graphicSSIMMargin = 0.01
+
+// inToleranceBand reports whether size falls within [target*(1-tol), target].
+// Always false when tol is 0, so the strict searches are unaffected.
+func inToleranceBand(size int64, target int, tol float64) bool {
+	if tol <= 0 {
+		return false
+	}
+	return size <= int64(target) && float64(size) >= float64(target)*(1-tol)
+}
+
 // ── Strategy 1 ──────────────────────────────────────────────────────────────
 
-func jpegQualitySearch(src *image.NRGBA, targetBytes int) (*sizeResult, error) {
-	return jpegQualitySearchOpt(src, targetBytes, false)
+// jpegQualitySearch finds the JPEG quality whose output fits targetBytes,
+// encoding with the settings in enc (see Options.jpegEncoding) and pooling
+// the buffers of its SSIM checks in s.
+func jpegQualitySearch(ctx context.Context, prog *searchProgress, src *image.NRGBA, targetBytes int, tol float64, enc jpegEncoding, s *scratch) (*sizeResult, error) {
+	return jpegQualitySearchOpt(ctx, prog, src, targetBytes, tol, false, enc, s)
 }
 
-func jpegQualitySearchFast(src *image.NRGBA, targetBytes int) (*sizeResult, error) {
-	return jpegQualitySearchOpt(src, targetBytes, true)
+func jpegQualitySearchFast(ctx context.Context, src *image.NRGBA, targetBytes int, enc jpegEncoding) (*sizeResult, error) {
+	return jpegQualitySearchOpt(ctx, nil, src, targetBytes, 0, true, enc, nil)
 }
 
-func jpegQualitySearchOpt(src *image.NRGBA, targetBytes int, skipSSIM bool) (*sizeResult, error) {
+func jpegQualitySearchOpt(ctx context.Context, prog *searchProgress, src *image.NRGBA, targetBytes int, tol float64, skipSSIM bool, enc jpegEncoding, s *scratch) (*sizeResult, error) {
 	w := src.Bounds().Dx()
 	h := src.Bounds().Dy()
 	pixels := w * h
@@ -144,9 +406,12 @@ func jpegQualitySearchOpt(src *image.NRGBA, targetBytes int, skipSSIM bool) (*si
 	bestSSIM := 0.0
 
 	for lo <= hi {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		mid := (lo + hi) / 2
 		var buf bytes.Buffer
-		if err := encodeJPEG(&buf, src, mid, false); err != nil {
+		if err := encodeJPEG(&buf, src, mid, enc); err != nil {
 			return nil, err
 		}
 
@@ -154,15 +419,20 @@ func jpegQualitySearchOpt(src *image.NRGBA, targetBytes int, skipSSIM bool) (*si
 			bestBuf = copyBytes(buf.Bytes())
 			bestQ = mid
 			if !skipSSIM {
-				decoded := decodeJPEGFromBytes(bestBuf)
+				decoded := decodeJPEGFromBytes(bestBuf, s)
 				if decoded != nil {
-					bestSSIM = computeSSIMNRGBA(src, decoded)
+					bestSSIM = computeSSIMNRGBA(src, decoded, s)
+					s.releaseNRGBA(decoded)
 				}
 			}
+			if inToleranceBand(int64(buf.Len()), targetBytes, tol) {
+				break
+			}
 			lo = mid + 1
 		} else {
 			hi = mid - 1
 		}
+		prog.step()
 	}
 
 	if bestBuf == nil {
@@ -177,26 +447,45 @@ func jpegQualitySearchOpt(src *image.NRGBA, targetBytes int, skipSSIM bool) (*si
 
 // ── Strategy 2 ──────────────────────────────────────────────────────────────
 
-func quantizeStrategy(src *image.NRGBA, targetBytes int) (*sizeResult, error) {
+// quantizeColorCounts are the palette sizes quantizeStrategy tries, largest
+// first.
+var quantizeColorCounts = []int{256, 128, 64, 32, 16}
+
+// quantizeStrategy encodes src as an indexed PNG, or a GIF if format is
+// GIF, at each of quantizeColorCounts and returns the first that fits. Its
+// SSIM check pools buffers in s.
+func quantizeStrategy(ctx context.Context, prog *searchProgress, src *image.NRGBA, targetBytes int, format Format, perceptual bool, s *scratch) (*sizeResult, error) {
 	w := src.Bounds().Dx()
 	h := src.Bounds().Dy()
 
-	for _, maxColors := range []int{256, 128, 64, 32, 16} {
-		palette := medianCut(src, maxColors)
-		indexed := applyPalette(src, palette)
-
+	for _, maxColors := range quantizeColorCounts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		var buf bytes.Buffer
-		encoder := png.Encoder{CompressionLevel: png.BestCompression}
-		if err := encoder.Encode(&buf, indexed); err != nil {
+		var indexed *image.Paletted
+		var quantizedNRGBA *image.NRGBA
+		var err error
+		if format == GIF {
+			quantizedNRGBA, err = encodeGIF(&buf, src, maxColors, perceptual)
+		} else {
+			indexed = applyPalette(src, medianCut(src, maxColors), perceptual)
+			encoder := png.Encoder{CompressionLevel: png.BestCompression}
+			err = encoder.Encode(&buf, indexed)
+		}
+		prog.step()
+		if err != nil {
 			continue
 		}
 
 		if int64(buf.Len()) <= int64(targetBytes) {
-			quantizedNRGBA := palettedToNRGBA(indexed)
-			ssim := computeSSIMNRGBA(src, quantizedNRGBA)
+			if quantizedNRGBA == nil {
+				quantizedNRGBA = palettedToNRGBA(indexed)
+			}
+			ssim := computeSSIMNRGBA(src, quantizedNRGBA, s)
 
 			return &sizeResult{
-				data: buf.Bytes(), format: PNG, quality: 0,
+				data: buf.Bytes(), format: format, quality: 0,
 				ssim: ssim, finalW: w, finalH: h, img: quantizedNRGBA,
 			}, nil
 		}
@@ -207,25 +496,35 @@ func quantizeStrategy(src *image.NRGBA, targetBytes int) (*sizeResult, error) {
 
 // ── Strategy 3 ──────────────────────────────────────────────────────────────
 
-func jpegQualityScaleSearch(ctx context.Context, src *image.NRGBA, targetBytes int) (*sizeResult, error) {
+// jpegQualityScaleSearch finds the largest downscale that fits at an
+// acceptable JPEG quality. The final resize, interpolated as rs selects, is
+// sharpened by sharpen (0 = off) before the quality search, so the sharper
+// detail is what gets encoded.
+func jpegQualityScaleSearch(ctx context.Context, prog *searchProgress, src *image.NRGBA, probes *scaleProbes, targetBytes, iters int, tol, sharpen float64, rs resampling) (*sizeResult, error) {
 	origW, origH := src.Bounds().Dx(), src.Bounds().Dy()
-	bestCand := findBestScaleBinary(ctx, src, origW, origH, targetBytes)
-	bestCand = findBestScaleFixed(ctx, src, origW, origH, targetBytes, bestCand)
+	bestCand := findBestScaleBinary(ctx, prog, probes, origW, origH, targetBytes, iters, tol)
+	bestCand = findBestScaleFixed(ctx, prog, probes, origW, origH, targetBytes, bestCand)
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if bestCand == nil {
 		return nil, nil
 	}
 
 	finalW := int(float64(origW) * bestCand.scale)
 	finalH := int(float64(origH) * bestCand.scale)
-	finalScaled := lanczosResize(src, finalW, finalH)
+	finalScaled := AdaptiveSharpen(lanczosResizeAlpha(src, finalW, finalH, rs), sharpen)
 
-	r, err := jpegQualitySearch(finalScaled, targetBytes)
-	if err != nil || r == nil || r.quality < minJPEGQuality {
+	r, err := jpegQualitySearch(ctx, prog, finalScaled, targetBytes, tol, probes.enc, rs.s)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil || r.quality < minJPEGQuality {
 		return nil, nil
 	}
 
-	r.ssim = computeSSIMNRGBA(src, finalScaled)
+	r.ssim = computeSSIMNRGBA(src, finalScaled, rs.s)
 	r.finalW, r.finalH = finalW, finalH
 	r.img = finalScaled
 	return r, nil
@@ -237,44 +536,194 @@ type scaleCandidate struct {
 	size    int
 }
 
-func findBestScaleBinary(ctx context.Context, src *image.NRGBA, origW, origH, targetBytes int) *scaleCandidate {
+// scaleProbes memoizes fast JPEG quality searches on box-downsampled copies
+// of one source image. The source and target are fixed for a target-size
+// run, so a probe is fully determined by its pixel dimensions, and the
+// binary, fixed-ladder, and scale-only searches often land on the same
+// sizes (they share midpoints, and nearby scales truncate to equal sizes).
+type scaleProbes struct {
+	src         *image.NRGBA
+	targetBytes int
+	enc         jpegEncoding // downsampling keeps a gray source gray
+	results     map[image.Point]*sizeResult
+}
+
+func newScaleProbes(src *image.NRGBA, targetBytes int, enc jpegEncoding) *scaleProbes {
+	return &scaleProbes{src: src, targetBytes: targetBytes, enc: enc, results: make(map[image.Point]*sizeResult)}
+}
+
+// jpeg returns the fast quality-search result for src downsampled to w×h,
+// or nil if the search failed. A probe cut short by ctx isn't memoized.
+func (p *scaleProbes) jpeg(ctx context.Context, w, h int) *sizeResult {
+	key := image.Pt(w, h)
+	if r, ok := p.results[key]; ok {
+		return r
+	}
+	r, err := jpegQualitySearchFast(ctx, boxDownsample(p.src, w, h), p.targetBytes, p.enc)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		r = nil
+	}
+	p.results[key] = r
+	return r
+}
+
+// fitsJPEG reports whether the w×h probe fits the target at an acceptable
+// quality, along with its quality and size.
+func (p *scaleProbes) fitsJPEG(ctx context.Context, w, h int) (bool, int, int) {
+	r := p.jpeg(ctx, w, h)
+	if r != nil && int64(len(r.data)) <= int64(p.targetBytes) && r.quality >= minJPEGQuality {
+		return true, r.quality, len(r.data)
+	}
+	return false, 0, 0
+}
+
+// minScale and scaleResolution bound the scale binary searches: ten
+// halvings of [minScale, 1] is the finest step worth probing.
+const (
+	minScale        = 0.05
+	scaleResolution = (1 - minScale) / 1024
+)
+
+// scaleBracket is how far past the predicted scale the second probe
+// reaches. A prediction within this factor leaves a bracket a fraction of
+// the full range wide; a worse one costs only those two probes.
+const scaleBracket = 1.25
+
+// findBestScaleBinary finds the largest scale whose JPEG fits the target,
+// seeding the search with predictJPEGScale and then bisecting for at most
+// iters more probes.
+func findBestScaleBinary(ctx context.Context, prog *searchProgress, probes *scaleProbes, origW, origH, targetBytes, iters int, tol float64) *scaleCandidate {
 	var bestCand *scaleCandidate
-	loScale, hiScale := 0.05, 1.0
-	for i := 0; i < 10; i++ {
+	loScale, hiScale := minScale, 1.0
+
+	// probe reports whether the scale fits, recording it as the best so
+	// far, and narrows the bounds. It returns true once the search is done.
+	probe := func(scale float64) bool {
+		newW, newH := int(float64(origW)*scale), int(float64(origH)*scale)
+		if newW < 8 || newH < 8 {
+			loScale = scale
+			return false
+		}
+		fits, q, size := probes.fitsJPEG(ctx, newW, newH)
+		prog.step()
+		if fits {
+			bestCand = &scaleCandidate{scale: scale, quality: q, size: size}
+			if inToleranceBand(int64(size), targetBytes, tol) {
+				return true
+			}
+			loScale = scale
+		} else {
+			hiScale = scale
+		}
+		return false
+	}
+
+	// Seed the search at the predicted scale, then step once past it in
+	// whichever direction the answer lies.
+	guess := predictJPEGScale(probes.src, targetBytes)
+	if guess > loScale && guess < hiScale && ctx.Err() == nil {
+		if probe(guess) {
+			return bestCand
+		}
+		next := guess / scaleBracket
+		if loScale == guess {
+			next = guess * scaleBracket
+		}
+		if next > loScale && next < hiScale && ctx.Err() == nil && probe(next) {
+			return bestCand
+		}
+	}
+
+	for i := 0; i < iters && hiScale-loScale >= scaleResolution && !subpixel(loScale, hiScale, origW, origH); i++ {
 		if ctx.Err() != nil {
 			break
 		}
-		midScale := (loScale + hiScale) / 2
-		newW, newH := int(float64(origW)*midScale), int(float64(origH)*midScale)
-		if newW < 8 || newH < 8 {
-			loScale = midScale
-			continue
+		if probe((loScale + hiScale) / 2) {
+			break
 		}
-		r, err := jpegQualitySearchFast(boxDownsample(src, newW, newH), targetBytes)
-		if err == nil && r != nil && int64(len(r.data)) <= int64(targetBytes) && r.quality >= minJPEGQuality {
-			bestCand = &scaleCandidate{scale: midScale, quality: r.quality, size: len(r.data)}
-			loScale = midScale
+	}
+	return bestCand
+}
+
+// jpegHeaderBytes approximates the fixed cost of a baseline JPEG's
+// headers, quantization and Huffman tables.
+const jpegHeaderBytes = 600
+
+// predictJPEGScale estimates, without encoding, the scale at which src
+// encodes to targetBytes as a JPEG at minJPEGQuality. Bytes per pixel are
+// modeled from luminance entropy and edge density. Fine detail often
+// doesn't survive downscaling, so after a first guess from the source the
+// statistics are re-measured on a box-downsampled copy at the guessed
+// size. The estimate only seeds the scale search, so it needs to be close,
+// not exact. It returns 0 when there is nothing to predict.
+func predictJPEGScale(src *image.NRGBA, targetBytes int) float64 {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w == 0 || h == 0 || targetBytes <= jpegHeaderBytes {
+		return 0
+	}
+
+	img := src
+	scale := 0.0
+	for i := 0; i < 3; i++ {
+		bpp := 0.012 + 0.002*sampledEntropy(img) + 0.12*computeEdgeDensity(img, defaultEdgeThreshold)
+		next := math.Sqrt(float64(targetBytes-jpegHeaderBytes) / (bpp * float64(w*h)))
+		// Damp the refinement: detail that appears or vanishes between
+		// sizes would otherwise make the guess oscillate.
+		if scale == 0 {
+			scale = next
 		} else {
-			hiScale = midScale
+			scale = math.Sqrt(scale * next)
+		}
+
+		sw, sh := int(float64(w)*scale), int(float64(h)*scale)
+		if scale >= 1 || sw < 8 || sh < 8 {
+			break
 		}
+		img = boxDownsample(src, sw, sh)
 	}
-	return bestCand
+	return scale
 }
 
-func findBestScaleFixed(ctx context.Context, src *image.NRGBA, origW, origH, targetBytes int, best *scaleCandidate) *scaleCandidate {
-	for _, scale := range []float64{0.75, 0.50, 0.375, 0.25} {
+// sampledEntropy is the luminance entropy of img on the same sampling grid
+// computeEdgeDensity uses.
+func sampledEntropy(img *image.NRGBA) float64 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	stepX := int(math.Max(1, float64(w)/200))
+	stepY := int(math.Max(1, float64(h)/200))
+	var histogram [256]float64
+	var samples float64
+	for y := 0; y < h; y += stepY {
+		for x := 0; x < w; x += stepX {
+			histogram[int(sobelLum(img, x, y)+0.5)]++
+			samples++
+		}
+	}
+	return computeEntropy(histogram[:], samples)
+}
+
+// fixedScales are the scales findBestScaleFixed probes after the binary
+// search.
+var fixedScales = []float64{0.75, 0.50, 0.375, 0.25}
+
+func findBestScaleFixed(ctx context.Context, prog *searchProgress, probes *scaleProbes, origW, origH, targetBytes int, best *scaleCandidate) *scaleCandidate {
+	for _, scale := range fixedScales {
 		if ctx.Err() != nil {
 			break
 		}
+		prog.step()
+		// A probe at or below the best scale so far can't replace it.
+		if best != nil && scale <= best.scale {
+			continue
+		}
 		newW, newH := int(float64(origW)*scale), int(float64(origH)*scale)
 		if newW < 8 || newH < 8 {
 			continue
 		}
-		r, err := jpegQualitySearchFast(boxDownsample(src, newW, newH), targetBytes)
-		if err == nil && r != nil && int64(len(r.data)) <= int64(targetBytes) && r.quality >= minJPEGQuality {
-			if best == nil || scale > best.scale {
-				best = &scaleCandidate{scale: scale, quality: r.quality, size: len(r.data)}
-			}
+		if fits, q, size := probes.fitsJPEG(ctx, newW, newH); fits {
+			best = &scaleCandidate{scale: scale, quality: q, size: size}
 		}
 	}
 	return best
@@ -282,24 +731,36 @@ func findBestScaleFixed(ctx context.Context, src *image.NRGBA, origW, origH, tar
 
 // ── Strategy 4 ──────────────────────────────────────────────────────────────
 
-func scaleSearch(ctx context.Context, src *image.NRGBA, targetBytes int, format Format) (*sizeResult, error) {
+func scaleSearch(ctx context.Context, prog *searchProgress, src *image.NRGBA, probes *scaleProbes, targetBytes, iters int, format Format, tol, sharpen float64, rs resampling) (*sizeResult, error) {
 	origW, origH := src.Bounds().Dx(), src.Bounds().Dy()
 	lo, hi, bestScale, bestQ := 0.05, 1.0, 0.0, 0
 
-	for i := 0; i < 12; i++ {
-		if ctx.Err() != nil {
-			break
+	for i := 0; i < iters && !subpixel(lo, hi, origW, origH); i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
 		mid := (lo + hi) / 2
 		newW, newH := int(float64(origW)*mid), int(float64(origH)*mid)
-		if newW < 1 || newH < 1 {
+		// Like the other scale searches, stop at 8px: smaller output is
+		// useless, and a tiny target would otherwise walk down to it.
+		if newW < 8 || newH < 8 {
 			lo = mid
 			continue
 		}
 
-		fits, q := testScaleFits(boxDownsample(src, newW, newH), targetBytes, format)
+		var fits bool
+		var q, size int
+		if format == JPEG {
+			fits, q, size = probes.fitsJPEG(ctx, newW, newH)
+		} else {
+			fits, q, size = testScaleFits(ctx, boxDownsample(src, newW, newH), targetBytes, format, probes.enc)
+		}
+		prog.step()
 		if fits {
 			bestScale, bestQ, lo = mid, q, mid
+			if inToleranceBand(int64(size), targetBytes, tol) {
+				break
+			}
 		} else {
 			hi = mid
 		}
@@ -309,116 +770,145 @@ func scaleSearch(ctx context.Context, src *image.NRGBA, targetBytes int, format
 		return nil, nil
 	}
 	finalW, finalH := int(float64(origW)*bestScale), int(float64(origH)*bestScale)
-	return executeFinalScaleEncode(src, format, bestScale, bestQ, finalW, finalH, targetBytes)
+	return executeFinalScaleEncode(ctx, src, format, bestQ, finalW, finalH, targetBytes, sharpen, rs, probes.enc)
 }
 
-func testScaleFits(scaled *image.NRGBA, targetBytes int, format Format) (bool, int) {
+func testScaleFits(ctx context.Context, scaled *image.NRGBA, targetBytes int, format Format, enc jpegEncoding) (bool, int, int) {
 	if format == JPEG {
-		if r, err := jpegQualitySearchFast(scaled, targetBytes); err == nil && r != nil && int64(len(r.data)) <= int64(targetBytes) && r.quality >= minJPEGQuality {
-			return true, r.quality
+		if r, err := jpegQualitySearchFast(ctx, scaled, targetBytes, enc); err == nil && r != nil && int64(len(r.data)) <= int64(targetBytes) && r.quality >= minJPEGQuality {
+			return true, r.quality, len(r.data)
 		}
-		return false, 0
+		return false, 0, 0
 	}
 	var buf bytes.Buffer
-	encoder := png.Encoder{CompressionLevel: png.BestCompression}
-	if err := encoder.Encode(&buf, scaled); err == nil && int64(buf.Len()) <= int64(targetBytes) {
-		return true, 0
+	var err error
+	if format == GIF {
+		_, err = encodeGIF(&buf, scaled, 256, false)
+	} else {
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		err = encoder.Encode(&buf, scaled)
 	}
-	return false, 0
+	if err == nil && int64(buf.Len()) <= int64(targetBytes) {
+		return true, 0, buf.Len()
+	}
+	return false, 0, 0
 }
 
-func executeFinalScaleEncode(src *image.NRGBA, format Format, scale float64, bestQ, finalW, finalH, targetBytes int) (*sizeResult, error) {
-	scaled := lanczosResize(src, finalW, finalH)
+// executeFinalScaleEncode resizes src to finalW×finalH with Lanczos,
+// interpolated as rs selects, optionally sharpens it, and encodes the
+// result.
+func executeFinalScaleEncode(ctx context.Context, src *image.NRGBA, format Format, bestQ, finalW, finalH, targetBytes int, sharpen float64, rs resampling, enc jpegEncoding) (*sizeResult, error) {
+	scaled := lanczosResizeAlpha(src, finalW, finalH, rs)
+	if sharpen > 0 && format != JPEG {
+		// The scale was chosen without sharpening, and PNG and GIF have no
+		// quality knob to absorb the extra bytes: keep the sharpened
+		// version only if it still fits.
+		sharpened := AdaptiveSharpen(scaled, sharpen)
+		if fits, _, _ := testScaleFits(ctx, sharpened, targetBytes, format, jpegEncoding{}); fits {
+			scaled = sharpened
+		}
+	} else {
+		scaled = AdaptiveSharpen(scaled, sharpen)
+	}
 	var buf bytes.Buffer
 	if format == JPEG {
-		r, err := jpegQualitySearchFast(scaled, targetBytes)
+		r, err := jpegQualitySearchFast(ctx, scaled, targetBytes, enc)
+		if err != nil && ctx.Err() != nil {
+			return nil, err
+		}
 		if err == nil && r != nil {
-			return &sizeResult{data: r.data, format: JPEG, quality: r.quality, ssim: computeSSIMNRGBA(src, scaled), finalW: finalW, finalH: finalH, img: scaled}, nil
+			return &sizeResult{data: r.data, format: JPEG, quality: r.quality, ssim: computeSSIMNRGBA(src, scaled, rs.s), finalW: finalW, finalH: finalH, img: scaled}, nil
 		}
-		if err := encodeJPEG(&buf, scaled, bestQ, false); err != nil {
+		if err := encodeJPEG(&buf, scaled, bestQ, enc); err != nil {
 			return nil, err
 		}
+	} else if format == GIF {
+		stored, err := encodeGIF(&buf, scaled, 256, false)
+		if err != nil {
+			return nil, err
+		}
+		return &sizeResult{data: buf.Bytes(), format: GIF, ssim: computeSSIMNRGBA(src, stored, rs.s), finalW: finalW, finalH: finalH, img: stored}, nil
 	} else {
 		encoder := png.Encoder{CompressionLevel: png.BestCompression}
 		if err := encoder.Encode(&buf, scaled); err != nil {
 			return nil, err
 		}
 	}
-	return &sizeResult{data: buf.Bytes(), format: format, quality: bestQ, ssim: computeSSIMNRGBA(src, scaled), finalW: finalW, finalH: finalH, img: scaled}, nil
+	return &sizeResult{data: buf.Bytes(), format: format, quality: bestQ, ssim: computeSSIMNRGBA(src, scaled, rs.s), finalW: finalW, finalH: finalH, img: scaled}, nil
 }
 
 // ── Median-Cut Color Quantizer ──────────────────────────────────────────────
 
+// colorBox is a box in RGBA space holding the sampled pixels it covers.
+// Alpha is a fourth axis so transparent and soft-edged pixels get their own
+// palette entries instead of being flattened to opaque.
 type colorBox struct {
-	pixels     [][3]uint8
-	rMin, rMax uint8
-	gMin, gMax uint8
-	bMin, bMax uint8
+	pixels [][4]uint8
+	min    [4]uint8
+	max    [4]uint8
 }
 
-func newColorBox(pixels [][3]uint8) *colorBox {
+func newColorBox(pixels [][4]uint8) *colorBox {
 	box := &colorBox{
 		pixels: pixels,
-		rMin:   255, gMin: 255, bMin: 255,
+		min:    [4]uint8{255, 255, 255, 255},
 	}
 	for _, p := range pixels {
-		if p[0] < box.rMin {
-			box.rMin = p[0]
-		}
-		if p[0] > box.rMax {
-			box.rMax = p[0]
-		}
-		if p[1] < box.gMin {
-			box.gMin = p[1]
-		}
-		if p[1] > box.gMax {
-			box.gMax = p[1]
-		}
-		if p[2] < box.bMin {
-			box.bMin = p[2]
-		}
-		if p[2] > box.bMax {
-			box.bMax = p[2]
+		for c := 0; c < 4; c++ {
+			if p[c] < box.min[c] {
+				box.min[c] = p[c]
+			}
+			if p[c] > box.max[c] {
+				box.max[c] = p[c]
+			}
 		}
 	}
 	return box
 }
 
 func (b *colorBox) longestAxis() int {
-	rRange := int(b.rMax) - int(b.rMin)
-	gRange := int(b.gMax) - int(b.gMin)
-	bRange := int(b.bMax) - int(b.bMin)
-	if rRange >= gRange && rRange >= bRange {
-		return 0
-	}
-	if gRange >= bRange {
-		return 1
+	axis, best := 0, -1
+	for c := 0; c < 4; c++ {
+		if r := int(b.max[c]) - int(b.min[c]); r > best {
+			axis, best = c, r
+		}
 	}
-	return 2
+	return axis
 }
 
 func (b *colorBox) average() color.NRGBA {
 	if len(b.pixels) == 0 {
 		return color.NRGBA{0, 0, 0, 255}
 	}
-	var rSum, gSum, bSum int64
+	// Weight color by alpha so nearly transparent pixels don't skew the hue.
+	var rSum, gSum, bSum, aSum int64
 	for _, p := range b.pixels {
-		rSum += int64(p[0])
-		gSum += int64(p[1])
-		bSum += int64(p[2])
+		a := int64(p[3])
+		rSum += int64(p[0]) * a
+		gSum += int64(p[1]) * a
+		bSum += int64(p[2]) * a
+		aSum += a
 	}
 	n := int64(len(b.pixels))
+	if aSum == 0 {
+		return color.NRGBA{}
+	}
 	return color.NRGBA{
-		R: uint8(rSum / n), G: uint8(gSum / n), B: uint8(bSum / n), A: 255,
+		R: uint8(rSum / aSum), G: uint8(gSum / aSum), B: uint8(bSum / aSum), A: uint8(aSum / n),
 	}
 }
 
 func (b *colorBox) volume() int {
-	return (int(b.rMax) - int(b.rMin) + 1) *
-		(int(b.gMax) - int(b.gMin) + 1) *
-		(int(b.bMax) - int(b.bMin) + 1)
+	v := 1
+	for c := 0; c < 4; c++ {
+		v *= int(b.max[c]) - int(b.min[c]) + 1
+	}
+	return v
 }
 
+// medianCut builds a palette of at most maxColors RGBA colors. For images
+// with transparency the palette has non-opaque entries, which the PNG
+// encoder writes as a tRNS chunk.
 func medianCut(img *image.NRGBA, maxColors int) color.Palette {
 	bounds := img.Bounds()
 	w, h := bounds.Dx(), bounds.Dy()
@@ -432,19 +922,28 @@ func medianCut(img *image.NRGBA, maxColors int) color.Palette {
 		}
 	}
 
-	pixels := make([][3]uint8, 0, w*h/step)
-	for i := 0; i < w*h; i += step {
-		off := i * 4
-		if off+3 < len(img.Pix) {
-			pixels = append(pixels, [3]uint8{img.Pix[off], img.Pix[off+1], img.Pix[off+2]})
+	// Fully transparent pixels get a reserved palette entry so they stay
+	// exactly transparent instead of averaging with soft edges.
+	transparent := false
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] == 0 {
+			transparent = true
+			maxColors--
+			break
 		}
 	}
 
+	pixels := samplePixels(img.Pix, w*h, step)
+
 	if len(pixels) == 0 {
+		if transparent {
+			return color.Palette{color.NRGBA{}}
+		}
 		return color.Palette{color.NRGBA{0, 0, 0, 255}}
 	}
 
 	boxes := []*colorBox{newColorBox(pixels)}
+	scratch := make([][4]uint8, len(pixels))
 
 	for len(boxes) < maxColors {
 		bestIdx := -1
@@ -466,9 +965,7 @@ func medianCut(img *image.NRGBA, maxColors int) color.Palette {
 		box := boxes[bestIdx]
 		axis := box.longestAxis()
 
-		sort.Slice(box.pixels, func(i, j int) bool {
-			return box.pixels[i][axis] < box.pixels[j][axis]
-		})
+		sortByAxis(box.pixels, scratch[:len(box.pixels)], axis)
 
 		mid := len(box.pixels) / 2
 		left := newColorBox(box.pixels[:mid])
@@ -478,67 +975,165 @@ func medianCut(img *image.NRGBA, maxColors int) color.Palette {
 		boxes = append(boxes, right)
 	}
 
-	palette := make(color.Palette, len(boxes))
-	for i, box := range boxes {
-		palette[i] = box.average()
+	palette := make(color.Palette, 0, len(boxes)+1)
+	for _, box := range boxes {
+		palette = append(palette, box.average())
+	}
+	if transparent {
+		palette = append(palette, color.NRGBA{})
 	}
 	return palette
 }
 
-func applyPalette(src *image.NRGBA, palette color.Palette) *image.Paletted {
+// samplePixels collects every step-th non-transparent pixel of the first n
+// pixels in pix. Chunks are gathered concurrently and joined in order, so
+// the result matches a sequential scan.
+func samplePixels(pix []uint8, n, step int) [][4]uint8 {
+	samples := (n + step - 1) / step
+	chunks := runtime.GOMAXPROCS(0)
+	if chunks > samples {
+		chunks = samples
+	}
+	parts := make([][][4]uint8, chunks)
+	parallelDo(0, chunks, func(c int) {
+		lo, hi := c*samples/chunks, (c+1)*samples/chunks
+		part := make([][4]uint8, 0, hi-lo)
+		for s := lo; s < hi; s++ {
+			off := s * step * 4
+			if off+3 < len(pix) && pix[off+3] != 0 {
+				part = append(part, [4]uint8{pix[off], pix[off+1], pix[off+2], pix[off+3]})
+			}
+		}
+		parts[c] = part
+	})
+
+	total := 0
+	for _, part := range parts {
+		total += len(part)
+	}
+	pixels := make([][4]uint8, 0, total)
+	for _, part := range parts {
+		pixels = append(pixels, part...)
+	}
+	return pixels
+}
+
+// sortByAxis orders pixels by one channel with a stable counting sort,
+// using scratch (same length as pixels) as the temporary buffer. It runs in
+// linear time and is stable, so equal values keep their sampling order.
+func sortByAxis(pixels, scratch [][4]uint8, axis int) {
+	var offsets [257]int
+	for _, p := range pixels {
+		offsets[int(p[axis])+1]++
+	}
+	for i := 1; i < len(offsets); i++ {
+		offsets[i] += offsets[i-1]
+	}
+	for _, p := range pixels {
+		v := p[axis]
+		scratch[offsets[v]] = p
+		offsets[v]++
+	}
+	copy(pixels, scratch)
+}
+
+// applyPalette maps each pixel to its nearest palette entry. Distance is
+// measured on premultiplied RGB plus alpha, so all fully transparent pixels
+// match the same entry regardless of their (meaningless) color.
+func applyPalette(src *image.NRGBA, palette color.Palette, perceptual bool) *image.Paletted {
 	bounds := src.Bounds()
 	w, h := bounds.Dx(), bounds.Dy()
 
 	indexed := image.NewPaletted(bounds, palette)
 
-	type cacheKey struct{ r, g, b uint8 }
-	cache := make(map[cacheKey]uint8, 256)
-
-	for y := 0; y < h; y++ {
-		for x := 0; x < w; x++ {
-			off := y*src.Stride + x*4
-			r, g, b := src.Pix[off], src.Pix[off+1], src.Pix[off+2]
+	pal := make([][4]int, len(palette))
+	var labPal []labColor
+	if perceptual {
+		labPal = make([]labColor, len(palette))
+	}
+	for i, c := range palette {
+		n := color.NRGBAModel.Convert(c).(color.NRGBA)
+		pal[i] = premultiplied(n.R, n.G, n.B, n.A)
+		if perceptual {
+			labPal[i] = toLab(n.R, n.G, n.B, n.A)
+		}
+	}
 
-			key := cacheKey{r, g, b}
-			if idx, ok := cache[key]; ok {
-				indexed.Pix[y*indexed.Stride+x] = idx
-				continue
-			}
+	// Rows are split into one band per worker, each with its own lookup
+	// cache, so no locking is needed. The nearest-entry search breaks ties
+	// by lowest index, so the output doesn't depend on the banding.
+	type cacheKey struct{ r, g, b, a uint8 }
+	bands := runtime.GOMAXPROCS(0)
+	if bands > h {
+		bands = h
+	}
+	parallelDo(0, bands, func(band int) {
+		cache := make(map[cacheKey]uint8, 256)
+		for y := band * h / bands; y < (band+1)*h/bands; y++ {
+			for x := 0; x < w; x++ {
+				off := y*src.Stride + x*4
+				r, g, b, a := src.Pix[off], src.Pix[off+1], src.Pix[off+2], src.Pix[off+3]
+
+				key := cacheKey{r, g, b, a}
+				if idx, ok := cache[key]; ok {
+					indexed.Pix[y*indexed.Stride+x] = idx
+					continue
+				}
 
-			bestIdx := 0
-			bestDist := math.MaxInt32
-			for i, c := range palette {
-				pr, pg, pb, _ := c.RGBA()
-				dr := int(r) - int(pr>>8)
-				dg := int(g) - int(pg>>8)
-				db := int(b) - int(pb>>8)
-				dist := dr*dr + dg*dg + db*db
-				if dist < bestDist {
-					bestDist = dist
-					bestIdx = i
+				var idx uint8
+				if perceptual {
+					idx = nearestEntryPerceptual(labPal, toLab(r, g, b, a))
+				} else {
+					idx = nearestEntry(pal, premultiplied(r, g, b, a))
 				}
+				cache[key] = idx
+				indexed.Pix[y*indexed.Stride+x] = idx
 			}
+		}
+	})
+	return indexed
+}
 
-			cache[key] = uint8(bestIdx)
-			indexed.Pix[y*indexed.Stride+x] = uint8(bestIdx)
+// nearestEntry returns the index of the palette entry closest to p.
+func nearestEntry(pal [][4]int, p [4]int) uint8 {
+	bestIdx := 0
+	bestDist := math.MaxInt32
+	for i, q := range pal {
+		dr := p[0] - q[0]
+		dg := p[1] - q[1]
+		db := p[2] - q[2]
+		da := p[3] - q[3]
+		dist := dr*dr + dg*dg + db*db + da*da
+		if dist < bestDist {
+			bestDist = dist
+			bestIdx = i
 		}
 	}
-	return indexed
+	return uint8(bestIdx)
+}
+
+func premultiplied(r, g, b, a uint8) [4]int {
+	return [4]int{int(r) * int(a) / 255, int(g) * int(a) / 255, int(b) * int(a) / 255, int(a)}
 }
 
 func palettedToNRGBA(p *image.Paletted) *image.NRGBA {
 	bounds := p.Bounds()
 	w, h := bounds.Dx(), bounds.Dy()
-	dst := image.NewNRGBA(bounds)
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	pal := make([]color.NRGBA, len(p.Palette))
+	for i, c := range p.Palette {
+		pal[i] = color.NRGBAModel.Convert(c).(color.NRGBA)
+	}
 
 	for y := 0; y < h; y++ {
 		for x := 0; x < w; x++ {
-			r, g, b, a := p.At(x+bounds.Min.X, y+bounds.Min.Y).RGBA()
+			c := pal[p.Pix[y*p.Stride+x]]
 			off := y*dst.Stride + x*4
-			dst.Pix[off] = uint8(r >> 8)
-			dst.Pix[off+1] = uint8(g >> 8)
-			dst.Pix[off+2] = uint8(b >> 8)
-			dst.Pix[off+3] = uint8(a >> 8)
+			dst.Pix[off] = c.R
+			dst.Pix[off+1] = c.G
+			dst.Pix[off+2] = c.B
+			dst.Pix[off+3] = c.A
 		}
 	}
 	return dst
@@ -552,17 +1147,25 @@ func copyBytes(src []byte) []byte {
 	return dst
 }
 
-func decodeJPEGFromBytes(data []byte) *image.NRGBA {
+// decodeJPEGFromBytes decodes data into an image pooled in s; release it
+// with s.releaseNRGBA once done.
+func decodeJPEGFromBytes(data []byte, s *scratch) *image.NRGBA {
 	img, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
 		return nil
 	}
-	return toNRGBARef(img)
+	dst := s.tempNRGBA(img.Bounds().Dx(), img.Bounds().Dy())
+	convertToNRGBAInto(dst, img)
+	return dst
 }
 
-func computeSSIMNRGBA(a, b *image.NRGBA) float64 {
+// computeSSIMNRGBA is SSIMFast with its buffers pooled in s, resizing b to
+// a's dimensions first if they differ.
+func computeSSIMNRGBA(a, b *image.NRGBA, s *scratch) float64 {
 	if a.Bounds().Dx() != b.Bounds().Dx() || a.Bounds().Dy() != b.Bounds().Dy() {
 		b = lanczosResize(b, a.Bounds().Dx(), a.Bounds().Dy())
 	}
-	return SSIMFast(a, b)
+	ref := newSSIMRef(a, s)
+	defer ref.release()
+	return ref.compare(b)
 }
@@ -1,6 +1,9 @@
 package fennec
 
 import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
 	"image"
 	"image/color"
 	"image/jpeg"
@@ -11,6 +14,11 @@ import (
 )
 
 func TestGenerateTestData(t *testing.T) {
+	generateTestData(t)
+}
+
+func generateTestData(t *testing.T) {
+	t.Helper()
 	dir := "testdata"
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		t.Fatalf("mkdir testdata: %v", err)
@@ -21,6 +29,8 @@ func TestGenerateTestData(t *testing.T) {
 	genIfMissing(t, filepath.Join(dir, "fewcolors.png"), generateFewColors)
 	genIfMissing(t, filepath.Join(dir, "large_photo.jpg"), generateLargePhoto)
 	genIfMissing(t, filepath.Join(dir, "grayscale.png"), generateGrayscale)
+	genIfMissing(t, filepath.Join(dir, "scan.tif"), generateScanTIFF)
+	genIfMissing(t, filepath.Join(dir, "bitmap.bmp"), generateBMP)
 }
 
 func generateGradient(path string) {
@@ -111,3 +121,266 @@ func genIfMissing(t *testing.T, path string, gen func(string)) {
 	}
 	gen(path)
 }
+
+func generateScanTIFF(path string) {
+	// A grayscale "document": text-like bars on white, LZW-compressed with
+	// a predictor in 16-row strips, as scanners write it.
+	img := image.NewGray(image.Rect(0, 0, 240, 320))
+	for y := 0; y < 320; y++ {
+		for x := 0; x < 240; x++ {
+			v := uint8(250)
+			if y%20 < 8 && x > 20 && x < 220 && (x/6+y/20)%5 != 0 {
+				v = 30
+			}
+			img.Pix[y*img.Stride+x] = v
+		}
+	}
+	os.WriteFile(path, encodeTestTIFF(img, tiffLZW, true, 16), 0644)
+}
+
+func generateBMP(path string) {
+	img := image.NewNRGBA(image.Rect(0, 0, 150, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 150; x++ {
+			off := y*img.Stride + x*4
+			copy(img.Pix[off:off+4], []uint8{uint8(x * 255 / 150), uint8(y * 255 / 100), 0x80, 0xff})
+		}
+	}
+	os.WriteFile(path, encodeTestBMP(img), 0644)
+}
+
+// encodeTestBMP writes img as a bottom-up 24-bit BMP.
+func encodeTestBMP(img *image.NRGBA) []byte {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	stride := (w*3 + 3) &^ 3
+	buf := make([]byte, 54+stride*h)
+	le := binary.LittleEndian
+	copy(buf, "BM")
+	le.PutUint32(buf[2:], uint32(len(buf)))
+	le.PutUint32(buf[10:], 54)
+	le.PutUint32(buf[14:], 40)
+	le.PutUint32(buf[18:], uint32(w))
+	le.PutUint32(buf[22:], uint32(h))
+	le.PutUint16(buf[26:], 1)
+	le.PutUint16(buf[28:], 24)
+	for y := 0; y < h; y++ {
+		row := buf[54+(h-1-y)*stride:]
+		for x := 0; x < w; x++ {
+			c := img.NRGBAAt(x, y)
+			row[x*3], row[x*3+1], row[x*3+2] = c.B, c.G, c.R
+		}
+	}
+	return buf
+}
+
+// encodeTestTIFF writes a little-endian strip TIFF of an *image.Gray, an
+// *image.Gray16, or an opaque *image.NRGBA (as RGB) with the given
+// compression. The predictor only works for 8-bit samples.
+func encodeTestTIFF(img image.Image, compression int, predictor bool, rowsPerStrip int) []byte {
+	return encodeTestTIFFPages([]image.Image{img}, compression, predictor, rowsPerStrip)
+}
+
+// encodeTestTIFFPages writes imgs as the pages of one TIFF, as
+// encodeTestTIFF does for a single image.
+func encodeTestTIFFPages(imgs []image.Image, compression int, predictor bool, rowsPerStrip int) []byte {
+	out := make([]byte, 8, 1024)
+	copy(out, "II*\x00")
+	link := 4 // where the offset of the next page's IFD goes
+	for _, img := range imgs {
+		out, link = appendTestTIFFPage(out, img, compression, predictor, rowsPerStrip, link)
+	}
+	return out
+}
+
+// appendTestTIFFPage appends the strips and IFD of one page to out and
+// points the offset at link to the new IFD. It returns the extended file
+// and the position of the new IFD's next-IFD offset.
+func appendTestTIFFPage(out []byte, img image.Image, compression int, predictor bool, rowsPerStrip, link int) ([]byte, int) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	spp, bpsBits, photometric := 3, 8, tiffRGB
+	var raster []byte
+	switch m := img.(type) {
+	case *image.Gray:
+		spp, photometric = 1, tiffBlackIsZero
+		raster = append(raster, m.Pix...)
+	case *image.Gray16:
+		spp, bpsBits, photometric = 1, 16, tiffBlackIsZero
+		for i := 0; i < len(m.Pix); i += 2 {
+			raster = append(raster, m.Pix[i+1], m.Pix[i])
+		}
+	case *image.NRGBA:
+		for i := 0; i < len(m.Pix); i += 4 {
+			raster = append(raster, m.Pix[i:i+3]...)
+		}
+	}
+	rowBytes := w * spp * bpsBits / 8
+	if predictor {
+		for y := h - 1; y >= 0; y-- {
+			row := raster[y*rowBytes : (y+1)*rowBytes]
+			for i := len(row) - 1; i >= spp; i-- {
+				row[i] -= row[i-spp]
+			}
+		}
+	}
+
+	var offsets, counts []uint32
+	for y := 0; y < h; y += rowsPerStrip {
+		strip := raster[y*rowBytes : min(y+rowsPerStrip, h)*rowBytes]
+		var enc []byte
+		switch compression {
+		case tiffLZW:
+			enc = testLZWEncode(strip)
+		case tiffDeflate:
+			var b bytes.Buffer
+			zw := zlib.NewWriter(&b)
+			zw.Write(strip)
+			zw.Close()
+			enc = b.Bytes()
+		case tiffPackBits:
+			enc = testPackBits(strip)
+		default:
+			enc = strip
+		}
+		offsets = append(offsets, uint32(len(out)))
+		counts = append(counts, uint32(len(enc)))
+		out = append(out, enc...)
+		if len(out)%2 == 1 {
+			out = append(out, 0)
+		}
+	}
+
+	pred := uint32(1)
+	if predictor {
+		pred = tiffPredictorH
+	}
+	bps := make([]uint32, spp)
+	for i := range bps {
+		bps[i] = uint32(bpsBits)
+	}
+	type entry struct {
+		tag  uint16
+		typ  uint16
+		vals []uint32
+	}
+	entries := []entry{
+		{tiffImageWidth, exifLong, []uint32{uint32(w)}},
+		{tiffImageLength, exifLong, []uint32{uint32(h)}},
+		{tiffBitsPerSample, exifShort, bps},
+		{tiffCompression, exifShort, []uint32{uint32(compression)}},
+		{tiffPhotometric, exifShort, []uint32{uint32(photometric)}},
+		{tiffStripOffsets, exifLong, offsets},
+		{tiffSamplesPerPixel, exifShort, []uint32{uint32(spp)}},
+		{tiffRowsPerStrip, exifLong, []uint32{uint32(rowsPerStrip)}},
+		{tiffStripByteCounts, exifLong, counts},
+		{tiffPredictor, exifShort, []uint32{pred}},
+	}
+
+	le := binary.LittleEndian
+	ifdOff := len(out)
+	le.PutUint32(out[link:], uint32(ifdOff))
+	extra := ifdOff + 2 + len(entries)*12 + 4
+	ifd := make([]byte, extra-ifdOff)
+	var tail []byte
+	le.PutUint16(ifd, uint16(len(entries)))
+	for i, e := range entries {
+		size := 4
+		if e.typ == exifShort {
+			size = 2
+		}
+		val := make([]byte, max(4, size*len(e.vals)))
+		for j, v := range e.vals {
+			if size == 2 {
+				le.PutUint16(val[j*2:], uint16(v))
+			} else {
+				le.PutUint32(val[j*4:], v)
+			}
+		}
+		b := ifd[2+i*12:]
+		le.PutUint16(b, e.tag)
+		le.PutUint16(b[2:], e.typ)
+		le.PutUint32(b[4:], uint32(len(e.vals)))
+		if len(val) > 4 {
+			le.PutUint32(b[8:], uint32(extra+len(tail)))
+			tail = append(tail, val...)
+		} else {
+			copy(b[8:], val)
+		}
+	}
+	return append(append(out, ifd...), tail...), extra - 4
+}
+
+// testLZWEncode compresses data with TIFF's LZW variant.
+func testLZWEncode(data []byte) []byte {
+	var out []byte
+	var acc uint32
+	nBits, width := 0, 9
+	put := func(code int) {
+		acc = acc<<width | uint32(code)
+		nBits += width
+		for nBits >= 8 {
+			out = append(out, byte(acc>>(nBits-8)))
+			nBits -= 8
+		}
+	}
+
+	dict := map[[2]int]int{}
+	next := lzwFirst
+	put(lzwClear)
+	if len(data) == 0 {
+		put(lzwEOI)
+		return out
+	}
+	cur := int(data[0])
+	for _, c := range data[1:] {
+		if code, ok := dict[[2]int{cur, int(c)}]; ok {
+			cur = code
+			continue
+		}
+		put(cur)
+		dict[[2]int{cur, int(c)}] = next
+		next++
+		if next == 1<<lzwMaxBits-2 {
+			put(lzwClear)
+			dict = map[[2]int]int{}
+			next, width = lzwFirst, 9
+		} else if next >= 1<<width {
+			width++
+		}
+		cur = int(c)
+	}
+	put(cur)
+	next++
+	if next >= 1<<width && width < lzwMaxBits {
+		width++
+	}
+	put(lzwEOI)
+	if nBits > 0 {
+		out = append(out, byte(acc<<(8-nBits)))
+	}
+	return out
+}
+
+// testPackBits run-length encodes data, emitting runs of three or more
+// equal bytes as repeats and everything else as literals.
+func testPackBits(data []byte) []byte {
+	var out []byte
+	for i := 0; i < len(data); {
+		run := 1
+		for i+run < len(data) && run < 128 && data[i+run] == data[i] {
+			run++
+		}
+		if run >= 3 {
+			out = append(out, byte(int8(1-run)), data[i])
+			i += run
+			continue
+		}
+		j := i
+		for j < len(data) && j-i < 128 && !(j+2 < len(data) && data[j] == data[j+1] && data[j] == data[j+2]) {
+			j++
+		}
+		out = append(out, byte(j-i-1))
+		out = append(out, data[i:j]...)
+		i = j
+	}
+	return out
+}
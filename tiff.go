@@ -0,0 +1,569 @@
+package fennec
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// TIFF input: baseline strip-based TIFFs, the kind scanners and document
+// systems produce. Supported are bilevel, grayscale (1–16 bit), palette,
+// and RGB/RGBA (8 or 16 bit) images, uncompressed or compressed with LZW,
+// Deflate, or PackBits, with or without a horizontal predictor. Open and
+// the Compress functions read the first page; CompressPages reads them all.
+// Tiled and planar-separated files are rejected with ErrUnsupportedFormat.
+// Fennec never writes TIFF.
+
+var errTIFF = errors.New("fennec: invalid TIFF")
+
+// TIFF tags the decoder reads.
+const (
+	tiffImageWidth      = 256
+	tiffImageLength     = 257
+	tiffBitsPerSample   = 258
+	tiffCompression     = 259
+	tiffPhotometric     = 262
+	tiffStripOffsets    = 273
+	tiffOrientation     = 274
+	tiffSamplesPerPixel = 277
+	tiffRowsPerStrip    = 278
+	tiffStripByteCounts = 279
+	tiffPlanarConfig    = 284
+	tiffPredictor       = 317
+	tiffColorMap        = 320
+	tiffTileWidth       = 322
+	tiffExtraSamples    = 338
+)
+
+// TIFF compression schemes.
+const (
+	tiffNone       = 1
+	tiffLZW        = 5
+	tiffDeflate    = 8
+	tiffPackBits   = 32773
+	tiffDeflateOld = 32946
+)
+
+// PhotometricInterpretation values.
+const (
+	tiffWhiteIsZero = 0
+	tiffBlackIsZero = 1
+	tiffRGB         = 2
+	tiffPalette     = 3
+)
+
+const (
+	tiffPredictorH = 2 // Predictor: horizontal differencing
+	tiffAssocAlpha = 1 // ExtraSamples: premultiplied alpha
+)
+
+// tiffIFD holds the integer values of one IFD's tags, and the offset of
+// the next IFD (0 after the last page).
+type tiffIFD struct {
+	bo   binary.ByteOrder
+	tags map[uint16][]uint32
+	next int
+}
+
+// get returns the first value of tag, or def if it is absent.
+func (d *tiffIFD) get(tag uint16, def uint32) uint32 {
+	if v := d.tags[tag]; len(v) > 0 {
+		return v[0]
+	}
+	return def
+}
+
+// parseTIFFIFD reads the first IFD of a complete TIFF file.
+func parseTIFFIFD(data []byte) (*tiffIFD, error) {
+	if len(data) < 8 {
+		return nil, errTIFF
+	}
+	var bo binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		bo = binary.BigEndian
+	}
+	return parseTIFFIFDAt(data, bo, int(bo.Uint32(data[4:8])))
+}
+
+// parseTIFFIFDAt reads the IFD at offset off of a complete TIFF file.
+func parseTIFFIFDAt(data []byte, bo binary.ByteOrder, off int) (*tiffIFD, error) {
+	if off < 8 || off+2 > len(data) {
+		return nil, errTIFF
+	}
+	d := &tiffIFD{bo: bo, tags: map[uint16][]uint32{}}
+	count := int(d.bo.Uint16(data[off:]))
+	if count > maxTIFFEntries || off+2+count*12 > len(data) {
+		return nil, errTIFF
+	}
+	if end := off + 2 + count*12; end+4 <= len(data) {
+		d.next = int(d.bo.Uint32(data[end:]))
+	}
+
+	for i := range count {
+		e := data[off+2+i*12:]
+		tag := d.bo.Uint16(e[0:2])
+		typ := d.bo.Uint16(e[2:4])
+		n := int(d.bo.Uint32(e[4:8]))
+
+		var size int
+		switch typ {
+		case 1: // BYTE
+			size = 1
+		case exifShort:
+			size = 2
+		case exifLong:
+			size = 4
+		default:
+			continue // rationals, ASCII, etc. aren't needed
+		}
+		if n <= 0 || n > len(data)/size {
+			continue
+		}
+		val := e[8:12]
+		if n*size > 4 {
+			vo := int(d.bo.Uint32(e[8:12]))
+			if vo < 0 || vo+n*size > len(data) {
+				return nil, fmt.Errorf("%w: tag %d out of range", errTIFF, tag)
+			}
+			val = data[vo : vo+n*size]
+		}
+		vals := make([]uint32, n)
+		for j := range vals {
+			switch size {
+			case 1:
+				vals[j] = uint32(val[j])
+			case 2:
+				vals[j] = uint32(d.bo.Uint16(val[j*2:]))
+			case 4:
+				vals[j] = d.bo.Uint32(val[j*4:])
+			}
+		}
+		d.tags[tag] = vals
+	}
+	return d, nil
+}
+
+func decodeTIFFConfig(r io.Reader) (image.Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	d, err := parseTIFFIFD(data)
+	if err != nil {
+		return image.Config{}, err
+	}
+	w, h := int(d.get(tiffImageWidth, 0)), int(d.get(tiffImageLength, 0))
+	if w <= 0 || h <= 0 {
+		return image.Config{}, errTIFF
+	}
+	model := color.NRGBAModel
+	switch d.get(tiffPhotometric, tiffBlackIsZero) {
+	case tiffWhiteIsZero, tiffBlackIsZero:
+		if d.get(tiffSamplesPerPixel, 1) == 1 {
+			model = color.GrayModel
+			if d.get(tiffBitsPerSample, 1) == 16 {
+				model = color.Gray16Model
+			}
+		}
+	case tiffRGB:
+		if d.get(tiffBitsPerSample, 8) == 16 {
+			model = color.NRGBA64Model
+		}
+	}
+	return image.Config{ColorModel: model, Width: w, Height: h}, nil
+}
+
+func decodeTIFF(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	d, err := parseTIFFIFD(data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeTIFFPage(data, d)
+}
+
+// tiffPages returns the IFDs of every page of a complete TIFF file, in
+// file order. A next-IFD pointer that loops back ends the chain.
+func tiffPages(data []byte) ([]*tiffIFD, error) {
+	d, err := parseTIFFIFD(data)
+	if err != nil {
+		return nil, err
+	}
+	pages := []*tiffIFD{d}
+	seen := map[int]bool{int(d.bo.Uint32(data[4:8])): true}
+	for d.next != 0 && !seen[d.next] {
+		seen[d.next] = true
+		if d, err = parseTIFFIFDAt(data, d.bo, d.next); err != nil {
+			return nil, err
+		}
+		pages = append(pages, d)
+	}
+	return pages, nil
+}
+
+// orientation returns the page's Orientation tag, or OrientNormal.
+func (d *tiffIFD) orientation() Orientation {
+	if o := d.get(tiffOrientation, 1); o >= 1 && o <= 8 {
+		return Orientation(o)
+	}
+	return OrientNormal
+}
+
+// decodeTIFFPage decodes the page described by d from the complete file.
+func decodeTIFFPage(data []byte, d *tiffIFD) (image.Image, error) {
+	w, h := int(d.get(tiffImageWidth, 0)), int(d.get(tiffImageLength, 0))
+	if w <= 0 || h <= 0 || w*h > maxDecodePixels {
+		return nil, fmt.Errorf("%w: dimensions %dx%d", errTIFF, w, h)
+	}
+	if _, tiled := d.tags[tiffTileWidth]; tiled {
+		return nil, fmt.Errorf("%w: tiled TIFF", ErrUnsupportedFormat)
+	}
+	if d.get(tiffPlanarConfig, 1) != 1 {
+		return nil, fmt.Errorf("%w: planar TIFF", ErrUnsupportedFormat)
+	}
+
+	photometric := d.get(tiffPhotometric, tiffBlackIsZero)
+	spp := int(d.get(tiffSamplesPerPixel, 1))
+	bps := int(d.get(tiffBitsPerSample, 1))
+	for _, b := range d.tags[tiffBitsPerSample] {
+		if int(b) != bps {
+			return nil, fmt.Errorf("%w: mixed bits per sample", ErrUnsupportedFormat)
+		}
+	}
+	switch {
+	case (photometric == tiffWhiteIsZero || photometric == tiffBlackIsZero) && spp <= 2 &&
+		(bps == 1 || bps == 2 || bps == 4 || bps == 8 || bps == 16):
+	case photometric == tiffPalette && spp == 1 && (bps == 1 || bps == 2 || bps == 4 || bps == 8):
+	case photometric == tiffRGB && (spp == 3 || spp == 4) && (bps == 8 || bps == 16):
+	default:
+		return nil, fmt.Errorf("%w: TIFF photometric %d, %d×%d bit", ErrUnsupportedFormat, photometric, spp, bps)
+	}
+	if spp == 2 && bps < 8 {
+		return nil, fmt.Errorf("%w: TIFF gray+alpha at %d bit", ErrUnsupportedFormat, bps)
+	}
+
+	rowBytes := (w*spp*bps + 7) / 8
+	raster, err := readTIFFStrips(data, d, rowBytes, h)
+	if err != nil {
+		return nil, err
+	}
+	if d.get(tiffPredictor, 1) == tiffPredictorH {
+		if bps < 8 {
+			return nil, fmt.Errorf("%w: TIFF predictor at %d bit", ErrUnsupportedFormat, bps)
+		}
+		undoTIFFPredictor(raster, rowBytes, spp, bps, d.bo)
+	}
+	return tiffImage(raster, d, w, h, spp, bps, photometric)
+}
+
+// readTIFFStrips decompresses every strip into one raster of h rows.
+// Strips that decompress to fewer rows than they cover, and strips missing
+// from the end of the list, leave those rows black, as most readers do. A
+// strip whose offset or byte count points past the end of data, or whose
+// LZW or Deflate stream is corrupt, is an error.
+func readTIFFStrips(data []byte, d *tiffIFD, rowBytes, h int) ([]byte, error) {
+	offsets := d.tags[tiffStripOffsets]
+	counts := d.tags[tiffStripByteCounts]
+	if len(offsets) == 0 || len(counts) != len(offsets) {
+		return nil, fmt.Errorf("%w: missing strips", errTIFF)
+	}
+	rowsPerStrip := int(d.get(tiffRowsPerStrip, uint32(h)))
+	if rowsPerStrip <= 0 || rowsPerStrip > h {
+		rowsPerStrip = h
+	}
+	compression := d.get(tiffCompression, tiffNone)
+
+	raster := make([]byte, rowBytes*h)
+	for i, off := range offsets {
+		start := i * rowsPerStrip * rowBytes
+		if start >= len(raster) {
+			break
+		}
+		end := min(start+rowsPerStrip*rowBytes, len(raster))
+		o, n := int(off), int(counts[i])
+		if o < 0 || n < 0 || o+n > len(data) {
+			return nil, fmt.Errorf("%w: strip %d out of range", errTIFF, i)
+		}
+		src := data[o : o+n]
+		dst := raster[start:end]
+
+		switch compression {
+		case tiffNone:
+			copy(dst, src)
+		case tiffLZW:
+			if err := tiffLZWDecode(dst, src); err != nil {
+				return nil, fmt.Errorf("fennec: TIFF strip %d: %w", i, err)
+			}
+		case tiffDeflate, tiffDeflateOld:
+			zr, err := zlib.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, fmt.Errorf("fennec: TIFF strip %d: %w", i, err)
+			}
+			if _, err := io.ReadFull(zr, dst); err != nil && err != io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("fennec: TIFF strip %d: %w", i, err)
+			}
+		case tiffPackBits:
+			unpackBits(dst, src)
+		default:
+			return nil, fmt.Errorf("%w: TIFF compression %d", ErrUnsupportedFormat, compression)
+		}
+	}
+	return raster, nil
+}
+
+// undoTIFFPredictor reverses horizontal differencing (Predictor 2) in place.
+func undoTIFFPredictor(raster []byte, rowBytes, spp, bps int, bo binary.ByteOrder) {
+	for y := 0; y+rowBytes <= len(raster); y += rowBytes {
+		row := raster[y : y+rowBytes]
+		if bps == 8 {
+			for i := spp; i < len(row); i++ {
+				row[i] += row[i-spp]
+			}
+			continue
+		}
+		for i := spp * 2; i+1 < len(row); i += 2 {
+			bo.PutUint16(row[i:], bo.Uint16(row[i:])+bo.Uint16(row[i-spp*2:]))
+		}
+	}
+}
+
+// tiffImage converts a decoded raster to the closest image type.
+func tiffImage(raster []byte, d *tiffIFD, w, h, spp, bps int, photometric uint32) (image.Image, error) {
+	rowBytes := (w*spp*bps + 7) / 8
+	rect := image.Rect(0, 0, w, h)
+	// sample returns the n-th sample of row y at a bit depth below 16.
+	sample := func(y, n int) uint8 {
+		row := raster[y*rowBytes:]
+		switch bps {
+		case 8:
+			return row[n]
+		default:
+			bit := n * bps
+			v := row[bit/8] >> (8 - bps - bit%8) & (1<<bps - 1)
+			return uint8(int(v) * 255 / (1<<bps - 1))
+		}
+	}
+	// Extra samples are assumed unassociated unless tagged otherwise.
+	assoc := d.get(tiffExtraSamples, 0) == tiffAssocAlpha
+
+	switch {
+	case photometric == tiffPalette:
+		cmap := d.tags[tiffColorMap]
+		n := 1 << bps
+		if len(cmap) < 3*n {
+			return nil, fmt.Errorf("%w: short color map", errTIFF)
+		}
+		pal := make(color.Palette, n)
+		for i := range pal {
+			pal[i] = color.RGBA64{uint16(cmap[i]), uint16(cmap[n+i]), uint16(cmap[2*n+i]), 0xffff}
+		}
+		img := image.NewPaletted(rect, pal)
+		for y := 0; y < h; y++ {
+			row := raster[y*rowBytes:]
+			for x := 0; x < w; x++ {
+				bit := x * bps
+				img.Pix[y*img.Stride+x] = row[bit/8] >> (8 - bps - bit%8) & uint8(n-1)
+			}
+		}
+		return img, nil
+
+	case spp == 1 && bps == 16:
+		img := image.NewGray16(rect)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				v := d.bo.Uint16(raster[y*rowBytes+x*2:])
+				if photometric == tiffWhiteIsZero {
+					v = 0xffff - v
+				}
+				img.SetGray16(x, y, color.Gray16{Y: v})
+			}
+		}
+		return img, nil
+
+	case spp == 1:
+		img := image.NewGray(rect)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				v := sample(y, x)
+				if photometric == tiffWhiteIsZero {
+					v = 255 - v
+				}
+				img.Pix[y*img.Stride+x] = v
+			}
+		}
+		return img, nil
+
+	case bps == 16:
+		img := image.NewNRGBA64(rect)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				var c [4]uint16
+				c[3] = 0xffff
+				for s := range spp {
+					c[s] = d.bo.Uint16(raster[y*rowBytes+(x*spp+s)*2:])
+				}
+				if spp == 2 { // gray + alpha
+					c = [4]uint16{c[0], c[0], c[0], c[1]}
+					if photometric == tiffWhiteIsZero {
+						c[0], c[1], c[2] = 0xffff-c[0], 0xffff-c[0], 0xffff-c[0]
+					}
+				}
+				if assoc && c[3] != 0 {
+					for i := range 3 {
+						c[i] = uint16(min(uint32(c[i])*0xffff/uint32(c[3]), 0xffff))
+					}
+				}
+				img.SetNRGBA64(x, y, color.NRGBA64{c[0], c[1], c[2], c[3]})
+			}
+		}
+		return img, nil
+
+	default:
+		img := image.NewNRGBA(rect)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				var c [4]uint8
+				c[3] = 255
+				for s := range spp {
+					c[s] = raster[y*rowBytes+x*spp+s]
+				}
+				if spp == 2 {
+					v := c[0]
+					if photometric == tiffWhiteIsZero {
+						v = 255 - v
+					}
+					c = [4]uint8{v, v, v, c[1]}
+				}
+				if assoc && c[3] != 0 {
+					for i := range 3 {
+						c[i] = uint8(min(int(c[i])*255/int(c[3]), 255))
+					}
+				}
+				copy(img.Pix[y*img.Stride+x*4:], c[:])
+			}
+		}
+		return img, nil
+	}
+}
+
+// unpackBits decodes PackBits run-length data into dst, stopping when
+// either runs out.
+func unpackBits(dst, src []byte) {
+	o := 0
+	for i := 0; i < len(src) && o < len(dst); {
+		n := int(int8(src[i]))
+		i++
+		switch {
+		case n >= 0:
+			k := min(n+1, len(src)-i)
+			o += copy(dst[o:], src[i:i+k])
+			i += k
+		case n != -128:
+			if i >= len(src) {
+				return
+			}
+			for range 1 - n {
+				if o >= len(dst) {
+					return
+				}
+				dst[o] = src[i]
+				o++
+			}
+			i++
+		}
+	}
+}
+
+// TIFF LZW codes. Unlike compress/lzw, TIFF's variant widens its codes
+// one entry early, so it needs its own decoder.
+const (
+	lzwClear   = 256
+	lzwEOI     = 257
+	lzwFirst   = 258
+	lzwMaxBits = 12
+)
+
+// tiffLZWDecode decodes one LZW strip into dst. Output beyond len(dst) is
+// dropped; a strip that ends early leaves the rest of dst untouched.
+func tiffLZWDecode(dst, src []byte) error {
+	var (
+		prefix [1 << lzwMaxBits]uint16
+		suffix [1 << lzwMaxBits]uint8
+		first  [1 << lzwMaxBits]uint8
+		length [1 << lzwMaxBits]uint16
+	)
+	for i := range 256 {
+		suffix[i], first[i], length[i] = uint8(i), uint8(i), 1
+	}
+
+	var bitBuf uint32
+	nBits, pos, o := 0, 0, 0
+	width, next, prev := 9, lzwFirst, -1
+
+	// emit writes the string for code, clipped to dst.
+	emit := func(code int) {
+		n := int(length[code])
+		end := o + n
+		for i, c := end-1, code; i >= o; i-- {
+			if i < len(dst) {
+				dst[i] = suffix[c]
+			}
+			c = int(prefix[c])
+		}
+		o = end
+	}
+
+	for o < len(dst) {
+		for nBits < width {
+			if pos >= len(src) {
+				return nil
+			}
+			bitBuf = bitBuf<<8 | uint32(src[pos])
+			pos++
+			nBits += 8
+		}
+		code := int(bitBuf>>(nBits-width)) & (1<<width - 1)
+		nBits -= width
+
+		switch {
+		case code == lzwEOI:
+			return nil
+		case code == lzwClear:
+			width, next, prev = 9, lzwFirst, -1
+			continue
+		case prev < 0:
+			if code >= 256 {
+				return fmt.Errorf("%w: LZW code %d after clear", errTIFF, code)
+			}
+			emit(code)
+			prev = code
+			continue
+		case code > next || (code == next && next >= 1<<lzwMaxBits):
+			return fmt.Errorf("%w: LZW code %d out of range", errTIFF, code)
+		}
+
+		if next < 1<<lzwMaxBits {
+			c := first[code]
+			if code == next {
+				c = first[prev]
+			}
+			prefix[next], suffix[next] = uint16(prev), c
+			first[next], length[next] = first[prev], length[prev]+1
+			next++
+		}
+		emit(code)
+		prev = code
+		if next >= 1<<width-1 && width < lzwMaxBits {
+			width++
+		}
+	}
+	return nil
+}
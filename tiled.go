@@ -0,0 +1,884 @@
+package fennec
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// ── Tiled Compression ───────────────────────────────────────────────────────
+//
+// The standard pipeline holds the whole image as NRGBA, four bytes a pixel,
+// plus a copy or two while resizing and encoding: a gigapixel scan needs
+// several gigabytes. CompressTiled works through the image in horizontal
+// strips instead. A non-interlaced PNG is inflated and unfiltered a row at
+// a time, resized with a sliding window of source rows, and filtered and
+// deflated into IDAT chunks as it goes, so peak memory follows the image's
+// width and the resize ratio but not its height. Other inputs are decoded
+// whole, since the standard library's decoders can't stop part way, and
+// only the resizing and encoding are done in strips.
+
+// tiledStripRows is how many source rows CompressTiled decodes and resizes
+// at a time, between cancellation checks. The decoders' pixel guard,
+// maxDecodePixels, bounds one strip, which caps the width of a streamed PNG.
+const tiledStripRows = 64
+
+// idatChunkSize is the most image data CompressTiled writes per IDAT chunk.
+const idatChunkSize = 1 << 16
+
+var errPNG = errors.New("fennec: invalid PNG")
+
+// CompressTiled compresses the image read from r to PNG and writes it to w,
+// working in horizontal strips so peak memory stays bounded however tall
+// the image is. Use it for gigapixel scans and other images too large to
+// hold in memory as a whole.
+//
+// A non-interlaced PNG is decoded a strip at a time, so memory grows with
+// its width, and with the scale factor when resizing, but not its height.
+// Other inputs, JPEG and interlaced PNG included, are decoded whole first,
+// because the standard decoders have no strip mode; only resizing and
+// encoding are then done in strips.
+//
+// Without a resize, a PNG keeps its color type, bit depth, and palette and
+// is only re-filtered and re-compressed; otherwise the output is 8-bit
+// gray, RGB, or RGBA, with alpha only if the input has it. The options used
+// are MaxWidth, MaxHeight, AllowUpscale, ResizeFilter, StraightAlpha,
+// LinearResize, and OnProgress, plus AutoOrient for inputs decoded whole,
+// such as a JPEG with an EXIF orientation. Format must be Auto or PNG, and
+// the options that need the whole image at once (the targets, ExactSize,
+// and InterlacePNG) return ErrInvalidOptions; the rest, such as
+// sharpening, palette reduction, and metadata, are not applied. Like
+// CompressTo's, the Result has no CompressedData, and no Image either.
+func CompressTiled(ctx context.Context, r io.Reader, w io.Writer, opts Options) (*Result, error) {
+	c, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.CompressTiled(ctx, r, w)
+}
+
+// CompressTiled is the Compressor form of the package-level CompressTiled.
+func (c *Compressor) CompressTiled(ctx context.Context, r io.Reader, w io.Writer) (*Result, error) {
+	opts := c.opts
+	if opts.Format != Auto && opts.Format != PNG {
+		return nil, fmt.Errorf("%w: CompressTiled writes PNG, not %v", ErrInvalidOptions, opts.Format)
+	}
+	if opts.TargetSize > 0 || opts.TargetBPP > 0 || opts.TargetRatio > 0 || opts.ExactSize != (image.Point{}) || opts.InterlacePNG {
+		return nil, fmt.Errorf("%w: CompressTiled can't apply a target, ExactSize, or InterlacePNG", ErrInvalidOptions)
+	}
+
+	in := &countingReader{r: r}
+	br := bufio.NewReader(in)
+	out := &countingWriter{w: w}
+	result := &Result{Format: PNG, SSIM: 1.0, TargetMet: true}
+
+	// IHDR's last byte is the interlace method.
+	hdr, _ := br.Peek(len(pngSignature) + 8 + 13)
+	if len(hdr) == len(pngSignature)+8+13 && string(hdr[:len(pngSignature)]) == pngSignature && hdr[len(hdr)-1] == 0 {
+		d, err := newPNGStripDecoder(br)
+		if err != nil {
+			return nil, decodeError(err)
+		}
+		result.SourceFormat = PNG
+		result.OriginalDimensions = image.Pt(d.w, d.h)
+		if dst, ok := tiledSize(d.w, d.h, opts); ok {
+			err = encodeStrips(ctx, out, d.w, d.h, dst, d.outputColorType(), d.nextNRGBA, opts)
+			result.FinalDimensions = dst
+		} else {
+			err = d.recompress(ctx, out, opts)
+			result.FinalDimensions = result.OriginalDimensions
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := d.finish(); err != nil {
+			return nil, decodeError(err)
+		}
+	} else {
+		// Keep what the decoder reads for the frame count, as
+		// CompressReader does.
+		var read bytes.Buffer
+		img, format, err := decodeImage(io.TeeReader(br, &read))
+		if err != nil {
+			return nil, decodeError(err)
+		}
+		meta := readInputMeta(bytes.NewReader(read.Bytes()))
+		if err := checkAnimated(io.MultiReader(&read, br)); err != nil {
+			return nil, err
+		}
+		src := toNRGBARef(img)
+		if opts.AutoOrient && meta.orient > OrientNormal {
+			src = ApplyOrientation(src, meta.orient)
+		}
+		srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+		result.SourceFormat = sourceFormat(format)
+		result.OriginalDimensions = image.Pt(srcW, srcH)
+		result.FinalDimensions = result.OriginalDimensions
+		if dst, ok := tiledSize(srcW, srcH, opts); ok {
+			result.FinalDimensions = dst
+		}
+
+		var ct byte = 6 // RGBA
+		switch gray := isGrayscale(src); {
+		case isOpaque(src) && gray:
+			ct = 0
+		case isOpaque(src):
+			ct = 2
+		case gray:
+			ct = 4
+		}
+		y := 0
+		next := func(row []byte) error {
+			copy(row, src.Pix[y*src.Stride:])
+			y++
+			return nil
+		}
+		if err := encodeStrips(ctx, out, srcW, srcH, result.FinalDimensions, ct, next, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	result.OriginalSize = in.n
+	result.CompressedSize = out.n
+	result.computeStats()
+	if err := opts.reportProgress(ctx, StageWriting, 1.0); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// decodeError wraps a decoder error in ErrDecode.
+func decodeError(err error) error {
+	return fmt.Errorf("%w: %w", ErrDecode, err)
+}
+
+// tiledSize returns the size CompressTiled resizes a w×h image to and
+// whether it resizes at all, by smartResize's rules.
+func tiledSize(w, h int, opts Options) (image.Point, bool) {
+	if opts.MaxWidth <= 0 && opts.MaxHeight <= 0 || !opts.AllowUpscale && fitsWithin(w, h, opts.MaxWidth, opts.MaxHeight) {
+		return image.Point{}, false
+	}
+	dw, dh := fitBox(w, h, opts.MaxWidth, opts.MaxHeight)
+	return image.Pt(dw, dh), dw != w || dh != h
+}
+
+// encodeStrips writes the srcW×srcH image whose NRGBA rows next yields,
+// top to bottom, to w as a dst-sized 8-bit PNG of color type ct.
+func encodeStrips(ctx context.Context, w io.Writer, srcW, srcH int, dst image.Point, ct byte, next func(row []byte) error, opts Options) error {
+	enc, err := newPNGStripEncoder(w, dst.X, dst.Y, 8, ct, nil, nil)
+	if err != nil {
+		return err
+	}
+	packed := make([]byte, dst.X*pngChannels[ct])
+	emit := func(row []byte) error {
+		packNRGBARow(packed, row, ct)
+		return enc.writeRow(packed)
+	}
+
+	var rs *stripResizer
+	if dst != image.Pt(srcW, srcH) {
+		rs = newStripResizer(srcW, srcH, dst.X, dst.Y, opts.resampling())
+	}
+	strip := make([][]byte, min(tiledStripRows, srcH))
+	for i := range strip {
+		strip[i] = make([]byte, srcW*4)
+	}
+	for y := 0; y < srcH; y += len(strip) {
+		if err := opts.reportProgress(ctx, StageEncoding, float64(y)/float64(srcH)); err != nil {
+			return err
+		}
+		n := min(len(strip), srcH-y)
+		for i := range n {
+			if err := next(strip[i]); err != nil {
+				return decodeError(err)
+			}
+		}
+		if rs == nil {
+			for _, row := range strip[:n] {
+				if err := emit(row); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := rs.add(strip[:n], emit); err != nil {
+			return err
+		}
+	}
+	return enc.close()
+}
+
+// packNRGBARow writes the NRGBA row src to dst as 8-bit samples of PNG
+// color type ct: gray (0), RGB (2), gray and alpha (4), or RGBA (6).
+func packNRGBARow(dst, src []byte, ct byte) {
+	switch ct {
+	case 0:
+		for i := range dst {
+			dst[i] = src[i*4]
+		}
+	case 2:
+		for i, j := 0, 0; i < len(dst); i, j = i+3, j+4 {
+			dst[i], dst[i+1], dst[i+2] = src[j], src[j+1], src[j+2]
+		}
+	case 4:
+		for i, j := 0, 0; i < len(dst); i, j = i+2, j+4 {
+			dst[i], dst[i+1] = src[j], src[j+3]
+		}
+	default:
+		copy(dst, src)
+	}
+}
+
+// ── Strip Resizing ──────────────────────────────────────────────────────────
+
+// stripResizer resizes a stream of NRGBA rows with a sliding window. Each
+// source row is resampled horizontally once, into float32 rows kept in a
+// ring, and an output row is produced as soon as the last source row its
+// vertical filter reads has arrived. The ring holds one filter's span of
+// rows plus a strip, and vertical weights are computed per output row, so
+// nothing grows with the image's height. It computes what
+// lanczosResizeAlpha does, without that function's rounding to bytes
+// between the passes.
+type stripResizer struct {
+	srcH, dstW, dstH int
+	rs               resampling
+	wh               [][]weightEntry
+	wv               [][]weightEntry // vertical weights of the rows in out, reused
+	levels           *[256]float64   // sample value to the filtering domain, in [0, 1]
+	rows             [][]float32     // horizontally resampled rows, by source y mod len
+	out              [][]byte        // output rows finished by one strip
+	y                int             // source rows received
+	next             int             // next output row
+}
+
+// newStripResizer returns a resizer from srcW×srcH to dstW×dstH.
+func newStripResizer(srcW, srcH, dstW, dstH int, rs resampling) *stripResizer {
+	s := &stripResizer{
+		srcH: srcH,
+		dstW: dstW,
+		dstH: dstH,
+		rs:   rs,
+		wh:   resizeWeights(dstW, srcW, rs.filter),
+	}
+	s.levels = &srgbLevels
+	if rs.linear {
+		s.levels = &srgbToLinear
+	}
+	// A vertical filter reads at most 2×support+1 rows.
+	support := rs.filter.support() * max(float64(srcH)/float64(dstH), 1)
+	span := int(math.Ceil(2*support)) + 1
+	s.rows = make([][]float32, span+tiledStripRows)
+	for i := range s.rows {
+		s.rows[i] = make([]float32, dstW*4)
+	}
+	return s
+}
+
+// srgbLevels maps a sample value to [0, 1] unchanged, for resizing on
+// sRGB values.
+var srgbLevels = func() (t [256]float64) {
+	for i := range t {
+		t[i] = float64(i) / 255
+	}
+	return t
+}()
+
+// add resamples the source rows in strip, the next ones in order, and
+// calls emit with each output row they complete.
+func (s *stripResizer) add(strip [][]byte, emit func(row []byte) error) error {
+	parallelDoCost(0, len(strip), s.dstW*len(s.wh[0]), func(i int) {
+		s.resizeRowH(strip[i], s.rows[(s.y+i)%len(s.rows)])
+	})
+	s.y += len(strip)
+
+	n := 0
+	for ; s.next+n < s.dstH; n++ {
+		if n == len(s.wv) {
+			s.wv = append(s.wv, nil)
+		}
+		s.wv[n] = appendResizeWeights(s.wv[n][:0], s.next+n, s.dstH, s.srcH, s.rs.filter)
+		if lastIndex(s.wv[n]) >= s.y {
+			break
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	for len(s.out) < n {
+		s.out = append(s.out, make([]byte, s.dstW*4))
+	}
+	parallelDoCost(0, n, s.dstW*len(s.wv[0]), func(i int) {
+		s.resizeRowV(s.wv[i], s.out[i])
+	})
+	for _, row := range s.out[:n] {
+		if err := emit(row); err != nil {
+			return err
+		}
+	}
+	s.next += n
+	return nil
+}
+
+// lastIndex returns the last source index ws reads, or -1 if none.
+func lastIndex(ws []weightEntry) int {
+	if len(ws) == 0 {
+		return -1
+	}
+	return ws[len(ws)-1].index
+}
+
+// resizeRowH resamples the NRGBA row src to dst, four float32 values a
+// pixel with color premultiplied by alpha unless rs.straight is set.
+func (s *stripResizer) resizeRowH(src []byte, dst []float32) {
+	for dx, ws := range s.wh {
+		var r, g, b, a float64
+		for _, we := range ws {
+			p := src[we.index*4 : we.index*4+4]
+			sa := float64(p[3]) / 255
+			aw := sa * we.weight
+			if s.rs.straight {
+				aw = we.weight
+			}
+			r += s.levels[p[0]] * aw
+			g += s.levels[p[1]] * aw
+			b += s.levels[p[2]] * aw
+			a += sa * we.weight
+		}
+		dst[dx*4], dst[dx*4+1], dst[dx*4+2], dst[dx*4+3] = float32(r), float32(g), float32(b), float32(a)
+	}
+}
+
+// resizeRowV computes the output row with vertical weights ws into the
+// NRGBA row dst from the ring.
+func (s *stripResizer) resizeRowV(ws []weightEntry, dst []byte) {
+	for x := range s.dstW {
+		var r, g, b, a float64
+		for _, we := range ws {
+			p := s.rows[we.index%len(s.rows)][x*4 : x*4+4]
+			r += float64(p[0]) * we.weight
+			g += float64(p[1]) * we.weight
+			b += float64(p[2]) * we.weight
+			a += float64(p[3]) * we.weight
+		}
+
+		o := dst[x*4 : x*4+4]
+		if !s.rs.straight {
+			// Like resizeV, leave pixels under half an alpha level
+			// fully transparent.
+			if a*255 <= 0.5 {
+				o[0], o[1], o[2], o[3] = 0, 0, 0, 0
+				continue
+			}
+			r, g, b = r/a, g/a, b/a
+		}
+		if s.rs.linear {
+			o[0], o[1], o[2] = linearToSRGB(r), linearToSRGB(g), linearToSRGB(b)
+		} else {
+			o[0], o[1], o[2] = clampF(r*255), clampF(g*255), clampF(b*255)
+		}
+		o[3] = clampF(a * 255)
+	}
+}
+
+// ── Streaming PNG Decoder ───────────────────────────────────────────────────
+
+// pngStripDecoder decodes a non-interlaced PNG a row at a time.
+type pngStripDecoder struct {
+	r          io.Reader
+	w, h       int
+	depth      int
+	colorType  byte
+	plte, trns []byte        // the PLTE and tRNS payloads, if present
+	palette    color.Palette // PLTE with tRNS alpha, padded to 256 entries
+	key        []byte        // the transparent sample, as stored, if tRNS sets one
+	bpp        int           // filter distance: bytes per pixel, at least 1
+	idat       *idatReader
+	zr         io.ReadCloser
+	raw        []byte // the current row with its filter byte
+	cur, prev  []byte // the current and previous unfiltered rows
+}
+
+// newPNGStripDecoder reads a PNG's header and the chunks before its image
+// data from r and returns a decoder positioned at the first row.
+func newPNGStripDecoder(r io.Reader) (*pngStripDecoder, error) {
+	var hdr [len(pngSignature) + 8 + 13 + 4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, errPNG
+	}
+	ihdr := hdr[len(pngSignature)+4 : len(hdr)-4]
+	if string(ihdr[:4]) != "IHDR" || binary.BigEndian.Uint32(hdr[len(pngSignature):]) != 13 ||
+		crc32.ChecksumIEEE(ihdr) != binary.BigEndian.Uint32(hdr[len(hdr)-4:]) {
+		return nil, errPNG
+	}
+	d := &pngStripDecoder{
+		r:         r,
+		w:         int(binary.BigEndian.Uint32(ihdr[4:])),
+		h:         int(binary.BigEndian.Uint32(ihdr[8:])),
+		depth:     int(ihdr[12]),
+		colorType: ihdr[13],
+	}
+	channels, ok := pngChannels[d.colorType]
+	if !ok || !validPNGDepth(d.colorType, d.depth) || ihdr[14] != 0 || ihdr[15] != 0 || ihdr[16] != 0 ||
+		d.w <= 0 || d.h <= 0 || d.w > 1<<31-1 || d.h > 1<<31-1 {
+		return nil, fmt.Errorf("%w: unsupported header", errPNG)
+	}
+	if d.w > maxDecodePixels/tiledStripRows {
+		return nil, fmt.Errorf("%w: %d pixels wide, over the %d a strip allows", errPNG, d.w, maxDecodePixels/tiledStripRows)
+	}
+	bitsPerPixel := channels * d.depth
+	d.bpp = max(bitsPerPixel/8, 1)
+	rowBytes := (d.w*bitsPerPixel + 7) / 8
+	d.raw = make([]byte, rowBytes+1)
+	d.cur = make([]byte, rowBytes)
+	d.prev = make([]byte, rowBytes)
+
+	// PLTE and tRNS come before the image data.
+	for {
+		typ, n, err := readPNGChunkHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case "IDAT":
+			if d.colorType == 3 && d.plte == nil {
+				return nil, fmt.Errorf("%w: no palette", errPNG)
+			}
+			d.setTransparency()
+			d.idat = &idatReader{r: r, remaining: n, crc: crc32.NewIEEE()}
+			d.idat.crc.Write([]byte("IDAT"))
+			d.zr, err = zlib.NewReader(d.idat)
+			if err != nil {
+				return nil, errPNG
+			}
+			return d, nil
+		case "IEND":
+			return nil, fmt.Errorf("%w: no image data", errPNG)
+		case "PLTE", "tRNS", "acTL":
+			if n > 3*256 {
+				return nil, errPNG
+			}
+			payload := make([]byte, n+4)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return nil, errPNG
+			}
+			crc := crc32.NewIEEE()
+			crc.Write([]byte(typ))
+			crc.Write(payload[:n])
+			if crc.Sum32() != binary.BigEndian.Uint32(payload[n:]) {
+				return nil, fmt.Errorf("%w: %s checksum mismatch", errPNG, typ)
+			}
+			switch typ {
+			case "PLTE":
+				if n%3 != 0 || n == 0 {
+					return nil, errPNG
+				}
+				d.plte = payload[:n]
+			case "tRNS":
+				d.trns = payload[:n]
+			case "acTL":
+				if n == 8 {
+					if frames := int(binary.BigEndian.Uint32(payload)); frames > 1 {
+						return nil, animatedError("png", frames)
+					}
+				}
+			}
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(n)+4); err != nil {
+				return nil, errPNG
+			}
+		}
+	}
+}
+
+// validPNGDepth reports whether the PNG specification allows bit depth
+// depth with color type ct.
+func validPNGDepth(ct byte, depth int) bool {
+	switch depth {
+	case 1, 2, 4:
+		return ct == 0 || ct == 3
+	case 8:
+		return true
+	case 16:
+		return ct != 3
+	}
+	return false
+}
+
+// setTransparency builds the palette and transparent key from PLTE and
+// tRNS. Out-of-range palette indices decode as opaque black, as in
+// image/png, and a tRNS chunk that doesn't fit the color type is ignored.
+func (d *pngStripDecoder) setTransparency() {
+	if d.colorType == 3 {
+		d.palette = make(color.Palette, 256)
+		for i := range d.palette {
+			c := color.NRGBA{A: 0xff}
+			if 3*i < len(d.plte) {
+				c.R, c.G, c.B = d.plte[3*i], d.plte[3*i+1], d.plte[3*i+2]
+				if i < len(d.trns) {
+					c.A = d.trns[i]
+				}
+			}
+			d.palette[i] = c
+		}
+		if len(d.trns) > len(d.plte)/3 {
+			d.trns = nil
+		}
+		return
+	}
+
+	// The key is one 16-bit value per channel; 8-bit samples compare with
+	// its low byte.
+	samples := map[byte]int{0: 1, 2: 3}[d.colorType]
+	if samples == 0 || len(d.trns) != 2*samples {
+		d.trns = nil
+		return
+	}
+	switch {
+	case d.depth == 16:
+		d.key = d.trns
+	case d.depth == 8:
+		for i := range samples {
+			d.key = append(d.key, d.trns[2*i+1])
+		}
+	default:
+		d.key = d.trns[:2] // Compared by value in nextNRGBA.
+	}
+}
+
+// outputColorType returns the 8-bit color type that holds d's pixels once
+// resized: gray or RGB, with alpha if d has any.
+func (d *pngStripDecoder) outputColorType() byte {
+	switch d.colorType {
+	case 0:
+		if d.trns != nil {
+			return 4
+		}
+		return 0
+	case 3:
+		for _, c := range d.palette {
+			if c.(color.NRGBA).A != 0xff {
+				return 6
+			}
+		}
+		return 2
+	case 2:
+		if d.trns != nil {
+			return 6
+		}
+	}
+	return d.colorType
+}
+
+// readRow reads and unfilters the next row, which it leaves in d.cur.
+func (d *pngStripDecoder) readRow() error {
+	if _, err := io.ReadFull(d.zr, d.raw); err != nil {
+		return fmt.Errorf("%w: %w", errPNG, err)
+	}
+	d.prev, d.cur = d.cur, d.prev
+	copy(d.cur, d.raw[1:])
+	if !unfilterPNGRow(d.raw[0], d.cur, d.prev, d.bpp) {
+		return fmt.Errorf("%w: bad filter type %d", errPNG, d.raw[0])
+	}
+	return nil
+}
+
+// nextNRGBA reads the next row and expands it to 8-bit NRGBA in dst.
+// 16-bit samples keep their high byte.
+func (d *pngStripDecoder) nextNRGBA(dst []byte) error {
+	if err := d.readRow(); err != nil {
+		return err
+	}
+	row := d.cur
+
+	if d.depth < 8 {
+		mask := byte(1<<d.depth - 1)
+		for x := range d.w {
+			bit := x * d.depth
+			v := row[bit/8] >> (8 - d.depth - bit%8) & mask
+			o := dst[x*4 : x*4+4]
+			if d.colorType == 3 {
+				c := d.palette[v].(color.NRGBA)
+				o[0], o[1], o[2], o[3] = c.R, c.G, c.B, c.A
+				continue
+			}
+			g := v * (0xff / mask)
+			o[0], o[1], o[2], o[3] = g, g, g, 0xff
+			if d.key != nil && uint16(v) == binary.BigEndian.Uint16(d.key) {
+				o[3] = 0
+			}
+		}
+		return nil
+	}
+
+	n := d.depth / 8
+	size := pngChannels[d.colorType] * n
+	for x := range d.w {
+		p := row[x*size : (x+1)*size]
+		o := dst[x*4 : x*4+4]
+		switch d.colorType {
+		case 0:
+			o[0], o[1], o[2], o[3] = p[0], p[0], p[0], 0xff
+		case 2:
+			o[0], o[1], o[2], o[3] = p[0], p[n], p[2*n], 0xff
+		case 3:
+			c := d.palette[p[0]].(color.NRGBA)
+			o[0], o[1], o[2], o[3] = c.R, c.G, c.B, c.A
+		case 4:
+			o[0], o[1], o[2], o[3] = p[0], p[0], p[0], p[n]
+		case 6:
+			o[0], o[1], o[2], o[3] = p[0], p[n], p[2*n], p[3*n]
+		}
+		if d.key != nil && bytes.Equal(p, d.key) {
+			o[3] = 0
+		}
+	}
+	return nil
+}
+
+// recompress writes d's rows to w as a PNG of the same size, color type,
+// bit depth, and palette, re-filtered and re-compressed.
+func (d *pngStripDecoder) recompress(ctx context.Context, w io.Writer, opts Options) error {
+	enc, err := newPNGStripEncoder(w, d.w, d.h, d.depth, d.colorType, d.plte, d.trns)
+	if err != nil {
+		return err
+	}
+	for y := range d.h {
+		if y%tiledStripRows == 0 {
+			if err := opts.reportProgress(ctx, StageEncoding, float64(y)/float64(d.h)); err != nil {
+				return err
+			}
+		}
+		if err := d.readRow(); err != nil {
+			return decodeError(err)
+		}
+		if err := enc.writeRow(d.cur); err != nil {
+			return err
+		}
+	}
+	return enc.close()
+}
+
+// finish reads the rest of the PNG through IEND, checking the image data's
+// zlib checksum on the way.
+func (d *pngStripDecoder) finish() error {
+	if _, err := io.Copy(io.Discard, d.zr); err != nil {
+		return fmt.Errorf("%w: %w", errPNG, err)
+	}
+	if _, err := io.Copy(io.Discard, d.idat); err != nil {
+		return err
+	}
+	typ, n := d.idat.nextType, d.idat.nextLen
+	for typ != "IEND" {
+		if _, err := io.CopyN(io.Discard, d.r, int64(n)+4); err != nil {
+			return errPNG
+		}
+		var err error
+		if typ, n, err = readPNGChunkHeader(d.r); err != nil {
+			return err
+		}
+	}
+	if _, err := io.CopyN(io.Discard, d.r, int64(n)+4); err != nil {
+		return errPNG
+	}
+	return nil
+}
+
+// readPNGChunkHeader reads a chunk's length and type.
+func readPNGChunkHeader(r io.Reader) (typ string, n int, err error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return "", 0, fmt.Errorf("%w: truncated", errPNG)
+	}
+	if n := binary.BigEndian.Uint32(b[:4]); n > 1<<31-1 {
+		return "", 0, errPNG
+	}
+	return string(b[4:]), int(binary.BigEndian.Uint32(b[:4])), nil
+}
+
+// idatReader reads the concatenated payloads of consecutive IDAT chunks,
+// checking each chunk's CRC, and stops at the first other chunk, whose
+// header it keeps.
+type idatReader struct {
+	r         io.Reader
+	remaining int // payload bytes left in the current chunk
+	crc       hash.Hash32
+	done      bool
+	nextType  string // the chunk after the image data, once done
+	nextLen   int
+}
+
+func (c *idatReader) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		var b [4]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil || binary.BigEndian.Uint32(b[:]) != c.crc.Sum32() {
+			return 0, fmt.Errorf("%w: IDAT checksum mismatch", errPNG)
+		}
+		typ, n, err := readPNGChunkHeader(c.r)
+		if err != nil {
+			return 0, err
+		}
+		if typ != "IDAT" {
+			c.done, c.nextType, c.nextLen = true, typ, n
+			return 0, io.EOF
+		}
+		c.remaining = n
+		c.crc.Reset()
+		c.crc.Write([]byte("IDAT"))
+	}
+	if len(p) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= n
+	c.crc.Write(p[:n])
+	if err == io.EOF {
+		if c.remaining > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// ── Streaming PNG Encoder ───────────────────────────────────────────────────
+
+// pngStripEncoder writes a non-interlaced PNG a row at a time.
+type pngStripEncoder struct {
+	idat      *idatWriter
+	zw        *zlib.Writer
+	filter    bool
+	bpp       int
+	prev, out []byte
+}
+
+// newPNGStripEncoder writes the signature, IHDR, and any PLTE and tRNS
+// chunks to w, and returns an encoder for the rows.
+func newPNGStripEncoder(w io.Writer, width, height, depth int, ct byte, plte, trns []byte) (*pngStripEncoder, error) {
+	ihdr := binary.BigEndian.AppendUint32(nil, uint32(width))
+	ihdr = binary.BigEndian.AppendUint32(ihdr, uint32(height))
+	ihdr = append(ihdr, byte(depth), ct, 0, 0, 0)
+	head := appendPNGChunk([]byte(pngSignature), "IHDR", ihdr)
+	if plte != nil {
+		head = appendPNGChunk(head, "PLTE", plte)
+	}
+	if trns != nil {
+		head = appendPNGChunk(head, "tRNS", trns)
+	}
+	if _, err := w.Write(head); err != nil {
+		return nil, fmt.Errorf("fennec: write: %w", err)
+	}
+
+	bitsPerPixel := pngChannels[ct] * depth
+	rowBytes := (width*bitsPerPixel + 7) / 8
+	e := &pngStripEncoder{
+		idat: &idatWriter{w: w},
+		// Palette and sub-byte images stay unfiltered, as image/png
+		// writes them.
+		filter: ct != 3 && depth >= 8,
+		bpp:    max(bitsPerPixel/8, 1),
+		prev:   make([]byte, rowBytes),
+		out:    make([]byte, rowBytes+1),
+	}
+	e.zw, _ = zlib.NewWriterLevel(e.idat, zlib.BestCompression)
+	return e, nil
+}
+
+// writeRow filters and compresses the next row of packed samples.
+func (e *pngStripEncoder) writeRow(row []byte) error {
+	if e.filter {
+		filterPNGRow(e.out, row, e.prev, e.bpp)
+		copy(e.prev, row)
+	} else {
+		e.out[0] = 0
+		copy(e.out[1:], row)
+	}
+	if _, err := e.zw.Write(e.out); err != nil {
+		return fmt.Errorf("fennec: write: %w", err)
+	}
+	return nil
+}
+
+// close finishes the image data and writes IEND.
+func (e *pngStripEncoder) close() error {
+	if err := e.zw.Close(); err != nil {
+		return fmt.Errorf("fennec: write: %w", err)
+	}
+	if err := e.idat.flush(); err != nil {
+		return err
+	}
+	if _, err := e.idat.w.Write(appendPNGChunk(nil, "IEND", nil)); err != nil {
+		return fmt.Errorf("fennec: write: %w", err)
+	}
+	return nil
+}
+
+// idatWriter collects deflated image data and writes it to w in IDAT
+// chunks of up to idatChunkSize bytes.
+type idatWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (iw *idatWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		k := min(len(p), idatChunkSize-len(iw.buf))
+		iw.buf = append(iw.buf, p[:k]...)
+		p = p[k:]
+		if len(iw.buf) == idatChunkSize {
+			if err := iw.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush writes the collected data as an IDAT chunk, if there is any.
+func (iw *idatWriter) flush() error {
+	if len(iw.buf) == 0 {
+		return nil
+	}
+	if _, err := iw.w.Write(appendPNGChunk(nil, "IDAT", iw.buf)); err != nil {
+		return fmt.Errorf("fennec: write: %w", err)
+	}
+	iw.buf = iw.buf[:0]
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
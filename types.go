@@ -5,7 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"io"
+	"math"
+	"strings"
 )
 
 // Version is the library version.
@@ -27,6 +30,24 @@ var (
 
 	// ErrUnsupportedFormat is returned when an unknown format is specified.
 	ErrUnsupportedFormat = errors.New("fennec: unsupported format")
+
+	// ErrDecode wraps failures to decode an input image: corrupt or
+	// truncated data, or a format no registered decoder recognizes. It
+	// marks a bad input rather than an internal failure.
+	ErrDecode = errors.New("fennec: decode")
+
+	// ErrInvalidOptions wraps Options.Validate failures and unknown enum
+	// names in JSON options.
+	ErrInvalidOptions = errors.New("fennec: invalid options")
+
+	// ErrTargetUnreachable is returned with Options.StrictTargetSize when
+	// even the smallest output Fennec can produce exceeds TargetSize.
+	ErrTargetUnreachable = errors.New("fennec: target size unreachable")
+
+	// ErrAnimated is returned for inputs with more than one frame (animated
+	// GIF, APNG, or animated WebP), which Fennec would otherwise reduce to
+	// their first frame.
+	ErrAnimated = errors.New("fennec: animated input not supported")
 )
 
 // Format represents an output image format.
@@ -39,6 +60,15 @@ const (
 	JPEG
 	// PNG for images with transparency, text, or sharp edges.
 	PNG
+	// GIF for legacy destinations such as email and ad banners: at most
+	// 256 colors and on-or-off transparency. Auto never picks it in
+	// quality mode; see Options.TargetSize for when the target-size engine
+	// does.
+	GIF
+	// OtherFormat is reported as Result.SourceFormat for input decoded
+	// from a format Fennec reads but doesn't write, such as TIFF or BMP.
+	// It is not an output format.
+	OtherFormat
 )
 
 func (f Format) String() string {
@@ -47,19 +77,75 @@ func (f Format) String() string {
 		return "JPEG"
 	case PNG:
 		return "PNG"
+	case GIF:
+		return "GIF"
+	case OtherFormat:
+		return "Other"
 	default:
 		return "Auto"
 	}
 }
 
+// extension returns the file extension Fennec writes the format with, or
+// "" for Auto.
+func (f Format) extension() string {
+	switch f {
+	case JPEG:
+		return ".jpg"
+	case PNG:
+		return ".png"
+	case GIF:
+		return ".gif"
+	default:
+		return ""
+	}
+}
+
+// QuantTables selects the quantization tables JPEG output is encoded with.
+// The tables decide how coarsely each DCT frequency is stored, so they
+// shape what detail survives at a given quality.
+type QuantTables int
+
+const (
+	// TablesStandard uses the ITU T.81 Annex K tables, as Go's image/jpeg
+	// encoder does (default).
+	TablesStandard QuantTables = iota
+	// TablesPhotographic keeps low frequencies finer and drops high ones
+	// faster, which suits photos: smaller files at the same SSIM.
+	TablesPhotographic
+	// TablesFlat stores every frequency with the same step, which keeps
+	// text and hard UI edges crisper.
+	TablesFlat
+)
+
+// String returns the name of the table set.
+func (t QuantTables) String() string {
+	switch t {
+	case TablesStandard:
+		return "Standard"
+	case TablesPhotographic:
+		return "Photographic"
+	case TablesFlat:
+		return "Flat"
+	default:
+		return "Unknown"
+	}
+}
+
 // Quality presets define compression aggressiveness.
 // The zero value is Balanced, which is the recommended default.
 type Quality int
 
 const (
 	// Balanced targets SSIM >= 0.94 — great quality, strong compression (default).
+	// With LossyPNG it quantizes to 128 colors rather than the full 256.
 	Balanced Quality = iota
-	// Lossless preserves every pixel (PNG only, no quality loss).
+	// Lossless preserves every pixel (PNG only, no quality loss). With
+	// Format JPEG (or OptimizeOnly) and a baseline JPEG input to CompressFile or
+	// CompressBytes, the file is instead recompressed without decoding:
+	// its DCT coefficients are kept, Huffman tables are optimized, and
+	// metadata is stripped (PreserveMetadata still copies EXIF). Pixels
+	// are untouched, so resizing, denoising, or rotating disables this.
 	Lossless
 	// Ultra targets SSIM >= 0.99 — visually identical to original.
 	Ultra
@@ -69,12 +155,44 @@ const (
 	Aggressive
 	// Maximum targets SSIM >= 0.85 — acceptable quality, extreme compression.
 	Maximum
+	// NearLossless targets SSIM >= 0.995 — visually lossless JPEG for
+	// archiving. Chroma is kept at full resolution (4:4:4) and the quality
+	// search never goes below 85; a TargetSize still takes precedence over
+	// the floor.
+	NearLossless
 )
 
+// nearLosslessMinQuality is the lowest JPEG quality the NearLossless
+// preset's search tries.
+const nearLosslessMinQuality = 85
+
+// targetMSSSIM is targetSSIM for Options.UseMSSSIM. MS-SSIM scores a given
+// distortion higher than SSIM, so each preset's target is higher too.
+func (q Quality) targetMSSSIM() float64 {
+	switch q {
+	case Lossless:
+		return 1.0
+	case NearLossless:
+		return 0.998
+	case Ultra:
+		return 0.995
+	case High:
+		return 0.985
+	case Aggressive:
+		return 0.95
+	case Maximum:
+		return 0.92
+	default:
+		return 0.97
+	}
+}
+
 func (q Quality) targetSSIM() float64 {
 	switch q {
 	case Lossless:
 		return 1.0
+	case NearLossless:
+		return 0.995
 	case Ultra:
 		return 0.99
 	case High:
@@ -90,11 +208,29 @@ func (q Quality) targetSSIM() float64 {
 	}
 }
 
+// paletteColors returns the palette size LossyPNG quantizes to for this
+// preset. Lower presets trade more colors for smaller files, the way they
+// trade SSIM for JPEG.
+func (q Quality) paletteColors() int {
+	switch q {
+	case Aggressive:
+		return 64
+	case Maximum:
+		return 32
+	case Balanced:
+		return 128
+	default:
+		return 256
+	}
+}
+
 // String returns the human-readable name of the quality preset.
 func (q Quality) String() string {
 	switch q {
 	case Lossless:
 		return "Lossless"
+	case NearLossless:
+		return "NearLossless"
 	case Ultra:
 		return "Ultra"
 	case High:
@@ -135,6 +271,27 @@ type Options struct {
 	// Format specifies the output format. Auto will analyze the image.
 	Format Format
 
+	// OptimizeOnly re-encodes an image as small as its quality preset
+	// allows without changing anything visible about it: a JPEG input
+	// stays JPEG (through the SSIM search), a PNG stays PNG (palette and
+	// grayscale detection, best compression), a GIF stays GIF, and
+	// MaxWidth, MaxHeight, ExactSize, and AllowUpscale are ignored.
+	// Inputs of other formats, and images passed to CompressImage,
+	// CompressTo, or CompressVariants (whose encoded format is unknown),
+	// get the format Auto picks. Format must be Auto. Size targets
+	// (TargetSize, TargetBPP, TargetRatio) still take precedence: the
+	// target-size engine keeps the format but may downscale to fit.
+	// Default: false.
+	OptimizeOnly bool
+
+	// AnalysisSamples sets how many pixels Format Auto samples to count
+	// colors when choosing between JPEG and PNG (0 keeps the default of
+	// 10,000). Denser sampling costs time roughly in proportion but avoids
+	// misreading huge images, such as a photo dominated by flat sky that a
+	// sparse sample mistakes for a few-color graphic. See also
+	// AnalyzeSamples.
+	AnalysisSamples int
+
 	// MaxWidth constrains the output width. 0 means no constraint.
 	// Aspect ratio is always preserved.
 	MaxWidth int
@@ -143,30 +300,287 @@ type Options struct {
 	// Aspect ratio is always preserved.
 	MaxHeight int
 
-	// Subsample enables chroma subsampling for JPEG (default: true).
-	// This exploits the fact that human eyes are less sensitive to
-	// color detail than luminance detail.
-	//
-	// Note: Go's stdlib JPEG encoder does not expose a subsampling toggle.
-	// This field is reserved for future use with custom encoders. Currently,
-	// it is accepted but has no effect on the encoded output.
+	// AllowUpscale lets MaxWidth/MaxHeight enlarge images smaller than the
+	// box, scaling up with Lanczos until one side meets it, so every output
+	// comes out the same size. Upscaling only interpolates: it cannot add
+	// detail the source doesn't have, and it makes files larger.
+	// Default: false (images that fit are left alone).
+	AllowUpscale bool
+
+	// ExactSize forces the output to exactly these dimensions, for grids
+	// where every cell must match. Unlike MaxWidth/MaxHeight, which are
+	// ceilings, it crops or pads as ExactFit dictates, and it also
+	// upscales. When set, MaxWidth, MaxHeight, and AllowUpscale are
+	// ignored. A size target never changes these dimensions: if quality
+	// or palette reduction alone can't meet it, compression fails with
+	// ErrTargetUnreachable. The zero value disables it.
+	ExactSize image.Point
+
+	// ExactFit chooses how the image is mapped onto ExactSize. FitCover
+	// center-crops the overflow; FitStretch ignores aspect ratio; the
+	// default FitContain letterboxes the image onto a transparent canvas
+	// (JPEG output fills the padding with Background).
+	ExactFit FitMode
+
+	// StraightAlpha interpolates straight (non-premultiplied) RGBA when
+	// resizing, so the colors stored under fully transparent pixels survive,
+	// as game textures with a separate alpha mask need. The default
+	// premultiplied interpolation is correct for photographs and UI art: it
+	// keeps transparent pixels' colors from bleeding into visible edges,
+	// which straight interpolation can produce as dark fringes. It applies
+	// to MaxWidth/MaxHeight, ExactSize, and the target-size engine's
+	// PNG downscales. Default: false.
+	StraightAlpha bool
+
+	// LinearResize interpolates in linear light instead of on gamma-encoded
+	// sRGB values when resizing. It is the more correct choice: averaging
+	// sRGB values darkens mixes of bright and dark pixels, so thin bright
+	// lines, fine text, and high-contrast patterns dim when downscaled.
+	// Linear resizing keeps their brightness, at roughly twice the
+	// resize's memory and some extra time. It applies wherever
+	// StraightAlpha does, and to the target-size engine's JPEG downscales.
+	// Default: false, matching earlier releases' output.
+	LinearResize bool
+
+	// ResizeFilter selects the resizing kernel. Lanczos3, the default,
+	// keeps the most detail but rings most, leaving faint halos beside
+	// hard edges. Lanczos2 trades a little sharpness for about half the
+	// ringing and is faster; Mitchell is softer still and barely rings,
+	// which suits upscaling and smooth gradients. It applies wherever
+	// LinearResize does.
+	ResizeFilter ResizeFilter
+
+	// Subsample is kept for compatibility and has no effect: JPEG output
+	// uses 4:2:0 chroma subsampling unless FullChroma is set, so the zero
+	// Options value encodes like DefaultOptions.
 	Subsample bool
 
+	// FullChroma keeps JPEG chroma at full resolution (4:4:4) instead of
+	// 4:2:0 subsampling. Sharp color edges, such as red text on blue, stay
+	// crisp, at the cost of larger files and Fennec's own, slower encoder.
+	// The NearLossless preset always uses 4:4:4. Default: false.
+	FullChroma bool
+
+	// ForceColor keeps JPEG output as three-channel color even when every
+	// pixel is gray. By default a grayscale source is encoded as a
+	// single-channel JPEG, which drops the empty chroma planes and is
+	// smaller. Default: false.
+	ForceColor bool
+
+	// QuantTables selects the JPEG quantization tables. Anything other
+	// than TablesStandard encodes with Fennec's own baseline encoder
+	// instead of image/jpeg. Analyze's RecommendedTables suggests a set.
+	// Default: TablesStandard.
+	QuantTables QuantTables
+
+	// OptimizeHuffman fits the JPEG Huffman tables to each image with a
+	// second pass over its coefficients, instead of using the standard
+	// tables. This typically saves 2–5% with no quality change, at the
+	// cost of Fennec's own encoder, which is slower than image/jpeg.
+	// Default: false.
+	OptimizeHuffman bool
+
 	// TargetSSIM overrides the Quality preset with a custom SSIM target.
 	// Must be between 0.0 and 1.0. 0 means use the Quality preset.
 	TargetSSIM float64
 
-	// TargetSize tries to achieve a specific file size in bytes.
-	// 0 means no size target (use quality-based optimization).
+	// FocusRegion marks the part of the image that matters most, such as a
+	// face in a portrait. The JPEG quality search then weights SSIM inside
+	// it at 75% and the rest of the image at 25%, keeping the region crisp
+	// while letting the background compress harder; Result.SSIM reports
+	// that weighted score. The rectangle is in input pixels with (0,0) at
+	// the top-left, after AutoOrient, and is scaled along with any resize.
+	// nil (the default) weights every part of the image equally.
+	FocusRegion *image.Rectangle
+
+	// UseMSSSIM makes the JPEG quality search measure MS-SSIM (see MSSSIM)
+	// instead of SSIM. MS-SSIM also scores coarser scales, so it tracks
+	// perceived quality better and can settle on a lower quality where
+	// fine-scale loss is invisible. Each search step costs about 1.5× as
+	// much. Presets use their own MS-SSIM targets (0.97 for Balanced,
+	// 0.995 for Ultra); TargetSSIM, if set, is read as an MS-SSIM target,
+	// and Result.SSIM reports the MS-SSIM score. FocusRegion is ignored.
+	// Default: false.
+	UseMSSSIM bool
+
+	// TargetSize tries to achieve a specific file size in bytes. It must
+	// be at least 100 bytes, below which no image format fits. A target at
+	// or above the image's uncompressed size (4 bytes per pixel, after
+	// resizing) can't constrain anything, so it falls through to
+	// quality-based optimization; the output is still checked against it
+	// for Result.TargetMet and StrictTargetSize. 0 means no size target (use
+	// quality-based optimization). With Format GIF the engine quantizes
+	// and scales GIFs. With Auto it also tries a GIF for targets of at
+	// most 8 KB when the image has no partial transparency: GIF's header
+	// is smaller than PNG's, so a tiny graphic may fit with more colors.
 	TargetSize int
 
+	// TargetBPP sets the size target as bits per pixel of the output
+	// image instead of absolute bytes, so one setting gives consistent
+	// quality across differently sized images. After resizing, TargetSize
+	// becomes TargetBPP × width × height / 8 (at least 100 bytes) and the
+	// target-size engine runs as usual. At most one of TargetSize, TargetBPP,
+	// TargetRatio, and TargetSSIM may be set. 0 disables it.
+	TargetBPP float64
+
+	// TargetRatio sets the size target as a fraction of the encoded input:
+	// 10 asks for an output 10× smaller than the original file. TargetSize
+	// becomes the input size / TargetRatio (at least 100 bytes) and the
+	// target-size engine runs as usual. The input size is only known to
+	// CompressFile, CompressFileAuto, CompressBytes, and CompressPages;
+	// other entry points fail with ErrInvalidOptions. Must be 0 (disabled)
+	// or greater than 1.
+	TargetRatio float64
+
+	// TargetSizeTolerance lets the target-size engine accept any result in
+	// [TargetSize*(1-tol), TargetSize] instead of strictly the highest-quality
+	// result under the target. For example 0.1 accepts results within 10%
+	// below the target, so the searches stop early and prefer candidates
+	// that fill the byte budget. 0 keeps the strict behavior.
+	TargetSizeTolerance float64
+
+	// StrictTargetSize makes a TargetSize that can't be met an error
+	// wrapping ErrTargetUnreachable. By default Fennec returns the smallest
+	// result it found even when that is still over the target.
+	StrictTargetSize bool
+
+	// SearchIterations caps the bisection steps of the target-size
+	// engine's downscale searches, which run when quality alone can't hit
+	// the target and each cost a JPEG quality search or a PNG encode.
+	// Fewer iterations are faster but land on a coarser scale, leaving
+	// more of the byte budget unused: each one halves the remaining
+	// range, so 6 resolves the scale to about 1.5%. 0 keeps the defaults
+	// (10 for the JPEG scale search, 12 for the plain scale search), and
+	// either search stops early once further steps would change the
+	// output by less than a pixel, so small images need fewer.
+	SearchIterations int
+
+	// LossyPNG quantizes PNG output to a palette (like pngquant) even when
+	// the image has more colors, trading exactness for much smaller files.
+	// The Quality preset sets the palette size: 256 colors for Ultra and
+	// High, 128 for Balanced, 64 for Aggressive, 32 for Maximum. The
+	// resulting SSIM against the original is reported in Result.SSIM.
+	// Transparency is kept in the palette. Ignored for the Lossless preset.
+	// Default: false (PNG output is lossless).
+	LossyPNG bool
+
+	// PerceptualQuantize maps pixels to palette colors by CIEDE2000
+	// distance in Lab space instead of plain RGB distance, wherever the
+	// output is quantized (LossyPNG and the target-size palette strategy).
+	// It avoids the hue shifts RGB distance causes in skin tones and blues
+	// at small palette sizes, at the cost of slower mapping.
+	// Default: false (RGB distance).
+	PerceptualQuantize bool
+
+	// InterlacePNG writes PNG output with Adam7 interlacing, so browsers
+	// render a coarse preview of large images on slow connections before
+	// the whole file arrives. The pixels are unchanged, but interlaced files
+	// compress worse, typically a few percent larger. In target-size mode
+	// the output stays non-interlaced if interlacing would push it over
+	// TargetSize. Default: false.
+	InterlacePNG bool
+
+	// Preserve16Bit keeps 16-bit input (*image.Gray16, *image.RGBA64,
+	// *image.NRGBA64) at full depth when the output is PNG, instead of
+	// reducing it to 8 bits. It applies only when the image fits within
+	// MaxWidth and MaxHeight, ExactSize is unset, AllowUpscale and
+	// AutoLevels are off, and TargetSize, TargetBPP, TargetRatio, Denoise,
+	// Brightness, and Contrast are 0; otherwise the output is 8-bit. When it
+	// applies the PNG is lossless, so LossyPNG is ignored. Result.Image
+	// remains an 8-bit preview. Default: false.
+	Preserve16Bit bool
+
+	// Denoise applies Denoise at this strength (0.0–1.0) before resizing
+	// and the SSIM search, so the encoder doesn't spend bits on sensor
+	// noise. SSIM is then measured against the denoised image. 0 (the
+	// default) disables it, since it alters pixels.
+	Denoise float64
+
+	// AutoLevels applies AutoLevels before resizing, stretching the
+	// luminance range of underexposed or faded images such as scans and
+	// old photos. SSIM is then measured against the adjusted image.
+	// Default: false.
+	AutoLevels bool
+
+	// Brightness and Contrast (each −1.0–1.0) apply
+	// AdjustBrightnessContrast before resizing, after any AutoLevels, to
+	// lift dim photos or flatten harsh scans. Like AutoLevels they alter
+	// pixels, so SSIM is measured against the adjusted image, not the
+	// input. 0 (the default) leaves the image alone.
+	Brightness float64
+	Contrast   float64
+
+	// ContentAware blurs flat, low-detail regions slightly before JPEG
+	// encoding, leaving edges and texture untouched, so the encoder spends
+	// its bits on the subject instead of smooth backgrounds. Files are
+	// smaller at the same perceived quality. Like Denoise, it alters
+	// pixels, and SSIM is measured against the smoothed image. It has no
+	// effect on PNG output. Default: false.
+	ContentAware bool
+
+	// Sharpen applies AdaptiveSharpen at this strength (0.0–1.0) after any
+	// downscale — from MaxWidth/MaxHeight or the target-size engine — and
+	// before encoding, to restore crispness lost in resizing. 0 disables it.
+	// Sharpening adds edge detail, which costs bytes and can lower the
+	// reported SSIM in target-size mode, so tune it for your content.
+	Sharpen float64
+
+	// Background is the color transparent images are composited over when
+	// the output is JPEG, which has no alpha channel. Its alpha is ignored.
+	// The zero value means white (the default).
+	Background color.NRGBA
+
 	// AutoOrient reads EXIF orientation data and auto-rotates the image.
 	// Default: true. Set to false to preserve original pixel orientation.
 	AutoOrient bool
 
+	// PreserveMetadata copies the input's EXIF block into JPEG output. If
+	// AutoOrient rotated the pixels, the copied orientation tag is reset to
+	// normal so viewers don't rotate them again. Only CompressFile and
+	// CompressBytes see the input's bytes, and PNG output never carries
+	// EXIF. In target-size mode the EXIF block counts toward TargetSize.
+	// Default: false (output has no metadata).
+	PreserveMetadata bool
+
+	// JPEGComment, if set, is written into the output after encoding: as a
+	// COM marker in JPEG, or as a tEXt chunk keyed by PNGCommentKeyword in
+	// PNG. Use it to tag outputs with a processing signature. It may not
+	// contain NUL bytes, and in target-size mode it counts toward
+	// TargetSize. Default: "" (no comment).
+	JPEGComment string
+
+	// PNGCommentKeyword is the tEXt keyword JPEGComment is stored under in
+	// PNG output: 1–79 printable ASCII characters without leading or
+	// trailing spaces. Default: "" ("Comment").
+	PNGCommentKeyword string
+
+	// DPI, if set, records the print density in the output after encoding:
+	// a JFIF APP0 segment in dots per inch for JPEG, or a pHYs chunk in the
+	// equivalent pixels per meter for PNG. Pixels are not changed. In
+	// target-size mode the header counts toward TargetSize. Must be at
+	// most 65535. Default: 0 (the encoder's default, no density).
+	DPI int
+
 	// OnProgress is called during compression to report progress.
 	// Optional. Returning a non-nil error aborts the operation.
 	OnProgress ProgressFunc
+
+	// CollectTrace records each (quality, SSIM, size) probe of the JPEG
+	// quality search in Result.Trace. Target-size mode and PNG output
+	// don't run that search and leave Trace nil. Default: false.
+	CollectTrace bool
+
+	// Logger, if set, receives trace lines explaining the pipeline's
+	// decisions: the format Auto chose, each quality/SSIM step of the JPEG
+	// search, and each target-size strategy's result and the winner. It
+	// is printf-style with no trailing newline, so log.Printf fits. It is
+	// purely observational. Batch functions call it concurrently.
+	// Default: nil (no tracing).
+	Logger func(format string, args ...any)
+
+	// scratch is the buffer pool of the Compressor running these options,
+	// set by New. It is nil outside a Compressor.
+	scratch *scratch
 }
 
 // DefaultOptions returns sensible defaults for general use.
@@ -176,6 +590,7 @@ func DefaultOptions() Options {
 		Format:     Auto,
 		Subsample:  true,
 		AutoOrient: true,
+		Background: color.NRGBA{255, 255, 255, 255},
 	}
 }
 
@@ -184,23 +599,152 @@ func DefaultOptions() Options {
 // compression functions, but can be called manually for early validation.
 func (o *Options) Validate() error {
 	if o.MaxWidth < 0 {
-		return fmt.Errorf("fennec: MaxWidth must be >= 0, got %d", o.MaxWidth)
+		return fmt.Errorf("%w: MaxWidth must be >= 0, got %d", ErrInvalidOptions, o.MaxWidth)
 	}
 	if o.MaxHeight < 0 {
-		return fmt.Errorf("fennec: MaxHeight must be >= 0, got %d", o.MaxHeight)
+		return fmt.Errorf("%w: MaxHeight must be >= 0, got %d", ErrInvalidOptions, o.MaxHeight)
+	}
+	if o.ExactSize.X < 0 || o.ExactSize.Y < 0 || (o.ExactSize.X == 0) != (o.ExactSize.Y == 0) {
+		return fmt.Errorf("%w: ExactSize must be both positive or both 0, got %dx%d", ErrInvalidOptions, o.ExactSize.X, o.ExactSize.Y)
+	}
+	if o.AnalysisSamples < 0 {
+		return fmt.Errorf("%w: AnalysisSamples must be >= 0, got %d", ErrInvalidOptions, o.AnalysisSamples)
+	}
+	if o.ExactFit < FitContain || o.ExactFit > FitStretch {
+		return fmt.Errorf("%w: invalid ExactFit %d", ErrInvalidOptions, o.ExactFit)
+	}
+	if o.ResizeFilter < Lanczos3 || o.ResizeFilter > Mitchell {
+		return fmt.Errorf("%w: invalid ResizeFilter %d", ErrInvalidOptions, o.ResizeFilter)
+	}
+	if o.FocusRegion != nil && o.FocusRegion.Empty() {
+		return fmt.Errorf("%w: FocusRegion %v is empty", ErrInvalidOptions, *o.FocusRegion)
 	}
 	if o.TargetSSIM < 0 || o.TargetSSIM > 1.0 {
-		return fmt.Errorf("fennec: TargetSSIM must be in [0.0, 1.0], got %f", o.TargetSSIM)
+		return fmt.Errorf("%w: TargetSSIM must be in [0.0, 1.0], got %f", ErrInvalidOptions, o.TargetSSIM)
+	}
+	if o.TargetSize < 0 || (o.TargetSize > 0 && o.TargetSize < minTargetSize) {
+		return fmt.Errorf("%w: TargetSize must be 0 or at least %d bytes, got %d", ErrInvalidOptions, minTargetSize, o.TargetSize)
+	}
+	if o.TargetBPP < 0 || math.IsNaN(o.TargetBPP) || math.IsInf(o.TargetBPP, 0) {
+		return fmt.Errorf("%w: TargetBPP must be a finite value >= 0, got %f", ErrInvalidOptions, o.TargetBPP)
+	}
+	if o.TargetRatio != 0 && (!(o.TargetRatio > 1) || math.IsInf(o.TargetRatio, 0)) {
+		return fmt.Errorf("%w: TargetRatio must be 0 or a finite value > 1, got %f", ErrInvalidOptions, o.TargetRatio)
+	}
+	if n := countTrue(o.TargetSize != 0, o.TargetBPP != 0, o.TargetRatio != 0, o.TargetSSIM != 0); n > 1 {
+		return fmt.Errorf("%w: set at most one of TargetSize, TargetBPP, TargetRatio, and TargetSSIM", ErrInvalidOptions)
+	}
+	if o.TargetSizeTolerance < 0 || o.TargetSizeTolerance >= 1.0 {
+		return fmt.Errorf("%w: TargetSizeTolerance must be in [0.0, 1.0), got %f", ErrInvalidOptions, o.TargetSizeTolerance)
+	}
+	if o.SearchIterations < 0 {
+		return fmt.Errorf("%w: SearchIterations must be >= 0, got %d", ErrInvalidOptions, o.SearchIterations)
+	}
+	if o.Denoise < 0 || o.Denoise > 1.0 {
+		return fmt.Errorf("%w: Denoise must be in [0.0, 1.0], got %f", ErrInvalidOptions, o.Denoise)
 	}
-	if o.TargetSize < 0 {
-		return fmt.Errorf("fennec: TargetSize must be >= 0, got %d", o.TargetSize)
+	if !(o.Brightness >= -1 && o.Brightness <= 1) {
+		return fmt.Errorf("%w: Brightness must be in [-1.0, 1.0], got %f", ErrInvalidOptions, o.Brightness)
 	}
-	if o.Format < Auto || o.Format > PNG {
-		return fmt.Errorf("fennec: invalid Format %d", o.Format)
+	if !(o.Contrast >= -1 && o.Contrast <= 1) {
+		return fmt.Errorf("%w: Contrast must be in [-1.0, 1.0], got %f", ErrInvalidOptions, o.Contrast)
+	}
+	if o.Sharpen < 0 || o.Sharpen > 1.0 {
+		return fmt.Errorf("%w: Sharpen must be in [0.0, 1.0], got %f", ErrInvalidOptions, o.Sharpen)
+	}
+	if o.Format < Auto || o.Format > GIF {
+		return fmt.Errorf("%w: invalid Format %d", ErrInvalidOptions, o.Format)
+	}
+	if o.OptimizeOnly && o.Format != Auto {
+		return fmt.Errorf("%w: OptimizeOnly keeps the input format, so Format must be Auto", ErrInvalidOptions)
+	}
+	if o.QuantTables < TablesStandard || o.QuantTables > TablesFlat {
+		return fmt.Errorf("%w: invalid QuantTables %d", ErrInvalidOptions, o.QuantTables)
+	}
+	if len(o.JPEGComment) > maxJPEGSegment-4 || strings.IndexByte(o.JPEGComment, 0) >= 0 {
+		return fmt.Errorf("%w: JPEGComment must be at most %d bytes with no NUL", ErrInvalidOptions, maxJPEGSegment-4)
+	}
+	if o.DPI < 0 || o.DPI > 0xFFFF {
+		return fmt.Errorf("%w: DPI must be between 0 and 65535, got %d", ErrInvalidOptions, o.DPI)
+	}
+	if o.PNGCommentKeyword != "" && !validPNGKeyword(o.PNGCommentKeyword) {
+		return fmt.Errorf("%w: invalid PNGCommentKeyword %q", ErrInvalidOptions, o.PNGCommentKeyword)
 	}
 	return nil
 }
 
+// minTargetSize is the smallest TargetSize accepted. No JPEG and only PNGs
+// of a few pixels fit below it, so lower targets would just run every
+// strategy down to the fallback.
+const minTargetSize = 100
+
+// background returns the JPEG background color, defaulting to white.
+func (o *Options) background() color.NRGBA {
+	if o.Background == (color.NRGBA{}) {
+		return color.NRGBA{255, 255, 255, 255}
+	}
+	return o.Background
+}
+
+// losslessJPEG reports whether a JPEG input should be recompressed on its
+// coefficients instead of re-encoded (see Lossless): JPEG output, or
+// OptimizeOnly, at the Lossless preset, with no option that changes pixels
+// or targets a size.
+func (o *Options) losslessJPEG() bool {
+	return (o.Format == JPEG || o.OptimizeOnly) && o.Quality == Lossless && o.TargetSize == 0 &&
+		o.TargetBPP == 0 && o.TargetRatio == 0 && o.TargetSSIM == 0 && o.Denoise == 0 && !o.ContentAware
+}
+
+// applyOptimizeOnly applies OptimizeOnly for an input decoded as format
+// (an image package format name, "" if unknown): the output keeps the
+// input's format when Fennec writes it, and nothing is resized.
+func (o *Options) applyOptimizeOnly(format string) {
+	if !o.OptimizeOnly {
+		return
+	}
+	switch format {
+	case "jpeg":
+		o.Format = JPEG
+	case "png":
+		o.Format = PNG
+	case "gif":
+		o.Format = GIF
+	}
+	o.MaxWidth, o.MaxHeight = 0, 0
+	o.ExactSize = image.Point{}
+	o.AllowUpscale = false
+}
+
+// countTrue returns how many of set are true.
+func countTrue(set ...bool) int {
+	n := 0
+	for _, b := range set {
+		if b {
+			n++
+		}
+	}
+	return n
+}
+
+// grayJPEG reports whether img should be encoded as a single-channel JPEG:
+// it is opaque, every pixel is gray, and ForceColor is off.
+func (o *Options) grayJPEG(img *image.NRGBA) bool {
+	return !o.ForceColor && isOpaque(img) && isGrayscale(img)
+}
+
+// jpegEncoding returns the JPEG encoder settings for img.
+func (o *Options) jpegEncoding(img *image.NRGBA) jpegEncoding {
+	return jpegEncoding{gray: o.grayJPEG(img), fullChroma: o.FullChroma || o.Quality == NearLossless,
+		tables: o.QuantTables, optimizeHuffman: o.OptimizeHuffman}
+}
+
+// logf writes a trace line to Logger, if set.
+func (o *Options) logf(format string, args ...any) {
+	if o.Logger != nil {
+		o.Logger(format, args...)
+	}
+}
+
 // reportProgress safely invokes the progress callback if set.
 // Returns context error or progress callback error.
 func (o *Options) reportProgress(ctx context.Context, stage ProgressStage, percent float64) error {
@@ -219,39 +763,86 @@ func (o *Options) reportProgress(ctx context.Context, stage ProgressStage, perce
 
 // Result contains compression results and statistics.
 type Result struct {
-	// Image is the final processed image (resized, oriented).
-	Image *image.NRGBA
+	// Image is the final processed image (resized, oriented). In
+	// target-size mode it is the image the winning strategy encoded, so its
+	// bounds always equal FinalDimensions.
+	Image *image.NRGBA `json:"-"`
 
-	// CompressedData holds the actual encoded bytes (JPEG or PNG).
+	// CompressedData holds the actual encoded bytes (JPEG, PNG, or GIF).
 	// Use WriteTo to write this data to any io.Writer.
-	CompressedData []byte
+	CompressedData []byte `json:"-"`
 
 	// Format is the chosen output format.
-	Format Format
+	Format Format `json:"format"`
+
+	// SourceFormat is the format the input was decoded from: JPEG, PNG,
+	// or GIF; OtherFormat for other decodable input, such as TIFF or BMP;
+	// or Auto when no encoded input was given, as with CompressImage.
+	SourceFormat Format `json:"source_format"`
 
 	// OriginalSize is the original image size in bytes (if known from file).
-	OriginalSize int64
+	OriginalSize int64 `json:"original_size"`
 
 	// CompressedSize is the compressed output size in bytes.
-	CompressedSize int64
+	CompressedSize int64 `json:"compressed_size"`
 
 	// SSIM is the structural similarity between original and compressed.
-	SSIM float64
+	SSIM float64 `json:"ssim"`
 
-	// JPEGQuality is the JPEG quality used (0 if PNG).
-	JPEGQuality int
+	// JPEGQuality is the JPEG quality used (0 if PNG, a lossless JPEG
+	// recompression, or RecompressRegion, which keeps the original's
+	// tables).
+	JPEGQuality int `json:"jpeg_quality"`
 
 	// Ratio is the compression ratio (original / compressed).
-	Ratio float64
+	Ratio float64 `json:"ratio"`
 
 	// SavingsPercent is the percentage of bytes saved.
-	SavingsPercent float64
+	SavingsPercent float64 `json:"savings_percent"`
 
 	// OriginalDimensions is the original width x height.
-	OriginalDimensions image.Point
+	OriginalDimensions image.Point `json:"original_dimensions"`
 
 	// FinalDimensions is the output width x height.
-	FinalDimensions image.Point
+	FinalDimensions image.Point `json:"final_dimensions"`
+
+	// Strategy names the target-size strategy that produced the output:
+	// "jpeg-quality" (JPEG quality search at full size), "quantize-png"
+	// (palette-quantized PNG), "quantize-gif" (palette-quantized GIF),
+	// "jpeg-scale" (downscale plus JPEG quality search), "scale-search"
+	// (downscale only), or "fallback" (nothing fit, so the smallest
+	// encode was used). Empty unless TargetSize, TargetBPP, or
+	// TargetRatio is set.
+	Strategy string `json:"strategy,omitempty"`
+
+	// TargetSSIM is the SSIM the JPEG quality search aimed for: the
+	// Quality preset's, or Options.TargetSSIM (MS-SSIM with UseMSSSIM);
+	// JPEG can't reach 1.0, so Lossless aims for 0.999. It is 0 when no
+	// quality search ran: PNG output, lossless JPEG recompression, and
+	// target-size mode.
+	TargetSSIM float64 `json:"target_ssim,omitempty"`
+
+	// TargetMet reports whether the output met the target it was
+	// compressed to. In quality mode that is SSIM reaching TargetSSIM; a
+	// source that can't reach it even at JPEG quality 100, such as one
+	// that is already degraded, gets quality 100 and TargetMet false. In
+	// target-size mode it is CompressedSize within the byte budget; false
+	// means the engine fell back to an over-target result. Output with no
+	// target to miss, such as lossless PNG, reports true.
+	TargetMet bool `json:"target_met"`
+
+	// Trace lists the probes of the JPEG quality search in the order they
+	// ran, for building quality-vs-size curves. Only set with
+	// Options.CollectTrace and JPEG output in quality mode; nil otherwise.
+	Trace []QualityProbe `json:"trace,omitempty"`
+}
+
+// QualityProbe is one step of the JPEG quality search: the quality tried
+// and the SSIM and size it produced.
+type QualityProbe struct {
+	Quality int     `json:"quality"`
+	SSIM    float64 `json:"ssim"`
+	Size    int     `json:"size"`
 }
 
 // WriteTo writes the compressed image data to w.
@@ -278,13 +869,17 @@ func (r *Result) String() string {
 	if r.Format == JPEG && r.JPEGQuality > 0 {
 		qStr = fmt.Sprintf(" Q=%d |", r.JPEGQuality)
 	}
+	sStr := ""
+	if r.Strategy != "" {
+		sStr = fmt.Sprintf(" | Strategy: %s", r.Strategy)
+	}
 	return fmt.Sprintf(
-		"Fennec Result: %s |%s %dx%d → %dx%d | %s → %s | SSIM: %.4f | Saved: %.1f%%",
+		"Fennec Result: %s |%s %dx%d → %dx%d | %s → %s | SSIM: %.4f | Saved: %.1f%%%s",
 		format, qStr,
 		r.OriginalDimensions.X, r.OriginalDimensions.Y,
 		r.FinalDimensions.X, r.FinalDimensions.Y,
 		humanBytes(r.OriginalSize), humanBytes(r.CompressedSize),
-		r.SSIM, r.SavingsPercent,
+		r.SSIM, r.SavingsPercent, sStr,
 	)
 }
 